@@ -1,31 +1,42 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 
+	"github.com/hamza-boudouche/autodev/pkg/config"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/locking"
 )
 
 func main() {
-	client := cache.CreateEtcdClient()
+	client, err := cache.CreateEtcdClient(config.Default().Etcd)
+	if err != nil {
+		panic(err)
+	}
 
 	defer client.Close()
 
 	lock := "my-lock"
 
-    _, release, err := locking.AcquireLock(client, lock)
+    locker := locking.NewLocker(client, config.Default().Locks)
+    l, err := locker.AcquireLock(context.Background(), lock, locking.Options{})
     if err != nil {
         panic(err)
     }
 
 	for i := 0; i < 10; i++ {
+		select {
+		case <-l.Lost():
+			panic("lost the lock")
+		default:
+		}
 		fmt.Println("doing work ...")
 		time.Sleep(time.Second)
 	}
 
-	err = release()
+	err = l.Release()
 	if err != nil {
 		panic(err)
 	}
@@ -1,38 +1,190 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
 	"github.com/gin-gonic/gin"
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/handlers"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/k8s"
-	"github.com/hamza-boudouche/autodev/pkg/handlers"
+	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
 )
 
-
 func main() {
-	kcs, err := k8s.GetK8sClient()
+	configPath := flag.String("config", os.Getenv("AUTODEV_CONFIG"), "path to the YAML configuration file")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		logging.Logger.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
+	if cfg.Components.DefinitionsPath != "" {
+		loaded, err := cmp.LoadDefinitions(cfg.Components.DefinitionsPath)
+		if err != nil {
+			logging.Logger.Error("failed to load component definitions", "error", err)
+			os.Exit(1)
+		}
+		logging.Logger.Info("loaded component definitions", "types", loaded)
+	}
+
+	kcs, err := k8s.GetK8sClient(cfg.Kubernetes.Kubeconfig)
 	if err != nil {
 		panic(err)
 	}
+	dcs, err := k8s.GetDynamicClient(cfg.Kubernetes.Kubeconfig)
+	if err != nil {
+		panic(err)
+	}
+	restConfig, err := k8s.GetRestConfig(cfg.Kubernetes.Kubeconfig)
+	if err != nil {
+		panic(err)
+	}
+
+	if cfg.Env == config.Production && !cfg.Etcd.TLS.IsEnabled() {
+		logging.Logger.Warn("connecting to etcd without TLS in production")
+	}
+	cc, err := cache.CreateEtcdClient(cfg.Etcd)
+	if err != nil {
+		logging.Logger.Error("failed to connect to etcd", "error", err)
+		os.Exit(1)
+	}
+	defer cc.Close()
+	if err := cache.CheckHealth(context.Background(), cc, cfg.Etcd.RequestTimeout); err != nil {
+		logging.Logger.Error("etcd health probe failed", "error", err)
+		os.Exit(1)
+	}
+	kv := cache.NewEtcdStore(cc, cfg.Etcd.RequestTimeout)
+	journal := consistency.NewJournal(kv)
+	// the records written by older versions are moved to their current keys
+	// before anything reads them
+	if err := ss.Migrate(context.Background(), kv); err != nil {
+		logging.Logger.Error("failed to migrate the session records", "error", err)
+		os.Exit(1)
+	}
+	if err := journal.Migrate(context.Background()); err != nil {
+		logging.Logger.Error("failed to migrate the saga records", "error", err)
+		os.Exit(1)
+	}
+	store := ss.NewSessionStore(kv)
+	if err := ss.MigrateVolumeClaims(context.Background(), kcs, store); err != nil {
+		logging.Logger.Error("failed to migrate the volume claims of the sessions", "error", err)
+		os.Exit(1)
+	}
+	snapshots := ss.NewSnapshotStore(kv)
+	templates := ss.NewTemplateStore(kv)
+	locker := lck.NewLocker(cc, cfg.Locks)
+
+	// sagas left unfinished by a crash, of this replica or another one, are
+	// recovered once they've made no progress for a while
+	ss.RegisterRecovery(journal, kcs, dcs, store, snapshots, cfg.Sessions)
+	go func() {
+		for {
+			if err := journal.Recover(context.Background(), cfg.Sagas.StaleAfter); err != nil {
+				logging.Logger.Error("failed to recover unfinished sagas", "error", err)
+			}
+			time.Sleep(cfg.Sagas.RecoveryInterval)
+		}
+	}()
+
+	// the activity seen by this replica is recorded in the sessions on every
+	// check, even if idle sessions are not stopped. The use of the code
+	// editors, which doesn't go through the API, is read from their pods.
+	tracker := ss.NewActivityTracker()
+	probe := ss.NewExecActivityProbe(kcs, restConfig)
+	go func() {
+		for {
+			time.Sleep(cfg.Idle.CheckInterval)
+			if err := tracker.Flush(context.Background(), store, locker); err != nil {
+				logging.Logger.Error("failed to record session activity", "error", err)
+			}
+			if cfg.Idle.Timeout <= 0 {
+				continue
+			}
+			if err := ss.StopIdleSessions(context.Background(), kcs, store, locker, probe, cfg.Idle.Timeout); err != nil {
+				logging.Logger.Error("failed to stop idle sessions", "error", err)
+			}
+		}
+	}()
+
+	// sessions that have a time to live are warned about, stopped, then
+	// deleted as they expire
+	go func() {
+		for {
+			if err := ss.ExpireSessions(context.Background(), kcs, store, journal, locker, cfg.Sessions, cfg.Expiry); err != nil {
+				logging.Logger.Error("failed to expire sessions", "error", err)
+			}
+			time.Sleep(cfg.Expiry.CheckInterval)
+		}
+	}()
 
-	cc := cache.CreateEtcdClient()
+	// the state of the sessions follows their objects in the cluster,
+	// without waiting for a client to refresh them
+	reconciler := ss.NewReconciler(kcs, store, locker, cfg.Reconciler.ResyncPeriod)
+	go func() {
+		if err := reconciler.Run(context.Background(), cfg.Reconciler.Workers); err != nil {
+			logging.Logger.Error("session reconciler stopped", "error", err)
+		}
+	}()
 
 	r := gin.Default()
+	r.Use(handlers.TrackActivity(tracker))
+
+	r.GET("/healthcheck", handlers.HealthcheckHandler(cc, cfg.Etcd.RequestTimeout))
+
+	r.POST("/init/:sessionID", handlers.InitSessionHandler(locker, store, journal, kcs, cfg.Sessions))
+
+	r.POST("/create/:sessionID", handlers.CreateSessionHandler(locker, store, journal, templates, kcs, cfg.Sessions))
+
+	r.GET("/statuses/:sessionID", handlers.SessionStatusHandler(locker, store, kcs))
+
+	r.GET("/logs/:sessionID/:componentID", handlers.ComponentLogsHandler(store, kcs))
+
+	r.POST("/refresh/:sessionID", handlers.RefreshSessionHandler(locker, store, kcs))
+
+	r.PATCH("/toggle/:sessionID", handlers.ToggleSessionHandler(locker, store, kcs))
+
+	r.DELETE("/:sessionID", handlers.DeleteSessionHandler(locker, store, journal, kcs, cfg.Sessions))
+
+	r.GET("/sessions", handlers.ListSessionsHandler(store))
+
+	r.POST("/sessions/:sessionID/heartbeat", handlers.HeartbeatHandler(store))
+
+	r.PATCH("/sessions/:sessionID/expiry", handlers.ExtendSessionHandler(locker, store, cfg.Sessions))
+
+	r.PUT("/sessions/:sessionID", handlers.ApplySessionHandler(locker, store, journal, templates, kcs, cfg.Sessions))
+
+	r.POST("/sessions/:sessionID/components", handlers.AddComponentHandler(locker, store, journal, kcs, cfg.Sessions))
+
+	r.DELETE("/sessions/:sessionID/components/:componentID", handlers.RemoveComponentHandler(locker, store, journal, kcs, cfg.Sessions))
+
+	r.PATCH("/sessions/:sessionID/components/:componentID/storage", handlers.ExpandStorageHandler(locker, store, kcs, cfg.Sessions))
 
-	r.GET("/healthcheck", handlers.HealthcheckHandler())
+	r.POST("/sessions/:sessionID/snapshots", handlers.CreateSnapshotHandler(locker, store, journal, snapshots, kcs, dcs, cfg.Sessions))
 
-	r.POST("/init/:sessionID", handlers.InitSessionHandler(cc, kcs))
+	r.GET("/sessions/:sessionID/snapshots", handlers.ListSnapshotsHandler(snapshots, dcs))
 
-	r.POST("/create/:sessionID", handlers.CreateSessionHandler(cc, kcs))
+	r.POST("/sessions/:sessionID/snapshots/:snapshotName/restore", handlers.RestoreSnapshotHandler(locker, store, journal, snapshots, kcs, dcs, cfg.Sessions))
 
-	r.GET("/statuses/:sessionID", handlers.SessionStatusHandler(cc, kcs))
+	r.POST("/templates", handlers.CreateTemplateHandler(templates, cfg.Sessions))
 
-	r.GET("/logs/:sessionID/:componentID", handlers.ComponentLogsHandler(cc, kcs))
+	r.GET("/templates", handlers.ListTemplatesHandler(templates))
 
-	r.POST("/refresh/:sessionID", handlers.RefreshSessionHandler(cc, kcs))
+	r.GET("/templates/:templateName", handlers.GetTemplateHandler(templates))
 
-	r.PATCH("/toggle/:sessionID", handlers.ToggleSessionHandler(cc, kcs))
+	r.PUT("/templates/:templateName", handlers.UpdateTemplateHandler(templates, cfg.Sessions))
 
-	r.DELETE("/:sessionID", handlers.DeleteSessionHandler(cc, kcs))
+	r.DELETE("/templates/:templateName", handlers.DeleteTemplateHandler(templates))
 
-	r.Run()
+	r.Run(fmt.Sprintf(":%d", cfg.Server.Port))
 }
@@ -0,0 +1,115 @@
+package components
+
+// builtinDefinitions are the component types always available.
+var builtinDefinitions = []ComponentDefinition{
+	{
+		Type:  Code,
+		Image: "linuxserver/code-server",
+		Port:  8443,
+		Env: []EnvVarDefinition{
+			{Name: "PUID", Value: "1000"},
+			{Name: "PGID", Value: "1000"},
+			{Name: "TZ", Value: "Etc/UTC"},
+			{Name: "PASSWORD", Value: "{{ .Password }}"},
+			{Name: "SUDO_PASSWORD", Value: "password"},
+		},
+		Volume: &VolumeDefinition{
+			Workspace: true,
+			MountPath: "/config/workspace",
+		},
+		ReadinessProbe: &ProbeDefinition{
+			HTTPPath: "/healthz",
+		},
+		// touched by code-server at most once a minute while a client is
+		// connected, in the data dir of its user (HOME is /config)
+		ActivityFile: "/config/.local/share/code-server/heartbeat",
+	},
+	{
+		Type:  Redis,
+		Image: "redis:latest",
+		Port:  6379,
+		Volume: &VolumeDefinition{
+			MountPath:       "/data",
+			legacyClaimName: "redis-data",
+		},
+		ReadinessProbe: &ProbeDefinition{
+			Exec: []string{"redis-cli", "ping"},
+		},
+	},
+	{
+		Type:  Mongo,
+		Image: "mongo:latest",
+		Port:  27017,
+		Volume: &VolumeDefinition{
+			MountPath:       "/data/db",
+			legacyClaimName: "mongodb-data",
+		},
+		ReadinessProbe: &ProbeDefinition{
+			Exec: []string{"mongosh", "--quiet", "--eval", "db.adminCommand('ping')"},
+		},
+	},
+	{
+		Type:             Postgres,
+		Image:            "postgres:16",
+		Port:             5432,
+		GeneratePassword: true,
+		Env: []EnvVarDefinition{
+			{Name: "POSTGRES_USER", Value: "postgres"},
+			{Name: "POSTGRES_PASSWORD", Value: "{{ .Password }}"},
+			{Name: "POSTGRES_DB", Value: "app"},
+		},
+		Volume: &VolumeDefinition{
+			MountPath: "/var/lib/postgresql/data",
+			SubPath:   "pgdata",
+		},
+		ReadinessProbe: &ProbeDefinition{
+			Exec:          []string{"pg_isready", "-h", "127.0.0.1", "-U", "postgres", "-d", "app"},
+			PeriodSeconds: 5,
+		},
+		ExportedEnv: []EnvVarDefinition{
+			{Name: "DATABASE_URL", Value: "postgres://postgres:{{ urlquery .Password }}@localhost:{{ .Port }}/app"},
+			{Name: "PGHOST", Value: "localhost"},
+			{Name: "PGPORT", Value: "{{ .Port }}"},
+			{Name: "PGUSER", Value: "postgres"},
+			{Name: "PGPASSWORD", Value: "{{ .Password }}"},
+			{Name: "PGDATABASE", Value: "app"},
+		},
+	},
+	{
+		Type:             MySQL,
+		Image:            "mysql:8",
+		Port:             3306,
+		GeneratePassword: true,
+		Env: []EnvVarDefinition{
+			{Name: "MYSQL_ROOT_PASSWORD", Value: "{{ .Password }}"},
+			{Name: "MYSQL_DATABASE", Value: "app"},
+		},
+		Volume: &VolumeDefinition{
+			MountPath: "/var/lib/mysql",
+			SubPath:   "mysql",
+		},
+		ReadinessProbe: &ProbeDefinition{
+			Exec:                []string{"sh", "-c", `mysqladmin ping -h 127.0.0.1 -uroot -p"$MYSQL_ROOT_PASSWORD"`},
+			InitialDelaySeconds: 10,
+			PeriodSeconds:       5,
+		},
+		ExportedEnv: []EnvVarDefinition{
+			{Name: "DATABASE_URL", Value: "mysql://root:{{ urlquery .Password }}@localhost:{{ .Port }}/app"},
+			{Name: "MYSQL_HOST", Value: "127.0.0.1"},
+			{Name: "MYSQL_PORT", Value: "{{ .Port }}"},
+			{Name: "MYSQL_USER", Value: "root"},
+			{Name: "MYSQL_PASSWORD", Value: "{{ .Password }}"},
+			{Name: "MYSQL_DATABASE", Value: "app"},
+		},
+	},
+}
+
+func init() {
+	for _, def := range builtinDefinitions {
+		provider, err := NewDefinitionProvider(def)
+		if err != nil {
+			panic(err)
+		}
+		MustRegister(provider)
+	}
+}
@@ -1,11 +1,22 @@
 package components
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math/big"
+	"strings"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
+// ErrInvalidComponent is returned for components that can't be created as
+// requested.
+var ErrInvalidComponent = errors.New("invalid component")
+
 type ComponentType string
 
 const (
@@ -13,6 +24,8 @@ const (
 	Code      ComponentType = "code"
 	Redis     ComponentType = "redis"
 	Mongo     ComponentType = "mongo"
+	Postgres  ComponentType = "postgres"
+	MySQL     ComponentType = "mysql"
 )
 
 type ComponentState string
@@ -33,130 +46,186 @@ type Component struct {
 	ExposeComponent   bool              `json:"exposeComponent"`
 	ComponentID       string            `json:"componentID"`
 	ComponentMetadata ComponentMetadata `json:"componentMetadata"`
+	// Resources are resolved against the server defaults and caps (see
+	// ResolveResources) when the component is created.
+	Resources Resources `json:"resources,omitempty"`
+	// Storage is the volume of the component, for the types that have one.
+	// It is resolved against the server defaults and bounds (see
+	// ResolveStorage) when the component is created.
+	Storage Storage `json:"storage,omitempty"`
+	// LegacyVolume is set on the components created before their volumes
+	// were named by VolumeName, which still mount the claim their type used
+	// back then (see LegacyVolumeName). It is only set by the migration of
+	// the sessions, never by clients.
+	LegacyVolume bool `json:"legacyVolume,omitempty"`
 }
 
+// defaultPublicPort is reported for component types that aren't registered.
+const defaultPublicPort = 8080
+
 func (c Component) GetPublicPort() int {
-	switch c.ComponentType {
-	case Code:
-		return 8443
-	case Redis:
-		return 6379
-	case Mongo:
-		return 27017
-	default:
-		return 8080
+	provider, ok := Lookup(c.ComponentType)
+	if !ok {
+		return defaultPublicPort
 	}
+	return provider.PublicPort()
 }
 
 func (c Component) ToContainer(sessionID string) (*v1.Container, *v1.Volume, error) {
-	if c.ComponentType == Code {
-		return &v1.Container{
-				Name:  c.ComponentID,
-				Image: "linuxserver/code-server",
-				Ports: []v1.ContainerPort{
-					{
-						ContainerPort: int32(c.GetPublicPort()),
-					},
-				},
-				Env: []v1.EnvVar{
-					{
-						Name:  "PUID",
-						Value: "1000",
-					},
-					{
-						Name:  "PGID",
-						Value: "1000",
-					},
-					{
-						Name:  "TZ",
-						Value: "Etc/UTC",
-					},
-					{
-						Name:  "PASSWORD",
-						Value: c.ComponentMetadata.Password,
-					},
-					{
-						Name:  "SUDO_PASSWORD",
-						Value: "password",
-					},
-				},
-				VolumeMounts: []v1.VolumeMount{
-					{
-						Name:      sessionID,
-						MountPath: "/config/workspace",
-					},
-				},
-			}, &v1.Volume{
-				Name: sessionID,
-				VolumeSource: v1.VolumeSource{
-					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
-						ClaimName: sessionID,
-					},
-				},
-			}, nil
-	} else if c.ComponentType == Redis {
-		return &v1.Container{
-				Name:  c.ComponentID,
-				Image: "redis:latest",
-				Ports: []v1.ContainerPort{
-					{
-						ContainerPort: int32(c.GetPublicPort()),
-					},
-				},
-				VolumeMounts: []v1.VolumeMount{
-					{
-						Name:      "redis-data",
-						MountPath: "/data",
-					},
-				},
-			}, &v1.Volume{
-				Name: "redis-data",
-				VolumeSource: v1.VolumeSource{
-					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
-						ClaimName: "redis-data",
-					},
-				},
-			}, nil
-	} else if c.ComponentType == Mongo {
-		return &v1.Container{
-				Name:  c.ComponentID,
-				Image: "mongo:latest",
-				Ports: []v1.ContainerPort{
-					{
-						ContainerPort: int32(c.GetPublicPort()),
-					},
-				},
-				VolumeMounts: []v1.VolumeMount{
-					{
-						Name:      "mongodb-data",
-						MountPath: "/data/db",
-					},
-				},
-			}, &v1.Volume{
-				Name: "mongodb-data",
-				VolumeSource: v1.VolumeSource{
-					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
-						ClaimName: "mongodb-data",
-					},
-				},
-			}, nil
+	provider, ok := Lookup(c.ComponentType)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: unsupported component %s", ErrInvalidComponent, c.ComponentType)
+	}
+	requirements, err := c.Resources.Requirements()
+	if err != nil {
+		return nil, nil, err
 	}
-	return nil, nil, fmt.Errorf("unsupported component %s", c.ComponentType)
+	container, volume, err := provider.ToContainer(c, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	container.Resources = requirements
+	return container, volume, nil
 }
 
+const (
+	passwordLength  = 24
+	passwordCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// GenerateCredentials sets a random password on the components that need
+// one and were not given any. It must be called before the components are
+// persisted, so that the same credentials are used when the session is
+// started again.
+func GenerateCredentials(components []Component) error {
+	for i, component := range components {
+		provider, ok := Lookup(component.ComponentType)
+		if !ok {
+			continue
+		}
+		pp, ok := provider.(PasswordProvider)
+		if !ok || !pp.NeedsPassword() || component.ComponentMetadata.Password != "" {
+			continue
+		}
+		password, err := generatePassword()
+		if err != nil {
+			return fmt.Errorf("failed to generate a password for component %s: %w", component.ComponentID, err)
+		}
+		components[i].ComponentMetadata.Password = password
+	}
+	return nil
+}
+
+func generatePassword() (string, error) {
+	res := make([]byte, passwordLength)
+	max := big.NewInt(int64(len(passwordCharset)))
+	for i := range res {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		res[i] = passwordCharset[n.Int64()]
+	}
+	return string(res), nil
+}
+
+// WorkspaceVolumeName is the name of the workspace volume, and of its claim,
+// created when the session is initialized.
+func WorkspaceVolumeName(sessionID string) string {
+	return sessionID
+}
+
+// LegacyVolumeName returns the name of the claim that the components of the
+// type used to mount, shared by every session of a namespace, before their
+// volumes were named by VolumeName. It is empty for the types that never
+// had one.
+func LegacyVolumeName(componentType ComponentType) string {
+	provider, ok := Lookup(componentType)
+	if !ok {
+		return ""
+	}
+	if p, ok := provider.(*definitionProvider); ok && p.def.Volume != nil {
+		return p.def.Volume.legacyClaimName
+	}
+	return ""
+}
+
+// volumeHashLength is the length of the hash suffixed to component volume
+// names.
+const volumeHashLength = 8
+
+// VolumeName is the name of the volume, and of its claim, of a component. It
+// is derived from both IDs and suffixed with a hash of them, so that it is
+// unique across the sessions of a namespace, and shortened to remain a valid
+// DNS label.
+func VolumeName(sessionID string, componentID string) string {
+	sum := sha256.Sum256([]byte(sessionID + "/" + componentID))
+	hash := hex.EncodeToString(sum[:])[:volumeHashLength]
+	name := fmt.Sprintf("%s-%s", sessionID, componentID)
+	if maxLength := validation.DNS1123LabelMaxLength - volumeHashLength - 1; len(name) > maxLength {
+		name = strings.TrimRight(name[:maxLength], "-")
+	}
+	return fmt.Sprintf("%s-%s", name, hash)
+}
+
+// ParseComponents returns the containers and volumes of the session pod. It
+// fails if two components share an ID, and components mounting the workspace
+// share a single volume. The env vars exported by the components (see
+// EnvExporter) are added to the code containers; when several components
+// export the same variable, the first one wins.
 func ParseComponents(components []Component, sessionID string) ([]*v1.Container, []*v1.Volume, error) {
 	containers := make([]*v1.Container, len(components))
 	var volumes []*v1.Volume
+	var exported []v1.EnvVar
+	componentIDs := make(map[string]bool, len(components))
+	volumeNames := make(map[string]bool, len(components))
 	for i, component := range components {
+		if msgs := validation.IsDNS1123Label(component.ComponentID); len(msgs) > 0 {
+			return nil, nil, fmt.Errorf("%w: invalid component ID %q: %s", ErrInvalidComponent, component.ComponentID, strings.Join(msgs, ", "))
+		}
+		if componentIDs[component.ComponentID] {
+			return nil, nil, fmt.Errorf("%w: duplicate component ID %q", ErrInvalidComponent, component.ComponentID)
+		}
+		componentIDs[component.ComponentID] = true
+
 		container, volume, err := component.ToContainer(sessionID)
 		if err != nil {
 			return nil, nil, err
 		}
 		containers[i] = container
-		if volume != nil {
+		if volume != nil && !volumeNames[volume.Name] {
+			volumeNames[volume.Name] = true
 			volumes = append(volumes, volume)
 		}
+		provider, _ := Lookup(component.ComponentType)
+		if exporter, ok := provider.(EnvExporter); ok {
+			env, err := exporter.ExportedEnv(component, sessionID)
+			if err != nil {
+				return nil, nil, err
+			}
+			exported = append(exported, env...)
+		}
+	}
+	for i, component := range components {
+		if component.ComponentType == Code {
+			containers[i].Env = mergeEnv(containers[i].Env, exported)
+		}
 	}
 	return containers, volumes, nil
 }
 
+// mergeEnv appends to env the variables of extra it doesn't already define.
+func mergeEnv(env []v1.EnvVar, extra []v1.EnvVar) []v1.EnvVar {
+	defined := make(map[string]bool, len(env)+len(extra))
+	for _, e := range env {
+		defined[e.Name] = true
+	}
+	for _, e := range extra {
+		if defined[e.Name] {
+			continue
+		}
+		defined[e.Name] = true
+		env = append(env, e)
+	}
+	return env
+}
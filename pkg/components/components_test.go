@@ -0,0 +1,263 @@
+package components
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestBuiltinComponents(t *testing.T) {
+	for _, componentType := range []ComponentType{Code, Redis, Mongo} {
+		if _, ok := Lookup(componentType); !ok {
+			t.Fatalf("expected %s to be registered", componentType)
+		}
+	}
+
+	code := Component{
+		ComponentType:     Code,
+		ComponentID:       "editor",
+		ComponentMetadata: ComponentMetadata{Password: "secret"},
+	}
+	if code.GetPublicPort() != 8443 {
+		t.Fatalf("unexpected code port %d", code.GetPublicPort())
+	}
+	container, volume, err := code.ToContainer("session-test")
+	if err != nil {
+		t.Fatalf("ToContainer failed: %v", err)
+	}
+	if container.Name != "editor" || container.Image != "linuxserver/code-server" {
+		t.Fatalf("unexpected container %+v", container)
+	}
+	var password string
+	for _, env := range container.Env {
+		if env.Name == "PASSWORD" {
+			password = env.Value
+		}
+	}
+	if password != "secret" {
+		t.Fatalf("expected the password to be templated, got %q", password)
+	}
+	if volume == nil || volume.PersistentVolumeClaim.ClaimName != "session-test" {
+		t.Fatalf("expected the workspace volume, got %+v", volume)
+	}
+	if container.ReadinessProbe == nil || container.ReadinessProbe.HTTPGet == nil {
+		t.Fatalf("expected an HTTP readiness probe, got %+v", container.ReadinessProbe)
+	}
+
+	unknown := Component{ComponentType: "unknown", ComponentID: "x"}
+	if _, _, err := unknown.ToContainer("session-test"); err == nil {
+		t.Fatal("expected unknown component types to be rejected")
+	}
+	if unknown.GetPublicPort() != defaultPublicPort {
+		t.Fatalf("unexpected port %d for unknown component", unknown.GetPublicPort())
+	}
+}
+
+func TestLoadDefinitions(t *testing.T) {
+	dir := t.TempDir()
+	content := `
+components:
+  - type: testdb
+    image: testdb:1
+    port: 5555
+    env:
+      - name: TESTDB_PASSWORD
+        value: "{{ .Password }}"
+    volume:
+      mountPath: /data
+    readinessProbe: {}
+`
+	if err := os.WriteFile(filepath.Join(dir, "testdb.yaml"), []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write definitions: %v", err)
+	}
+	loaded, err := LoadDefinitions(dir)
+	if err != nil {
+		t.Fatalf("LoadDefinitions failed: %v", err)
+	}
+	if len(loaded) != 1 || loaded[0] != "testdb" {
+		t.Fatalf("unexpected loaded types %v", loaded)
+	}
+
+	c := Component{
+		ComponentType:     "testdb",
+		ComponentID:       "db",
+		ComponentMetadata: ComponentMetadata{Password: "pw"},
+	}
+	if c.GetPublicPort() != 5555 {
+		t.Fatalf("unexpected port %d", c.GetPublicPort())
+	}
+	container, volume, err := c.ToContainer("session-test")
+	if err != nil {
+		t.Fatalf("ToContainer failed: %v", err)
+	}
+	if len(container.Env) != 1 || container.Env[0].Value != "pw" {
+		t.Fatalf("unexpected env %+v", container.Env)
+	}
+	if volume.Name != VolumeName("session-test", "db") || container.VolumeMounts[0].MountPath != "/data" {
+		t.Fatalf("unexpected volume %+v", volume)
+	}
+	if container.ReadinessProbe == nil || container.ReadinessProbe.TCPSocket == nil {
+		t.Fatalf("expected a TCP readiness probe, got %+v", container.ReadinessProbe)
+	}
+
+	// loading the same types again collides with the registered ones
+	if _, err := LoadDefinitions(dir); err == nil || !strings.Contains(err.Error(), "already registered") {
+		t.Fatalf("expected duplicate types to be rejected, got %v", err)
+	}
+}
+
+func TestLoadDefinitionsRejectsInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invalid.yaml")
+	content := `
+components:
+  - type: Not_Valid
+    port: 0
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write definitions: %v", err)
+	}
+	_, err := LoadDefinitions(path)
+	if err == nil {
+		t.Fatal("expected invalid definitions to be rejected")
+	}
+	for _, msg := range []string{"invalid component type", "image must be set", "port must be"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected error to mention %q, got %v", msg, err)
+		}
+	}
+}
+
+func TestLoadDefinitionsRejectsDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.yaml": `
+components:
+  - type: dupfirst
+    image: dupfirst:1
+    port: 1111
+`,
+		"b.yaml": `
+components:
+  - type: dupsecond
+    image: dupsecond:1
+    port: 2222
+  - type: dupfirst
+    image: dupfirst:2
+    port: 1111
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write definitions: %v", err)
+		}
+	}
+	loaded, err := LoadDefinitions(dir)
+	if err == nil || !strings.Contains(err.Error(), "already defined") {
+		t.Fatalf("expected duplicate types to be rejected, got %v", err)
+	}
+	if len(loaded) != 0 {
+		t.Fatalf("expected nothing to be loaded, got %v", loaded)
+	}
+	for _, componentType := range []ComponentType{"dupfirst", "dupsecond"} {
+		if _, ok := Lookup(componentType); ok {
+			t.Errorf("expected %s not to be registered", componentType)
+		}
+	}
+}
+
+func TestDatabaseComponents(t *testing.T) {
+	components := []Component{
+		{ComponentType: Code, ComponentID: "editor"},
+		{ComponentType: Postgres, ComponentID: "pg"},
+		{ComponentType: MySQL, ComponentID: "db", ComponentMetadata: ComponentMetadata{Password: "given"}},
+	}
+	if err := GenerateCredentials(components); err != nil {
+		t.Fatalf("GenerateCredentials failed: %v", err)
+	}
+	if components[0].ComponentMetadata.Password != "" {
+		t.Fatal("expected no password to be generated for the code component")
+	}
+	password := components[1].ComponentMetadata.Password
+	if len(password) != passwordLength {
+		t.Fatalf("expected a generated postgres password, got %q", password)
+	}
+	if components[2].ComponentMetadata.Password != "given" {
+		t.Fatal("expected the given mysql password to be kept")
+	}
+
+	containers, volumes, err := ParseComponents(components, "session-test")
+	if err != nil {
+		t.Fatalf("ParseComponents failed: %v", err)
+	}
+	if len(volumes) != 3 {
+		t.Fatalf("expected 3 volumes, got %d", len(volumes))
+	}
+	if containers[1].ReadinessProbe == nil || containers[1].ReadinessProbe.Exec == nil {
+		t.Fatal("expected postgres to have an exec readiness probe")
+	}
+	if mount := containers[1].VolumeMounts[0]; mount.SubPath != "pgdata" {
+		t.Fatalf("unexpected postgres volume mount %+v", mount)
+	}
+
+	env := make(map[string]string)
+	for _, e := range containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	// postgres comes first, so it owns DATABASE_URL
+	if want := "postgres://postgres:" + password + "@localhost:5432/app"; env["DATABASE_URL"] != want {
+		t.Fatalf("expected DATABASE_URL %q, got %q", want, env["DATABASE_URL"])
+	}
+	if env["PGPASSWORD"] != password || env["MYSQL_PASSWORD"] != "given" || env["MYSQL_PORT"] != "3306" {
+		t.Fatalf("unexpected env injected into the code container %v", env)
+	}
+	for _, e := range containers[1].Env {
+		if e.Name == "DATABASE_URL" {
+			t.Fatal("expected exported env to be injected into code containers only")
+		}
+	}
+}
+
+func TestVolumeNames(t *testing.T) {
+	name := VolumeName("session-test", "my-redis")
+	if !strings.HasPrefix(name, "session-test-my-redis-") {
+		t.Fatalf("unexpected volume name %q", name)
+	}
+	// the same name split differently between session and component
+	if name == VolumeName("session-test-my", "redis") {
+		t.Fatal("expected volume names of different sessions to differ")
+	}
+	long := VolumeName("session-"+strings.Repeat("a", 60), "my-redis")
+	if msgs := validation.IsDNS1123Label(long); len(msgs) > 0 {
+		t.Fatalf("expected %q to be a valid DNS label: %v", long, msgs)
+	}
+
+	components := []Component{
+		{ComponentType: Code, ComponentID: "editor"},
+		{ComponentType: Code, ComponentID: "second-editor"},
+		{ComponentType: Redis, ComponentID: "cache"},
+		{ComponentType: Redis, ComponentID: "queue"},
+	}
+	_, volumes, err := ParseComponents(components, "session-test")
+	if err != nil {
+		t.Fatalf("ParseComponents failed: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, volume := range volumes {
+		names[volume.Name] = true
+	}
+	if len(volumes) != 3 || !names["session-test"] || !names[VolumeName("session-test", "cache")] || !names[VolumeName("session-test", "queue")] {
+		t.Fatalf("expected a shared workspace and one volume per redis, got %v", names)
+	}
+
+	components[3].ComponentID = "cache"
+	if _, _, err := ParseComponents(components, "session-test"); err == nil {
+		t.Fatal("expected duplicate component IDs to be rejected")
+	}
+	components[3].ComponentID = "Not_Valid"
+	if _, _, err := ParseComponents(components, "session-test"); err == nil {
+		t.Fatal("expected invalid component IDs to be rejected")
+	}
+}
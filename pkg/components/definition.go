@@ -0,0 +1,339 @@
+package components
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// ComponentDefinition describes a component type declaratively. Env values
+// are Go templates evaluated against TemplateData, e.g. "{{ .Password }}".
+type ComponentDefinition struct {
+	Type           ComponentType      `yaml:"type"`
+	Image          string             `yaml:"image"`
+	Port           int                `yaml:"port"`
+	Env            []EnvVarDefinition `yaml:"env"`
+	Volume         *VolumeDefinition  `yaml:"volume"`
+	ReadinessProbe *ProbeDefinition   `yaml:"readinessProbe"`
+	// GeneratePassword fills the password of components created without one
+	// with a random one.
+	GeneratePassword bool `yaml:"generatePassword"`
+	// ExportedEnv is injected into the code containers of the session, to
+	// tell them how to reach the component (e.g. DATABASE_URL).
+	ExportedEnv []EnvVarDefinition `yaml:"exportedEnv"`
+	// ActivityFile is a file the component touches while it is in use, such
+	// as the heartbeat of code-server, read before stopping an idle session.
+	ActivityFile string `yaml:"activityFile"`
+}
+
+// EnvVarDefinition is an env var set on a container. Value is a Go template
+// evaluated against TemplateData.
+type EnvVarDefinition struct {
+	// Name must be a valid env var name.
+	Name string `yaml:"name"`
+	// Value is rendered once per component, e.g. "{{ .Password }}".
+	Value string `yaml:"value"`
+}
+
+// VolumeDefinition is the persistent volume claim mounted by the component.
+// Each component gets its own claim, named by VolumeName, unless Workspace is
+// set.
+type VolumeDefinition struct {
+	// Workspace mounts the workspace volume created when the session is
+	// initialized, shared by every component of the session that sets it.
+	Workspace bool   `yaml:"workspace"`
+	MountPath string `yaml:"mountPath"`
+	// SubPath mounts a directory of the volume instead of its root, for
+	// images that refuse to initialize a non-empty data directory.
+	SubPath string `yaml:"subPath"`
+	// legacyClaimName is the claim the built in types mounted before each
+	// component got its own, see LegacyVolumeName.
+	legacyClaimName string
+}
+
+// ProbeDefinition is the readiness check of the component. It runs Exec if
+// set, an HTTP GET on HTTPPath if set, and otherwise opens a TCP connection
+// to the component port.
+type ProbeDefinition struct {
+	Exec                []string `yaml:"exec"`
+	HTTPPath            string   `yaml:"httpPath"`
+	InitialDelaySeconds int32    `yaml:"initialDelaySeconds"`
+	PeriodSeconds       int32    `yaml:"periodSeconds"`
+}
+
+// TemplateData is what the templates of a ComponentDefinition are evaluated
+// against.
+type TemplateData struct {
+	SessionID   string
+	ComponentID string
+	Password    string
+	Port        int
+}
+
+type definitionProvider struct {
+	def         ComponentDefinition
+	env         []*template.Template
+	exportedEnv []*template.Template
+}
+
+// NewDefinitionProvider validates def and returns the provider running it.
+func NewDefinitionProvider(def ComponentDefinition) (ComponentProvider, error) {
+	if err := def.validate(); err != nil {
+		return nil, err
+	}
+	env, err := parseEnv(def.Type, def.Env)
+	if err != nil {
+		return nil, err
+	}
+	exportedEnv, err := parseEnv(def.Type, def.ExportedEnv)
+	if err != nil {
+		return nil, err
+	}
+	p := &definitionProvider{
+		def:         def,
+		env:         env,
+		exportedEnv: exportedEnv,
+	}
+	return p, nil
+}
+
+func parseEnv(componentType ComponentType, env []EnvVarDefinition) ([]*template.Template, error) {
+	res := make([]*template.Template, len(env))
+	for i, e := range env {
+		tmpl, err := template.New(e.Name).Option("missingkey=error").Parse(e.Value)
+		if err != nil {
+			return nil, fmt.Errorf("component %s: invalid value for env var %s: %w", componentType, e.Name, err)
+		}
+		res[i] = tmpl
+	}
+	return res, nil
+}
+
+func (d ComponentDefinition) validate() error {
+	var errs []error
+	if msgs := validation.IsDNS1123Label(string(d.Type)); len(msgs) > 0 {
+		errs = append(errs, fmt.Errorf("invalid component type %q: %s", d.Type, strings.Join(msgs, ", ")))
+	}
+	if d.Image == "" {
+		errs = append(errs, fmt.Errorf("component %s: image must be set", d.Type))
+	}
+	if d.Port <= 0 || d.Port > 65535 {
+		errs = append(errs, fmt.Errorf("component %s: port must be between 1 and 65535, got %d", d.Type, d.Port))
+	}
+	for _, env := range append(d.Env, d.ExportedEnv...) {
+		for _, msg := range validation.IsEnvVarName(env.Name) {
+			errs = append(errs, fmt.Errorf("component %s: invalid env var name %q: %s", d.Type, env.Name, msg))
+		}
+	}
+	if d.Volume != nil && d.Volume.MountPath == "" {
+		errs = append(errs, fmt.Errorf("component %s: volume needs a mountPath", d.Type))
+	}
+	return errors.Join(errs...)
+}
+
+func (p *definitionProvider) Type() ComponentType {
+	return p.def.Type
+}
+
+func (p *definitionProvider) PublicPort() int {
+	return p.def.Port
+}
+
+func (p *definitionProvider) NeedsPassword() bool {
+	return p.def.GeneratePassword
+}
+
+func (p *definitionProvider) ActivityFile() string {
+	return p.def.ActivityFile
+}
+
+func (p *definitionProvider) templateData(c Component, sessionID string) TemplateData {
+	return TemplateData{
+		SessionID:   sessionID,
+		ComponentID: c.ComponentID,
+		Password:    c.ComponentMetadata.Password,
+		Port:        p.def.Port,
+	}
+}
+
+func (p *definitionProvider) ExportedEnv(c Component, sessionID string) ([]v1.EnvVar, error) {
+	env, err := renderEnv(p.def.ExportedEnv, p.exportedEnv, p.templateData(c, sessionID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to render exported env of component %s: %w", c.ComponentID, err)
+	}
+	return env, nil
+}
+
+func (p *definitionProvider) ToContainer(c Component, sessionID string) (*v1.Container, *v1.Volume, error) {
+	data := p.templateData(c, sessionID)
+	env, err := renderEnv(p.def.Env, p.env, data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to render env of component %s: %w", c.ComponentID, err)
+	}
+	container := &v1.Container{
+		Name:  c.ComponentID,
+		Image: p.def.Image,
+		Ports: []v1.ContainerPort{
+			{
+				ContainerPort: int32(p.def.Port),
+			},
+		},
+		Env:            env,
+		ReadinessProbe: p.probe(),
+	}
+	if p.def.Volume == nil {
+		return container, nil, nil
+	}
+	claimName := VolumeName(sessionID, c.ComponentID)
+	if p.def.Volume.Workspace {
+		claimName = WorkspaceVolumeName(sessionID)
+	} else if c.LegacyVolume && p.def.Volume.legacyClaimName != "" {
+		claimName = p.def.Volume.legacyClaimName
+	}
+	container.VolumeMounts = []v1.VolumeMount{
+		{
+			Name:      claimName,
+			MountPath: p.def.Volume.MountPath,
+			SubPath:   p.def.Volume.SubPath,
+		},
+	}
+	return container, &v1.Volume{
+		Name: claimName,
+		VolumeSource: v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+				ClaimName: claimName,
+			},
+		},
+	}, nil
+}
+
+func (p *definitionProvider) probe() *v1.Probe {
+	def := p.def.ReadinessProbe
+	if def == nil {
+		return nil
+	}
+	probe := &v1.Probe{
+		InitialDelaySeconds: def.InitialDelaySeconds,
+		PeriodSeconds:       def.PeriodSeconds,
+	}
+	switch {
+	case len(def.Exec) > 0:
+		probe.Exec = &v1.ExecAction{Command: def.Exec}
+	case def.HTTPPath != "":
+		probe.HTTPGet = &v1.HTTPGetAction{
+			Path: def.HTTPPath,
+			Port: intstr.FromInt(p.def.Port),
+		}
+	default:
+		probe.TCPSocket = &v1.TCPSocketAction{
+			Port: intstr.FromInt(p.def.Port),
+		}
+	}
+	return probe
+}
+
+func renderEnv(defs []EnvVarDefinition, templates []*template.Template, data TemplateData) ([]v1.EnvVar, error) {
+	var res []v1.EnvVar
+	for i, tmpl := range templates {
+		value, err := render(tmpl, data)
+		if err != nil {
+			return nil, fmt.Errorf("env var %s: %w", defs[i].Name, err)
+		}
+		res = append(res, v1.EnvVar{
+			Name:  defs[i].Name,
+			Value: value,
+		})
+	}
+	return res, nil
+}
+
+func render(tmpl *template.Template, data TemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+type definitionsFile struct {
+	Components []ComponentDefinition `yaml:"components"`
+}
+
+// LoadDefinitions registers the component definitions found at path, which
+// is either a YAML file or a directory of YAML files. Each file holds a
+// "components" list of ComponentDefinition. Nothing is registered unless every
+// definition is valid and its type is neither defined twice nor already
+// registered.
+func LoadDefinitions(path string) ([]ComponentType, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read component definitions: %w", err)
+	}
+	files := []string{path}
+	if info.IsDir() {
+		files = nil
+		for _, pattern := range []string{"*.yaml", "*.yml"} {
+			matches, err := filepath.Glob(filepath.Join(path, pattern))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+	}
+
+	var providers []ComponentProvider
+	definedIn := make(map[ComponentType]string)
+	for _, file := range files {
+		defs, err := readDefinitions(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, def := range defs {
+			provider, err := NewDefinitionProvider(def)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			if other, ok := definedIn[def.Type]; ok {
+				return nil, fmt.Errorf("%s: component type %s is already defined in %s", file, def.Type, other)
+			}
+			if _, ok := Lookup(def.Type); ok {
+				return nil, fmt.Errorf("%s: component type %s is already registered", file, def.Type)
+			}
+			definedIn[def.Type] = file
+			providers = append(providers, provider)
+		}
+	}
+
+	var loaded []ComponentType
+	for _, provider := range providers {
+		if err := Register(provider); err != nil {
+			return loaded, err
+		}
+		loaded = append(loaded, provider.Type())
+	}
+	return loaded, nil
+}
+
+func readDefinitions(file string) ([]ComponentDefinition, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open component definitions: %w", err)
+	}
+	defer f.Close()
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	var content definitionsFile
+	if err := decoder.Decode(&content); err != nil {
+		return nil, fmt.Errorf("failed to parse component definitions %s: %w", file, err)
+	}
+	return content.Components, nil
+}
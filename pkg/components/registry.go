@@ -0,0 +1,90 @@
+package components
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// ComponentProvider knows how to run one type of component inside the pod of
+// a session.
+type ComponentProvider interface {
+	Type() ComponentType
+	// PublicPort is the port the component listens on, used to expose it.
+	PublicPort() int
+	// ToContainer returns the container running c, along with the volume it
+	// mounts (nil if it doesn't need one).
+	ToContainer(c Component, sessionID string) (*v1.Container, *v1.Volume, error)
+}
+
+// PasswordProvider is implemented by providers whose components need a
+// password, generated by GenerateCredentials when none is given.
+type PasswordProvider interface {
+	NeedsPassword() bool
+}
+
+// EnvExporter is implemented by providers whose components can be reached
+// from the code containers of the session. The env vars it returns are
+// injected into those containers by ParseComponents.
+type EnvExporter interface {
+	ExportedEnv(c Component, sessionID string) ([]v1.EnvVar, error)
+}
+
+// ActivityReporter is implemented by providers whose components record
+// when they were last used in a file of their container, whose path
+// ActivityFile returns. An empty path means they don't.
+type ActivityReporter interface {
+	ActivityFile() string
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[ComponentType]ComponentProvider)
+)
+
+// Register makes a component type available to sessions. Registering the same
+// type twice is an error.
+func Register(provider ComponentProvider) error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	componentType := provider.Type()
+	if componentType == "" || componentType == Undefined {
+		return fmt.Errorf("invalid component type %q", componentType)
+	}
+	if _, ok := registry[componentType]; ok {
+		return fmt.Errorf("component type %s is already registered", componentType)
+	}
+	registry[componentType] = provider
+	return nil
+}
+
+// MustRegister is like Register but panics on error. It is meant for init
+// functions.
+func MustRegister(provider ComponentProvider) {
+	if err := Register(provider); err != nil {
+		panic(err)
+	}
+}
+
+func Lookup(componentType ComponentType) (ComponentProvider, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	provider, ok := registry[componentType]
+	return provider, ok
+}
+
+// RegisteredTypes lists every registered component type, sorted.
+func RegisteredTypes() []ComponentType {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	res := make([]ComponentType, 0, len(registry))
+	for componentType := range registry {
+		res = append(res, componentType)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
@@ -0,0 +1,160 @@
+package components
+
+import (
+	"errors"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// ResourceList holds quantities in the Kubernetes notation, e.g. "500m" or
+// "1Gi". Empty fields are unset.
+type ResourceList struct {
+	CPU              string `json:"cpu,omitempty" yaml:"cpu"`
+	Memory           string `json:"memory,omitempty" yaml:"memory"`
+	EphemeralStorage string `json:"ephemeralStorage,omitempty" yaml:"ephemeralStorage"`
+}
+
+// Resources are the compute resources requested by a component, and the
+// limits it is constrained to.
+type Resources struct {
+	Requests ResourceList `json:"requests,omitempty" yaml:"requests"`
+	Limits   ResourceList `json:"limits,omitempty" yaml:"limits"`
+}
+
+var resourceNames = []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory, v1.ResourceEphemeralStorage}
+
+func (l ResourceList) get(name v1.ResourceName) string {
+	switch name {
+	case v1.ResourceCPU:
+		return l.CPU
+	case v1.ResourceMemory:
+		return l.Memory
+	default:
+		return l.EphemeralStorage
+	}
+}
+
+func (l *ResourceList) set(name v1.ResourceName, value string) {
+	switch name {
+	case v1.ResourceCPU:
+		l.CPU = value
+	case v1.ResourceMemory:
+		l.Memory = value
+	default:
+		l.EphemeralStorage = value
+	}
+}
+
+func parseQuantity(kind string, name v1.ResourceName, value string) (*resource.Quantity, error) {
+	if value == "" {
+		return nil, nil
+	}
+	q, err := resource.ParseQuantity(value)
+	if err != nil || q.Sign() < 0 {
+		return nil, fmt.Errorf("%w: invalid %s %s %q", ErrInvalidComponent, name, kind, value)
+	}
+	return &q, nil
+}
+
+// ResolveResources returns r with its unset requests and limits taken from
+// defaults, and checks the result against max. A default that would conflict
+// with what was explicitly set (e.g. a default limit lower than the given
+// request) is adjusted to the explicit value, and a resource with no limit at
+// all is limited to max.
+func ResolveResources(r Resources, defaults Resources, max ResourceList) (Resources, error) {
+	var errs []error
+	res := r
+	for _, name := range resourceNames {
+		request, err := parseQuantity("request", name, r.Requests.get(name))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		limit, err := parseQuantity("limit", name, r.Limits.get(name))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		maxQuantity, err := parseQuantity("maximum", name, max.get(name))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if request == nil {
+			request, err = parseQuantity("default request", name, defaults.Requests.get(name))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if request != nil && limit != nil && request.Cmp(*limit) > 0 {
+				request = limit
+			}
+		}
+		if limit == nil {
+			limit, err = parseQuantity("default limit", name, defaults.Limits.get(name))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if limit == nil {
+				limit = maxQuantity
+			}
+			if limit != nil && request != nil && limit.Cmp(*request) < 0 {
+				limit = request
+			}
+		}
+
+		if request != nil && limit != nil && request.Cmp(*limit) > 0 {
+			errs = append(errs, fmt.Errorf("%w: %s request %s exceeds its limit %s", ErrInvalidComponent, name, request, limit))
+		}
+		if maxQuantity != nil {
+			if request != nil && request.Cmp(*maxQuantity) > 0 {
+				errs = append(errs, fmt.Errorf("%w: %s request %s exceeds the maximum of %s", ErrInvalidComponent, name, request, maxQuantity))
+			}
+			if limit != nil && limit.Cmp(*maxQuantity) > 0 {
+				errs = append(errs, fmt.Errorf("%w: %s limit %s exceeds the maximum of %s", ErrInvalidComponent, name, limit, maxQuantity))
+			}
+		}
+		res.Requests.set(name, quantityString(request))
+		res.Limits.set(name, quantityString(limit))
+	}
+	return res, errors.Join(errs...)
+}
+
+func quantityString(q *resource.Quantity) string {
+	if q == nil {
+		return ""
+	}
+	return q.String()
+}
+
+// Requirements converts r to the resources of a container.
+func (r Resources) Requirements() (v1.ResourceRequirements, error) {
+	var res v1.ResourceRequirements
+	for _, name := range resourceNames {
+		request, err := parseQuantity("request", name, r.Requests.get(name))
+		if err != nil {
+			return res, err
+		}
+		if request != nil {
+			if res.Requests == nil {
+				res.Requests = v1.ResourceList{}
+			}
+			res.Requests[name] = *request
+		}
+		limit, err := parseQuantity("limit", name, r.Limits.get(name))
+		if err != nil {
+			return res, err
+		}
+		if limit != nil {
+			if res.Limits == nil {
+				res.Limits = v1.ResourceList{}
+			}
+			res.Limits[name] = *limit
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,68 @@
+package components
+
+import (
+	"errors"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestResolveResources(t *testing.T) {
+	defaults := Resources{
+		Requests: ResourceList{CPU: "100m", Memory: "128Mi"},
+		Limits:   ResourceList{CPU: "1", Memory: "1Gi"},
+	}
+	max := ResourceList{CPU: "2", Memory: "4Gi", EphemeralStorage: "1Gi"}
+
+	res, err := ResolveResources(Resources{}, defaults, max)
+	if err != nil {
+		t.Fatalf("ResolveResources failed: %v", err)
+	}
+	if res.Requests.CPU != "100m" || res.Limits.Memory != "1Gi" {
+		t.Fatalf("expected defaults to be applied, got %+v", res)
+	}
+	if res.Requests.EphemeralStorage != "" || res.Limits.EphemeralStorage != "1Gi" {
+		t.Fatalf("expected resources without limit to be capped, got %+v", res)
+	}
+
+	// an explicit request above the default limit raises the limit
+	res, err = ResolveResources(Resources{Requests: ResourceList{Memory: "2Gi"}}, defaults, max)
+	if err != nil {
+		t.Fatalf("ResolveResources failed: %v", err)
+	}
+	if res.Limits.Memory != "2Gi" {
+		t.Fatalf("expected the memory limit to follow the request, got %+v", res)
+	}
+
+	for _, r := range []Resources{
+		{Requests: ResourceList{CPU: "3"}},
+		{Limits: ResourceList{Memory: "8Gi"}},
+		{Requests: ResourceList{CPU: "1"}, Limits: ResourceList{CPU: "500m"}},
+		{Requests: ResourceList{Memory: "a lot"}},
+	} {
+		if _, err := ResolveResources(r, defaults, max); !errors.Is(err, ErrInvalidComponent) {
+			t.Errorf("expected %+v to be rejected, got %v", r, err)
+		}
+	}
+}
+
+func TestContainerResources(t *testing.T) {
+	c := Component{
+		ComponentType: Redis,
+		ComponentID:   "cache",
+		Resources: Resources{
+			Requests: ResourceList{CPU: "250m"},
+			Limits:   ResourceList{Memory: "256Mi"},
+		},
+	}
+	container, _, err := c.ToContainer("session-test")
+	if err != nil {
+		t.Fatalf("ToContainer failed: %v", err)
+	}
+	if cpu := container.Resources.Requests[v1.ResourceCPU]; cpu.String() != "250m" {
+		t.Fatalf("unexpected cpu request %s", cpu.String())
+	}
+	if memory := container.Resources.Limits[v1.ResourceMemory]; memory.String() != "256Mi" {
+		t.Fatalf("unexpected memory limit %s", memory.String())
+	}
+}
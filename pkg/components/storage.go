@@ -0,0 +1,83 @@
+package components
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Storage describes the persistent volume of a component. Empty fields are
+// filled in from the server defaults by ResolveStorage.
+type Storage struct {
+	Size string `json:"size,omitempty"`
+	// StorageClass is the class of the volume. Empty means the cluster
+	// default.
+	StorageClass string                        `json:"storageClass,omitempty"`
+	AccessMode   v1.PersistentVolumeAccessMode `json:"accessMode,omitempty"`
+}
+
+// StorageBounds restricts the storage components can ask for. Empty fields
+// don't restrict anything.
+type StorageBounds struct {
+	MinSize string `yaml:"minSize"`
+	MaxSize string `yaml:"maxSize"`
+	// StorageClasses lists the storage classes components may use.
+	StorageClasses []string `yaml:"storageClasses"`
+}
+
+var accessModes = []v1.PersistentVolumeAccessMode{
+	v1.ReadWriteOnce,
+	v1.ReadOnlyMany,
+	v1.ReadWriteMany,
+	v1.ReadWriteOncePod,
+}
+
+// ResolveStorage returns s with its unset fields taken from defaults, and
+// checks the result against bounds. The access mode defaults to
+// ReadWriteOnce.
+func ResolveStorage(s Storage, defaults Storage, bounds StorageBounds) (Storage, error) {
+	if s.Size == "" {
+		s.Size = defaults.Size
+	}
+	if s.StorageClass == "" {
+		s.StorageClass = defaults.StorageClass
+	}
+	if s.AccessMode == "" {
+		s.AccessMode = defaults.AccessMode
+	}
+	if s.AccessMode == "" {
+		s.AccessMode = v1.ReadWriteOnce
+	}
+
+	var errs []error
+	size, err := resource.ParseQuantity(s.Size)
+	if err != nil || size.Sign() <= 0 {
+		errs = append(errs, fmt.Errorf("%w: invalid storage size %q", ErrInvalidComponent, s.Size))
+	} else {
+		s.Size = size.String()
+		if bounds.MinSize != "" {
+			if min, err := resource.ParseQuantity(bounds.MinSize); err != nil {
+				errs = append(errs, fmt.Errorf("%w: invalid minimum storage size %q", ErrInvalidComponent, bounds.MinSize))
+			} else if size.Cmp(min) < 0 {
+				errs = append(errs, fmt.Errorf("%w: storage size %s is below the minimum of %s", ErrInvalidComponent, s.Size, bounds.MinSize))
+			}
+		}
+		if bounds.MaxSize != "" {
+			if max, err := resource.ParseQuantity(bounds.MaxSize); err != nil {
+				errs = append(errs, fmt.Errorf("%w: invalid maximum storage size %q", ErrInvalidComponent, bounds.MaxSize))
+			} else if size.Cmp(max) > 0 {
+				errs = append(errs, fmt.Errorf("%w: storage size %s exceeds the maximum of %s", ErrInvalidComponent, s.Size, bounds.MaxSize))
+			}
+		}
+	}
+	if s.StorageClass != "" && len(bounds.StorageClasses) > 0 && !slices.Contains(bounds.StorageClasses, s.StorageClass) {
+		errs = append(errs, fmt.Errorf("%w: storage class %q is not allowed", ErrInvalidComponent, s.StorageClass))
+	}
+	if !slices.Contains(accessModes, s.AccessMode) {
+		errs = append(errs, fmt.Errorf("%w: invalid access mode %q", ErrInvalidComponent, s.AccessMode))
+	}
+	return s, errors.Join(errs...)
+}
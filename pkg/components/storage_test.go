@@ -0,0 +1,45 @@
+package components
+
+import (
+	"errors"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestResolveStorage(t *testing.T) {
+	defaults := Storage{Size: "20Mi", StorageClass: "standard"}
+	bounds := StorageBounds{
+		MinSize:        "10Mi",
+		MaxSize:        "50Gi",
+		StorageClasses: []string{"standard", "fast-ssd"},
+	}
+
+	s, err := ResolveStorage(Storage{}, defaults, bounds)
+	if err != nil {
+		t.Fatalf("ResolveStorage failed: %v", err)
+	}
+	if s.Size != "20Mi" || s.StorageClass != "standard" || s.AccessMode != v1.ReadWriteOnce {
+		t.Fatalf("expected defaults to be applied, got %+v", s)
+	}
+
+	s, err = ResolveStorage(Storage{Size: "20Gi", StorageClass: "fast-ssd", AccessMode: v1.ReadWriteMany}, defaults, bounds)
+	if err != nil {
+		t.Fatalf("ResolveStorage failed: %v", err)
+	}
+	if s.Size != "20Gi" || s.StorageClass != "fast-ssd" || s.AccessMode != v1.ReadWriteMany {
+		t.Fatalf("expected explicit values to be kept, got %+v", s)
+	}
+
+	for _, s := range []Storage{
+		{Size: "1Mi"},
+		{Size: "100Gi"},
+		{Size: "huge"},
+		{StorageClass: "gold"},
+		{AccessMode: "WriteSometimes"},
+	} {
+		if _, err := ResolveStorage(s, defaults, bounds); !errors.Is(err, ErrInvalidComponent) {
+			t.Errorf("expected %+v to be rejected, got %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,502 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	Development = "development"
+	Production  = "production"
+)
+
+// Config is the configuration of the autodev server. It is read from a YAML
+// file (see Load) and every field can be overridden by an AUTODEV_* env var.
+type Config struct {
+	// Env is either "development" or "production".
+	Env        string           `yaml:"env"`
+	Server     ServerConfig     `yaml:"server"`
+	Etcd       EtcdConfig       `yaml:"etcd"`
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+	Sessions   SessionsConfig   `yaml:"sessions"`
+	Components ComponentsConfig `yaml:"components"`
+	Sagas      SagasConfig      `yaml:"sagas"`
+	Locks      LocksConfig      `yaml:"locks"`
+	Idle       IdleConfig       `yaml:"idle"`
+	Expiry     ExpiryConfig     `yaml:"expiry"`
+	Reconciler ReconcilerConfig `yaml:"reconciler"`
+}
+
+type ServerConfig struct {
+	Port int `yaml:"port"`
+}
+
+type EtcdConfig struct {
+	Endpoints   []string      `yaml:"endpoints"`
+	DialTimeout time.Duration `yaml:"dialTimeout"`
+	// RequestTimeout bounds every individual request made to etcd, including
+	// the health probe.
+	RequestTimeout time.Duration `yaml:"requestTimeout"`
+	Username       string        `yaml:"username"`
+	Password       string        `yaml:"password"`
+	TLS            EtcdTLSConfig `yaml:"tls"`
+}
+
+// EtcdTLSConfig configures the TLS connection to etcd. TLS is enabled as soon
+// as Enabled is set or any certificate file is given.
+type EtcdTLSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// CertFile and KeyFile are the client certificate and its key, used when
+	// etcd requires client certificate authentication.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// CAFile is the bundle used to verify the etcd server certificates,
+	// instead of the system roots.
+	CAFile             string `yaml:"caFile"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+func (c EtcdTLSConfig) IsEnabled() bool {
+	return c.Enabled || c.CertFile != "" || c.KeyFile != "" || c.CAFile != ""
+}
+
+type KubernetesConfig struct {
+	// Kubeconfig is the kubeconfig file used when running outside of a
+	// cluster. It defaults to ~/.kube/config.
+	Kubeconfig string `yaml:"kubeconfig"`
+}
+
+// SessionsConfig drives where and how the Kubernetes resources of sessions
+// are created.
+type SessionsConfig struct {
+	// Namespace is shared by every session unless DedicatedNamespaces is set.
+	Namespace string `yaml:"namespace"`
+	// DedicatedNamespaces gives each session its own namespace, named after
+	// the session, which is deleted along with the session.
+	DedicatedNamespaces bool `yaml:"dedicatedNamespaces"`
+	// IngressName is the shared ingress, living in Namespace, that exposes
+	// the components of every session.
+	IngressName string `yaml:"ingressName"`
+	// IngressClassName is the class of the ingresses created for sessions
+	// in dedicated namespaces. Empty means the cluster default.
+	IngressClassName string `yaml:"ingressClassName"`
+	// BaseDomain is appended to "<session>.<component>." to build the host
+	// name of exposed components.
+	BaseDomain string `yaml:"baseDomain"`
+	// WorkspaceStorage is the default size of the IDE workspace volume.
+	WorkspaceStorage string `yaml:"workspaceStorage"`
+	// ComponentStorage is the default size of every other component volume.
+	ComponentStorage string `yaml:"componentStorage"`
+	// DefaultStorageClass is the class of the volumes that don't ask for
+	// one. Empty means the cluster default.
+	DefaultStorageClass string `yaml:"defaultStorageClass"`
+	// StorageBounds restricts the size and class of every volume.
+	StorageBounds cmp.StorageBounds `yaml:"storageBounds"`
+	// SnapshotClassName is the VolumeSnapshotClass of session snapshots.
+	// Empty means the cluster default.
+	SnapshotClassName string `yaml:"snapshotClassName"`
+	// DefaultResources apply to the components created without explicit
+	// requests or limits.
+	DefaultResources cmp.Resources `yaml:"defaultResources"`
+	// MaxResources caps the requests and limits of every component.
+	// Creating a component above them is rejected.
+	MaxResources cmp.ResourceList `yaml:"maxResources"`
+	// DefaultTTL is the time to live of the sessions initialized without
+	// one. Zero means they never expire.
+	DefaultTTL time.Duration `yaml:"defaultTTL"`
+	// MaxTTL caps the time to live of every session, and the time they can
+	// be extended by. Zero means no cap, and allows sessions that never
+	// expire.
+	MaxTTL time.Duration `yaml:"maxTTL"`
+}
+
+type ComponentsConfig struct {
+	// DefinitionsPath is a YAML file, or a directory of YAML files, defining
+	// component types on top of the builtin ones.
+	DefinitionsPath string `yaml:"definitionsPath"`
+}
+
+// SagasConfig drives the recovery of the sagas left unfinished by a crash.
+type SagasConfig struct {
+	// StaleAfter is how long a saga must go without progress before it is
+	// considered unfinished. It must exceed the longest saga step.
+	StaleAfter time.Duration `yaml:"staleAfter"`
+	// RecoveryInterval is how often unfinished sagas are looked for, on top
+	// of the startup recovery.
+	RecoveryInterval time.Duration `yaml:"recoveryInterval"`
+}
+
+// LocksConfig drives the etcd locks serializing the changes made to a
+// session.
+type LocksConfig struct {
+	// TTL is how long a lock outlives a holder that stopped renewing it. It
+	// is rounded down to the second.
+	TTL time.Duration `yaml:"ttl"`
+	// WaitTimeout is how long a request waits for a lock held by another
+	// request before failing.
+	WaitTimeout time.Duration `yaml:"waitTimeout"`
+	// LegacyKeys also takes every lock under the key used by the versions
+	// that kept the locks at the top level of etcd, so that the replicas of
+	// both versions exclude each other during a rolling upgrade. It can be
+	// turned off once no replica of such a version runs anymore.
+	LegacyKeys bool `yaml:"legacyKeys"`
+}
+
+// IdleConfig drives the automatic stop of the running sessions that are no
+// longer used.
+type IdleConfig struct {
+	// Timeout is how long a running session can go without activity before
+	// it is stopped. Zero disables the automatic stop.
+	Timeout time.Duration `yaml:"timeout"`
+	// CheckInterval is how often the activity of the sessions is recorded
+	// and idle sessions are looked for.
+	CheckInterval time.Duration `yaml:"checkInterval"`
+}
+
+// ExpiryConfig drives the expiry of the sessions that have a time to live.
+type ExpiryConfig struct {
+	// WarnBefore is how long before it expires a session is marked as
+	// expiring.
+	WarnBefore time.Duration `yaml:"warnBefore"`
+	// DeleteAfter is how long an expired session is kept stopped, and can
+	// still be extended, before it is deleted.
+	DeleteAfter time.Duration `yaml:"deleteAfter"`
+	// CheckInterval is how often expired sessions are looked for.
+	CheckInterval time.Duration `yaml:"checkInterval"`
+}
+
+// ReconcilerConfig drives the loop keeping the sessions in line with their
+// objects in the cluster.
+type ReconcilerConfig struct {
+	// Workers is how many sessions are reconciled at once.
+	Workers int `yaml:"workers"`
+	// ResyncPeriod is how often every session is reconciled, on top of the
+	// changes of its objects.
+	ResyncPeriod time.Duration `yaml:"resyncPeriod"`
+}
+
+// Default returns the configuration used when nothing is overridden, which
+// matches a local development setup.
+func Default() *Config {
+	return &Config{
+		Env: Development,
+		Server: ServerConfig{
+			Port: 8080,
+		},
+		Etcd: EtcdConfig{
+			Endpoints:      []string{"localhost:2379"},
+			DialTimeout:    5 * time.Second,
+			RequestTimeout: 5 * time.Second,
+		},
+		Sessions: SessionsConfig{
+			Namespace:        "default",
+			IngressName:      "minimal-ingress",
+			BaseDomain:       "hamzaboudouche.tech",
+			WorkspaceStorage: "10Mi",
+			ComponentStorage: "20Mi",
+			StorageBounds: cmp.StorageBounds{
+				MinSize: "1Mi",
+				MaxSize: "50Gi",
+			},
+			DefaultResources: cmp.Resources{
+				Requests: cmp.ResourceList{
+					CPU:    "100m",
+					Memory: "128Mi",
+				},
+				Limits: cmp.ResourceList{
+					CPU:    "2",
+					Memory: "2Gi",
+				},
+			},
+			MaxResources: cmp.ResourceList{
+				CPU:              "4",
+				Memory:           "8Gi",
+				EphemeralStorage: "10Gi",
+			},
+		},
+		Sagas: SagasConfig{
+			StaleAfter:       2 * time.Minute,
+			RecoveryInterval: time.Minute,
+		},
+		Locks: LocksConfig{
+			TTL:         10 * time.Second,
+			WaitTimeout: 30 * time.Second,
+			LegacyKeys:  true,
+		},
+		Idle: IdleConfig{
+			CheckInterval: time.Minute,
+		},
+		Expiry: ExpiryConfig{
+			WarnBefore:    time.Hour,
+			DeleteAfter:   24 * time.Hour,
+			CheckInterval: time.Minute,
+		},
+		Reconciler: ReconcilerConfig{
+			Workers:      2,
+			ResyncPeriod: 10 * time.Minute,
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, the YAML file at path (if
+// path is not empty) and the AUTODEV_* env vars, in that order of precedence,
+// and validates the result.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open config file: %w", err)
+		}
+		defer f.Close()
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) applyEnv() error {
+	var errs []error
+	setString := func(name string, target *string) {
+		if value, ok := os.LookupEnv(name); ok {
+			*target = value
+		}
+	}
+	setBool := func(name string, target *bool) {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", name, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+	setInt := func(name string, target *int) {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", name, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+	setDuration := func(name string, target *time.Duration) {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", name, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+	setList := func(name string, target *[]string) {
+		if value, ok := os.LookupEnv(name); ok {
+			*target = strings.Split(value, ",")
+		}
+	}
+
+	setString("AUTODEV_ENV", &c.Env)
+	setInt("AUTODEV_PORT", &c.Server.Port)
+	setList("AUTODEV_ETCD_ENDPOINTS", &c.Etcd.Endpoints)
+	setDuration("AUTODEV_ETCD_DIAL_TIMEOUT", &c.Etcd.DialTimeout)
+	setDuration("AUTODEV_ETCD_REQUEST_TIMEOUT", &c.Etcd.RequestTimeout)
+	setString("AUTODEV_ETCD_USERNAME", &c.Etcd.Username)
+	setString("AUTODEV_ETCD_PASSWORD", &c.Etcd.Password)
+	setBool("AUTODEV_ETCD_TLS_ENABLED", &c.Etcd.TLS.Enabled)
+	setString("AUTODEV_ETCD_CERT_FILE", &c.Etcd.TLS.CertFile)
+	setString("AUTODEV_ETCD_KEY_FILE", &c.Etcd.TLS.KeyFile)
+	setString("AUTODEV_ETCD_CA_FILE", &c.Etcd.TLS.CAFile)
+	setString("AUTODEV_ETCD_SERVER_NAME", &c.Etcd.TLS.ServerName)
+	setBool("AUTODEV_ETCD_INSECURE_SKIP_VERIFY", &c.Etcd.TLS.InsecureSkipVerify)
+	setString("AUTODEV_KUBECONFIG", &c.Kubernetes.Kubeconfig)
+	setString("AUTODEV_NAMESPACE", &c.Sessions.Namespace)
+	setBool("AUTODEV_DEDICATED_NAMESPACES", &c.Sessions.DedicatedNamespaces)
+	setString("AUTODEV_INGRESS_NAME", &c.Sessions.IngressName)
+	setString("AUTODEV_INGRESS_CLASS_NAME", &c.Sessions.IngressClassName)
+	setString("AUTODEV_BASE_DOMAIN", &c.Sessions.BaseDomain)
+	setString("AUTODEV_WORKSPACE_STORAGE", &c.Sessions.WorkspaceStorage)
+	setString("AUTODEV_COMPONENT_STORAGE", &c.Sessions.ComponentStorage)
+	setString("AUTODEV_DEFAULT_STORAGE_CLASS", &c.Sessions.DefaultStorageClass)
+	setString("AUTODEV_MIN_STORAGE", &c.Sessions.StorageBounds.MinSize)
+	setString("AUTODEV_MAX_STORAGE", &c.Sessions.StorageBounds.MaxSize)
+	setList("AUTODEV_STORAGE_CLASSES", &c.Sessions.StorageBounds.StorageClasses)
+	setString("AUTODEV_SNAPSHOT_CLASS_NAME", &c.Sessions.SnapshotClassName)
+	setString("AUTODEV_DEFAULT_CPU_REQUEST", &c.Sessions.DefaultResources.Requests.CPU)
+	setString("AUTODEV_DEFAULT_MEMORY_REQUEST", &c.Sessions.DefaultResources.Requests.Memory)
+	setString("AUTODEV_DEFAULT_EPHEMERAL_STORAGE_REQUEST", &c.Sessions.DefaultResources.Requests.EphemeralStorage)
+	setString("AUTODEV_DEFAULT_CPU_LIMIT", &c.Sessions.DefaultResources.Limits.CPU)
+	setString("AUTODEV_DEFAULT_MEMORY_LIMIT", &c.Sessions.DefaultResources.Limits.Memory)
+	setString("AUTODEV_DEFAULT_EPHEMERAL_STORAGE_LIMIT", &c.Sessions.DefaultResources.Limits.EphemeralStorage)
+	setString("AUTODEV_MAX_CPU", &c.Sessions.MaxResources.CPU)
+	setString("AUTODEV_MAX_MEMORY", &c.Sessions.MaxResources.Memory)
+	setString("AUTODEV_MAX_EPHEMERAL_STORAGE", &c.Sessions.MaxResources.EphemeralStorage)
+	setDuration("AUTODEV_DEFAULT_TTL", &c.Sessions.DefaultTTL)
+	setDuration("AUTODEV_MAX_TTL", &c.Sessions.MaxTTL)
+	setString("AUTODEV_COMPONENT_DEFINITIONS", &c.Components.DefinitionsPath)
+	setDuration("AUTODEV_SAGA_STALE_AFTER", &c.Sagas.StaleAfter)
+	setDuration("AUTODEV_SAGA_RECOVERY_INTERVAL", &c.Sagas.RecoveryInterval)
+	setDuration("AUTODEV_LOCK_TTL", &c.Locks.TTL)
+	setDuration("AUTODEV_LOCK_WAIT_TIMEOUT", &c.Locks.WaitTimeout)
+	setBool("AUTODEV_LOCK_LEGACY_KEYS", &c.Locks.LegacyKeys)
+	setDuration("AUTODEV_IDLE_TIMEOUT", &c.Idle.Timeout)
+	setDuration("AUTODEV_IDLE_CHECK_INTERVAL", &c.Idle.CheckInterval)
+	setDuration("AUTODEV_EXPIRY_WARN_BEFORE", &c.Expiry.WarnBefore)
+	setDuration("AUTODEV_EXPIRY_DELETE_AFTER", &c.Expiry.DeleteAfter)
+	setDuration("AUTODEV_EXPIRY_CHECK_INTERVAL", &c.Expiry.CheckInterval)
+	setInt("AUTODEV_RECONCILER_WORKERS", &c.Reconciler.Workers)
+	setDuration("AUTODEV_RECONCILER_RESYNC_PERIOD", &c.Reconciler.ResyncPeriod)
+
+	return errors.Join(errs...)
+}
+
+// Validate reports every invalid field of the configuration at once.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Env != Development && c.Env != Production {
+		errs = append(errs, fmt.Errorf("env must be %q or %q, got %q", Development, Production, c.Env))
+	}
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port must be between 1 and 65535, got %d", c.Server.Port))
+	}
+	errs = append(errs, c.Etcd.validate()...)
+	errs = append(errs, c.Sessions.validate()...)
+	if c.Sagas.StaleAfter <= 0 {
+		errs = append(errs, errors.New("sagas.staleAfter must be positive"))
+	}
+	if c.Sagas.RecoveryInterval <= 0 {
+		errs = append(errs, errors.New("sagas.recoveryInterval must be positive"))
+	}
+	if c.Locks.TTL < time.Second {
+		errs = append(errs, errors.New("locks.ttl must be at least 1s"))
+	}
+	if c.Locks.WaitTimeout <= 0 {
+		errs = append(errs, errors.New("locks.waitTimeout must be positive"))
+	}
+	if c.Idle.Timeout < 0 {
+		errs = append(errs, errors.New("idle.timeout must not be negative"))
+	}
+	if c.Idle.CheckInterval <= 0 {
+		errs = append(errs, errors.New("idle.checkInterval must be positive"))
+	}
+	if c.Expiry.WarnBefore < 0 {
+		errs = append(errs, errors.New("expiry.warnBefore must not be negative"))
+	}
+	if c.Expiry.DeleteAfter < 0 {
+		errs = append(errs, errors.New("expiry.deleteAfter must not be negative"))
+	}
+	if c.Expiry.CheckInterval <= 0 {
+		errs = append(errs, errors.New("expiry.checkInterval must be positive"))
+	}
+	if c.Reconciler.Workers <= 0 {
+		errs = append(errs, errors.New("reconciler.workers must be positive"))
+	}
+	if c.Reconciler.ResyncPeriod <= 0 {
+		errs = append(errs, errors.New("reconciler.resyncPeriod must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+func (c *EtcdConfig) validate() []error {
+	var errs []error
+	if len(c.Endpoints) == 0 {
+		errs = append(errs, errors.New("etcd.endpoints must not be empty"))
+	}
+	for _, endpoint := range c.Endpoints {
+		if strings.TrimSpace(endpoint) == "" {
+			errs = append(errs, errors.New("etcd.endpoints must not contain empty endpoints"))
+		}
+	}
+	if c.DialTimeout <= 0 {
+		errs = append(errs, errors.New("etcd.dialTimeout must be positive"))
+	}
+	if c.RequestTimeout <= 0 {
+		errs = append(errs, errors.New("etcd.requestTimeout must be positive"))
+	}
+	if (c.Username == "") != (c.Password == "") {
+		errs = append(errs, errors.New("etcd.username and etcd.password must be set together"))
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("etcd.tls.certFile and etcd.tls.keyFile must be set together"))
+	}
+	return errs
+}
+
+func (c *SessionsConfig) validate() []error {
+	var errs []error
+	if !c.DedicatedNamespaces {
+		for _, msg := range validation.IsDNS1123Label(c.Namespace) {
+			errs = append(errs, fmt.Errorf("sessions.namespace %q is invalid: %s", c.Namespace, msg))
+		}
+		if c.IngressName == "" {
+			errs = append(errs, errors.New("sessions.ingressName must be set when sessions share a namespace"))
+		}
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(c.BaseDomain) {
+		errs = append(errs, fmt.Errorf("sessions.baseDomain %q is invalid: %s", c.BaseDomain, msg))
+	}
+	errs = append(errs, validateQuantity("sessions.workspaceStorage", c.WorkspaceStorage)...)
+	errs = append(errs, validateQuantity("sessions.componentStorage", c.ComponentStorage)...)
+	for _, def := range []cmp.Storage{c.WorkspaceStorageDefaults(), c.ComponentStorageDefaults()} {
+		if _, err := cmp.ResolveStorage(cmp.Storage{}, def, c.StorageBounds); err != nil {
+			errs = append(errs, fmt.Errorf("sessions storage defaults are inconsistent with sessions.storageBounds: %w", err))
+			break
+		}
+	}
+	if _, err := cmp.ResolveResources(cmp.Resources{}, c.DefaultResources, c.MaxResources); err != nil {
+		errs = append(errs, fmt.Errorf("sessions.defaultResources and sessions.maxResources are inconsistent: %w", err))
+	}
+	if c.DefaultTTL < 0 || c.MaxTTL < 0 {
+		errs = append(errs, errors.New("sessions.defaultTTL and sessions.maxTTL must not be negative"))
+	}
+	if c.MaxTTL > 0 && (c.DefaultTTL == 0 || c.DefaultTTL > c.MaxTTL) {
+		errs = append(errs, errors.New("sessions.defaultTTL must be set and at most sessions.maxTTL when sessions.maxTTL is set"))
+	}
+	return errs
+}
+
+// WorkspaceStorageDefaults is the storage of workspace volumes that don't
+// ask for anything else.
+func (c *SessionsConfig) WorkspaceStorageDefaults() cmp.Storage {
+	return cmp.Storage{
+		Size:         c.WorkspaceStorage,
+		StorageClass: c.DefaultStorageClass,
+	}
+}
+
+// ComponentStorageDefaults is the storage of component volumes that don't
+// ask for anything else.
+func (c *SessionsConfig) ComponentStorageDefaults() cmp.Storage {
+	return cmp.Storage{
+		Size:         c.ComponentStorage,
+		StorageClass: c.DefaultStorageClass,
+	}
+}
+
+func validateQuantity(name string, value string) []error {
+	if _, err := resource.ParseQuantity(value); err != nil {
+		return []error{fmt.Errorf("%s %q is not a valid quantity", name, value)}
+	}
+	return nil
+}
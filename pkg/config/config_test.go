@@ -0,0 +1,121 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "autodev.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Server.Port != 8080 || cfg.Sessions.IngressName != "minimal-ingress" {
+		t.Fatalf("unexpected defaults %+v", cfg)
+	}
+	if !cfg.Locks.LegacyKeys {
+		t.Fatal("expected the legacy lock keys to be taken by default")
+	}
+}
+
+func TestLoadFileAndEnv(t *testing.T) {
+	path := writeConfig(t, `
+env: production
+server:
+  port: 9090
+etcd:
+  endpoints: ["etcd-0:2379", "etcd-1:2379"]
+  dialTimeout: 10s
+sessions:
+  namespace: dev-sessions
+  baseDomain: dev.example.com
+  workspaceStorage: 1Gi
+`)
+	t.Setenv("AUTODEV_BASE_DOMAIN", "staging.example.com")
+	t.Setenv("AUTODEV_DEDICATED_NAMESPACES", "true")
+	t.Setenv("AUTODEV_LOCK_LEGACY_KEYS", "false")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Env != Production || cfg.Server.Port != 9090 {
+		t.Fatalf("file values were not applied: %+v", cfg)
+	}
+	if len(cfg.Etcd.Endpoints) != 2 || cfg.Etcd.DialTimeout != 10*time.Second {
+		t.Fatalf("unexpected etcd config %+v", cfg.Etcd)
+	}
+	if cfg.Sessions.Namespace != "dev-sessions" || cfg.Sessions.WorkspaceStorage != "1Gi" {
+		t.Fatalf("unexpected sessions config %+v", cfg.Sessions)
+	}
+	// unset values keep their default
+	if cfg.Sessions.ComponentStorage != "20Mi" {
+		t.Fatalf("expected default component storage, got %q", cfg.Sessions.ComponentStorage)
+	}
+	// env vars take precedence over the file
+	if cfg.Sessions.BaseDomain != "staging.example.com" || !cfg.Sessions.DedicatedNamespaces {
+		t.Fatalf("env overrides were not applied: %+v", cfg.Sessions)
+	}
+	if cfg.Locks.LegacyKeys {
+		t.Fatal("expected AUTODEV_LOCK_LEGACY_KEYS to turn off the legacy lock keys")
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	path := writeConfig(t, "sessions:\n  ingresName: typo\n")
+	if _, err := Load(path); err == nil {
+		t.Fatal("expected unknown fields to be rejected")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Setenv("AUTODEV_PORT", "0")
+	t.Setenv("AUTODEV_NAMESPACE", "Not_A_Namespace")
+	t.Setenv("AUTODEV_WORKSPACE_STORAGE", "lots")
+
+	_, err := Load("")
+	if err == nil {
+		t.Fatal("expected invalid configuration to be rejected")
+	}
+	for _, field := range []string{"server.port", "sessions.namespace", "sessions.workspaceStorage"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("expected error to mention %s, got %v", field, err)
+		}
+	}
+
+	t.Setenv("AUTODEV_PORT", "8080")
+	t.Setenv("AUTODEV_NAMESPACE", "default")
+	t.Setenv("AUTODEV_WORKSPACE_STORAGE", "10Mi")
+	t.Setenv("AUTODEV_ETCD_USERNAME", "autodev")
+	t.Setenv("AUTODEV_ETCD_CERT_FILE", "/etc/autodev/etcd.crt")
+	_, err = Load("")
+	for _, field := range []string{"etcd.username", "etcd.tls.certFile"} {
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("expected error to mention %s, got %v", field, err)
+		}
+	}
+
+	t.Setenv("AUTODEV_ETCD_USERNAME", "")
+	t.Setenv("AUTODEV_ETCD_CERT_FILE", "")
+	t.Setenv("AUTODEV_DEFAULT_MEMORY_REQUEST", "16Gi")
+	if _, err := Load(""); err == nil || !strings.Contains(err.Error(), "sessions.defaultResources") {
+		t.Errorf("expected default resources above the caps to be rejected, got %v", err)
+	}
+
+	t.Setenv("AUTODEV_PORT", "not-a-number")
+	if _, err := Load(""); err == nil {
+		t.Fatal("expected malformed env vars to be rejected")
+	}
+}
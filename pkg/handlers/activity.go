@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
+)
+
+// TrackActivity records the successful requests made to a session as
+// activity of that session. GET requests are left out, since dashboards
+// polling the status of a session don't mean it is in use.
+func TrackActivity(tracker *ss.ActivityTracker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
+		if sessionName == "" || c.Request.Method == http.MethodGet || c.Writer.Status() >= http.StatusBadRequest {
+			return
+		}
+		tracker.Touch(fmt.Sprintf("session-%s", sessionName))
+	}
+}
+
+// HeartbeatHandler lets the code editor of a session, or anything else
+// working with it, report that the session is in use.
+func HeartbeatHandler(store ss.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
+		sessionID := fmt.Sprintf("session-%s", sessionName)
+
+		// the activity itself is recorded by TrackActivity
+		if _, _, err := store.Get(c.Request.Context(), sessionID); err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to record the activity of session %s", sessionName)))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": fmt.Sprintf("activity of session %s recorded successfully", sessionName),
+		})
+	}
+}
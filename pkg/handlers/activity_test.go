@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
+)
+
+func TestHeartbeatHandler(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	if err := ss.InitSession(ctx, env.store, env.journal, env.kcs, env.cfg.Sessions, "session-demo", cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	tracker := ss.NewActivityTracker()
+	router := gin.New()
+	router.Use(TrackActivity(tracker))
+	router.POST("/sessions/:sessionID/heartbeat", HeartbeatHandler(env.store))
+
+	if status, response := serve(t, router, http.MethodPost, "/sessions/demo/heartbeat", ""); status != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %v", http.StatusOK, status, response)
+	}
+	if status, response := serve(t, router, http.MethodPost, "/sessions/missing/heartbeat", ""); status != http.StatusNotFound {
+		t.Fatalf("expected %d, got %d: %v", http.StatusNotFound, status, response)
+	}
+	if err := tracker.Flush(ctx, env.store, env.locker); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	session, _, err := env.store.Get(ctx, "session-demo")
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	if session.LastActivity.IsZero() {
+		t.Fatal("expected the heartbeat to be recorded as activity")
+	}
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
+	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
+	"k8s.io/client-go/kubernetes"
+)
+
+// applyEnv is the desired state of a session.
+type applyEnv struct {
+	// Template and Components work as in createEnv.
+	Template   string          `json:"template"`
+	Components []cmp.Component `json:"components"`
+	// Storage is the storage of the workspace volume, only used when the
+	// session is created.
+	Storage cmp.Storage `json:"storage"`
+	// Labels are the labels of the session, only used when the session is
+	// created.
+	Labels map[string]string `json:"labels"`
+	// TTL works as in initEnv, only used when the session is created.
+	TTL string `json:"ttl"`
+}
+
+func ApplySessionHandler(locker *lck.Locker, store ss.SessionStore, journal *consistency.Journal, templates ss.TemplateStore, kcs kubernetes.Interface, cfg config.SessionsConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
+		sessionID := fmt.Sprintf("session-%s", sessionName)
+
+		var body applyEnv
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		ttl, err := parseTTL(body.TTL)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		keepData, err := strconv.ParseBool(c.DefaultQuery("keepData", "false"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("invalid keepData: %s", err),
+			})
+			return
+		}
+
+		logging.Logger.Info("trying to acquire lock", "session", sessionID)
+		sessionLock, errSessionLock := locker.AcquireLock(c.Request.Context(), sessionID, lck.Options{})
+		defer sessionLock.Release()
+		if errSessionLock != nil {
+			logging.Logger.Error("failed to acquire lock", "session", sessionID, "error", errSessionLock)
+			c.JSON(errorStatus(errSessionLock), errorResponse(errSessionLock, fmt.Sprintf("failed to apply session %s", sessionName)))
+			return
+		}
+		logging.Logger.Info("acquired lock successfully", "session", sessionID)
+
+		logging.Logger.Info("trying to acquire ingress lock", "session", sessionID)
+		ingressLock, errIngressLock := locker.AcquireLock(c.Request.Context(), "ingress", lck.Options{})
+		defer ingressLock.Release()
+		if errIngressLock != nil {
+			logging.Logger.Error("failed to acquire ingress lock", "session", sessionID, "error", errIngressLock)
+			c.JSON(errorStatus(errIngressLock), errorResponse(errIngressLock, fmt.Sprintf("failed to apply session %s", sessionName)))
+			return
+		}
+		logging.Logger.Info("acquired ingress lock successfully", "session", sessionID)
+
+		components := body.Components
+		if body.Template != "" {
+			components, err = ss.TemplateComponents(c.Request.Context(), templates, body.Template, body.Components)
+			if err != nil {
+				c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to apply session %s", sessionName)))
+				return
+			}
+		}
+		diff, err := ss.ApplySession(c.Request.Context(), kcs, store, journal, cfg, sessionID, components, body.Storage, body.Labels, ttl, keepData)
+		if err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to apply session %s", sessionName)))
+			return
+		}
+		status := http.StatusOK
+		if diff.Created {
+			status = http.StatusCreated
+		}
+		c.JSON(status, gin.H{
+			"message": fmt.Sprintf("session %s applied successfully", sessionName),
+			"result":  diff,
+		})
+	}
+}
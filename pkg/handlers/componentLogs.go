@@ -9,11 +9,10 @@ import (
 
 	"github.com/gin-gonic/gin"
 	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
-	clientv3 "go.etcd.io/etcd/client/v3"
 	"k8s.io/client-go/kubernetes"
 )
 
-func ComponentLogsHandler(cc *clientv3.Client, kcs *kubernetes.Clientset) gin.HandlerFunc {
+func ComponentLogsHandler(store ss.SessionStore, kcs kubernetes.Interface) gin.HandlerFunc {
     return func(c *gin.Context) {
 		c.Writer.Header().Set("Content-Type", "text/event-stream")
 		c.Writer.Header().Set("Cache-Control", "no-cache")
@@ -25,11 +24,12 @@ func ComponentLogsHandler(cc *clientv3.Client, kcs *kubernetes.Clientset) gin.Ha
         sessionID := fmt.Sprintf("session-%s", sessionName)
 		componentID := strings.ReplaceAll(c.Param("componentID"), "/", "")
 
-		logStream, err := ss.GetSessionLogs(c.Request.Context(), kcs, sessionID, componentID)
+		logStream, err := ss.GetSessionLogs(c.Request.Context(), kcs, store, sessionID, componentID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
 		defer logStream.Close()
 
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestComponentLogsHandlerMissingSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/logs/:sessionID/:componentID", ComponentLogsHandler(ss.NewSessionStore(cache.NewMemoryStore()), fake.NewSimpleClientset()))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/logs/missing/editor", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("expected %d, got %d: %s", http.StatusInternalServerError, recorder.Code, recorder.Body)
+	}
+}
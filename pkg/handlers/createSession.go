@@ -7,45 +7,46 @@ import (
 
 	"github.com/gin-gonic/gin"
 	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
 	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
 	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
-	clientv3 "go.etcd.io/etcd/client/v3"
 	"k8s.io/client-go/kubernetes"
 )
 
 type createEnv struct {
+	// Template is the name of the template the components are taken from,
+	// in which case Components override the template components with the
+	// same ID.
+	Template   string          `json:"template"`
 	Components []cmp.Component `json:"components"`
 }
 
-func CreateSessionHandler(cc *clientv3.Client, kcs *kubernetes.Clientset) gin.HandlerFunc {
-    return func(c *gin.Context) {
+func CreateSessionHandler(locker *lck.Locker, store ss.SessionStore, journal *consistency.Journal, templates ss.TemplateStore, kcs kubernetes.Interface, cfg config.SessionsConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
 		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
-        sessionID := fmt.Sprintf("session-%s", sessionName)
+		sessionID := fmt.Sprintf("session-%s", sessionName)
 
-        logging.Logger.Info("trying to acquire lock", "session", sessionID)
-        _, releaseSession, errSessionLock := lck.AcquireLock(cc, sessionID)
-        defer releaseSession()
-        if errSessionLock != nil {
-            logging.Logger.Error("failed to acquire lock", "session", sessionID)
-            c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("failed to initialize session %s", sessionName),
-			})
+		logging.Logger.Info("trying to acquire lock", "session", sessionID)
+		sessionLock, errSessionLock := locker.AcquireLock(c.Request.Context(), sessionID, lck.Options{})
+		defer sessionLock.Release()
+		if errSessionLock != nil {
+			logging.Logger.Error("failed to acquire lock", "session", sessionID, "error", errSessionLock)
+			c.JSON(errorStatus(errSessionLock), errorResponse(errSessionLock, fmt.Sprintf("failed to initialize session %s", sessionName)))
 			return
-        }
-        logging.Logger.Info("acquired lock successfully", "session", sessionID)
+		}
+		logging.Logger.Info("acquired lock successfully", "session", sessionID)
 
-        logging.Logger.Info("trying to acquire ingress lock", "session", sessionID)
-        _, releaseIngress, errIngressLock := lck.AcquireLock(cc, "ingress")
-        defer releaseIngress()
-        if errIngressLock != nil {
-            logging.Logger.Error("failed to acquire ingress lock", "session", sessionID)
-            c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("failed to initialize session %s", sessionName),
-			})
+		logging.Logger.Info("trying to acquire ingress lock", "session", sessionID)
+		ingressLock, errIngressLock := locker.AcquireLock(c.Request.Context(), "ingress", lck.Options{})
+		defer ingressLock.Release()
+		if errIngressLock != nil {
+			logging.Logger.Error("failed to acquire ingress lock", "session", sessionID, "error", errIngressLock)
+			c.JSON(errorStatus(errIngressLock), errorResponse(errIngressLock, fmt.Sprintf("failed to initialize session %s", sessionName)))
 			return
-        }
-        logging.Logger.Info("acquired ingress lock successfully", "session", sessionID)
+		}
+		logging.Logger.Info("acquired ingress lock successfully", "session", sessionID)
 
 		var body createEnv
 		if err := c.ShouldBindJSON(&body); err != nil {
@@ -54,15 +55,22 @@ func CreateSessionHandler(cc *clientv3.Client, kcs *kubernetes.Clientset) gin.Ha
 			})
 			return
 		}
-		err := ss.CreateDeploy(c.Request.Context(),kcs, cc, sessionID, body.Components)
+		components := body.Components
+		if body.Template != "" {
+			var err error
+			components, err = ss.TemplateComponents(c.Request.Context(), templates, body.Template, body.Components)
+			if err != nil {
+				c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to create components for session %s", sessionName)))
+				return
+			}
+		}
+		err := ss.CreateDeploy(c.Request.Context(), kcs, store, journal, cfg, sessionID, components)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("failed to create components for session %s", sessionName),
-			})
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to create components for session %s", sessionName)))
 			return
 		}
 		c.JSON(http.StatusCreated, gin.H{
 			"message": fmt.Sprintf("components for session %s have been created successfully", sessionName),
 		})
-    }
+	}
 }
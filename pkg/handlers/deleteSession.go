@@ -6,47 +6,42 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
 	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
 	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
-	clientv3 "go.etcd.io/etcd/client/v3"
 	"k8s.io/client-go/kubernetes"
 )
 
-func DeleteSessionHandler(cc *clientv3.Client, kcs *kubernetes.Clientset) gin.HandlerFunc {
-    return func(c *gin.Context) {
+func DeleteSessionHandler(locker *lck.Locker, store ss.SessionStore, journal *consistency.Journal, kcs kubernetes.Interface, cfg config.SessionsConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
 		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
-        sessionID := fmt.Sprintf("session-%s", sessionName)
-
-        logging.Logger.Info("trying to acquire lock", "session", sessionID)
-        _, releaseSession, errSessionLock := lck.AcquireLock(cc, sessionID)
-        defer releaseSession()
-        if errSessionLock != nil {
-            logging.Logger.Error("failed to acquire lock", "session", sessionID)
-            c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("failed to initialize session %s", sessionName),
-			})
+		sessionID := fmt.Sprintf("session-%s", sessionName)
+
+		logging.Logger.Info("trying to acquire lock", "session", sessionID)
+		sessionLock, errSessionLock := locker.AcquireLock(c.Request.Context(), sessionID, lck.Options{})
+		defer sessionLock.Release()
+		if errSessionLock != nil {
+			logging.Logger.Error("failed to acquire lock", "session", sessionID, "error", errSessionLock)
+			c.JSON(errorStatus(errSessionLock), errorResponse(errSessionLock, fmt.Sprintf("failed to initialize session %s", sessionName)))
 			return
-        }
-        logging.Logger.Info("acquired lock successfully", "session", sessionID)
-
-        logging.Logger.Info("trying to acquire ingress lock", "session", sessionID)
-        _, releaseIngress, errIngressLock := lck.AcquireLock(cc, "ingress")
-        defer releaseIngress()
-        if errIngressLock != nil {
-            logging.Logger.Error("failed to acquire ingress lock", "session", sessionID)
-            c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("failed to initialize session %s", sessionName),
-			})
+		}
+		logging.Logger.Info("acquired lock successfully", "session", sessionID)
+
+		logging.Logger.Info("trying to acquire ingress lock", "session", sessionID)
+		ingressLock, errIngressLock := locker.AcquireLock(c.Request.Context(), "ingress", lck.Options{})
+		defer ingressLock.Release()
+		if errIngressLock != nil {
+			logging.Logger.Error("failed to acquire ingress lock", "session", sessionID, "error", errIngressLock)
+			c.JSON(errorStatus(errIngressLock), errorResponse(errIngressLock, fmt.Sprintf("failed to initialize session %s", sessionName)))
 			return
-        }
-        logging.Logger.Info("acquired ingress lock successfully", "session", sessionID)
+		}
+		logging.Logger.Info("acquired ingress lock successfully", "session", sessionID)
 
-		err := ss.DeleteDeploy(c.Request.Context(),kcs, cc, sessionID)
+		err := ss.DeleteDeploy(c.Request.Context(), kcs, store, journal, cfg, sessionID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("failed to delete session %s", sessionName),
-			})
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to delete session %s", sessionName)))
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{
@@ -54,6 +49,3 @@ func DeleteSessionHandler(cc *clientv3.Client, kcs *kubernetes.Clientset) gin.Ha
 		})
 	}
 }
-
-
-
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
+	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
+)
+
+// errorStatus maps an error returned by the sessions package to the HTTP
+// status code reported to the client.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ss.ErrConflict),
+		errors.Is(err, ss.ErrSnapshotExists),
+		errors.Is(err, ss.ErrSnapshotNotRestorable),
+		errors.Is(err, ss.ErrTemplateExists),
+		errors.Is(err, ss.ErrComponentExists),
+		// another request is still changing the session
+		errors.Is(err, lck.ErrLocked):
+		return http.StatusConflict
+	case errors.Is(err, ss.ErrSessionNotFound),
+		errors.Is(err, ss.ErrComponentNotFound),
+		errors.Is(err, ss.ErrSnapshotNotFound),
+		errors.Is(err, ss.ErrTemplateNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, cmp.ErrInvalidComponent),
+		errors.Is(err, ss.ErrInvalidLabels),
+		errors.Is(err, ss.ErrInvalidCursor),
+		errors.Is(err, ss.ErrInvalidTTL):
+		return http.StatusBadRequest
+	case errors.Is(err, ss.ErrExpansionNotAllowed),
+		errors.Is(err, ss.ErrSnapshotsUnsupported),
+		errors.Is(err, ss.ErrSessionExpired):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errorMessage returns msg, followed by the cause of err when the request
+// itself was at fault, so that the client can fix it.
+func errorMessage(err error, msg string) string {
+	if status := errorStatus(err); status != http.StatusInternalServerError {
+		return fmt.Sprintf("%s: %s", msg, err)
+	}
+	return msg
+}
+
+// errorResponse is the body reported to the client for err. When err comes
+// from a saga, it also names the step that failed, everything done before it
+// having been rolled back, except for the steps listed as left behind.
+func errorResponse(err error, msg string) gin.H {
+	res := gin.H{
+		"error": errorMessage(err, msg),
+	}
+	if leftBehind := consistency.LeftBehind(err); len(leftBehind) > 0 {
+		res["leftBehind"] = leftBehind
+	}
+	var stepErr *consistency.StepError
+	for errors.As(err, &stepErr) {
+		// nested sagas report their innermost step
+		res["failedStep"] = stepErr.Step
+		err = stepErr.Err
+	}
+	return res
+}
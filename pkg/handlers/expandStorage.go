@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
+	"k8s.io/client-go/kubernetes"
+)
+
+type expandStorageEnv struct {
+	Size string `json:"size" binding:"required"`
+}
+
+func ExpandStorageHandler(locker *lck.Locker, store ss.SessionStore, kcs kubernetes.Interface, cfg config.SessionsConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
+		sessionID := fmt.Sprintf("session-%s", sessionName)
+		componentID := c.Param("componentID")
+
+		var body expandStorageEnv
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		logging.Logger.Info("trying to acquire lock", "session", sessionID)
+		lock, errLock := locker.AcquireLock(c.Request.Context(), sessionID, lck.Options{})
+		defer lock.Release()
+		if errLock != nil {
+			logging.Logger.Error("failed to acquire lock", "session", sessionID, "error", errLock)
+			c.JSON(errorStatus(errLock), errorResponse(errLock, fmt.Sprintf("failed to expand the storage of component %s in session %s", componentID, sessionName)))
+			return
+		}
+		logging.Logger.Info("acquired lock successfully", "session", sessionID)
+
+		status, err := ss.ExpandStorage(c.Request.Context(), kcs, store, cfg, sessionID, componentID, body.Size)
+		if err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to expand the storage of component %s in session %s", componentID, sessionName)))
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": fmt.Sprintf("storage expansion of component %s in session %s requested successfully", componentID, sessionName),
+			"result":  status,
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
+)
+
+// extendEnv is the body of the extend request.
+type extendEnv struct {
+	// TTL is how long the session lives from now on, such as "8h".
+	TTL string `json:"ttl" binding:"required"`
+}
+
+// parseTTL parses a time to live given by a client. An empty ttl is zero,
+// which stands for the configured default.
+func parseTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+	res, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl: %w", err)
+	}
+	return res, nil
+}
+
+func ExtendSessionHandler(locker *lck.Locker, store ss.SessionStore, cfg config.SessionsConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
+		sessionID := fmt.Sprintf("session-%s", sessionName)
+
+		var body extendEnv
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		ttl, err := parseTTL(body.TTL)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		logging.Logger.Info("trying to acquire lock", "session", sessionID)
+		lock, errLock := locker.AcquireLock(c.Request.Context(), sessionID, lck.Options{})
+		defer lock.Release()
+		if errLock != nil {
+			logging.Logger.Error("failed to acquire lock", "session", sessionID, "error", errLock)
+			c.JSON(errorStatus(errLock), errorResponse(errLock, fmt.Sprintf("failed to extend session %s", sessionName)))
+			return
+		}
+		logging.Logger.Info("acquired lock successfully", "session", sessionID)
+
+		session, err := ss.ExtendSession(c.Request.Context(), store, cfg, sessionID, ttl)
+		if err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to extend session %s", sessionName)))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":   fmt.Sprintf("session %s extended successfully", sessionName),
+			"expiresAt": session.ExpiresAt,
+		})
+	}
+}
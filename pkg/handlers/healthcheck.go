@@ -2,15 +2,25 @@ package handlers
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
-func HealthcheckHandler() gin.HandlerFunc {
-    return func(c *gin.Context) {
-        c.JSON(http.StatusOK, gin.H{
-            "message": "server is running",
-        })
-    }
+func HealthcheckHandler(cc *clientv3.Client, etcdTimeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := cache.CheckHealth(c.Request.Context(), cc, etcdTimeout); err != nil {
+			logging.Logger.Error("healthcheck failed", "error", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "server is running",
+		})
+	}
 }
-
@@ -1,42 +1,67 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
 	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
 	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
-	clientv3 "go.etcd.io/etcd/client/v3"
 	"k8s.io/client-go/kubernetes"
 )
 
-func InitSessionHandler(cc *clientv3.Client, kcs *kubernetes.Clientset) gin.HandlerFunc {
+// initEnv is the optional body of the init request.
+type initEnv struct {
+	// Storage is the storage of the workspace volume.
+	Storage cmp.Storage `json:"storage"`
+	// Labels are used to find the session when listing sessions.
+	Labels map[string]string `json:"labels"`
+	// TTL is how long the session lives, such as "8h". It defaults to the
+	// configured default time to live.
+	TTL string `json:"ttl"`
+}
+
+func InitSessionHandler(locker *lck.Locker, store ss.SessionStore, journal *consistency.Journal, kcs kubernetes.Interface, cfg config.SessionsConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
 		sessionID := fmt.Sprintf("session-%s", sessionName)
 
 		logging.Logger.Info("trying to acquire lock", "session", sessionID)
-		_, release, errLock := lck.AcquireLock(cc, sessionID)
-		defer release()
+		lock, errLock := locker.AcquireLock(c.Request.Context(), sessionID, lck.Options{})
+		defer lock.Release()
 		if errLock != nil {
-			logging.Logger.Error("failed to acquire lock", "session", sessionID)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("failed to initialize session %s", sessionName),
-			})
+			logging.Logger.Error("failed to acquire lock", "session", sessionID, "error", errLock)
+			c.JSON(errorStatus(errLock), errorResponse(errLock, fmt.Sprintf("failed to initialize session %s", sessionName)))
 			return
 		}
 		logging.Logger.Info("acquired lock successfully", "session", sessionID)
 
-		err := ss.InitSession(c.Request.Context(), cc, kcs, sessionID)
+		var body initEnv
+		if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		ttl, err := parseTTL(body.TTL)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("failed to initialize session %s", sessionName),
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
 			})
 			return
 		}
+		err = ss.InitSession(c.Request.Context(), store, journal, kcs, cfg, sessionID, body.Storage, body.Labels, ttl)
+		if err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to initialize session %s", sessionName)))
+			return
+		}
 		c.JSON(http.StatusCreated, gin.H{
 			"message": fmt.Sprintf("session %s created successfully", sessionName),
 		})
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/etcdtest"
+	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testEnv is what the handlers are built with: the locks are taken in an
+// etcd server running in the test, the sessions are kept in memory and the
+// cluster is faked.
+type testEnv struct {
+	cfg     *config.Config
+	locker  *lck.Locker
+	store   ss.SessionStore
+	journal *consistency.Journal
+	kcs     kubernetes.Interface
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	cfg := config.Default()
+	cfg.Locks.WaitTimeout = 200 * time.Millisecond
+	return &testEnv{
+		cfg:     cfg,
+		locker:  lck.NewLocker(etcdtest.Start(t), cfg.Locks),
+		store:   ss.NewSessionStore(cache.NewMemoryStore()),
+		journal: consistency.NewJournal(cache.NewMemoryStore()),
+		kcs: fake.NewSimpleClientset(&networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Name: cfg.Sessions.IngressName, Namespace: "default"},
+		}),
+	}
+}
+
+// serve sends the request to router and decodes the JSON response.
+func serve(t *testing.T, router http.Handler, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var response map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode the response %q: %v", recorder.Body.String(), err)
+	}
+	return recorder.Code, response
+}
+
+func TestInitSessionHandler(t *testing.T) {
+	env := newTestEnv(t)
+	router := gin.New()
+	router.POST("/init/:sessionID", InitSessionHandler(env.locker, env.store, env.journal, env.kcs, env.cfg.Sessions))
+	router.GET("/sessions", ListSessionsHandler(env.store))
+
+	status, response := serve(t, router, http.MethodPost, "/init/demo", `{"labels": {"team": "web"}, "ttl": "2h"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %v", http.StatusCreated, status, response)
+	}
+	session, _, err := env.store.Get(context.Background(), "session-demo")
+	if err != nil {
+		t.Fatalf("expected the session to be recorded, got %v", err)
+	}
+	if session.ExpiresAt.IsZero() || time.Until(session.ExpiresAt) > 2*time.Hour {
+		t.Fatalf("expected the session to expire within 2h, got %v", session.ExpiresAt)
+	}
+
+	status, response = serve(t, router, http.MethodGet, "/sessions?label=team=web", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %v", http.StatusOK, status, response)
+	}
+	result, _ := response["result"].([]interface{})
+	if len(result) != 1 || result[0].(map[string]interface{})["sessionID"] != "session-demo" {
+		t.Fatalf("expected the session to be listed, got %v", response["result"])
+	}
+
+	status, response = serve(t, router, http.MethodPost, "/init/other", `{"ttl": "forever"}`)
+	if status != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d: %v", http.StatusBadRequest, status, response)
+	}
+}
+
+func TestInitSessionHandlerLocked(t *testing.T) {
+	env := newTestEnv(t)
+	router := gin.New()
+	router.POST("/init/:sessionID", InitSessionHandler(env.locker, env.store, env.journal, env.kcs, env.cfg.Sessions))
+
+	// another request is changing the session
+	lock, err := env.locker.AcquireLock(context.Background(), "session-demo", lck.Options{})
+	if err != nil {
+		t.Fatalf("AcquireLock failed: %v", err)
+	}
+	status, response := serve(t, router, http.MethodPost, "/init/demo", "")
+	if status != http.StatusConflict {
+		t.Fatalf("expected %d, got %d: %v", http.StatusConflict, status, response)
+	}
+	if _, _, err := env.store.Get(context.Background(), "session-demo"); err == nil {
+		t.Fatal("expected the session not to be recorded")
+	}
+
+	lock.Release()
+	if status, response := serve(t, router, http.MethodPost, "/init/demo", ""); status != http.StatusCreated {
+		t.Fatalf("expected %d once the lock is released, got %d: %v", http.StatusCreated, status, response)
+	}
+}
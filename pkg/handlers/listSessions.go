@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
+)
+
+// ListSessionsHandler lists the sessions, a page at a time. The sessions can
+// be filtered with the state, componentType and label query parameters, the
+// latter being a label selector such as "team=web,env!=prod".
+func ListSessionsHandler(store ss.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := ss.SessionFilter{
+			State:         ss.SessionState(c.Query("state")),
+			ComponentType: cmp.ComponentType(c.Query("componentType")),
+		}
+		if selector := c.Query("label"); selector != "" {
+			labels, err := ss.ParseLabelSelector(selector)
+			if err != nil {
+				c.JSON(errorStatus(err), errorResponse(err, "failed to list sessions"))
+				return
+			}
+			filter.Labels = labels
+		}
+		limit := 0
+		if value := c.Query("limit"); value != "" {
+			var err error
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": fmt.Sprintf("invalid limit: %s", value),
+				})
+				return
+			}
+		}
+
+		page, err := ss.ListSessions(c.Request.Context(), store, filter, c.Query("cursor"), limit)
+		if err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, "failed to list sessions"))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":    "sessions fetched successfully",
+			"result":     page.Sessions,
+			"nextCursor": page.NextCursor,
+		})
+	}
+}
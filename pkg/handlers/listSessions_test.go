@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
+)
+
+func TestListSessionsHandlerHidesPasswords(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	if err := ss.InitSession(ctx, env.store, env.journal, env.kcs, env.cfg.Sessions, "session-demo", cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	err := ss.CreateDeploy(ctx, env.kcs, env.store, env.journal, env.cfg.Sessions, "session-demo", []cmp.Component{
+		{ComponentType: cmp.Code, ComponentID: "editor", ComponentMetadata: cmp.ComponentMetadata{Password: "editorpassword"}},
+		{ComponentType: cmp.Postgres, ComponentID: "db"},
+	})
+	if err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	session, _, err := env.store.Get(ctx, "session-demo")
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	generated := session.Components[1].ComponentMetadata.Password
+	if generated == "" {
+		t.Fatal("expected a password to be generated for postgres")
+	}
+
+	router := gin.New()
+	router.GET("/sessions", ListSessionsHandler(env.store))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body)
+	}
+	body := recorder.Body.String()
+	if !strings.Contains(body, `"componentID":"db"`) {
+		t.Fatalf("expected the components to be listed, got %s", body)
+	}
+	for _, password := range []string{"editorpassword", generated} {
+		if strings.Contains(body, password) {
+			t.Fatalf("expected no password to be listed, got %s", body)
+		}
+	}
+
+	// the record keeps them
+	session, _, err = env.store.Get(ctx, "session-demo")
+	if err != nil || session.Components[0].ComponentMetadata.Password != "editorpassword" {
+		t.Fatalf("expected the stored password to be kept, got %+v (err %v)", session, err)
+	}
+}
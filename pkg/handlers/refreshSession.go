@@ -9,30 +9,27 @@ import (
 	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
 	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
-	clientv3 "go.etcd.io/etcd/client/v3"
 	"k8s.io/client-go/kubernetes"
 )
 
-func RefreshSessionHandler(cc *clientv3.Client, kcs *kubernetes.Clientset) gin.HandlerFunc {
+func RefreshSessionHandler(locker *lck.Locker, store ss.SessionStore, kcs kubernetes.Interface) gin.HandlerFunc {
 	return func(c *gin.Context) {
-        sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
-        sessionID := fmt.Sprintf("session-%s", sessionName)
+		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
+		sessionID := fmt.Sprintf("session-%s", sessionName)
 
-        logging.Logger.Info("trying to acquire lock", "session", sessionID)
-        _, release, errLock := lck.AcquireLock(cc, sessionID)
-        defer release()
-        if errLock != nil {
-            logging.Logger.Error("failed to acquire lock", "session", sessionID)
-            c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("failed to refresh session %s", sessionName),
-			})
+		logging.Logger.Info("trying to acquire lock", "session", sessionID)
+		lock, errLock := locker.AcquireLock(c.Request.Context(), sessionID, lck.Options{})
+		defer lock.Release()
+		if errLock != nil {
+			logging.Logger.Error("failed to acquire lock", "session", sessionID, "error", errLock)
+			c.JSON(errorStatus(errLock), errorResponse(errLock, fmt.Sprintf("failed to refresh session %s", sessionName)))
 			return
-        }
-        logging.Logger.Info("acquired lock successfully", "session", sessionID)
+		}
+		logging.Logger.Info("acquired lock successfully", "session", sessionID)
 
-		sessionInfo, err := ss.RefreshDeploy(c.Request.Context(),kcs, cc, sessionID)
+		sessionInfo, err := ss.RefreshDeploy(c.Request.Context(), kcs, store, sessionID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
+			c.JSON(errorStatus(err), gin.H{
 				"error": fmt.Sprintf("failed to refresh session %s", sessionName),
 			})
 			return
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
+	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
+	"k8s.io/client-go/kubernetes"
+)
+
+func AddComponentHandler(locker *lck.Locker, store ss.SessionStore, journal *consistency.Journal, kcs kubernetes.Interface, cfg config.SessionsConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
+		sessionID := fmt.Sprintf("session-%s", sessionName)
+
+		var body cmp.Component
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		logging.Logger.Info("trying to acquire lock", "session", sessionID)
+		sessionLock, errSessionLock := locker.AcquireLock(c.Request.Context(), sessionID, lck.Options{})
+		defer sessionLock.Release()
+		if errSessionLock != nil {
+			logging.Logger.Error("failed to acquire lock", "session", sessionID, "error", errSessionLock)
+			c.JSON(errorStatus(errSessionLock), errorResponse(errSessionLock, fmt.Sprintf("failed to add component %s to session %s", body.ComponentID, sessionName)))
+			return
+		}
+		logging.Logger.Info("acquired lock successfully", "session", sessionID)
+
+		logging.Logger.Info("trying to acquire ingress lock", "session", sessionID)
+		ingressLock, errIngressLock := locker.AcquireLock(c.Request.Context(), "ingress", lck.Options{})
+		defer ingressLock.Release()
+		if errIngressLock != nil {
+			logging.Logger.Error("failed to acquire ingress lock", "session", sessionID, "error", errIngressLock)
+			c.JSON(errorStatus(errIngressLock), errorResponse(errIngressLock, fmt.Sprintf("failed to add component %s to session %s", body.ComponentID, sessionName)))
+			return
+		}
+		logging.Logger.Info("acquired ingress lock successfully", "session", sessionID)
+
+		diff, err := ss.AddComponent(c.Request.Context(), kcs, store, journal, cfg, sessionID, body)
+		if err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to add component %s to session %s", body.ComponentID, sessionName)))
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"message": fmt.Sprintf("component %s added to session %s successfully", body.ComponentID, sessionName),
+			"result":  diff,
+		})
+	}
+}
+
+func RemoveComponentHandler(locker *lck.Locker, store ss.SessionStore, journal *consistency.Journal, kcs kubernetes.Interface, cfg config.SessionsConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
+		sessionID := fmt.Sprintf("session-%s", sessionName)
+		componentID := c.Param("componentID")
+
+		keepData, err := strconv.ParseBool(c.DefaultQuery("keepData", "false"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("invalid keepData: %s", err),
+			})
+			return
+		}
+
+		logging.Logger.Info("trying to acquire lock", "session", sessionID)
+		sessionLock, errSessionLock := locker.AcquireLock(c.Request.Context(), sessionID, lck.Options{})
+		defer sessionLock.Release()
+		if errSessionLock != nil {
+			logging.Logger.Error("failed to acquire lock", "session", sessionID, "error", errSessionLock)
+			c.JSON(errorStatus(errSessionLock), errorResponse(errSessionLock, fmt.Sprintf("failed to remove component %s from session %s", componentID, sessionName)))
+			return
+		}
+		logging.Logger.Info("acquired lock successfully", "session", sessionID)
+
+		logging.Logger.Info("trying to acquire ingress lock", "session", sessionID)
+		ingressLock, errIngressLock := locker.AcquireLock(c.Request.Context(), "ingress", lck.Options{})
+		defer ingressLock.Release()
+		if errIngressLock != nil {
+			logging.Logger.Error("failed to acquire ingress lock", "session", sessionID, "error", errIngressLock)
+			c.JSON(errorStatus(errIngressLock), errorResponse(errIngressLock, fmt.Sprintf("failed to remove component %s from session %s", componentID, sessionName)))
+			return
+		}
+		logging.Logger.Info("acquired ingress lock successfully", "session", sessionID)
+
+		diff, err := ss.RemoveComponent(c.Request.Context(), kcs, store, journal, cfg, sessionID, componentID, keepData)
+		if err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to remove component %s from session %s", componentID, sessionName)))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": fmt.Sprintf("component %s removed from session %s successfully", componentID, sessionName),
+			"result":  diff,
+		})
+	}
+}
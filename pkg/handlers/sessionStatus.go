@@ -9,37 +9,64 @@ import (
 	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
 	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
-	clientv3 "go.etcd.io/etcd/client/v3"
 	"k8s.io/client-go/kubernetes"
 )
 
-func SessionStatusHandler(cc *clientv3.Client, kcs *kubernetes.Clientset) gin.HandlerFunc {
+func SessionStatusHandler(locker *lck.Locker, store ss.SessionStore, kcs kubernetes.Interface) gin.HandlerFunc {
     return func(c *gin.Context) {
 		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
         sessionID := fmt.Sprintf("session-%s", sessionName)
 
         logging.Logger.Info("trying to acquire lock", "session", sessionID)
-        _, release, errLock := lck.AcquireLock(cc, sessionID)
-        defer release()
+        lock, errLock := locker.AcquireLock(c.Request.Context(), sessionID, lck.Options{})
+        defer lock.Release()
         if errLock != nil {
-            logging.Logger.Error("failed to acquire lock", "session", sessionID)
-            c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("failed to fetch container statuses of session %s", sessionName),
-			})
+            logging.Logger.Error("failed to acquire lock", "session", sessionID, "error", errLock)
+            c.JSON(errorStatus(errLock), errorResponse(errLock, fmt.Sprintf("failed to fetch container statuses of session %s", sessionName)))
 			return
         }
         logging.Logger.Info("acquired lock successfully", "session", sessionID)
 
-		containerStatuses, err := ss.ContainerStatus(c.Request.Context(),kcs, sessionID)
+		containerStatuses, err := ss.ContainerStatus(c.Request.Context(), kcs, store, sessionID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error": err.Error(),
 			})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{
-			"message": fmt.Sprintf("session %s container statuses fetched successfully", sessionName),
-			"result":  containerStatuses,
-		})
+		storageStatuses, err := ss.StorageStatus(c.Request.Context(), kcs, store, sessionID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		session, _, err := store.Get(c.Request.Context(), sessionID)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		res := gin.H{
+			"message":      fmt.Sprintf("session %s container statuses fetched successfully", sessionName),
+			"result":       containerStatuses,
+			"storage":      storageStatuses,
+			"sessionState": session.SessionState,
+		}
+		if len(session.Conditions) > 0 {
+			res["conditions"] = session.Conditions
+		}
+		if session.StopReason != "" {
+			res["stopReason"] = session.StopReason
+			res["stoppedAt"] = session.StoppedAt
+		}
+		if !session.ExpiresAt.IsZero() {
+			res["expiresAt"] = session.ExpiresAt
+		}
+		if session.Expiry != "" {
+			res["expiry"] = session.Expiry
+		}
+		c.JSON(http.StatusOK, res)
 	}}
 
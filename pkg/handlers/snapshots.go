@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
+	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+type createSnapshotEnv struct {
+	// Name defaults to the current time.
+	Name string `json:"name"`
+}
+
+type restoreSnapshotEnv struct {
+	// Target is the name of the session created from the snapshot.
+	Target string `json:"target" binding:"required"`
+}
+
+func CreateSnapshotHandler(locker *lck.Locker, store ss.SessionStore, journal *consistency.Journal, snapshots ss.SnapshotStore, kcs kubernetes.Interface, dcs dynamic.Interface, cfg config.SessionsConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
+		sessionID := fmt.Sprintf("session-%s", sessionName)
+
+		var body createSnapshotEnv
+		if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		logging.Logger.Info("trying to acquire lock", "session", sessionID)
+		lock, errLock := locker.AcquireLock(c.Request.Context(), sessionID, lck.Options{})
+		defer lock.Release()
+		if errLock != nil {
+			logging.Logger.Error("failed to acquire lock", "session", sessionID, "error", errLock)
+			c.JSON(errorStatus(errLock), errorResponse(errLock, fmt.Sprintf("failed to snapshot session %s", sessionName)))
+			return
+		}
+		logging.Logger.Info("acquired lock successfully", "session", sessionID)
+
+		snapshot, err := ss.CreateSnapshot(c.Request.Context(), kcs, dcs, store, journal, snapshots, cfg, sessionID, body.Name)
+		if err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to snapshot session %s", sessionName)))
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"message": fmt.Sprintf("snapshot %s of session %s created successfully", snapshot.Name, sessionName),
+			"result":  snapshot,
+		})
+	}
+}
+
+func ListSnapshotsHandler(snapshots ss.SnapshotStore, dcs dynamic.Interface) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
+		sessionID := fmt.Sprintf("session-%s", sessionName)
+
+		res, err := ss.ListSnapshots(c.Request.Context(), dcs, snapshots, sessionID)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{
+				"error": fmt.Sprintf("failed to list the snapshots of session %s", sessionName),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": fmt.Sprintf("snapshots of session %s fetched successfully", sessionName),
+			"result":  res,
+		})
+	}
+}
+
+func RestoreSnapshotHandler(locker *lck.Locker, store ss.SessionStore, journal *consistency.Journal, snapshots ss.SnapshotStore, kcs kubernetes.Interface, dcs dynamic.Interface, cfg config.SessionsConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
+		sessionID := fmt.Sprintf("session-%s", sessionName)
+		snapshotName := c.Param("snapshotName")
+
+		var body restoreSnapshotEnv
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		targetName := strings.ReplaceAll(body.Target, "/", "")
+		targetID := fmt.Sprintf("session-%s", targetName)
+
+		logging.Logger.Info("trying to acquire lock", "session", targetID)
+		lock, errLock := locker.AcquireLock(c.Request.Context(), targetID, lck.Options{})
+		defer lock.Release()
+		if errLock != nil {
+			logging.Logger.Error("failed to acquire lock", "session", targetID, "error", errLock)
+			c.JSON(errorStatus(errLock), errorResponse(errLock, fmt.Sprintf("failed to restore snapshot %s of session %s", snapshotName, sessionName)))
+			return
+		}
+		logging.Logger.Info("acquired lock successfully", "session", targetID)
+
+		logging.Logger.Info("trying to acquire ingress lock", "session", targetID)
+		ingressLock, errIngressLock := locker.AcquireLock(c.Request.Context(), "ingress", lck.Options{})
+		defer ingressLock.Release()
+		if errIngressLock != nil {
+			logging.Logger.Error("failed to acquire ingress lock", "session", targetID, "error", errIngressLock)
+			c.JSON(errorStatus(errIngressLock), errorResponse(errIngressLock, fmt.Sprintf("failed to restore snapshot %s of session %s", snapshotName, sessionName)))
+			return
+		}
+		logging.Logger.Info("acquired ingress lock successfully", "session", targetID)
+
+		err := ss.RestoreSnapshot(c.Request.Context(), kcs, dcs, store, journal, snapshots, cfg, sessionID, snapshotName, targetID)
+		if err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to restore snapshot %s of session %s", snapshotName, sessionName)))
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"message": fmt.Sprintf("session %s restored from snapshot %s of session %s successfully", targetName, snapshotName, sessionName),
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
+)
+
+type templateEnv struct {
+	Description string          `json:"description"`
+	Components  []cmp.Component `json:"components" binding:"required"`
+}
+
+type createTemplateEnv struct {
+	Name string `json:"name" binding:"required"`
+	templateEnv
+}
+
+func CreateTemplateHandler(templates ss.TemplateStore, cfg config.SessionsConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body createTemplateEnv
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		template := &ss.SessionTemplate{
+			Name:        body.Name,
+			Description: body.Description,
+			Components:  body.Components,
+		}
+		if err := ss.CreateTemplate(c.Request.Context(), templates, cfg, template); err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to create template %s", body.Name)))
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"message": fmt.Sprintf("template %s created successfully", body.Name),
+			"result":  template,
+		})
+	}
+}
+
+func ListTemplatesHandler(templates ss.TemplateStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		res, err := templates.List(c.Request.Context())
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{
+				"error": "failed to list templates",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "templates fetched successfully",
+			"result":  res,
+		})
+	}
+}
+
+func GetTemplateHandler(templates ss.TemplateStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("templateName")
+		template, _, err := templates.Get(c.Request.Context(), name)
+		if err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to get template %s", name)))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": fmt.Sprintf("template %s fetched successfully", name),
+			"result":  template,
+		})
+	}
+}
+
+func UpdateTemplateHandler(templates ss.TemplateStore, cfg config.SessionsConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("templateName")
+		var body templateEnv
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		template := &ss.SessionTemplate{
+			Name:        name,
+			Description: body.Description,
+			Components:  body.Components,
+		}
+		if err := ss.UpdateTemplate(c.Request.Context(), templates, cfg, template); err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to update template %s", name)))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": fmt.Sprintf("template %s updated successfully", name),
+			"result":  template,
+		})
+	}
+}
+
+func DeleteTemplateHandler(templates ss.TemplateStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("templateName")
+		if err := ss.DeleteTemplate(c.Request.Context(), templates, name); err != nil {
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to delete template %s", name)))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": fmt.Sprintf("template %s deleted successfully", name),
+		})
+	}
+}
@@ -9,32 +9,27 @@ import (
 	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
 	ss "github.com/hamza-boudouche/autodev/pkg/sessions"
-	clientv3 "go.etcd.io/etcd/client/v3"
 	"k8s.io/client-go/kubernetes"
 )
 
-func ToggleSessionHandler(cc *clientv3.Client, kcs *kubernetes.Clientset) gin.HandlerFunc {
-    return func(c *gin.Context) {
+func ToggleSessionHandler(locker *lck.Locker, store ss.SessionStore, kcs kubernetes.Interface) gin.HandlerFunc {
+	return func(c *gin.Context) {
 		sessionName := strings.ReplaceAll(c.Param("sessionID"), "/", "")
-        sessionID := fmt.Sprintf("session-%s", sessionName)
+		sessionID := fmt.Sprintf("session-%s", sessionName)
 
-        logging.Logger.Info("trying to acquire lock", "session", sessionID)
-        _, release, errLock := lck.AcquireLock(cc, sessionID)
-        defer release()
-        if errLock != nil {
-            logging.Logger.Error("failed to acquire lock", "session", sessionID)
-            c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("failed to toggle session %s", sessionName),
-			})
+		logging.Logger.Info("trying to acquire lock", "session", sessionID)
+		lock, errLock := locker.AcquireLock(c.Request.Context(), sessionID, lck.Options{})
+		defer lock.Release()
+		if errLock != nil {
+			logging.Logger.Error("failed to acquire lock", "session", sessionID, "error", errLock)
+			c.JSON(errorStatus(errLock), errorResponse(errLock, fmt.Sprintf("failed to toggle session %s", sessionName)))
 			return
-        }
-        logging.Logger.Info("acquired lock successfully", "session", sessionID)
+		}
+		logging.Logger.Info("acquired lock successfully", "session", sessionID)
 
-		err := ss.ToggleDeploy(c.Request.Context(),kcs, cc, sessionID)
+		err := ss.ToggleDeploy(c.Request.Context(), kcs, store, sessionID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("failed to toggle session %s", sessionName),
-			})
+			c.JSON(errorStatus(err), errorResponse(err, fmt.Sprintf("failed to toggle session %s", sessionName)))
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{
@@ -42,5 +37,3 @@ func ToggleSessionHandler(cc *clientv3.Client, kcs *kubernetes.Clientset) gin.Ha
 		})
 	}
 }
-
-
@@ -1,26 +1,87 @@
 package cache
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"os"
 	"time"
 
+	"github.com/hamza-boudouche/autodev/pkg/config"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
-func CreateEtcdClient() *clientv3.Client {
-	logging.Logger.Info("constructing etcd client")
-	if os.Getenv("AUTODEV_ENV") == "production" {
-		logging.Logger.Error("production env etcd client connection not implemented yet")
+// healthKey is read by CheckHealth. It doesn't need to exist.
+const healthKey = "health"
+
+// CreateEtcdClient connects to the etcd cluster described by cfg. The
+// connection is established lazily, so use CheckHealth to make sure the
+// cluster is actually reachable.
+func CreateEtcdClient(cfg config.EtcdConfig) (*clientv3.Client, error) {
+	logging.Logger.Info("constructing etcd client", "endpoints", cfg.Endpoints, "tls", cfg.TLS.IsEnabled(), "auth", cfg.Username != "")
+	clientConfig := clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: cfg.DialTimeout,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+	}
+	if cfg.TLS.IsEnabled() {
+		tlsConfig, err := newTLSConfig(cfg.TLS)
+		if err != nil {
+			logging.Logger.Error("failed to load etcd TLS configuration", "error", err)
+			return nil, err
+		}
+		clientConfig.TLS = tlsConfig
 	}
-	cli, err := clientv3.New(clientv3.Config{
-		Endpoints:   []string{"localhost:2379"},
-		DialTimeout: 5 * time.Second,
-	})
+	cli, err := clientv3.New(clientConfig)
 	if err != nil {
-		logging.Logger.Error("failed to create etcd client ")
-        panic(err)
+		logging.Logger.Error("failed to create etcd client", "error", err)
+		return nil, err
 	}
 	logging.Logger.Info("etcd client constructed successfully")
-    return cli
+	return cli, nil
+}
+
+func newTLSConfig(cfg config.EtcdTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load etcd client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CAFile != "" {
+		caPEM, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read etcd CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificate found in etcd CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// CheckHealth reports whether the etcd cluster can serve a linearizable read
+// within timeout, which requires a reachable quorum. Like etcdctl's endpoint
+// health, being denied access to the probe key still counts as healthy.
+func CheckHealth(ctx context.Context, cc *clientv3.Client, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, err := cc.Get(ctx, healthKey)
+	if err != nil && !errors.Is(err, rpctypes.ErrPermissionDenied) {
+		return fmt.Errorf("etcd is unhealthy: %w", err)
+	}
+	return nil
 }
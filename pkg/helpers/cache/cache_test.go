@@ -0,0 +1,33 @@
+package cache
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hamza-boudouche/autodev/pkg/config"
+)
+
+func TestCreateEtcdClientInvalidTLS(t *testing.T) {
+	cfg := config.Default().Etcd
+	cfg.TLS.CertFile = filepath.Join(t.TempDir(), "missing.crt")
+	cfg.TLS.KeyFile = filepath.Join(t.TempDir(), "missing.key")
+	if _, err := CreateEtcdClient(cfg); err == nil {
+		t.Fatal("expected missing client certificates to be reported")
+	}
+}
+
+func TestCheckHealthUnreachable(t *testing.T) {
+	cfg := config.Default().Etcd
+	// nothing listens on port 1
+	cfg.Endpoints = []string{"127.0.0.1:1"}
+	cc, err := CreateEtcdClient(cfg)
+	if err != nil {
+		t.Fatalf("CreateEtcdClient failed: %v", err)
+	}
+	defer cc.Close()
+	if err := CheckHealth(context.Background(), cc, 200*time.Millisecond); err == nil {
+		t.Fatal("expected an unreachable cluster to be reported as unhealthy")
+	}
+}
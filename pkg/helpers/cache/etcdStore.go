@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type etcdStore struct {
+	cc             *clientv3.Client
+	requestTimeout time.Duration
+}
+
+// NewEtcdStore returns a Store backed by the given etcd client. Every request
+// except Watch is bounded by requestTimeout, unless it is zero.
+func NewEtcdStore(cc *clientv3.Client, requestTimeout time.Duration) Store {
+	return &etcdStore{cc: cc, requestTimeout: requestTimeout}
+}
+
+func (s *etcdStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.requestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.requestTimeout)
+}
+
+func (s *etcdStore) Get(ctx context.Context, key string) (*KeyValue, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	resp, err := s.cc.Get(ctx, key)
+	if err != nil {
+		logging.Logger.Error("failed to read key from etcd", "key", key)
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrNotFound
+	}
+	return &KeyValue{
+		Key:      key,
+		Value:    resp.Kvs[0].Value,
+		Revision: resp.Kvs[0].ModRevision,
+	}, nil
+}
+
+func (s *etcdStore) CreateIfAbsent(ctx context.Context, key string, value []byte) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	txnResp, err := s.cc.Txn(ctx).If(
+		clientv3.Compare(clientv3.CreateRevision(key), "=", 0), // Check if key doesn't exist
+	).Then(
+		clientv3.OpPut(key, string(value)),
+	).Commit()
+	if err != nil {
+		logging.Logger.Error("failed to create key in etcd", "key", key)
+		return false, err
+	}
+	return txnResp.Succeeded, nil
+}
+
+func (s *etcdStore) CompareAndSwap(ctx context.Context, key string, revision int64, value []byte) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	txnResp, err := s.cc.Txn(ctx).If(
+		clientv3.Compare(clientv3.ModRevision(key), "=", revision),
+	).Then(
+		clientv3.OpPut(key, string(value)),
+	).Commit()
+	if err != nil {
+		logging.Logger.Error("failed to swap key in etcd", "key", key)
+		return false, err
+	}
+	return txnResp.Succeeded, nil
+}
+
+func (s *etcdStore) Delete(ctx context.Context, key string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	_, err := s.cc.Delete(ctx, key)
+	if err != nil {
+		logging.Logger.Error("failed to delete key from etcd", "key", key)
+	}
+	return err
+}
+
+func (s *etcdStore) CompareAndDelete(ctx context.Context, key string, revision int64) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	txnResp, err := s.cc.Txn(ctx).If(
+		clientv3.Compare(clientv3.ModRevision(key), "=", revision),
+	).Then(
+		clientv3.OpDelete(key),
+	).Commit()
+	if err != nil {
+		logging.Logger.Error("failed to delete key from etcd", "key", key)
+		return false, err
+	}
+	return txnResp.Succeeded, nil
+}
+
+func (s *etcdStore) List(ctx context.Context, prefix string) ([]KeyValue, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	resp, err := s.cc.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		logging.Logger.Error("failed to list keys from etcd", "prefix", prefix)
+		return nil, err
+	}
+	res := make([]KeyValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		res = append(res, KeyValue{
+			Key:      string(kv.Key),
+			Value:    kv.Value,
+			Revision: kv.ModRevision,
+		})
+	}
+	return res, nil
+}
+
+func (s *etcdStore) ListPage(ctx context.Context, prefix string, after string, limit int) ([]KeyValue, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	from := prefix
+	if after >= prefix {
+		// the smallest key greater than after
+		from = after + "\x00"
+	}
+	resp, err := s.cc.Get(ctx, from,
+		clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix)),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+		clientv3.WithLimit(int64(limit)),
+	)
+	if err != nil {
+		logging.Logger.Error("failed to list keys from etcd", "prefix", prefix, "after", after)
+		return nil, err
+	}
+	res := make([]KeyValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		res = append(res, KeyValue{
+			Key:      string(kv.Key),
+			Value:    kv.Value,
+			Revision: kv.ModRevision,
+		})
+	}
+	return res, nil
+}
+
+func (s *etcdStore) Watch(ctx context.Context, prefix string) <-chan Event {
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for resp := range s.cc.Watch(ctx, prefix, clientv3.WithPrefix()) {
+			if err := resp.Err(); err != nil {
+				logging.Logger.Error("etcd watch failed", "prefix", prefix, "error", err)
+				return
+			}
+			for _, ev := range resp.Events {
+				event := Event{
+					Type:     EventPut,
+					Key:      string(ev.Kv.Key),
+					Value:    ev.Kv.Value,
+					Revision: ev.Kv.ModRevision,
+				}
+				if ev.Type == clientv3.EventTypeDelete {
+					event.Type = EventDelete
+					event.Value = nil
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hamza-boudouche/autodev/pkg/helpers/etcdtest"
+)
+
+func TestEtcdStoreConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+	s := NewEtcdStore(etcdtest.Start(t), 5*time.Second)
+
+	if _, err := s.Get(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if ok, err := s.CreateIfAbsent(ctx, "a", []byte("1")); err != nil || !ok {
+		t.Fatalf("expected first create to succeed, got %v (err %v)", ok, err)
+	}
+	if ok, _ := s.CreateIfAbsent(ctx, "a", []byte("2")); ok {
+		t.Fatal("expected second create to fail")
+	}
+	kv, err := s.Get(ctx, "a")
+	if err != nil || string(kv.Value) != "1" {
+		t.Fatalf("unexpected value %v (err %v)", kv, err)
+	}
+	if ok, _ := s.CompareAndSwap(ctx, "a", kv.Revision+1, []byte("3")); ok {
+		t.Fatal("expected swap at a stale revision to fail")
+	}
+	if ok, _ := s.CompareAndSwap(ctx, "a", kv.Revision, []byte("3")); !ok {
+		t.Fatal("expected swap at the current revision to succeed")
+	}
+	if ok, _ := s.CompareAndSwap(ctx, "a", kv.Revision, []byte("4")); ok {
+		t.Fatal("expected second swap at the same revision to fail")
+	}
+	kv, err = s.Get(ctx, "a")
+	if err != nil || string(kv.Value) != "3" {
+		t.Fatalf("unexpected value %v (err %v)", kv, err)
+	}
+	if ok, _ := s.CompareAndDelete(ctx, "a", kv.Revision-1); ok {
+		t.Fatal("expected delete at a stale revision to fail")
+	}
+	if ok, _ := s.CompareAndDelete(ctx, "a", kv.Revision); !ok {
+		t.Fatal("expected delete at the current revision to succeed")
+	}
+	if _, err := s.Get(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+	if err := s.Delete(ctx, "a"); err != nil {
+		t.Fatalf("expected deleting a missing key to succeed, got %v", err)
+	}
+}
+
+func TestEtcdStoreListAndWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewEtcdStore(etcdtest.Start(t), 5*time.Second)
+	events := s.Watch(ctx, "p-")
+
+	// the watch is set up in the background, write until it sees a change
+	waitForWatch(t, s, events)
+
+	s.CreateIfAbsent(ctx, "p-b", []byte("b"))
+	s.CreateIfAbsent(ctx, "other", []byte("o"))
+	s.CreateIfAbsent(ctx, "p-a", []byte("a"))
+	s.Delete(ctx, "p-b")
+
+	kvs, err := s.List(ctx, "p-")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(kvs) != 1 || kvs[0].Key != "p-a" || string(kvs[0].Value) != "a" {
+		t.Fatalf("unexpected list result %v", kvs)
+	}
+
+	want := []Event{
+		{Type: EventPut, Key: "p-b", Value: []byte("b")},
+		{Type: EventPut, Key: "p-a", Value: []byte("a")},
+		{Type: EventDelete, Key: "p-b"},
+	}
+	for _, w := range want {
+		select {
+		case ev := <-events:
+			if ev.Type != w.Type || ev.Key != w.Key || string(ev.Value) != string(w.Value) {
+				t.Fatalf("expected %s %s %q, got %s %s %q", w.Type, w.Key, w.Value, ev.Type, ev.Key, ev.Value)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s %s", w.Type, w.Key)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestEtcdStoreListPage(t *testing.T) {
+	ctx := context.Background()
+	s := NewEtcdStore(etcdtest.Start(t), 5*time.Second)
+	for _, key := range []string{"p-c", "p-a", "other", "p-b", "q-a"} {
+		s.CreateIfAbsent(ctx, key, []byte(key))
+	}
+
+	var keys []string
+	after := ""
+	for {
+		kvs, err := s.ListPage(ctx, "p-", after, 2)
+		if err != nil {
+			t.Fatalf("ListPage failed: %v", err)
+		}
+		if len(kvs) == 0 {
+			break
+		}
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		after = kvs[len(kvs)-1].Key
+	}
+	if strings.Join(keys, ",") != "p-a,p-b,p-c" {
+		t.Fatalf("unexpected pages %v", keys)
+	}
+}
+
+// waitForWatch writes p-sync until events reports it, then deletes it and
+// consumes that delete too.
+func waitForWatch(t *testing.T, s Store, events <-chan Event) {
+	t.Helper()
+	ctx := context.Background()
+	deadline := time.After(5 * time.Second)
+	for {
+		s.Delete(ctx, "p-sync")
+		s.CreateIfAbsent(ctx, "p-sync", nil)
+	drain:
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == EventPut && ev.Key == "p-sync" {
+					s.Delete(ctx, "p-sync")
+					for ev := range events {
+						if ev.Type == EventDelete && ev.Key == "p-sync" {
+							return
+						}
+					}
+					t.Fatal("watch stopped before the sync key was deleted")
+				}
+			case <-time.After(100 * time.Millisecond):
+				break drain
+			case <-deadline:
+				t.Fatal("timed out waiting for the watch to be set up")
+			}
+		}
+	}
+}
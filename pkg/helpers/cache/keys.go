@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"context"
+	"strings"
+
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+)
+
+// KeyPrefix is the prefix of every key written by autodev, so that its data
+// doesn't collide with anything else stored in the same etcd. The version in
+// the prefix is the version of the layout of the keys below it.
+const KeyPrefix = "/autodev/v1/"
+
+// RewriteFunc returns the value a record moved by MoveKeys is written with.
+type RewriteFunc func(value []byte) ([]byte, error)
+
+// MoveKeys moves every record whose key starts with from to the same key
+// with from replaced by to, passing its value through rewrite when it isn't
+// nil. A record already present at the new key is kept, and the old record
+// is only deleted if it wasn't modified while it was moved, so MoveKeys can
+// be run again, and by several processes at once, until it reports that it
+// had nothing left to move. Records that rewrite fails on are left where
+// they are.
+func MoveKeys(ctx context.Context, kv Store, from string, to string, rewrite RewriteFunc) (int, error) {
+	kvs, err := kv.List(ctx, from)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, old := range kvs {
+		key := to + strings.TrimPrefix(old.Key, from)
+		value := old.Value
+		if rewrite != nil {
+			if value, err = rewrite(value); err != nil {
+				logging.Logger.Warn("not moving record that can't be rewritten", "key", old.Key, "error", err)
+				continue
+			}
+		}
+		if _, err := kv.CreateIfAbsent(ctx, key, value); err != nil {
+			return moved, err
+		}
+		deleted, err := kv.CompareAndDelete(ctx, old.Key, old.Revision)
+		if err != nil {
+			return moved, err
+		}
+		if !deleted {
+			// written again in the meantime, by a process still using the
+			// old key: it's moved on the next run
+			logging.Logger.Warn("record changed while it was moved", "key", old.Key)
+			continue
+		}
+		logging.Logger.Info("moved record", "from", old.Key, "to", key)
+		moved++
+	}
+	return moved, nil
+}
@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+)
+
+// watchBufferSize is the number of events buffered for each in-memory
+// watcher before new events start being dropped.
+const watchBufferSize = 64
+
+type memoryWatcher struct {
+	prefix string
+	events chan Event
+}
+
+type memoryStore struct {
+	mu       sync.Mutex
+	revision int64
+	data     map[string]KeyValue
+	watchers map[*memoryWatcher]struct{}
+}
+
+// NewMemoryStore returns a Store that keeps everything in memory. It mimics
+// the etcd semantics (global revision counter, prefix watches) closely
+// enough to stand in for etcd in tests and local experiments.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		data:     make(map[string]KeyValue),
+		watchers: make(map[*memoryWatcher]struct{}),
+	}
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) (*KeyValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kv, ok := s.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	kv.Value = bytes.Clone(kv.Value)
+	return &kv, nil
+}
+
+func (s *memoryStore) CreateIfAbsent(ctx context.Context, key string, value []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[key]; ok {
+		return false, nil
+	}
+	s.put(key, value)
+	return true, nil
+}
+
+func (s *memoryStore) CompareAndSwap(ctx context.Context, key string, revision int64, value []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kv, ok := s.data[key]
+	if !ok || kv.Revision != revision {
+		return false, nil
+	}
+	s.put(key, value)
+	return true, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[key]; !ok {
+		return nil
+	}
+	s.remove(key)
+	return nil
+}
+
+func (s *memoryStore) CompareAndDelete(ctx context.Context, key string, revision int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kv, ok := s.data[key]
+	if !ok || kv.Revision != revision {
+		return false, nil
+	}
+	s.remove(key)
+	return true, nil
+}
+
+func (s *memoryStore) List(ctx context.Context, prefix string) ([]KeyValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]KeyValue, 0)
+	for key, kv := range s.data {
+		if strings.HasPrefix(key, prefix) {
+			kv.Value = bytes.Clone(kv.Value)
+			res = append(res, kv)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
+	})
+	return res, nil
+}
+
+func (s *memoryStore) ListPage(ctx context.Context, prefix string, after string, limit int) ([]KeyValue, error) {
+	kvs, err := s.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]KeyValue, 0, limit)
+	for _, kv := range kvs {
+		if kv.Key <= after {
+			continue
+		}
+		if len(res) == limit {
+			break
+		}
+		res = append(res, kv)
+	}
+	return res, nil
+}
+
+func (s *memoryStore) Watch(ctx context.Context, prefix string) <-chan Event {
+	w := &memoryWatcher{
+		prefix: prefix,
+		events: make(chan Event, watchBufferSize),
+	}
+	s.mu.Lock()
+	s.watchers[w] = struct{}{}
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		delete(s.watchers, w)
+		close(w.events)
+		s.mu.Unlock()
+	}()
+	return w.events
+}
+
+// put must be called with s.mu held.
+func (s *memoryStore) put(key string, value []byte) {
+	s.revision++
+	kv := KeyValue{
+		Key:      key,
+		Value:    bytes.Clone(value),
+		Revision: s.revision,
+	}
+	s.data[key] = kv
+	s.notify(Event{Type: EventPut, Key: key, Value: bytes.Clone(value), Revision: s.revision})
+}
+
+// remove must be called with s.mu held.
+func (s *memoryStore) remove(key string) {
+	s.revision++
+	delete(s.data, key)
+	s.notify(Event{Type: EventDelete, Key: key, Revision: s.revision})
+}
+
+// notify must be called with s.mu held.
+func (s *memoryStore) notify(event Event) {
+	for w := range s.watchers {
+		if !strings.HasPrefix(event.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			logging.Logger.Warn("dropping event for slow in-memory watcher", "key", event.Key)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	if _, err := s.Get(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if ok, _ := s.CreateIfAbsent(ctx, "a", []byte("1")); !ok {
+		t.Fatal("expected first create to succeed")
+	}
+	if ok, _ := s.CreateIfAbsent(ctx, "a", []byte("2")); ok {
+		t.Fatal("expected second create to fail")
+	}
+	kv, err := s.Get(ctx, "a")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if ok, _ := s.CompareAndSwap(ctx, "a", kv.Revision+1, []byte("3")); ok {
+		t.Fatal("expected swap at a stale revision to fail")
+	}
+	if ok, _ := s.CompareAndSwap(ctx, "a", kv.Revision, []byte("3")); !ok {
+		t.Fatal("expected swap at the current revision to succeed")
+	}
+	if ok, _ := s.CompareAndSwap(ctx, "a", kv.Revision, []byte("4")); ok {
+		t.Fatal("expected second swap at the same revision to fail")
+	}
+	kv, err = s.Get(ctx, "a")
+	if err != nil || string(kv.Value) != "3" {
+		t.Fatalf("unexpected value %v (err %v)", kv, err)
+	}
+	if ok, _ := s.CompareAndDelete(ctx, "a", kv.Revision-1); ok {
+		t.Fatal("expected delete at a stale revision to fail")
+	}
+	if err := s.Delete(ctx, "a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := s.Get(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestMemoryStoreListAndWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewMemoryStore()
+	events := s.Watch(ctx, "p-")
+
+	s.CreateIfAbsent(ctx, "p-b", []byte("b"))
+	s.CreateIfAbsent(ctx, "other", []byte("o"))
+	s.CreateIfAbsent(ctx, "p-a", []byte("a"))
+	s.Delete(ctx, "p-b")
+
+	kvs, err := s.List(ctx, "p-")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(kvs) != 1 || kvs[0].Key != "p-a" {
+		t.Fatalf("unexpected list result %v", kvs)
+	}
+
+	want := []Event{
+		{Type: EventPut, Key: "p-b"},
+		{Type: EventPut, Key: "p-a"},
+		{Type: EventDelete, Key: "p-b"},
+	}
+	for _, w := range want {
+		select {
+		case ev := <-events:
+			if ev.Type != w.Type || ev.Key != w.Key {
+				t.Fatalf("expected %s %s, got %s %s", w.Type, w.Key, ev.Type, ev.Key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s %s", w.Type, w.Key)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestMemoryStoreListPage(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	for _, key := range []string{"p-c", "p-a", "other", "p-b", "q-a"} {
+		s.CreateIfAbsent(ctx, key, []byte(key))
+	}
+
+	var keys []string
+	after := ""
+	for {
+		kvs, err := s.ListPage(ctx, "p-", after, 2)
+		if err != nil {
+			t.Fatalf("ListPage failed: %v", err)
+		}
+		if len(kvs) == 0 {
+			break
+		}
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		after = kvs[len(kvs)-1].Key
+	}
+	if strings.Join(keys, ",") != "p-a,p-b,p-c" {
+		t.Fatalf("unexpected pages %v", keys)
+	}
+}
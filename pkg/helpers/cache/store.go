@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound is returned by Store.Get when the key does not exist.
+var ErrNotFound = errors.New("key not found")
+
+// KeyValue is a single record read from a Store.
+type KeyValue struct {
+	Key   string
+	Value []byte
+	// Revision is the revision at which the key was last modified.
+	Revision int64
+}
+
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+)
+
+// Event describes a change to a key observed through Store.Watch.
+type Event struct {
+	Type     EventType
+	Key      string
+	Value    []byte
+	Revision int64
+}
+
+// Store is the key/value backend used to persist autodev's state. It only
+// exposes conditional writes so that callers cannot blindly overwrite a
+// record that was modified concurrently.
+type Store interface {
+	// Get returns the record stored at key, or ErrNotFound.
+	Get(ctx context.Context, key string) (*KeyValue, error)
+	// CreateIfAbsent writes value at key only if the key does not exist yet.
+	// It reports whether the write happened.
+	CreateIfAbsent(ctx context.Context, key string, value []byte) (bool, error)
+	// CompareAndSwap replaces the value at key with value only if the key
+	// was last modified at revision. It reports whether the swap happened.
+	CompareAndSwap(ctx context.Context, key string, revision int64, value []byte) (bool, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// CompareAndDelete removes key only if it was last modified at revision.
+	// It reports whether the delete happened.
+	CompareAndDelete(ctx context.Context, key string, revision int64) (bool, error)
+	// List returns every record whose key starts with prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]KeyValue, error)
+	// ListPage returns, sorted by key, at most limit records whose key
+	// starts with prefix and comes after after. An empty after starts from
+	// the first key.
+	ListPage(ctx context.Context, prefix string, after string, limit int) ([]KeyValue, error)
+	// Watch streams the changes made to keys starting with prefix until ctx
+	// is cancelled, at which point the returned channel is closed.
+	Watch(ctx context.Context, prefix string) <-chan Event
+}
@@ -0,0 +1,422 @@
+package consistency
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+)
+
+// sagaKeyPrefix is the prefix of the records of the sagas in progress.
+const sagaKeyPrefix = cache.KeyPrefix + "sagas/"
+
+// legacySagaKeyPrefix is where the records were kept before the keys of
+// autodev were prefixed with cache.KeyPrefix.
+const legacySagaKeyPrefix = "saga-"
+
+type SagaState string
+
+const (
+	SagaRunning SagaState = "running"
+	// SagaCompensating means a step failed and the saga is undoing the
+	// steps that completed before it.
+	SagaCompensating SagaState = "compensating"
+	// SagaRecovering means the saga was left unfinished and is being
+	// recovered by Journal.Recover.
+	SagaRecovering SagaState = "recovering"
+	// SagaCompleted means every step of the saga completed, and only its
+	// record is left to delete. It is never undone.
+	SagaCompleted SagaState = "completed"
+)
+
+type StepState string
+
+const (
+	StepStarted   StepState = "started"
+	StepCompleted StepState = "completed"
+	// StepFailed steps returned an error, and are not compensated, as in
+	// Saga.Run.
+	StepFailed StepState = "failed"
+)
+
+// Compensation names the registered action undoing a step, and the input it
+// is called with.
+type Compensation struct {
+	Action string          `json:"action"`
+	Input  json.RawMessage `json:"input,omitempty"`
+}
+
+// StepRecord is the progress of one step of a saga.
+type StepRecord struct {
+	Name  string    `json:"name"`
+	State StepState `json:"state"`
+	// Compensation is nil for steps that have nothing to undo.
+	Compensation *Compensation `json:"compensation,omitempty"`
+}
+
+// SagaRecord is the progress of a saga, as recorded in the journal. Records
+// are deleted once their saga has completed or has been compensated, so the
+// journal only holds the sagas that are in progress, that were left
+// unfinished by a crash, or whose record couldn't be deleted.
+type SagaRecord struct {
+	ID    string          `json:"id"`
+	Name  string          `json:"name"`
+	Input json.RawMessage `json:"input,omitempty"`
+	State SagaState       `json:"state"`
+	Steps []StepRecord    `json:"steps,omitempty"`
+	// UpdatedAt is bumped on every step, so that sagas that stopped making
+	// progress can be told apart from sagas that are still running.
+	StartedAt time.Time `json:"startedAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// CompensationFunc undoes a step from the input of its Compensation. It may
+// be called for a step that was started but didn't complete, or more than
+// once, so it must tolerate what it undoes being already gone.
+type CompensationFunc func(ctx context.Context, input json.RawMessage) error
+
+// ResumeFunc finishes an unfinished saga from its input, instead of undoing
+// its steps. It is registered for sagas whose steps are safe to run again.
+type ResumeFunc func(ctx context.Context, input json.RawMessage) error
+
+// Journal persists the progress of sagas run with Saga.RunJournaled, so that
+// the sagas left unfinished when the process dies can be recovered: they are
+// resumed if a ResumeFunc is registered for them, and compensated otherwise.
+type Journal struct {
+	kv            cache.Store
+	mu            sync.RWMutex
+	compensations map[string]CompensationFunc
+	resumes       map[string]ResumeFunc
+}
+
+func NewJournal(kv cache.Store) *Journal {
+	return &Journal{
+		kv:            kv,
+		compensations: make(map[string]CompensationFunc),
+		resumes:       make(map[string]ResumeFunc),
+	}
+}
+
+// RegisterCompensation registers the action named in Compensation.Action.
+func (j *Journal) RegisterCompensation(action string, fn CompensationFunc) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.compensations[action] = fn
+}
+
+// RegisterResume registers how to finish the sagas run under name.
+func (j *Journal) RegisterResume(name string, fn ResumeFunc) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.resumes[name] = fn
+}
+
+// Migrate moves the records kept under their legacy keys. It must run before
+// Recover, which would not see them otherwise.
+func (j *Journal) Migrate(ctx context.Context) error {
+	moved, err := cache.MoveKeys(ctx, j.kv, legacySagaKeyPrefix, sagaKeyPrefix, nil)
+	if err != nil {
+		return fmt.Errorf("failed to migrate saga records: %w", err)
+	}
+	if moved > 0 {
+		logging.Logger.Info("migrated saga records", "count", moved)
+	}
+	return nil
+}
+
+// List returns the records of the sagas in progress, sorted by ID.
+func (j *Journal) List(ctx context.Context) ([]*SagaRecord, error) {
+	kvs, err := j.kv.List(ctx, sagaKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*SagaRecord, 0, len(kvs))
+	for _, kv := range kvs {
+		var record SagaRecord
+		if err := json.Unmarshal(kv.Value, &record); err != nil {
+			logging.Logger.Warn("skipping undecodable saga record", "key", kv.Key)
+			continue
+		}
+		res = append(res, &record)
+	}
+	return res, nil
+}
+
+// Recover resumes or compensates the sagas that made no progress for
+// staleAfter, which are assumed to have been left unfinished by a crash.
+// Sagas that can't be recovered are kept, to be retried by the next call.
+func (j *Journal) Recover(ctx context.Context, staleAfter time.Duration) error {
+	kvs, err := j.kv.List(ctx, sagaKeyPrefix)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, kv := range kvs {
+		var record SagaRecord
+		if err := json.Unmarshal(kv.Value, &record); err != nil {
+			logging.Logger.Warn("skipping undecodable saga record", "key", kv.Key)
+			continue
+		}
+		if time.Since(record.UpdatedAt) < staleAfter {
+			continue
+		}
+		if record.State == SagaCompleted {
+			// only the record of the saga was left behind
+			if _, err := j.kv.CompareAndDelete(ctx, kv.Key, kv.Revision); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			logging.Logger.Info("removed completed saga", "saga", record.Name, "sagaID", record.ID)
+			continue
+		}
+		// claim the saga, so that other replicas leave it alone
+		record.State = SagaRecovering
+		record.UpdatedAt = time.Now().UTC()
+		recordJSON, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		claimed, err := j.kv.CompareAndSwap(ctx, kv.Key, kv.Revision, recordJSON)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !claimed {
+			logging.Logger.Info("saga is being recovered elsewhere", "saga", record.Name, "sagaID", record.ID)
+			continue
+		}
+		logging.Logger.Info("recovering unfinished saga", "saga", record.Name, "sagaID", record.ID, "steps", len(record.Steps))
+		if err := j.recover(ctx, &record); err != nil {
+			logging.Logger.Error("failed to recover saga", "saga", record.Name, "sagaID", record.ID, "error", err)
+			errs = append(errs, fmt.Errorf("saga %s (%s): %w", record.ID, record.Name, err))
+			continue
+		}
+		if err := j.kv.Delete(ctx, kv.Key); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		logging.Logger.Info("recovered saga", "saga", record.Name, "sagaID", record.ID)
+	}
+	return errors.Join(errs...)
+}
+
+func (j *Journal) recover(ctx context.Context, record *SagaRecord) error {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if resume, ok := j.resumes[record.Name]; ok {
+		return resume(ctx, record.Input)
+	}
+	var errs []error
+	for i := len(record.Steps) - 1; i >= 0; i-- {
+		compensation := record.Steps[i].Compensation
+		if compensation == nil || record.Steps[i].State == StepFailed {
+			continue
+		}
+		compensate, ok := j.compensations[compensation.Action]
+		if !ok {
+			errs = append(errs, fmt.Errorf("no compensation registered for %s", compensation.Action))
+			continue
+		}
+		if err := compensate(ctx, compensation.Input); err != nil {
+			errs = append(errs, fmt.Errorf("step %s: %w", record.Steps[i].Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sagaRun records the progress of one run of a saga in the journal.
+type sagaRun struct {
+	journal *Journal
+	key     string
+	mu      sync.Mutex
+	record  SagaRecord
+	// last is set while the last step of the saga runs, whose end also
+	// records the completion of the saga
+	last bool
+}
+
+type sagaRunKey struct{}
+
+func runFrom(ctx context.Context) *sagaRun {
+	run, _ := ctx.Value(sagaRunKey{}).(*sagaRun)
+	return run
+}
+
+func (j *Journal) start(ctx context.Context, name string, input interface{}) (*sagaRun, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	inputJSON, err := json.Marshal(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the input of saga %s: %w", name, err)
+	}
+	now := time.Now().UTC()
+	run := &sagaRun{
+		journal: j,
+		record: SagaRecord{
+			ID:        fmt.Sprintf("%s-%s", now.Format("20060102-150405"), hex.EncodeToString(id)),
+			Name:      name,
+			Input:     inputJSON,
+			State:     SagaRunning,
+			StartedAt: now,
+			UpdatedAt: now,
+		},
+	}
+	run.key = sagaKeyPrefix + run.record.ID
+	recordJSON, err := json.Marshal(&run.record)
+	if err != nil {
+		return nil, err
+	}
+	created, err := j.kv.CreateIfAbsent(ctx, run.key, recordJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to journal saga %s: %w", name, err)
+	}
+	if !created {
+		return nil, fmt.Errorf("saga %s already exists", run.record.ID)
+	}
+	return run, nil
+}
+
+// save writes the record back, failing if the saga was claimed by
+// Journal.Recover in the meantime.
+func (r *sagaRun) save(ctx context.Context) error {
+	kv, err := r.journal.kv.Get(ctx, r.key)
+	if err != nil {
+		return fmt.Errorf("failed to read saga %s: %w", r.record.ID, err)
+	}
+	var stored SagaRecord
+	if err := json.Unmarshal(kv.Value, &stored); err != nil {
+		return err
+	}
+	if stored.State == SagaRecovering {
+		return fmt.Errorf("saga %s is being recovered", r.record.ID)
+	}
+	r.record.UpdatedAt = time.Now().UTC()
+	recordJSON, err := json.Marshal(&r.record)
+	if err != nil {
+		return err
+	}
+	swapped, err := r.journal.kv.CompareAndSwap(ctx, r.key, kv.Revision, recordJSON)
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return fmt.Errorf("saga %s was modified concurrently", r.record.ID)
+	}
+	return nil
+}
+
+// begin records that the step is about to run. It is recorded before the
+// step has any side effect, so that its compensation runs even if the
+// process dies while the step is running.
+func (r *sagaRun) begin(ctx context.Context, name string, action string, input interface{}) error {
+	step := StepRecord{Name: name, State: StepStarted}
+	if action != "" {
+		inputJSON, err := json.Marshal(input)
+		if err != nil {
+			return fmt.Errorf("failed to encode the compensation of step %s: %w", name, err)
+		}
+		step.Compensation = &Compensation{Action: action, Input: inputJSON}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record.Steps = append(r.record.Steps, step)
+	return r.save(ctx)
+}
+
+// end records the outcome of the last step begun. The end of the last step
+// of the saga is recorded with the completion of the saga, so that there is
+// no moment where every step completed but the saga would be undone.
+func (r *sagaRun) end(ctx context.Context, state StepState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record.Steps[len(r.record.Steps)-1].State = state
+	completes := state == StepCompleted && r.last
+	if completes {
+		r.record.State = SagaCompleted
+	}
+	if err := r.save(ctx); err != nil {
+		// the step is still recorded as started, which is only compensated
+		// more than needed, unless complete records it
+		if completes {
+			r.record.State = SagaRunning
+		}
+		logging.Logger.Warn("failed to journal the end of a saga step", "sagaID", r.record.ID, "step", r.record.Steps[len(r.record.Steps)-1].Name, "error", err)
+	}
+}
+
+// lastStep tells that the next step is the last one of the saga.
+func (r *sagaRun) lastStep() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last = true
+}
+
+// complete records that every step of the saga completed, unless the end of
+// its last step already did. Until it is recorded, Journal.Recover would
+// undo the saga.
+func (r *sagaRun) complete(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.record.State == SagaCompleted {
+		return nil
+	}
+	r.record.State = SagaCompleted
+	err := retryJournal(ctx, func() error { return r.save(ctx) })
+	if err != nil {
+		r.record.State = SagaRunning
+		return fmt.Errorf("failed to journal the completion of saga %s: %w", r.record.ID, err)
+	}
+	return nil
+}
+
+func (r *sagaRun) compensating(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record.State = SagaCompensating
+	if err := r.save(ctx); err != nil {
+		logging.Logger.Warn("failed to journal the compensation of a saga", "sagaID", r.record.ID, "error", err)
+	}
+}
+
+// finish removes the record once the saga has completed or has been
+// compensated. A record left behind is harmless: Journal.Recover deletes
+// completed sagas, and compensations tolerate running more than once.
+func (r *sagaRun) finish(ctx context.Context) error {
+	err := retryJournal(ctx, func() error { return r.journal.kv.Delete(ctx, r.key) })
+	if err != nil {
+		return fmt.Errorf("failed to remove saga %s from the journal: %w", r.record.ID, err)
+	}
+	return nil
+}
+
+const (
+	journalAttempts = 3
+	journalBackoff  = 100 * time.Millisecond
+)
+
+// retryJournal retries a write to the journal that failed, which is most
+// likely a blip of etcd.
+func retryJournal(ctx context.Context, write func() error) error {
+	backoff := journalBackoff
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil || attempt >= journalAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
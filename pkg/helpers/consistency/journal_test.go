@@ -0,0 +1,258 @@
+package consistency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+)
+
+func noop(ctx context.Context) (context.Context, func(context.Context) error, error) {
+	return ctx, NoCompensation, nil
+}
+
+func TestRunJournaled(t *testing.T) {
+	ctx := context.Background()
+	kv := cache.NewMemoryStore()
+	j := NewJournal(kv)
+
+	var recorded []*SagaRecord
+	observe := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		records, err := j.List(ctx)
+		if err != nil {
+			return ctx, nil, err
+		}
+		recorded = records
+		return ctx, NoCompensation, nil
+	}
+	_, err := Saga{
+		DurableStep("first", "undo-first", map[string]string{"name": "a"}, noop),
+		Step("observe", observe),
+	}.RunJournaled(ctx, j, "test", map[string]string{"input": "b"})
+	if err != nil {
+		t.Fatalf("RunJournaled failed: %v", err)
+	}
+	if len(recorded) != 1 || len(recorded[0].Steps) != 2 {
+		t.Fatalf("expected the saga to be recorded while running, got %+v", recorded)
+	}
+	first, observed := recorded[0].Steps[0], recorded[0].Steps[1]
+	if first.State != StepCompleted || first.Compensation == nil || first.Compensation.Action != "undo-first" {
+		t.Fatalf("unexpected first step %+v", first)
+	}
+	if observed.State != StepStarted || observed.Compensation != nil {
+		t.Fatalf("unexpected running step %+v", observed)
+	}
+	if records, _ := j.List(ctx); len(records) != 0 {
+		t.Fatalf("expected the finished saga to be removed, got %+v", records)
+	}
+
+	// failed sagas are compensated in process and removed as well
+	_, err = Saga{
+		Step("first", noop),
+		Step("fail", func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+			return ctx, nil, errors.New("boom")
+		}),
+	}.RunJournaled(ctx, j, "test", nil)
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "fail" {
+		t.Fatalf("expected the fail step to fail, got %v", err)
+	}
+	if records, _ := j.List(ctx); len(records) != 0 {
+		t.Fatalf("expected the failed saga to be removed, got %+v", records)
+	}
+}
+
+func writeRecord(t *testing.T, kv cache.Store, record SagaRecord) {
+	t.Helper()
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.CreateIfAbsent(context.Background(), sagaKeyPrefix+record.ID, recordJSON); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	ctx := context.Background()
+	kv := cache.NewMemoryStore()
+	j := NewJournal(kv)
+
+	var undone []string
+	j.RegisterCompensation("undo", func(ctx context.Context, input json.RawMessage) error {
+		var name string
+		if err := json.Unmarshal(input, &name); err != nil {
+			return err
+		}
+		undone = append(undone, name)
+		return nil
+	})
+	var resumed []string
+	j.RegisterResume("resumable", func(ctx context.Context, input json.RawMessage) error {
+		resumed = append(resumed, string(input))
+		return nil
+	})
+
+	stale := time.Now().Add(-time.Hour)
+	compensation := func(name string) *Compensation {
+		return &Compensation{Action: "undo", Input: json.RawMessage(`"` + name + `"`)}
+	}
+	writeRecord(t, kv, SagaRecord{
+		ID:    "crashed",
+		Name:  "compensated",
+		State: SagaRunning,
+		Steps: []StepRecord{
+			{Name: "a", State: StepCompleted, Compensation: compensation("a")},
+			{Name: "b", State: StepCompleted},
+			{Name: "c", State: StepStarted, Compensation: compensation("c")},
+		},
+		UpdatedAt: stale,
+	})
+	writeRecord(t, kv, SagaRecord{
+		ID:    "failed",
+		Name:  "compensated",
+		State: SagaCompensating,
+		Steps: []StepRecord{
+			{Name: "a", State: StepCompleted, Compensation: compensation("d")},
+			{Name: "b", State: StepFailed, Compensation: compensation("e")},
+		},
+		UpdatedAt: stale,
+	})
+	writeRecord(t, kv, SagaRecord{
+		ID:        "resumed",
+		Name:      "resumable",
+		Input:     json.RawMessage(`"input"`),
+		State:     SagaRunning,
+		Steps:     []StepRecord{{Name: "a", State: StepCompleted, Compensation: compensation("f")}},
+		UpdatedAt: stale,
+	})
+	writeRecord(t, kv, SagaRecord{
+		ID:        "running",
+		Name:      "compensated",
+		State:     SagaRunning,
+		Steps:     []StepRecord{{Name: "a", State: StepStarted, Compensation: compensation("g")}},
+		UpdatedAt: time.Now(),
+	})
+
+	if err := j.Recover(ctx, time.Minute); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	// steps are compensated in reverse, except the ones that failed
+	if len(undone) != 3 || undone[0] != "c" || undone[1] != "a" || undone[2] != "d" {
+		t.Fatalf("unexpected compensations %v", undone)
+	}
+	if len(resumed) != 1 || resumed[0] != `"input"` {
+		t.Fatalf("unexpected resumes %v", resumed)
+	}
+	records, err := j.List(ctx)
+	if err != nil || len(records) != 1 || records[0].ID != "running" {
+		t.Fatalf("expected only the running saga to be kept, got %+v (err %v)", records, err)
+	}
+}
+
+func TestRecoverKeepsFailedRecoveries(t *testing.T) {
+	ctx := context.Background()
+	kv := cache.NewMemoryStore()
+	j := NewJournal(kv)
+
+	writeRecord(t, kv, SagaRecord{
+		ID:        "crashed",
+		Name:      "compensated",
+		State:     SagaRunning,
+		Steps:     []StepRecord{{Name: "a", State: StepCompleted, Compensation: &Compensation{Action: "unknown"}}},
+		UpdatedAt: time.Now().Add(-time.Hour),
+	})
+	if err := j.Recover(ctx, time.Minute); err == nil {
+		t.Fatal("expected a saga without registered compensation to fail recovery")
+	}
+	records, err := j.List(ctx)
+	if err != nil || len(records) != 1 || records[0].State != SagaRecovering {
+		t.Fatalf("expected the saga to be kept for the next recovery, got %+v (err %v)", records, err)
+	}
+}
+
+// failingDelete is a store whose deletes fail.
+type failingDelete struct {
+	cache.Store
+}
+
+func (failingDelete) Delete(context.Context, string) error {
+	return errors.New("etcd is down")
+}
+
+func TestRecoverLeavesCompletedSagas(t *testing.T) {
+	ctx := context.Background()
+	kv := cache.NewMemoryStore()
+	j := NewJournal(kv)
+	var undone []string
+	j.RegisterCompensation("undo", func(ctx context.Context, input json.RawMessage) error {
+		undone = append(undone, string(input))
+		return nil
+	})
+
+	// the record of a saga that completed, but couldn't be removed
+	_, err := Saga{
+		DurableStep("a", "undo", "a", noop),
+		DurableStep("b", "undo", "b", noop),
+	}.RunJournaled(ctx, NewJournal(failingDelete{kv}), "test", nil)
+	if err != nil {
+		t.Fatalf("RunJournaled failed: %v", err)
+	}
+	records, err := j.List(ctx)
+	if err != nil || len(records) != 1 || records[0].State != SagaCompleted {
+		t.Fatalf("expected the saga to be recorded as completed, got %+v (err %v)", records, err)
+	}
+
+	if err := j.Recover(ctx, 0); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	if len(undone) != 0 {
+		t.Fatalf("expected nothing to be compensated, got %v", undone)
+	}
+	if records, _ := j.List(ctx); len(records) != 0 {
+		t.Fatalf("expected the completed saga to be removed, got %+v", records)
+	}
+}
+
+func TestRunJournaledKeepsWhatWasLeftBehind(t *testing.T) {
+	ctx := context.Background()
+	j := NewJournal(cache.NewMemoryStore())
+
+	_, err := Saga{
+		DurableStep("a", "undo", "a", func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+			return ctx, func(context.Context) error { return errors.New("stuck") }, nil
+		}),
+		Step("fail", failing(errors.New("boom"))),
+	}.RunJournaled(ctx, j, "test", nil)
+	if LeftBehind(err) == nil {
+		t.Fatalf("expected step a to be left behind, got %v", err)
+	}
+	records, err := j.List(ctx)
+	if err != nil || len(records) != 1 || records[0].State != SagaCompensating {
+		t.Fatalf("expected the saga to be kept for recovery, got %+v (err %v)", records, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	kv := cache.NewMemoryStore()
+	j := NewJournal(kv)
+	recordJSON, _ := json.Marshal(SagaRecord{ID: "old", Name: "saga", State: SagaRunning})
+	kv.CreateIfAbsent(ctx, legacySagaKeyPrefix+"old", recordJSON)
+
+	for i := 0; i < 2; i++ {
+		if err := j.Migrate(ctx); err != nil {
+			t.Fatalf("Migrate failed: %v", err)
+		}
+	}
+	records, err := j.List(ctx)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(records) != 1 || records[0].ID != "old" {
+		t.Fatalf("expected the legacy record to be migrated, got %+v", records)
+	}
+}
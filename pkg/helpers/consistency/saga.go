@@ -1,24 +1,376 @@
 package consistency
 
-import "context"
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+)
 
 type Saga []Transaction
 
-func (s Saga) Run() (context.Context, error) {
-    cancels := make([]func(context.Context), 0, len(s))
-    ctx := context.Background()
-    for _, transaction := range s {
-        newCtx, cancel, err := transaction(ctx)
+// Transaction is a step of a saga. When it succeeds, it returns the context
+// passed to the next steps and the function undoing it, which is called if a
+// later step fails. When it fails, it must leave nothing behind.
+type Transaction func(context.Context) (context.Context, func(context.Context) error, error)
+
+// NoCompensation is the compensation of the transactions that have nothing
+// to undo.
+func NoCompensation(context.Context) error {
+    return nil
+}
+
+// StepResult is the outcome of one step of a saga.
+type StepResult struct {
+    // Name is the name given to the step with Step, or its position in the
+    // saga.
+    Name string
+    // Attempts is how many times the step ran, retries included.
+    Attempts int
+    // Err is why the step failed, after its last attempt.
+    Err error
+    // Compensated is true when the step completed and was undone because a
+    // later step failed.
+    Compensated bool
+    // CompensationErr is why undoing the step failed. What the step did is
+    // then left behind.
+    CompensationErr error
+}
+
+// SagaResult is the outcome of every step of a saga that was started. The
+// steps after the one that failed are not listed.
+type SagaResult struct {
+    Steps []StepResult
+}
+
+// Failed returns the step that failed, or nil if the saga completed.
+func (r *SagaResult) Failed() *StepResult {
+    for i := range r.Steps {
+        if r.Steps[i].Err != nil {
+            return &r.Steps[i]
+        }
+    }
+    return nil
+}
+
+// LeftBehind returns the steps that completed and couldn't be undone.
+func (r *SagaResult) LeftBehind() []string {
+    var steps []string
+    for _, step := range r.Steps {
+        if step.CompensationErr != nil {
+            steps = append(steps, step.Name)
+        }
+    }
+    return steps
+}
+
+// Run runs the steps of the saga in order with ctx, or until one fails, in
+// which case the steps that completed are undone in reverse order. Undoing
+// them doesn't stop when ctx is done, so that nothing is left behind because
+// the caller gave up. The error of a failed saga is the error of the failed
+// step, joined with a CompensationError for each step that couldn't be undone.
+func (s Saga) Run(ctx context.Context) (*SagaResult, error) {
+    result, _, err := s.run(ctx, nil)
+    return result, err
+}
+
+// RunJournaled is Run, with the progress of the saga recorded in j under
+// name so that the saga can be recovered if the process dies before it
+// completes (see Journal.Recover). input is what the ResumeFunc registered
+// for name is called with. A nil j only runs the saga. A saga whose steps
+// couldn't all be undone is kept in the journal, for Journal.Recover to undo
+// them later. A saga whose completion couldn't be journaled fails, since
+// Journal.Recover would undo it.
+func (s Saga) RunJournaled(ctx context.Context, j *Journal, name string, input interface{}) (*SagaResult, error) {
+    if j == nil {
+        return s.Run(ctx)
+    }
+    run, err := j.start(ctx, name, input)
+    if err != nil {
+        return &SagaResult{}, err
+    }
+    result, compensated, err := s.run(ctx, run)
+    if err == nil {
+        if err := run.complete(detach(ctx)); err != nil {
+            return result, err
+        }
+    }
+    if !compensated {
+        logging.Logger.Warn("keeping saga in the journal to undo what was left behind", "saga", name, "sagaID", run.record.ID, "leftBehind", result.LeftBehind())
+        return result, err
+    }
+    if finishErr := run.finish(detach(ctx)); finishErr != nil {
+        logging.Logger.Warn("failed to remove a finished saga from the journal", "saga", name, "sagaID", run.record.ID, "error", finishErr)
+    }
+    return result, err
+}
+
+// run runs the saga, recording its progress in run if it isn't nil, and
+// reports whether everything the saga did was either kept or undone.
+func (s Saga) run(ctx context.Context, run *sagaRun) (*SagaResult, bool, error) {
+    // nested sagas are journaled on their own, if at all
+    ctx = context.WithValue(ctx, sagaRunKey{}, run)
+    result := &SagaResult{Steps: make([]StepResult, 0, len(s))}
+    cancels := make([]func(context.Context) error, 0, len(s))
+    for i, transaction := range s {
+        if run != nil && i == len(s)-1 {
+            run.lastStep()
+        }
+        result.Steps = append(result.Steps, StepResult{Name: fmt.Sprintf("step %d", i+1)})
+        step := &result.Steps[i]
+        newCtx, cancel, err := transaction(context.WithValue(ctx, stepResultKey{}, step))
+        if step.Attempts == 0 {
+            // not run through Step
+            step.Attempts = 1
+        }
         if err != nil {
-            for i := len(cancels) - 1; i >= 0; i-- {
-                cancels[i](ctx)
-            }
-            return ctx, err
+            step.Err = err
+            return result, s.compensate(ctx, run, result, cancels), joinCompensationErrors(err, result)
         }
         cancels = append(cancels, cancel)
         ctx = newCtx
     }
-    return ctx, nil
+    return result, true, nil
+}
+
+func (s Saga) compensate(ctx context.Context, run *sagaRun, result *SagaResult, cancels []func(context.Context) error) bool {
+    ctx = detach(ctx)
+    if run != nil {
+        run.compensating(ctx)
+    }
+    compensated := true
+    for i := len(cancels) - 1; i >= 0; i-- {
+        if cancels[i] == nil {
+            continue
+        }
+        if err := cancels[i](ctx); err != nil {
+            logging.Logger.Error("failed to undo saga step", "step", result.Steps[i].Name, "error", err)
+            result.Steps[i].CompensationErr = err
+            compensated = false
+            continue
+        }
+        result.Steps[i].Compensated = true
+    }
+    return compensated
+}
+
+// CompensationError is the error of a step that couldn't be undone after a
+// later step of its saga failed.
+type CompensationError struct {
+    Step string
+    Err  error
+}
+
+func (e *CompensationError) Error() string {
+    return fmt.Sprintf("failed to undo %s: %s", e.Step, e.Err)
+}
+
+func (e *CompensationError) Unwrap() error {
+    return e.Err
+}
+
+func joinCompensationErrors(err error, result *SagaResult) error {
+    errs := []error{err}
+    for _, step := range result.Steps {
+        if step.CompensationErr != nil {
+            errs = append(errs, &CompensationError{Step: step.Name, Err: step.CompensationErr})
+        }
+    }
+    if len(errs) == 1 {
+        return err
+    }
+    return errors.Join(errs...)
+}
+
+// LeftBehind returns the steps that couldn't be undone according to err, the
+// error of a saga, including the steps of the sagas nested in it.
+func LeftBehind(err error) []string {
+    var steps []string
+    var walk func(err error)
+    walk = func(err error) {
+        switch e := err.(type) {
+        case *CompensationError:
+            steps = append(steps, e.Step)
+        case interface{ Unwrap() []error }:
+            for _, err := range e.Unwrap() {
+                walk(err)
+            }
+        case interface{ Unwrap() error }:
+            walk(e.Unwrap())
+        }
+    }
+    walk(err)
+    return steps
+}
+
+// StepError is the error of a transaction named with Step. It tells callers
+// of Saga.Run which step failed.
+type StepError struct {
+    Step string
+    Err  error
+}
+
+func (e *StepError) Error() string {
+    return fmt.Sprintf("%s: %s", e.Step, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+    return e.Err
+}
+
+// RetryPolicy retries a failing step. Only the steps that leave nothing
+// behind when they fail, and can run again, should be retried.
+type RetryPolicy struct {
+    // Attempts is the maximum number of runs of the step, the first one
+    // included.
+    Attempts int
+    // Backoff is the wait before the first retry. It doubles after each
+    // retry, up to MaxBackoff if it is set.
+    Backoff    time.Duration
+    MaxBackoff time.Duration
+    // Retryable tells which errors are worth retrying. Every error is when
+    // it is nil.
+    Retryable func(error) bool
+}
+
+type stepOptions struct {
+    retry   RetryPolicy
+    timeout time.Duration
+}
+
+type StepOption func(*stepOptions)
+
+// WithRetry retries the step according to policy.
+func WithRetry(policy RetryPolicy) StepOption {
+    return func(o *stepOptions) {
+        o.retry = policy
+    }
+}
+
+// WithTimeout bounds each attempt of the step to timeout, on top of the
+// deadline of the context the saga is run with.
+func WithTimeout(timeout time.Duration) StepOption {
+    return func(o *stepOptions) {
+        o.timeout = timeout
+    }
+}
+
+type stepResultKey struct{}
+
+// Step names transaction, so that its failure is reported as a StepError,
+// and so that its progress is journaled when the saga is run with
+// RunJournaled.
+func Step(name string, transaction Transaction, opts ...StepOption) Transaction {
+    return DurableStep(name, "", nil, transaction, opts...)
+}
+
+// DurableStep is Step, for a transaction undone after a crash by the
+// compensation registered in the journal under action, called with input.
+func DurableStep(name string, action string, input interface{}, transaction Transaction, opts ...StepOption) Transaction {
+    options := stepOptions{retry: RetryPolicy{Attempts: 1}}
+    for _, opt := range opts {
+        opt(&options)
+    }
+    return func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+        result, _ := ctx.Value(stepResultKey{}).(*StepResult)
+        if result == nil {
+            // run outside of a saga
+            result = &StepResult{}
+        }
+        result.Name = name
+        run := runFrom(ctx)
+        if run != nil {
+            if err := run.begin(ctx, name, action, input); err != nil {
+                result.Attempts = 1
+                return ctx, nil, &StepError{Step: name, Err: err}
+            }
+        }
+        newCtx, cancel, err := options.run(ctx, name, transaction, result)
+        if err != nil {
+            if run != nil {
+                run.end(detach(ctx), StepFailed)
+            }
+            return ctx, nil, &StepError{Step: name, Err: err}
+        }
+        if run != nil {
+            run.end(detach(ctx), StepCompleted)
+        }
+        return newCtx, cancel, nil
+    }
+}
+
+func (o stepOptions) run(ctx context.Context, name string, transaction Transaction, result *StepResult) (context.Context, func(context.Context) error, error) {
+    backoff := o.retry.Backoff
+    for {
+        result.Attempts++
+        newCtx, cancel, err := o.attempt(ctx, transaction)
+        if err == nil {
+            return newCtx, cancel, nil
+        }
+        if result.Attempts >= o.retry.Attempts || o.retry.Retryable != nil && !o.retry.Retryable(err) {
+            return ctx, nil, err
+        }
+        logging.Logger.Warn("retrying saga step", "step", name, "attempt", result.Attempts, "error", err)
+        select {
+        case <-ctx.Done():
+            return ctx, nil, err
+        case <-time.After(backoff):
+        }
+        backoff *= 2
+        if o.retry.MaxBackoff > 0 && backoff > o.retry.MaxBackoff {
+            backoff = o.retry.MaxBackoff
+        }
+    }
+}
+
+func (o stepOptions) attempt(ctx context.Context, transaction Transaction) (context.Context, func(context.Context) error, error) {
+    if o.timeout <= 0 {
+        return transaction(ctx)
+    }
+    attemptCtx, cancel := context.WithTimeout(ctx, o.timeout)
+    defer cancel()
+    newCtx, compensate, err := transaction(attemptCtx)
+    if err != nil {
+        return ctx, nil, err
+    }
+    // the next steps get the values of the step, without its deadline
+    return valuesOf{Context: ctx, values: newCtx}, compensate, nil
+}
+
+// valuesOf is Context, with the values of values.
+type valuesOf struct {
+    context.Context
+    values context.Context
 }
 
-type Transaction func(context.Context) (context.Context, func(context.Context), error)
+func (c valuesOf) Value(key interface{}) interface{} {
+    return c.values.Value(key)
+}
+
+// detach returns ctx without its deadline or cancellation, for what must be
+// done even if the caller gave up.
+func detach(ctx context.Context) context.Context {
+    return detached{values: ctx}
+}
+
+type detached struct {
+    values context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) {
+    return time.Time{}, false
+}
+
+func (detached) Done() <-chan struct{} {
+    return nil
+}
+
+func (detached) Err() error {
+    return nil
+}
+
+func (c detached) Value(key interface{}) interface{} {
+    return c.values.Value(key)
+}
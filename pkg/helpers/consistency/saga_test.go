@@ -0,0 +1,190 @@
+package consistency
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// undoable returns a transaction adding name to done, and removing it when
+// compensated, unless undoErr is set.
+func undoable(name string, done map[string]bool, undoErr error) Transaction {
+	return func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		done[name] = true
+		cancel := func(ctx context.Context) error {
+			if undoErr != nil {
+				return undoErr
+			}
+			delete(done, name)
+			return nil
+		}
+		return ctx, cancel, nil
+	}
+}
+
+func failing(err error) Transaction {
+	return func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		return ctx, nil, err
+	}
+}
+
+func TestRunCompensates(t *testing.T) {
+	done := make(map[string]bool)
+	boom := errors.New("boom")
+	result, err := Saga{
+		Step("a", undoable("a", done, nil)),
+		Step("b", undoable("b", done, nil)),
+		Step("c", failing(boom)),
+		Step("d", undoable("d", done, nil)),
+	}.Run(context.Background())
+
+	var stepErr *StepError
+	if !errors.Is(err, boom) || !errors.As(err, &stepErr) || stepErr.Step != "c" {
+		t.Fatalf("expected step c to fail, got %v", err)
+	}
+	if len(done) != 0 {
+		t.Fatalf("expected every step to be undone, got %v", done)
+	}
+	if len(result.Steps) != 3 {
+		t.Fatalf("expected the steps after the failed one not to be listed, got %+v", result.Steps)
+	}
+	if failed := result.Failed(); failed == nil || failed.Name != "c" {
+		t.Fatalf("unexpected failed step %+v", failed)
+	}
+	if !result.Steps[0].Compensated || !result.Steps[1].Compensated {
+		t.Fatalf("expected a and b to be compensated, got %+v", result.Steps)
+	}
+	if len(result.LeftBehind()) != 0 {
+		t.Fatalf("expected nothing to be left behind, got %v", result.LeftBehind())
+	}
+}
+
+func TestRunReportsCompensationErrors(t *testing.T) {
+	done := make(map[string]bool)
+	stuck := errors.New("stuck")
+	result, err := Saga{
+		Step("a", undoable("a", done, nil)),
+		Step("b", undoable("b", done, stuck)),
+		Step("c", failing(errors.New("boom"))),
+	}.Run(context.Background())
+
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "c" {
+		t.Fatalf("expected step c to fail, got %v", err)
+	}
+	var compensationErr *CompensationError
+	if !errors.As(err, &compensationErr) || compensationErr.Step != "b" || !errors.Is(err, stuck) {
+		t.Fatalf("expected the compensation of b to be reported, got %v", err)
+	}
+	// the compensations after the failed one still run
+	if len(done) != 1 || !done["b"] {
+		t.Fatalf("expected a to be undone, got %v", done)
+	}
+	if leftBehind := result.LeftBehind(); len(leftBehind) != 1 || leftBehind[0] != "b" {
+		t.Fatalf("unexpected left behind steps %v", leftBehind)
+	}
+
+	// the error of a nested saga tells what it left behind as well
+	_, err = Saga{
+		Step("outer", func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+			return ctx, nil, err
+		}),
+	}.Run(context.Background())
+	if leftBehind := LeftBehind(err); len(leftBehind) != 1 || leftBehind[0] != "b" {
+		t.Fatalf("unexpected left behind steps %v", leftBehind)
+	}
+}
+
+func TestStepRetries(t *testing.T) {
+	transient := errors.New("transient")
+	attempts := 0
+	flaky := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		attempts++
+		if attempts < 3 {
+			return ctx, nil, transient
+		}
+		return ctx, NoCompensation, nil
+	}
+	result, err := Saga{
+		Step("flaky", flaky, WithRetry(RetryPolicy{Attempts: 3, Backoff: time.Millisecond})),
+	}.Run(context.Background())
+	if err != nil {
+		t.Fatalf("expected the step to succeed on its third attempt, got %v", err)
+	}
+	if result.Steps[0].Attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", result.Steps[0].Attempts)
+	}
+
+	// errors that aren't retryable fail the step right away
+	attempts = 0
+	result, err = Saga{
+		Step("flaky", flaky, WithRetry(RetryPolicy{
+			Attempts:  3,
+			Backoff:   time.Millisecond,
+			Retryable: func(err error) bool { return !errors.Is(err, transient) },
+		})),
+	}.Run(context.Background())
+	if !errors.Is(err, transient) || result.Steps[0].Attempts != 1 {
+		t.Fatalf("expected a single attempt, got %d (err %v)", result.Steps[0].Attempts, err)
+	}
+}
+
+func TestStepTimeout(t *testing.T) {
+	type key struct{}
+	slow := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		select {
+		case <-ctx.Done():
+			return ctx, nil, ctx.Err()
+		case <-time.After(time.Second):
+			return ctx, NoCompensation, nil
+		}
+	}
+	setValue := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		return context.WithValue(ctx, key{}, "value"), NoCompensation, nil
+	}
+	var seen interface{}
+	var seenErr error
+	check := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		seen, seenErr = ctx.Value(key{}), ctx.Err()
+		return ctx, NoCompensation, nil
+	}
+
+	_, err := Saga{Step("slow", slow, WithTimeout(10*time.Millisecond))}.Run(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the step to time out, got %v", err)
+	}
+
+	// the next steps get the values of a step with a timeout, not its
+	// deadline
+	_, err = Saga{
+		Step("set", setValue, WithTimeout(time.Millisecond)),
+		Step("wait", func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+			time.Sleep(5 * time.Millisecond)
+			return ctx, NoCompensation, nil
+		}),
+		Step("check", check),
+	}.Run(context.Background())
+	if err != nil || seen != "value" || seenErr != nil {
+		t.Fatalf("unexpected context in the next steps: %v, %v (err %v)", seen, seenErr, err)
+	}
+
+	// compensations run even when the caller gave up
+	ctx, cancel := context.WithCancel(context.Background())
+	var compensationErr error
+	_, err = Saga{
+		Step("a", func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+			return ctx, func(ctx context.Context) error {
+				compensationErr = ctx.Err()
+				return nil
+			}, nil
+		}),
+		Step("cancel", func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+			cancel()
+			return ctx, nil, ctx.Err()
+		}),
+	}.Run(ctx)
+	if !errors.Is(err, context.Canceled) || compensationErr != nil {
+		t.Fatalf("expected compensations to run with a live context, got %v (err %v)", compensationErr, err)
+	}
+}
@@ -1,23 +1,33 @@
 package k8s
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
     "github.com/hamza-boudouche/autodev/pkg/helpers/logging"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/remotecommand"
 	"k8s.io/client-go/util/homedir"
 )
 
-func GetK8sClient() (*kubernetes.Clientset, error) {
-    logging.Logger.Info("constructing the k8s clientset")
+// GetRestConfig returns the in-cluster config when running inside
+// Kubernetes, and the config from the kubeconfig file otherwise
+// (~/.kube/config when kubeconfig is empty).
+func GetRestConfig(kubeconfig string) (*rest.Config, error) {
 	_, inKubernetes := os.LookupEnv("KUBERNETES_SERVICE_HOST")
     logging.Logger.Info("checking for env var", "KUBERNETES_SERVICE_HOST", inKubernetes)
 	if inKubernetes {
@@ -27,33 +37,54 @@ func GetK8sClient() (*kubernetes.Clientset, error) {
 		    logging.Logger.Error("failed to get in-cluster config")
 			return nil, err
 		}
-		// creates the clientset
-		clientset, err := kubernetes.NewForConfig(config)
-		if err != nil {
-		    logging.Logger.Error("failed to construct clientset from config")
-			return nil, err
-		}
-        logging.Logger.Info("k8s clientset created successfully")
-		return clientset, nil
-	} else {
-		logging.Logger.Info("not running inside a Kubernetes cluster.")
-        pathToConfig := filepath.Join(homedir.HomeDir(), ".kube", "config")
-		config, err := clientcmd.BuildConfigFromFlags("", pathToConfig)
-		if err != nil {
-		    logging.Logger.Error("failed to get config from file", "filePath", pathToConfig)
-			return nil, err
-		}
-		clientset, err := kubernetes.NewForConfig(config)
-		if err != nil {
-		    logging.Logger.Error("failed to construct clientset from config")
-			return nil, err
-		}
-        logging.Logger.Info("k8s clientset created successfully")
-		return clientset, nil
+		return config, nil
+	}
+	logging.Logger.Info("not running inside a Kubernetes cluster.")
+	pathToConfig := kubeconfig
+	if pathToConfig == "" {
+		pathToConfig = filepath.Join(homedir.HomeDir(), ".kube", "config")
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", pathToConfig)
+	if err != nil {
+	    logging.Logger.Error("failed to get config from file", "filePath", pathToConfig)
+		return nil, err
+	}
+	return config, nil
+}
+
+// GetK8sClient builds a clientset from the config returned by GetRestConfig.
+func GetK8sClient(kubeconfig string) (*kubernetes.Clientset, error) {
+    logging.Logger.Info("constructing the k8s clientset")
+	config, err := GetRestConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+	    logging.Logger.Error("failed to construct clientset from config")
+		return nil, err
 	}
+    logging.Logger.Info("k8s clientset created successfully")
+	return clientset, nil
 }
 
-func CreatePV(ctx context.Context, cs *kubernetes.Clientset, name string, capacity string) error {
+// GetDynamicClient builds a dynamic client, used for the custom resources
+// autodev manages (e.g. VolumeSnapshots), from the config returned by
+// GetRestConfig.
+func GetDynamicClient(kubeconfig string) (dynamic.Interface, error) {
+	config, err := GetRestConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+	    logging.Logger.Error("failed to construct dynamic client from config")
+		return nil, err
+	}
+	return client, nil
+}
+
+func CreatePV(ctx context.Context, cs kubernetes.Interface, name string, capacity string) error {
 	pvPath := "/root"
 	pv := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
@@ -77,26 +108,133 @@ func CreatePV(ctx context.Context, cs *kubernetes.Clientset, name string, capaci
 	return err
 }
 
-func CreatePVC(ctx context.Context, cs *kubernetes.Clientset, name string, capacity string) error {
-    logging.Logger.Info("creating PVC", "PVCName", name, "capacity", capacity)
+// CreatePVC creates a claim of the given capacity, with the given labels. An
+// empty storageClass uses the cluster default and an empty accessMode means
+// ReadWriteOnce.
+func CreatePVC(ctx context.Context, cs kubernetes.Interface, namespace string, name string, capacity string, storageClass string, accessMode v1.PersistentVolumeAccessMode, labels map[string]string) error {
+	logging.Logger.Info("creating PVC", "PVCName", name, "capacity", capacity, "storageClass", storageClass)
+	pvc, err := newPVC(namespace, name, capacity, storageClass, accessMode, labels)
+	if err != nil {
+		logging.Logger.Error("invalid PVC capacity", "PVCName", name, "capacity", capacity)
+		return err
+	}
+	_, err = cs.CoreV1().PersistentVolumeClaims(namespace).Create(ctx, pvc, metav1.CreateOptions{})
+	if err != nil {
+		logging.Logger.Error("failed to create PVC", "PVCName", name, "capacity", capacity)
+	}
+	return err
+}
+
+// CreatePVCFromSnapshot is like CreatePVC, but the claim is populated from
+// the VolumeSnapshot named snapshotName, which must live in the same
+// namespace.
+func CreatePVCFromSnapshot(ctx context.Context, cs kubernetes.Interface, namespace string, name string, capacity string, storageClass string, accessMode v1.PersistentVolumeAccessMode, snapshotName string, labels map[string]string) error {
+	logging.Logger.Info("creating PVC from snapshot", "PVCName", name, "capacity", capacity, "snapshot", snapshotName)
+	pvc, err := newPVC(namespace, name, capacity, storageClass, accessMode, labels)
+	if err != nil {
+		logging.Logger.Error("invalid PVC capacity", "PVCName", name, "capacity", capacity)
+		return err
+	}
+	apiGroup := VolumeSnapshotGVR.Group
+	pvc.Spec.DataSource = &v1.TypedLocalObjectReference{
+		APIGroup: &apiGroup,
+		Kind:     "VolumeSnapshot",
+		Name:     snapshotName,
+	}
+	_, err = cs.CoreV1().PersistentVolumeClaims(namespace).Create(ctx, pvc, metav1.CreateOptions{})
+	if err != nil {
+		logging.Logger.Error("failed to create PVC from snapshot", "PVCName", name, "snapshot", snapshotName)
+	}
+	return err
+}
+
+func newPVC(namespace string, name string, capacity string, storageClass string, accessMode v1.PersistentVolumeAccessMode, labels map[string]string) (*v1.PersistentVolumeClaim, error) {
+	if accessMode == "" {
+		accessMode = v1.ReadWriteOnce
+	}
+	quantity, err := resource.ParseQuantity(capacity)
+	if err != nil {
+		return nil, err
+	}
 	pvc := &v1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
-			Namespace: "default",
+			Namespace: namespace,
+			Labels:    labels,
 		},
 		Spec: v1.PersistentVolumeClaimSpec{
-			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			AccessModes: []v1.PersistentVolumeAccessMode{accessMode},
 			Resources: v1.ResourceRequirements{
 				Requests: v1.ResourceList{
-					v1.ResourceStorage: resource.MustParse(capacity),
+					v1.ResourceStorage: quantity,
 				},
 			},
 		},
 	}
-	_, err := cs.CoreV1().PersistentVolumeClaims("default").Create(ctx, pvc, metav1.CreateOptions{})
-    if err != nil {
-        logging.Logger.Error("failed to create PVC", "PVCName", name, "capacity", capacity)
-    }
+	if storageClass != "" {
+		pvc.Spec.StorageClassName = &storageClass
+	}
+	return pvc, nil
+}
+
+
+// ManagedByLabel marks the Kubernetes resources created by autodev.
+const ManagedByLabel = "app.kubernetes.io/managed-by"
+
+// SessionLabel is set to the session ID on the deployment, pods, service and
+// volumes of a session.
+const SessionLabel = "autodev.io/session"
+
+func CreateNamespace(ctx context.Context, cs kubernetes.Interface, name string) error {
+	logging.Logger.Info("creating namespace", "namespace", name)
+	namespace := &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				ManagedByLabel: "autodev",
+			},
+		},
+	}
+	_, err := cs.CoreV1().Namespaces().Create(ctx, namespace, metav1.CreateOptions{})
+	if err != nil {
+		logging.Logger.Error("failed to create namespace", "namespace", name)
+	}
 	return err
 }
 
+// DeleteNamespace deletes a namespace created by CreateNamespace. Deleting a
+// namespace that no longer exists is not an error.
+func DeleteNamespace(ctx context.Context, cs kubernetes.Interface, name string) error {
+	logging.Logger.Info("deleting namespace", "namespace", name)
+	err := cs.CoreV1().Namespaces().Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		logging.Logger.Error("failed to delete namespace", "namespace", name)
+		return err
+	}
+	return nil
+}
+
+// Exec runs command in a container of a pod, and returns what it wrote to
+// its standard output.
+func Exec(ctx context.Context, config *rest.Config, cs kubernetes.Interface, namespace string, pod string, container string, command []string) (string, error) {
+	req := cs.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(pod).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(config, http.MethodPost, req.URL())
+	if err != nil {
+		return "", err
+	}
+	var stdout, stderr bytes.Buffer
+	if err := executor.StreamWithContext(ctx, remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr}); err != nil {
+		return "", fmt.Errorf("failed to run %s in %s/%s: %w: %s", command[0], pod, container, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
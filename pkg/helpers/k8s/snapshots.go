@@ -0,0 +1,79 @@
+package k8s
+
+import (
+	"context"
+
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// VolumeSnapshotGVR identifies the VolumeSnapshots of the CSI external
+// snapshotter, which are not part of the typed clientset.
+var VolumeSnapshotGVR = schema.GroupVersionResource{
+	Group:    "snapshot.storage.k8s.io",
+	Version:  "v1",
+	Resource: "volumesnapshots",
+}
+
+// VolumeSnapshotStatus is the part of the status of a VolumeSnapshot autodev
+// cares about.
+type VolumeSnapshotStatus struct {
+	ReadyToUse  bool
+	RestoreSize string
+	Error       string
+}
+
+// CreateVolumeSnapshot snapshots the claim pvcName. An empty snapshotClass
+// uses the default VolumeSnapshotClass of the cluster.
+func CreateVolumeSnapshot(ctx context.Context, dc dynamic.Interface, namespace string, name string, pvcName string, snapshotClass string, labels map[string]string) error {
+	logging.Logger.Info("creating volume snapshot", "snapshot", name, "PVCName", pvcName)
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": pvcName,
+		},
+	}
+	if snapshotClass != "" {
+		spec["volumeSnapshotClassName"] = snapshotClass
+	}
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetAPIVersion(VolumeSnapshotGVR.GroupVersion().String())
+	snapshot.SetKind("VolumeSnapshot")
+	snapshot.SetName(name)
+	snapshot.SetNamespace(namespace)
+	snapshot.SetLabels(labels)
+	snapshot.Object["spec"] = spec
+
+	_, err := dc.Resource(VolumeSnapshotGVR).Namespace(namespace).Create(ctx, snapshot, metav1.CreateOptions{})
+	if err != nil {
+		logging.Logger.Error("failed to create volume snapshot", "snapshot", name, "PVCName", pvcName)
+	}
+	return err
+}
+
+func GetVolumeSnapshotStatus(ctx context.Context, dc dynamic.Interface, namespace string, name string) (*VolumeSnapshotStatus, error) {
+	snapshot, err := dc.Resource(VolumeSnapshotGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	status := &VolumeSnapshotStatus{}
+	status.ReadyToUse, _, _ = unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+	status.RestoreSize, _, _ = unstructured.NestedString(snapshot.Object, "status", "restoreSize")
+	status.Error, _, _ = unstructured.NestedString(snapshot.Object, "status", "error", "message")
+	return status, nil
+}
+
+// DeleteVolumeSnapshot deletes a snapshot. Deleting a snapshot that no longer
+// exists is not an error.
+func DeleteVolumeSnapshot(ctx context.Context, dc dynamic.Interface, namespace string, name string) error {
+	logging.Logger.Info("deleting volume snapshot", "snapshot", name)
+	err := dc.Resource(VolumeSnapshotGVR).Namespace(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		logging.Logger.Error("failed to delete volume snapshot", "snapshot", name)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package locking
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// lockKeyPrefix is the prefix of the keys of the locks in etcd. The locks
+// taken before the keys of autodev were prefixed with cache.KeyPrefix were
+// kept under legacyLockKeyPrefix, which is locked too while replicas of
+// those versions may still run (see config.LocksConfig.LegacyKeys).
+const (
+	lockKeyPrefix       = cache.KeyPrefix + "locks/"
+	legacyLockKeyPrefix = "lock-"
+)
+
+// ErrLocked is returned when the lock is held by someone else, either right
+// away with TryLock, or after waiting for it for as long as allowed.
+var ErrLocked = errors.New("lock is held by someone else")
+
+const (
+	defaultBackoff    = 100 * time.Millisecond
+	defaultMaxBackoff = 2 * time.Second
+	// releaseTimeout bounds the revocation of a lease, which happens even if
+	// the context of the caller is done.
+	releaseTimeout = 5 * time.Second
+)
+
+// Locker hands out locks backed by etcd leases: a lock is released when its
+// holder releases it, or when its lease expires because its holder stopped
+// renewing it.
+type Locker struct {
+	client *clientv3.Client
+	cfg    config.LocksConfig
+}
+
+func NewLocker(client *clientv3.Client, cfg config.LocksConfig) *Locker {
+	return &Locker{client: client, cfg: cfg}
+}
+
+// Options tells how to wait for a lock held by someone else.
+type Options struct {
+	// TryLock fails with ErrLocked right away instead of waiting.
+	TryLock bool
+	// Timeout bounds the wait, on top of the deadline of the context. It
+	// defaults to the configured wait timeout.
+	Timeout time.Duration
+	// Backoff is the wait between the first attempts, doubled after each
+	// attempt up to MaxBackoff. Each wait is jittered, so that the callers
+	// waiting for the same lock don't retry all at once.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Lock is a lock held by this process.
+type Lock struct {
+	lost     chan struct{}
+	released chan struct{}
+	once     sync.Once
+	release  func() error
+	err      error
+}
+
+// Lost is closed when the lock is lost before being released, because its
+// lease couldn't be renewed. Someone else may then hold it.
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release releases the lock. It can be called on a nil Lock, as returned
+// when AcquireLock fails, and more than once, so that it can be deferred
+// before checking the error of AcquireLock.
+func (l *Lock) Release() error {
+	if l == nil {
+		return nil
+	}
+	l.once.Do(func() {
+		close(l.released)
+		l.err = l.release()
+	})
+	return l.err
+}
+
+// AcquireLock acquires the lock name, waiting for it according to opts. The
+// lock is renewed until it is released, and Lock.Lost tells when renewing it
+// failed.
+func (lk *Locker) AcquireLock(ctx context.Context, name string, opts Options) (*Lock, error) {
+	keys := []string{lockKeyPrefix + name}
+	if lk.cfg.LegacyKeys {
+		keys = append(keys, legacyLockKeyPrefix+name)
+	}
+	if !opts.TryLock {
+		timeout := opts.Timeout
+		if timeout <= 0 {
+			timeout = lk.cfg.WaitTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	lease, err := lk.client.Grant(ctx, int64(lk.cfg.TTL/time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("failed to grant the lease of lock %s: %w", name, err)
+	}
+	// the lease is renewed while waiting too, or a wait longer than its TTL
+	// would end with the lease gone
+	keepAliveCtx, stop := context.WithCancel(context.Background())
+	revoke := func() error {
+		stop()
+		ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+		defer cancel()
+		_, err := lk.client.Revoke(ctx, lease.ID)
+		return err
+	}
+	keepAlive, err := lk.client.KeepAlive(keepAliveCtx, lease.ID)
+	if err != nil {
+		revoke()
+		return nil, fmt.Errorf("failed to renew the lease of lock %s: %w", name, err)
+	}
+	lock := &Lock{
+		lost:     make(chan struct{}),
+		released: make(chan struct{}),
+	}
+	lock.release = func() error {
+		if err := revoke(); err != nil {
+			logging.Logger.Error("failed to release lock", "lock", name, "error", err)
+			return err
+		}
+		return nil
+	}
+	go func() {
+		for range keepAlive {
+		}
+		// the channel is closed once the lease can't be renewed anymore
+		select {
+		case <-lock.released:
+		default:
+			logging.Logger.Warn("lost lock", "lock", name)
+			close(lock.lost)
+		}
+	}()
+	// giveUp revokes the lease of a lock that wasn't acquired, without
+	// reporting it lost
+	giveUp := func() {
+		close(lock.released)
+		revoke()
+	}
+
+	// every key is taken at once, or none
+	cmps := make([]clientv3.Cmp, len(keys))
+	puts := make([]clientv3.Op, len(keys))
+	for i, key := range keys {
+		cmps[i] = clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+		puts[i] = clientv3.OpPut(key, "", clientv3.WithLease(lease.ID))
+	}
+
+	backoff := opts.Backoff
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+	maxBackoff := opts.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	held := false
+	for attempt := 1; ; attempt++ {
+		resp, err := lk.client.Txn(ctx).If(cmps...).Then(puts...).Commit()
+		if err == nil && resp.Succeeded {
+			return lock, nil
+		}
+		if err == nil || (held && ctx.Err() != nil) {
+			// the wait may run out while asking for the lock again, which
+			// is still a lock held for too long
+			held = true
+			err = fmt.Errorf("%w: %s", ErrLocked, name)
+		}
+		if opts.TryLock {
+			giveUp()
+			return nil, err
+		}
+		logging.Logger.Debug("waiting for lock", "lock", name, "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			giveUp()
+			logging.Logger.Warn("gave up waiting for lock", "lock", name, "attempts", attempt, "error", err)
+			return nil, err
+		case <-lock.lost:
+			revoke()
+			return nil, fmt.Errorf("failed to renew the lease of lock %s while waiting for it: %w", name, err)
+		case <-time.After(jitter(backoff)):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// jitter returns a random duration between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
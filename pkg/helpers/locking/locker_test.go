@@ -0,0 +1,249 @@
+package locking
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/etcdtest"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestReleaseFailedLock(t *testing.T) {
+	var lock *Lock
+	if err := lock.Release(); err != nil {
+		t.Fatalf("expected releasing a lock that wasn't acquired to do nothing, got %v", err)
+	}
+}
+
+func TestReleaseTwice(t *testing.T) {
+	calls := 0
+	lock := &Lock{
+		lost:     make(chan struct{}),
+		released: make(chan struct{}),
+		release: func() error {
+			calls++
+			return nil
+		},
+	}
+	lock.Release()
+	lock.Release()
+	if calls != 1 {
+		t.Fatalf("expected the lock to be released once, got %d", calls)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second); d < time.Second/2 || d > time.Second {
+			t.Fatalf("jittered backoff %s out of bounds", d)
+		}
+	}
+}
+
+func TestAcquireLockHonorsDeadlines(t *testing.T) {
+	cfg := config.Default()
+	// nothing listens on port 1
+	cfg.Etcd.Endpoints = []string{"127.0.0.1:1"}
+	cc, err := cache.CreateEtcdClient(cfg.Etcd)
+	if err != nil {
+		t.Fatalf("CreateEtcdClient failed: %v", err)
+	}
+	defer cc.Close()
+	locker := NewLocker(cc, cfg.Locks)
+
+	start := time.Now()
+	lock, err := locker.AcquireLock(context.Background(), "test", Options{Timeout: 200 * time.Millisecond})
+	if err == nil {
+		t.Fatal("expected the lock not to be acquired")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected to give up after the timeout, waited %s", elapsed)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatalf("expected the release of a failed lock to be safe, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := locker.AcquireLock(ctx, "test", Options{TryLock: true}); err == nil {
+		t.Fatal("expected the lock not to be acquired")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected to give up with the context, waited %s", elapsed)
+	}
+}
+
+func testLocksConfig() config.LocksConfig {
+	cfg := config.Default().Locks
+	cfg.WaitTimeout = 5 * time.Second
+	return cfg
+}
+
+func TestAcquireLockContention(t *testing.T) {
+	ctx := context.Background()
+	client := etcdtest.Start(t)
+	// two lockers stand for two replicas of the server
+	first, second := NewLocker(client, testLocksConfig()), NewLocker(client, testLocksConfig())
+
+	lock, err := first.AcquireLock(ctx, "test", Options{})
+	if err != nil {
+		t.Fatalf("AcquireLock failed: %v", err)
+	}
+	if _, err := second.AcquireLock(ctx, "test", Options{TryLock: true}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	// other locks are not held
+	other, err := second.AcquireLock(ctx, "other", Options{TryLock: true})
+	if err != nil {
+		t.Fatalf("expected another lock to be free, got %v", err)
+	}
+	other.Release()
+
+	acquired := make(chan error, 1)
+	go func() {
+		lock, err := second.AcquireLock(ctx, "test", Options{Backoff: 10 * time.Millisecond})
+		lock.Release()
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("expected to wait for the lock, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("expected the lock to be acquired once released, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lock wasn't acquired once released")
+	}
+}
+
+func TestAcquireLockTimeout(t *testing.T) {
+	ctx := context.Background()
+	locker := NewLocker(etcdtest.Start(t), testLocksConfig())
+	lock, err := locker.AcquireLock(ctx, "test", Options{})
+	if err != nil {
+		t.Fatalf("AcquireLock failed: %v", err)
+	}
+	defer lock.Release()
+
+	start := time.Now()
+	_, err = locker.AcquireLock(ctx, "test", Options{Timeout: 300 * time.Millisecond, Backoff: 10 * time.Millisecond})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("expected to wait for the timeout, waited %s", elapsed)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	if _, err := locker.AcquireLock(waitCtx, "test", Options{}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked once the context is done, got %v", err)
+	}
+}
+
+func TestAcquireLockWaitsLongerThanTTL(t *testing.T) {
+	ctx := context.Background()
+	client := etcdtest.Start(t)
+	cfg := testLocksConfig()
+	cfg.TTL = 2 * time.Second
+	cfg.WaitTimeout = 10 * time.Second
+	first, second := NewLocker(client, cfg), NewLocker(client, cfg)
+
+	lock, err := first.AcquireLock(ctx, "test", Options{})
+	if err != nil {
+		t.Fatalf("AcquireLock failed: %v", err)
+	}
+	go func() {
+		time.Sleep(2 * cfg.TTL)
+		lock.Release()
+	}()
+	waiting, err := second.AcquireLock(ctx, "test", Options{MaxBackoff: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("expected the lock to be acquired after a wait longer than its TTL, got %v", err)
+	}
+	defer waiting.Release()
+	if _, err := first.AcquireLock(ctx, "test", Options{TryLock: true}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected the lock to be held, got %v", err)
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	ctx := context.Background()
+	client := etcdtest.Start(t)
+	cfg := testLocksConfig()
+	// the lease is renewed every third of its TTL
+	cfg.TTL = 3 * time.Second
+	lock, err := NewLocker(client, cfg).AcquireLock(ctx, "test", Options{})
+	if err != nil {
+		t.Fatalf("AcquireLock failed: %v", err)
+	}
+	defer lock.Release()
+
+	// the lease expiring is the same as it being revoked by someone else
+	resp, err := client.Get(ctx, lockKeyPrefix+"test")
+	if err != nil || len(resp.Kvs) != 1 {
+		t.Fatalf("expected the lock key to exist, got %v (error: %v)", resp, err)
+	}
+	if _, err := client.Revoke(ctx, clientv3.LeaseID(resp.Kvs[0].Lease)); err != nil {
+		t.Fatalf("failed to revoke the lease: %v", err)
+	}
+	select {
+	case <-lock.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the lock to be lost")
+	}
+}
+
+func TestAcquireLockLegacyKeys(t *testing.T) {
+	ctx := context.Background()
+	client := etcdtest.Start(t)
+	locker := NewLocker(client, testLocksConfig())
+
+	// the lock held by a replica of an older version
+	if _, err := client.Put(ctx, legacyLockKeyPrefix+"test", ""); err != nil {
+		t.Fatalf("failed to put the legacy lock: %v", err)
+	}
+	if _, err := locker.AcquireLock(ctx, "test", Options{TryLock: true}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected the legacy lock to be honored, got %v", err)
+	}
+	resp, err := client.Get(ctx, lockKeyPrefix+"test")
+	if err != nil || len(resp.Kvs) != 0 {
+		t.Fatalf("expected no key to be taken when one is held, got %v (error: %v)", resp.Kvs, err)
+	}
+
+	if _, err := client.Delete(ctx, legacyLockKeyPrefix+"test"); err != nil {
+		t.Fatalf("failed to delete the legacy lock: %v", err)
+	}
+	lock, err := locker.AcquireLock(ctx, "test", Options{TryLock: true})
+	if err != nil {
+		t.Fatalf("AcquireLock failed: %v", err)
+	}
+	resp, err = client.Get(ctx, legacyLockKeyPrefix+"test")
+	if err != nil || len(resp.Kvs) != 1 {
+		t.Fatalf("expected the legacy key to be taken too, got %v (error: %v)", resp.Kvs, err)
+	}
+	lock.Release()
+
+	cfg := testLocksConfig()
+	cfg.LegacyKeys = false
+	if _, err := client.Put(ctx, legacyLockKeyPrefix+"test", ""); err != nil {
+		t.Fatalf("failed to put the legacy lock: %v", err)
+	}
+	lock, err = NewLocker(client, cfg).AcquireLock(ctx, "test", Options{TryLock: true})
+	if err != nil {
+		t.Fatalf("expected the legacy lock to be ignored, got %v", err)
+	}
+	lock.Release()
+}
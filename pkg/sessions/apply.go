@@ -0,0 +1,450 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/k8s"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ErrComponentExists is returned when adding a component with the ID of an
+// existing component of the session.
+var ErrComponentExists = errors.New("component already exists")
+
+// SessionDiff describes what ApplySession changed to converge a session,
+// listing component IDs.
+type SessionDiff struct {
+	// Created is true when the session didn't exist and was initialized.
+	Created bool     `json:"created"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// Changed lists the components whose container was updated.
+	Changed []string `json:"changed,omitempty"`
+}
+
+// Empty reports whether the session was already in the desired state.
+func (d *SessionDiff) Empty() bool {
+	return !d.Created && len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// ApplySession converges the session to the given components: it
+// initializes the session if it doesn't exist (with workspace as the
+// workspace storage, with labels and expiring after ttl), creates its components if it has none, and otherwise
+// adds, removes and updates components and rolls the Deployment. The volumes
+// of removed components are kept if keepData is set. Applying the same
+// components twice changes nothing the second time.
+func ApplySession(ctx context.Context, cs kubernetes.Interface, store SessionStore, journal *consistency.Journal, cfg config.SessionsConfig, sessionID string, components []cmp.Component, workspace cmp.Storage, labels map[string]string, ttl time.Duration, keepData bool) (*SessionDiff, error) {
+	logging.Logger.Info("applying session", "sessionID", sessionID)
+	if len(components) == 0 {
+		return nil, fmt.Errorf("%w: a session needs at least one component", cmp.ErrInvalidComponent)
+	}
+	diff := &SessionDiff{}
+	session, _, err := store.Get(ctx, sessionID)
+	if errors.Is(err, ErrSessionNotFound) {
+		if err := InitSession(ctx, store, journal, cs, cfg, sessionID, workspace, labels, ttl); err != nil {
+			return nil, err
+		}
+		diff.Created = true
+		session = &SessionInfo{}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if session.SessionState == "" {
+		// nothing was deployed yet
+		if err := CreateDeploy(ctx, cs, store, journal, cfg, sessionID, components); err != nil {
+			return nil, err
+		}
+		for _, component := range components {
+			diff.Added = append(diff.Added, component.ComponentID)
+		}
+		return diff, nil
+	}
+	return updateComponents(ctx, cs, store, journal, cfg, sessionID, components, keepData)
+}
+
+// AddComponent adds component to the session, creating its volume and
+// exposing it if needed.
+func AddComponent(ctx context.Context, cs kubernetes.Interface, store SessionStore, journal *consistency.Journal, cfg config.SessionsConfig, sessionID string, component cmp.Component) (*SessionDiff, error) {
+	logging.Logger.Info("adding component", "sessionID", sessionID, "componentID", component.ComponentID)
+	session, _, err := store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	for _, existing := range session.Components {
+		if existing.ComponentID == component.ComponentID {
+			return nil, fmt.Errorf("%w: %s", ErrComponentExists, component.ComponentID)
+		}
+	}
+	if session.SessionState == "" {
+		// nothing was deployed yet
+		if err := CreateDeploy(ctx, cs, store, journal, cfg, sessionID, []cmp.Component{component}); err != nil {
+			return nil, err
+		}
+		return &SessionDiff{Added: []string{component.ComponentID}}, nil
+	}
+	desired := make([]cmp.Component, len(session.Components), len(session.Components)+1)
+	copy(desired, session.Components)
+	desired = append(desired, component)
+	return updateComponents(ctx, cs, store, journal, cfg, sessionID, desired, false)
+}
+
+// RemoveComponent removes a component from the session. Its volume is
+// deleted unless keepData is set, in which case it is reused if a component
+// with the same ID is added back.
+func RemoveComponent(ctx context.Context, cs kubernetes.Interface, store SessionStore, journal *consistency.Journal, cfg config.SessionsConfig, sessionID string, componentID string, keepData bool) (*SessionDiff, error) {
+	logging.Logger.Info("removing component", "sessionID", sessionID, "componentID", componentID, "keepData", keepData)
+	session, _, err := store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	desired := make([]cmp.Component, 0, len(session.Components))
+	for _, component := range session.Components {
+		if component.ComponentID != componentID {
+			desired = append(desired, component)
+		}
+	}
+	if len(desired) == len(session.Components) {
+		return nil, fmt.Errorf("%w: %s", ErrComponentNotFound, componentID)
+	}
+	if len(desired) == 0 {
+		return nil, fmt.Errorf("%w: a session needs at least one component, delete the session instead", cmp.ErrInvalidComponent)
+	}
+	return updateComponents(ctx, cs, store, journal, cfg, sessionID, desired, keepData)
+}
+
+// updateComponents replaces the components of a deployed session with
+// desired. The volumes of new components are created, the volumes of
+// removed components are deleted unless keepData is set, and the volumes of
+// the components that are kept are left as they are. Everything but the
+// deletion of volumes is rolled back if the update fails.
+func updateComponents(ctx context.Context, cs kubernetes.Interface, store SessionStore, journal *consistency.Journal, cfg config.SessionsConfig, sessionID string, desired []cmp.Component, keepData bool) (*SessionDiff, error) {
+	session, revision, err := store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	namespace := session.namespace()
+	current := make(map[string]cmp.Component, len(session.Components))
+	for _, component := range session.Components {
+		current[component.ComponentID] = component
+	}
+
+	diff := &SessionDiff{}
+	components := make([]cmp.Component, len(desired))
+	copy(components, desired)
+	kept := make(map[string]bool, len(components))
+	for i, component := range components {
+		components[i].Resources, err = cmp.ResolveResources(component.Resources, cfg.DefaultResources, cfg.MaxResources)
+		if err != nil {
+			logging.Logger.Error("invalid component resources", "sessionID", sessionID, "componentID", component.ComponentID)
+			return nil, err
+		}
+		old, ok := current[component.ComponentID]
+		if !ok {
+			// new components get volumes of their own
+			components[i].LegacyVolume = false
+			diff.Added = append(diff.Added, component.ComponentID)
+			continue
+		}
+		kept[component.ComponentID] = true
+		if err := checkKeptComponent(old, component); err != nil {
+			return nil, err
+		}
+		// what was generated or resolved when the component was created
+		// is kept, unless it is given again
+		components[i].Storage = old.Storage
+		components[i].LegacyVolume = old.LegacyVolume
+		if component.ComponentMetadata.Password == "" {
+			components[i].ComponentMetadata.Password = old.ComponentMetadata.Password
+		}
+		if componentChanged(old, components[i]) {
+			diff.Changed = append(diff.Changed, component.ComponentID)
+		}
+	}
+	for _, component := range session.Components {
+		if !kept[component.ComponentID] {
+			diff.Removed = append(diff.Removed, component.ComponentID)
+		}
+	}
+	if diff.Empty() {
+		logging.Logger.Info("session is up to date", "sessionID", sessionID)
+		return diff, nil
+	}
+
+	err = cmp.GenerateCredentials(components)
+	if err != nil {
+		logging.Logger.Error("failed to generate component credentials", "sessionID", sessionID)
+		return nil, err
+	}
+	containers, volumes, err := cmp.ParseComponents(components, sessionID)
+	if err != nil {
+		logging.Logger.Error("failed to parse the desired components", "sessionID", sessionID)
+		return nil, err
+	}
+	_, currentVolumes, err := cmp.ParseComponents(session.Components, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the storage of every new volume is checked before creating any of them
+	storages := make(map[string]cmp.Storage)
+	for i, component := range components {
+		volumeName := cmp.VolumeName(sessionID, component.ComponentID)
+		if kept[component.ComponentID] || !hasVolume(volumes, volumeName) {
+			continue
+		}
+		components[i].Storage, err = cmp.ResolveStorage(component.Storage, cfg.ComponentStorageDefaults(), cfg.StorageBounds)
+		if err != nil {
+			logging.Logger.Error("invalid component storage", "sessionID", sessionID, "componentID", component.ComponentID)
+			return nil, err
+		}
+		storages[volumeName] = components[i].Storage
+	}
+
+	transactions := make([]consistency.Transaction, 0, len(storages)+4)
+	for i, component := range components {
+		volumeName := cmp.VolumeName(sessionID, component.ComponentID)
+		storage, ok := storages[volumeName]
+		if !ok || hasVolume(currentVolumes, volumeName) {
+			continue
+		}
+		i := i
+		createVolume := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+			err := k8s.CreatePVC(ctx, cs, namespace, volumeName, storage.Size, storage.StorageClass, storage.AccessMode, sessionLabels(sessionID))
+			if apierrors.IsAlreadyExists(err) {
+				// the data of a component removed with keepData is reused
+				pvc, err := cs.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, volumeName, metav1.GetOptions{})
+				if err != nil {
+					return ctx, nil, err
+				}
+				components[i].Storage = claimStorage(pvc)
+				logging.Logger.Info("reusing the PVC of a removed component", "sessionID", sessionID, "PVCName", volumeName)
+				return ctx, consistency.NoCompensation, nil
+			}
+			if err != nil {
+				logging.Logger.Error("failed to create PVC", "sessionID", sessionID, "PVCName", volumeName)
+				return ctx, nil, err
+			}
+			logging.Logger.Info("created PVC successfully", "sessionID", sessionID, "PVCName", volumeName)
+			cancel := func(ctx context.Context) error {
+				logging.Logger.Info("rolling back the creation of the PVC", "sessionID", sessionID, "PVCName", volumeName)
+				return ignoreNotFound(cs.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, volumeName, metav1.DeleteOptions{}))
+			}
+			return ctx, cancel, nil
+		}
+		_, err := cs.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, volumeName, metav1.GetOptions{})
+		if err == nil {
+			// the claim of a component removed with keepData is reused, it
+			// must not be deleted when recovering from a crash
+			transactions = append(transactions, consistency.Step("create volume "+volumeName, createVolume))
+			continue
+		}
+		transactions = append(transactions, consistency.DurableStep("create volume "+volumeName, deleteVolumeAction, objectRef{Namespace: namespace, Name: volumeName}, createVolume))
+	}
+
+	rollDeployment := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		if session.SessionState == Stopped {
+			// stopped sessions have no deployment, it is created from the
+			// recorded components when they're toggled on
+			return ctx, consistency.NoCompensation, nil
+		}
+		deployment, err := cs.AppsV1().Deployments(namespace).Get(ctx, sessionID, metav1.GetOptions{})
+		if err != nil {
+			logging.Logger.Error("failed to get the deployment", "sessionID", sessionID)
+			return ctx, nil, err
+		}
+		previous := deployment.Spec.DeepCopy()
+		desiredDeployment := newDeployment(sessionID, containers, volumes)
+		deployment.Spec.Strategy = desiredDeployment.Spec.Strategy
+		deployment.Spec.Template = desiredDeployment.Spec.Template
+		_, err = cs.AppsV1().Deployments(namespace).Update(ctx, deployment, metav1.UpdateOptions{})
+		if err != nil {
+			logging.Logger.Error("failed to update the deployment", "sessionID", sessionID)
+			return ctx, nil, err
+		}
+		logging.Logger.Info("rolled the deployment", "sessionID", sessionID)
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the deployment", "sessionID", sessionID)
+			deployment, err := cs.AppsV1().Deployments(namespace).Get(ctx, sessionID, metav1.GetOptions{})
+			if err != nil {
+				logging.Logger.Error("failed to get the deployment to roll back", "sessionID", sessionID)
+				return err
+			}
+			deployment.Spec = *previous
+			_, err = cs.AppsV1().Deployments(namespace).Update(ctx, deployment, metav1.UpdateOptions{})
+			return err
+		}
+		return ctx, cancel, nil
+	}
+
+	updateService := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		if err := updateServicePorts(ctx, cs, session, sessionID, components); err != nil {
+			return ctx, nil, err
+		}
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the session service", "sessionID", sessionID)
+			return updateServicePorts(ctx, cs, session, sessionID, session.Components)
+		}
+		return ctx, cancel, nil
+	}
+
+	updateIngress := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		if err := updateIngressRules(ctx, cs, cfg, session, sessionID, components); err != nil {
+			return ctx, nil, err
+		}
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the ingress rules of the session", "sessionID", sessionID)
+			previous := make([]cmp.Component, len(session.Components))
+			copy(previous, session.Components)
+			return updateIngressRules(ctx, cs, cfg, session, sessionID, previous)
+		}
+		return ctx, cancel, nil
+	}
+
+	// the session is written last, so that it only records the new
+	// components once they're all in place
+	writeSession := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		updated := *session
+		updated.Components = components
+		if len(diff.Removed) > 0 && session.Resizes != nil {
+			updated.Resizes = make(map[string]VolumeStatus, len(session.Resizes))
+			for componentID, resize := range session.Resizes {
+				updated.Resizes[componentID] = resize
+			}
+			for _, componentID := range diff.Removed {
+				delete(updated.Resizes, componentID)
+			}
+		}
+		if err := swapSession(ctx, store, sessionID, revision, &updated); err != nil {
+			logging.Logger.Error("failed to write session status in etcd", "sessionID", sessionID)
+			return ctx, nil, err
+		}
+		return ctx, consistency.NoCompensation, nil
+	}
+
+	// restoring the session from its record also undoes the service and
+	// ingress updates that come after the deployment
+	transactions = append(transactions,
+		consistency.DurableStep("roll deployment", restoreSessionObjectsAction, sessionRef{SessionID: sessionID}, rollDeployment),
+		consistency.Step("update service", updateService),
+		consistency.Step("update ingress rules", updateIngress),
+		consistency.Step("record session", writeSession),
+	)
+	if _, err := consistency.Saga(transactions).RunJournaled(ctx, journal, updateComponentsSaga, sessionRef{SessionID: sessionID}); err != nil {
+		logging.Logger.Error("updating session components failed", "sessionID", sessionID)
+		return nil, err
+	}
+
+	// deleting data can't be rolled back, so it only happens once the
+	// session was updated
+	if keepData {
+		return diff, nil
+	}
+	for _, volume := range currentVolumes {
+		if hasVolume(volumes, volume.Name) || volume.Name == cmp.WorkspaceVolumeName(sessionID) {
+			continue
+		}
+		if shared, err := legacyClaimShared(ctx, store, session, sessionID, volume.Name); err != nil || shared {
+			logging.Logger.Info("keeping the legacy PVC of a removed component", "sessionID", sessionID, "PVCName", volume.Name, "error", err)
+			continue
+		}
+		err = cs.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, volume.Name, metav1.DeleteOptions{})
+		if err != nil {
+			logging.Logger.Warn("failed to delete the PVC of a removed component", "sessionID", sessionID, "PVCName", volume.Name)
+		}
+	}
+	return diff, nil
+}
+
+// checkKeptComponent rejects the changes that can't be made to a component
+// in place: its type, which its volume was created for, and its storage,
+// which is only grown through ExpandStorage.
+func checkKeptComponent(old cmp.Component, desired cmp.Component) error {
+	if desired.ComponentType != old.ComponentType {
+		return fmt.Errorf("%w: component %s can't change type from %s to %s, remove it first", cmp.ErrInvalidComponent, desired.ComponentID, old.ComponentType, desired.ComponentType)
+	}
+	if desired.ComponentType == cmp.Code {
+		// code components mount the workspace, their storage is ignored
+		return nil
+	}
+	storageChanged := desired.Storage.StorageClass != "" && desired.Storage.StorageClass != old.Storage.StorageClass ||
+		desired.Storage.AccessMode != "" && desired.Storage.AccessMode != old.Storage.AccessMode
+	if desired.Storage.Size != "" {
+		size, err := resource.ParseQuantity(desired.Storage.Size)
+		if err != nil {
+			return fmt.Errorf("%w: invalid storage size %q", cmp.ErrInvalidComponent, desired.Storage.Size)
+		}
+		oldSize, err := resource.ParseQuantity(old.Storage.Size)
+		storageChanged = storageChanged || err != nil || size.Cmp(oldSize) != 0
+	}
+	if storageChanged {
+		return fmt.Errorf("%w: the storage of component %s can't be changed in place, expand it through its storage endpoint", cmp.ErrInvalidComponent, desired.ComponentID)
+	}
+	return nil
+}
+
+// componentChanged reports whether the container of the component must be
+// updated.
+func componentChanged(old cmp.Component, desired cmp.Component) bool {
+	return old.ExposeComponent != desired.ExposeComponent ||
+		old.ComponentMetadata.Password != desired.ComponentMetadata.Password ||
+		!reflect.DeepEqual(old.Resources, desired.Resources)
+}
+
+// updateServicePorts updates the ports of the session Service to match
+// components.
+func updateServicePorts(ctx context.Context, cs kubernetes.Interface, session *SessionInfo, sessionID string, components []cmp.Component) error {
+	namespace := session.namespace()
+	service, err := cs.CoreV1().Services(namespace).Get(ctx, sessionID, metav1.GetOptions{})
+	if err != nil {
+		logging.Logger.Error("failed to get session service", "sessionID", sessionID)
+		return fmt.Errorf("failed to get service for session %s", sessionID)
+	}
+	service.Spec.Ports = servicePorts(components)
+	_, err = cs.CoreV1().Services(namespace).Update(ctx, service, metav1.UpdateOptions{})
+	if err != nil {
+		logging.Logger.Error("failed to update session service", "sessionID", sessionID)
+		return fmt.Errorf("failed to update service for session %s", sessionID)
+	}
+	logging.Logger.Info("updated session service", "sessionID", sessionID)
+	return nil
+}
+
+// updateIngressRules updates the ingress rules of the session to match
+// components, and sets the URL of the exposed components.
+func updateIngressRules(ctx context.Context, cs kubernetes.Interface, cfg config.SessionsConfig, session *SessionInfo, sessionID string, components []cmp.Component) error {
+	namespace := session.namespace()
+	for i, component := range components {
+		if !component.ExposeComponent {
+			components[i].ComponentMetadata.Url = ""
+		}
+	}
+	ingressName := cfg.IngressName
+	if session.DedicatedNamespace {
+		ingressName = sessionID
+	}
+	ingress, err := cs.NetworkingV1().Ingresses(namespace).Get(ctx, ingressName, metav1.GetOptions{})
+	if err != nil {
+		logging.Logger.Error("failed to get ingress", "ingressName", ingressName)
+		return fmt.Errorf("failed to get ingress %s", ingressName)
+	}
+	ingress.Spec.Rules = append(withoutSessionRules(ingress.Spec.Rules, sessionID), ingressRules(cfg, sessionID, components)...)
+	_, err = cs.NetworkingV1().Ingresses(namespace).Update(ctx, ingress, metav1.UpdateOptions{})
+	if err != nil {
+		logging.Logger.Error("failed to update ingress rules", "sessionID", sessionID)
+		return fmt.Errorf("failed to update the ingress %s for the session %s", ingressName, sessionID)
+	}
+	logging.Logger.Info("updated ingress rules successfully", "sessionID", sessionID)
+	return nil
+}
@@ -0,0 +1,209 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestApplySession(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+
+	diff, err := ApplySession(ctx, cs, store, nil, testConfig(), testSessionID, testComponents(), cmp.Storage{}, nil, 0, false)
+	if err != nil {
+		t.Fatalf("ApplySession failed: %v", err)
+	}
+	if !diff.Created || len(diff.Added) != 3 {
+		t.Fatalf("unexpected diff %+v", diff)
+	}
+	if _, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{}); err != nil {
+		t.Fatalf("deployment was not created: %v", err)
+	}
+	diff, err = ApplySession(ctx, cs, store, nil, testConfig(), testSessionID, testComponents(), cmp.Storage{}, nil, 0, false)
+	if err != nil || !diff.Empty() {
+		t.Fatalf("expected applying the same components to change nothing, got %+v (err %v)", diff, err)
+	}
+
+	// remove redis, add postgres and give the code editor more memory
+	desired := testComponents()
+	desired[0].Resources.Limits.Memory = "4Gi"
+	desired[1] = cmp.Component{ComponentType: cmp.Postgres, ComponentID: "my-postgres"}
+	diff, err = ApplySession(ctx, cs, store, nil, testConfig(), testSessionID, desired, cmp.Storage{}, nil, 0, false)
+	if err != nil {
+		t.Fatalf("ApplySession failed: %v", err)
+	}
+	want := &SessionDiff{Added: []string{"my-postgres"}, Removed: []string{"my-redis"}, Changed: []string{"my-code-editor"}}
+	if !reflect.DeepEqual(diff, want) {
+		t.Fatalf("expected diff %+v, got %+v", want, diff)
+	}
+	deployment, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	var names []string
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		names = append(names, container.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"my-code-editor", "my-postgres", "my-mongo"}) {
+		t.Fatalf("unexpected containers %v", names)
+	}
+	if _, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, cmp.VolumeName(testSessionID, "my-postgres"), metav1.GetOptions{}); err != nil {
+		t.Fatalf("postgres PVC was not created: %v", err)
+	}
+	if _, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, cmp.VolumeName(testSessionID, "my-redis"), metav1.GetOptions{}); err == nil {
+		t.Fatal("expected the redis PVC to be deleted")
+	}
+	service, err := cs.CoreV1().Services("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil || len(service.Spec.Ports) != 2 {
+		t.Fatalf("expected 2 service ports, got %+v (err %v)", service, err)
+	}
+	ingress, err := cs.NetworkingV1().Ingresses("default").Get(ctx, "minimal-ingress", metav1.GetOptions{})
+	if err != nil || len(ingress.Spec.Rules) != 2 {
+		t.Fatalf("expected 2 ingress rules, got %+v (err %v)", ingress, err)
+	}
+
+	// the generated password is kept, so applying again changes nothing
+	diff, err = ApplySession(ctx, cs, store, nil, testConfig(), testSessionID, desired, cmp.Storage{}, nil, 0, false)
+	if err != nil || !diff.Empty() {
+		t.Fatalf("expected applying the same components to change nothing, got %+v (err %v)", diff, err)
+	}
+
+	retyped := append([]cmp.Component(nil), desired...)
+	retyped[1].ComponentType = cmp.MySQL
+	if _, err := ApplySession(ctx, cs, store, nil, testConfig(), testSessionID, retyped, cmp.Storage{}, nil, 0, false); !errors.Is(err, cmp.ErrInvalidComponent) {
+		t.Fatalf("expected changing the type of a component to be rejected, got %v", err)
+	}
+	resized := append([]cmp.Component(nil), desired...)
+	resized[1].Storage.Size = "5Gi"
+	if _, err := ApplySession(ctx, cs, store, nil, testConfig(), testSessionID, resized, cmp.Storage{}, nil, 0, false); !errors.Is(err, cmp.ErrInvalidComponent) {
+		t.Fatalf("expected changing the storage of a component to be rejected, got %v", err)
+	}
+	if _, err := ApplySession(ctx, cs, store, nil, testConfig(), testSessionID, nil, cmp.Storage{}, nil, 0, false); !errors.Is(err, cmp.ErrInvalidComponent) {
+		t.Fatalf("expected an empty session to be rejected, got %v", err)
+	}
+}
+
+func TestApplyStoppedSession(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+
+	if _, err := ApplySession(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()[:1], cmp.Storage{}, nil, 0, false); err != nil {
+		t.Fatalf("ApplySession failed: %v", err)
+	}
+	markDeploymentReady(t, ctx, cs, testSessionID)
+	mustRefresh(t, ctx, cs, store, Running)
+	if err := ToggleDeploy(ctx, cs, store, testSessionID); err != nil {
+		t.Fatalf("ToggleDeploy failed: %v", err)
+	}
+
+	diff, err := ApplySession(ctx, cs, store, nil, testConfig(), testSessionID, testComponents(), cmp.Storage{}, nil, 0, false)
+	if err != nil {
+		t.Fatalf("ApplySession failed: %v", err)
+	}
+	if len(diff.Added) != 2 {
+		t.Fatalf("unexpected diff %+v", diff)
+	}
+	if _, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{}); err == nil {
+		t.Fatal("expected the stopped session to stay stopped")
+	}
+	if err := ToggleDeploy(ctx, cs, store, testSessionID); err != nil {
+		t.Fatalf("ToggleDeploy failed: %v", err)
+	}
+	deployment, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("deployment was not recreated: %v", err)
+	}
+	if got := len(deployment.Spec.Template.Spec.Containers); got != 3 {
+		t.Fatalf("expected 3 containers, got %d", got)
+	}
+}
+
+func TestAddAndRemoveComponents(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	redisClaim := cmp.VolumeName(testSessionID, "my-redis")
+
+	if _, err := ApplySession(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()[:1], cmp.Storage{}, nil, 0, false); err != nil {
+		t.Fatalf("ApplySession failed: %v", err)
+	}
+	redis := cmp.Component{ComponentType: cmp.Redis, ExposeComponent: true, ComponentID: "my-redis", Storage: cmp.Storage{Size: "50Mi"}}
+	if _, err := AddComponent(ctx, cs, store, nil, testConfig(), testSessionID, redis); err != nil {
+		t.Fatalf("AddComponent failed: %v", err)
+	}
+	if _, err := AddComponent(ctx, cs, store, nil, testConfig(), testSessionID, redis); !errors.Is(err, ErrComponentExists) {
+		t.Fatalf("expected ErrComponentExists, got %v", err)
+	}
+	ingress, err := cs.NetworkingV1().Ingresses("default").Get(ctx, "minimal-ingress", metav1.GetOptions{})
+	if err != nil || len(ingress.Spec.Rules) != 2 {
+		t.Fatalf("expected 2 ingress rules, got %+v (err %v)", ingress, err)
+	}
+
+	// the data of the component is kept, and reused when it is added back
+	if _, err := RemoveComponent(ctx, cs, store, nil, testConfig(), testSessionID, "my-redis", true); err != nil {
+		t.Fatalf("RemoveComponent failed: %v", err)
+	}
+	if _, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, redisClaim, metav1.GetOptions{}); err != nil {
+		t.Fatalf("expected the redis PVC to be kept: %v", err)
+	}
+	redis.Storage = cmp.Storage{}
+	if _, err := AddComponent(ctx, cs, store, nil, testConfig(), testSessionID, redis); err != nil {
+		t.Fatalf("AddComponent failed: %v", err)
+	}
+	session, _, err := store.Get(ctx, testSessionID)
+	if err != nil || session.Components[1].Storage.Size != "50Mi" {
+		t.Fatalf("expected the storage of the reused PVC to be recorded, got %+v (err %v)", session, err)
+	}
+
+	if _, err := RemoveComponent(ctx, cs, store, nil, testConfig(), testSessionID, "my-redis", false); err != nil {
+		t.Fatalf("RemoveComponent failed: %v", err)
+	}
+	if _, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, redisClaim, metav1.GetOptions{}); err == nil {
+		t.Fatal("expected the redis PVC to be deleted")
+	}
+	if _, err := RemoveComponent(ctx, cs, store, nil, testConfig(), testSessionID, "my-redis", false); !errors.Is(err, ErrComponentNotFound) {
+		t.Fatalf("expected ErrComponentNotFound, got %v", err)
+	}
+	if _, err := RemoveComponent(ctx, cs, store, nil, testConfig(), testSessionID, "my-code-editor", false); !errors.Is(err, cmp.ErrInvalidComponent) {
+		t.Fatalf("expected removing the last component to be rejected, got %v", err)
+	}
+}
+
+func TestAddComponentRollback(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+
+	if _, err := ApplySession(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()[:1], cmp.Storage{}, nil, 0, false); err != nil {
+		t.Fatalf("ApplySession failed: %v", err)
+	}
+	cs.(*fake.Clientset).PrependReactor("update", "ingresses", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("ingress is unavailable")
+	})
+	redis := cmp.Component{ComponentType: cmp.Redis, ExposeComponent: true, ComponentID: "my-redis"}
+	if _, err := AddComponent(ctx, cs, store, nil, testConfig(), testSessionID, redis); err == nil {
+		t.Fatal("expected AddComponent to fail")
+	}
+
+	if _, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, cmp.VolumeName(testSessionID, "my-redis"), metav1.GetOptions{}); err == nil {
+		t.Fatal("expected the redis PVC to be rolled back")
+	}
+	deployment, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil || len(deployment.Spec.Template.Spec.Containers) != 1 {
+		t.Fatalf("expected the deployment to be rolled back, got %+v (err %v)", deployment, err)
+	}
+	service, err := cs.CoreV1().Services("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil || len(service.Spec.Ports) != 1 {
+		t.Fatalf("expected the service to be rolled back, got %+v (err %v)", service, err)
+	}
+	session, _, err := store.Get(ctx, testSessionID)
+	if err != nil || len(session.Components) != 1 {
+		t.Fatalf("expected the session to be unchanged, got %+v (err %v)", session, err)
+	}
+}
@@ -0,0 +1,228 @@
+package sessions
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ConditionType names an aspect of the objects of a session tracked in its
+// conditions.
+type ConditionType string
+
+const (
+	// DeploymentReady tells whether the pod of a session meant to run is
+	// ready.
+	DeploymentReady ConditionType = "DeploymentReady"
+	// ServiceFound tells whether the service of a deployed session exists.
+	ServiceFound ConditionType = "ServiceFound"
+	// VolumesFound tells whether every volume of the session exists.
+	VolumesFound ConditionType = "VolumesFound"
+)
+
+// The reasons of the conditions of a session that report an object missing
+// from the cluster, which has to be fixed by hand or by deleting the session.
+const (
+	ReasonDeploymentMissing = "DeploymentMissing"
+	ReasonServiceMissing    = "ServiceMissing"
+	ReasonVolumesMissing    = "VolumesMissing"
+)
+
+// Condition is the last observed state of an aspect of the objects of a
+// session, like the conditions in the status of Kubernetes objects.
+type Condition struct {
+	Type    ConditionType          `json:"type"`
+	Status  metav1.ConditionStatus `json:"status"`
+	Reason  string                 `json:"reason"`
+	Message string                 `json:"message,omitempty"`
+	// LastTransitionTime is when Status last changed.
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+// Drifted reports whether an object of the session is missing from the
+// cluster.
+func (s *SessionInfo) Drifted() bool {
+	for _, condition := range s.Conditions {
+		if condition.Status != metav1.ConditionFalse {
+			continue
+		}
+		switch condition.Reason {
+		case ReasonDeploymentMissing, ReasonServiceMissing, ReasonVolumesMissing:
+			return true
+		}
+	}
+	return false
+}
+
+// setCondition records condition in conditions, and reports whether that
+// changed them. Its LastTransitionTime is set to now when its status changes.
+func setCondition(conditions *[]Condition, condition Condition, now time.Time) bool {
+	for i, old := range *conditions {
+		if old.Type != condition.Type {
+			continue
+		}
+		if old.Status == condition.Status && old.Reason == condition.Reason && old.Message == condition.Message {
+			return false
+		}
+		condition.LastTransitionTime = old.LastTransitionTime
+		if old.Status != condition.Status {
+			condition.LastTransitionTime = now
+		}
+		(*conditions)[i] = condition
+		return true
+	}
+	condition.LastTransitionTime = now
+	*conditions = append(*conditions, condition)
+	return true
+}
+
+// sessionClaims returns the names of the volume claims of the session.
+func sessionClaims(session *SessionInfo, sessionID string) []string {
+	claims := []string{cmp.WorkspaceVolumeName(sessionID)}
+	_, volumes, _ := cmp.ParseComponents(session.Components, sessionID)
+	for _, volume := range volumes {
+		if volume.Name != claims[0] {
+			claims = append(claims, volume.Name)
+		}
+	}
+	return claims
+}
+
+// observation is what was found in the cluster for a session: its
+// deployment and service, nil when they don't exist, the names of its
+// volume claims that exist, and its pods.
+type observation struct {
+	deployment *appsv1.Deployment
+	service    *v1.Service
+	claims     map[string]bool
+	pods       []*v1.Pod
+}
+
+// observeCluster reads the objects of the session from the API server. An
+// object it fails to read is an error, not a missing object.
+func observeCluster(ctx context.Context, cs kubernetes.Interface, session *SessionInfo, sessionID string) (*observation, error) {
+	namespace := session.namespace()
+	obs := &observation{claims: make(map[string]bool)}
+	deployment, err := cs.AppsV1().Deployments(namespace).Get(ctx, sessionID, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		obs.deployment = deployment
+	case !apierrors.IsNotFound(err):
+		return nil, err
+	}
+	service, err := cs.CoreV1().Services(namespace).Get(ctx, sessionID, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		obs.service = service
+	case !apierrors.IsNotFound(err):
+		return nil, err
+	}
+	for _, claim := range sessionClaims(session, sessionID) {
+		_, err := cs.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, claim, metav1.GetOptions{})
+		switch {
+		case err == nil:
+			obs.claims[claim] = true
+		case !apierrors.IsNotFound(err):
+			return nil, err
+		}
+	}
+	if obs.deployment != nil && obs.deployment.Status.ReadyReplicas == 0 {
+		pods, err := cs.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: "app=" + sessionID})
+		if err != nil {
+			return nil, err
+		}
+		for i := range pods.Items {
+			obs.pods = append(obs.pods, &pods.Items[i])
+		}
+	}
+	return obs, nil
+}
+
+// apply records the observation in the state and conditions of the
+// session, and reports whether that changed it. An Initialized session
+// becomes Running once its pod is ready. Missing objects are only recorded
+// in the conditions: the session is never deleted.
+func (o *observation) apply(session *SessionInfo, sessionID string, now time.Time) bool {
+	changed := false
+	set := func(condition Condition) {
+		if setCondition(&session.Conditions, condition, now) {
+			changed = true
+		}
+	}
+
+	var missing []string
+	for _, claim := range sessionClaims(session, sessionID) {
+		if !o.claims[claim] {
+			missing = append(missing, claim)
+		}
+	}
+	if len(missing) == 0 {
+		set(Condition{Type: VolumesFound, Status: metav1.ConditionTrue, Reason: "VolumesFound"})
+	} else {
+		set(Condition{Type: VolumesFound, Status: metav1.ConditionFalse, Reason: ReasonVolumesMissing,
+			Message: "missing volume claims: " + strings.Join(missing, ", ")})
+	}
+
+	if session.SessionState == "" {
+		// not deployed yet, there's nothing else to look for
+		return changed
+	}
+	if o.service == nil {
+		set(Condition{Type: ServiceFound, Status: metav1.ConditionFalse, Reason: ReasonServiceMissing,
+			Message: fmt.Sprintf("service %s not found", sessionID)})
+	} else {
+		set(Condition{Type: ServiceFound, Status: metav1.ConditionTrue, Reason: "ServiceFound"})
+	}
+
+	switch session.SessionState {
+	case Initialized, Running:
+		switch {
+		case o.deployment == nil:
+			set(Condition{Type: DeploymentReady, Status: metav1.ConditionFalse, Reason: ReasonDeploymentMissing,
+				Message: fmt.Sprintf("deployment %s not found", sessionID)})
+		case o.deployment.Status.ReadyReplicas > 0:
+			set(Condition{Type: DeploymentReady, Status: metav1.ConditionTrue, Reason: "PodReady"})
+			if session.SessionState == Initialized {
+				session.SessionState = Running
+				changed = true
+			}
+		default:
+			reason, message := podProblem(o.pods)
+			set(Condition{Type: DeploymentReady, Status: metav1.ConditionFalse, Reason: reason, Message: message})
+		}
+	case Stopped:
+		set(Condition{Type: DeploymentReady, Status: metav1.ConditionFalse, Reason: "SessionStopped"})
+	}
+	return changed
+}
+
+// podProblem tells why none of pods is ready, from the state of their
+// containers and their scheduling.
+func podProblem(pods []*v1.Pod) (string, string) {
+	for _, pod := range pods {
+		statuses := append(append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if waiting := status.State.Waiting; waiting != nil && waiting.Reason != "" && waiting.Reason != "ContainerCreating" && waiting.Reason != "PodInitializing" {
+				message := "container " + status.Name
+				if waiting.Message != "" {
+					message += ": " + waiting.Message
+				}
+				return waiting.Reason, message
+			}
+		}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodScheduled && condition.Status == v1.ConditionFalse {
+				return "Unschedulable", condition.Message
+			}
+		}
+	}
+	return "PodNotReady", "waiting for the pod of the session to be ready"
+}
@@ -0,0 +1,174 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
+	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	// ErrInvalidTTL is returned for a negative time to live, or one above
+	// the configured cap.
+	ErrInvalidTTL = errors.New("invalid time to live")
+	// ErrSessionExpired is returned when starting an expired session, which
+	// must be extended first.
+	ErrSessionExpired = errors.New("session expired")
+)
+
+// ExpiryState tells how close to its expiry a session is.
+type ExpiryState string
+
+const (
+	// Expiring sessions expire within the configured warning period.
+	Expiring ExpiryState = "expiring"
+	// Expired sessions are stopped, and deleted once the configured grace
+	// period is over unless they are extended.
+	Expired ExpiryState = "expired"
+)
+
+// expiryFor returns when a session created now with ttl expires, or the
+// zero time if it never does. A zero ttl stands for the configured default.
+func expiryFor(cfg config.SessionsConfig, ttl time.Duration, now time.Time) (time.Time, error) {
+	if ttl < 0 {
+		return time.Time{}, fmt.Errorf("%w: %s is negative", ErrInvalidTTL, ttl)
+	}
+	if ttl == 0 {
+		ttl = cfg.DefaultTTL
+	}
+	if cfg.MaxTTL > 0 && ttl > cfg.MaxTTL {
+		return time.Time{}, fmt.Errorf("%w: %s is above the maximum of %s", ErrInvalidTTL, ttl, cfg.MaxTTL)
+	}
+	if ttl == 0 {
+		return time.Time{}, nil
+	}
+	return now.Add(ttl), nil
+}
+
+func (s *SessionInfo) expired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)
+}
+
+// ExtendSession makes the session expire ttl from now. An expired session
+// that wasn't deleted yet is kept, stopped, until it expires again; it can
+// be toggled on again.
+func ExtendSession(ctx context.Context, store SessionStore, cfg config.SessionsConfig, sessionID string, ttl time.Duration) (*SessionInfo, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("%w: %s is not positive", ErrInvalidTTL, ttl)
+	}
+	expiresAt, err := expiryFor(cfg, ttl, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	logging.Logger.Info("extending session", "sessionID", sessionID, "expiresAt", expiresAt)
+	return updateSession(ctx, store, sessionID, func(session *SessionInfo) (bool, error) {
+		session.ExpiresAt = expiresAt
+		session.Expiry = ""
+		return true, nil
+	})
+}
+
+// expiryStep is what ExpireSessions has to do to a session.
+type expiryStep int
+
+const (
+	expiryNone expiryStep = iota
+	expiryWarn
+	expiryStop
+	expiryDelete
+)
+
+func dueExpiryStep(session *SessionInfo, now time.Time, expiry config.ExpiryConfig) expiryStep {
+	switch {
+	case session.ExpiresAt.IsZero():
+		return expiryNone
+	case !now.Before(session.ExpiresAt.Add(expiry.DeleteAfter)):
+		return expiryDelete
+	case !now.Before(session.ExpiresAt):
+		if session.Expiry == Expired {
+			return expiryNone
+		}
+		return expiryStop
+	case !now.Before(session.ExpiresAt.Add(-expiry.WarnBefore)):
+		if session.Expiry == Expiring {
+			return expiryNone
+		}
+		return expiryWarn
+	default:
+		return expiryNone
+	}
+}
+
+// ExpireSessions moves the sessions that have a time to live along their
+// expiry: they are marked Expiring within expiry.WarnBefore of their
+// expiry, stopped and marked Expired once it has passed, and deleted with
+// DeleteDeploy expiry.DeleteAfter later. Sessions whose lock is held are
+// left for the next call.
+func ExpireSessions(ctx context.Context, cs kubernetes.Interface, store SessionStore, journal *consistency.Journal, locker SessionLocker, cfg config.SessionsConfig, expiry config.ExpiryConfig) error {
+	sessions, err := store.List(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var errs []error
+	for sessionID, session := range sessions {
+		if dueExpiryStep(session, now, expiry) == expiryNone {
+			continue
+		}
+		if err := expireSession(ctx, cs, store, journal, locker, cfg, expiry, sessionID, now); err != nil {
+			logging.Logger.Error("failed to expire session", "sessionID", sessionID, "error", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func expireSession(ctx context.Context, cs kubernetes.Interface, store SessionStore, journal *consistency.Journal, locker SessionLocker, cfg config.SessionsConfig, expiry config.ExpiryConfig, sessionID string, now time.Time) error {
+	sessionLock, err := locker.AcquireLock(ctx, sessionID, lck.Options{TryLock: true})
+	defer sessionLock.Release()
+	if errors.Is(err, lck.ErrLocked) {
+		logging.Logger.Info("not expiring session, it is being changed", "sessionID", sessionID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// read it again under the lock, it may have been extended since
+	session, revision, err := store.Get(ctx, sessionID)
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch dueExpiryStep(session, now, expiry) {
+	case expiryWarn:
+		logging.Logger.Info("session is about to expire", "sessionID", sessionID, "expiresAt", session.ExpiresAt)
+		session.Expiry = Expiring
+		return swapSession(ctx, store, sessionID, revision, session)
+	case expiryStop:
+		logging.Logger.Info("session expired", "sessionID", sessionID, "expiresAt", session.ExpiresAt)
+		session.Expiry = Expired
+		if session.SessionState == Running {
+			return stopDeploy(ctx, cs, store, sessionID, session, revision, StoppedExpired)
+		}
+		return swapSession(ctx, store, sessionID, revision, session)
+	case expiryDelete:
+		// deleting the session changes the shared ingress
+		ingressLock, err := locker.AcquireLock(ctx, "ingress", lck.Options{})
+		defer ingressLock.Release()
+		if err != nil {
+			return err
+		}
+		logging.Logger.Info("deleting expired session", "sessionID", sessionID, "expiresAt", session.ExpiresAt)
+		return deleteIfExists(ctx, cs, store, journal, cfg, sessionID)
+	}
+	return nil
+}
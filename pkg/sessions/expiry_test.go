@@ -0,0 +1,104 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+)
+
+func TestInitSessionTTL(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	cfg := testConfig()
+	cfg.DefaultTTL = time.Hour
+	cfg.MaxTTL = 2 * time.Hour
+
+	if err := InitSession(ctx, store, nil, cs, cfg, testSessionID, cmp.Storage{}, nil, 3*time.Hour); !errors.Is(err, ErrInvalidTTL) {
+		t.Fatalf("expected a ttl above the maximum to be rejected, got %v", err)
+	}
+	if err := InitSession(ctx, store, nil, cs, cfg, testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	session, _, _ := store.Get(ctx, testSessionID)
+	if until := time.Until(session.ExpiresAt); until <= 0 || until > time.Hour {
+		t.Fatalf("expected the session to expire after the default ttl, expires at %s", session.ExpiresAt)
+	}
+	if _, err := ExtendSession(ctx, store, cfg, testSessionID, 3*time.Hour); !errors.Is(err, ErrInvalidTTL) {
+		t.Fatalf("expected an extension above the maximum to be rejected, got %v", err)
+	}
+}
+
+func TestExpireSessions(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	cfg := testConfig()
+	expiry := config.ExpiryConfig{WarnBefore: time.Hour, DeleteAfter: time.Hour}
+	if err := InitSession(ctx, store, nil, cs, cfg, testSessionID, cmp.Storage{}, nil, 30*time.Minute); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, nil, cfg, testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	// the expiry set by InitSession outlives the deployment of the session
+	deployed, _, err := store.Get(ctx, testSessionID)
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	if until := time.Until(deployed.ExpiresAt); until <= 29*time.Minute || until > 30*time.Minute {
+		t.Fatalf("expected the session to expire in 30m, got %s", deployed.ExpiresAt)
+	}
+	markDeploymentReady(t, ctx, cs, testSessionID)
+	mustRefresh(t, ctx, cs, store, Running)
+
+	setExpiry := func(expiresAt time.Time) {
+		updateSession(ctx, store, testSessionID, func(session *SessionInfo) (bool, error) {
+			session.SessionState = Running
+			session.ExpiresAt = expiresAt
+			return true, nil
+		})
+	}
+	expire := func() *SessionInfo {
+		t.Helper()
+		if err := ExpireSessions(ctx, cs, store, nil, freeLocker{}, cfg, expiry); err != nil {
+			t.Fatalf("ExpireSessions failed: %v", err)
+		}
+		session, _, err := store.Get(ctx, testSessionID)
+		if errors.Is(err, ErrSessionNotFound) {
+			return nil
+		}
+		return session
+	}
+
+	if session := expire(); session.Expiry != Expiring || session.SessionState != Running {
+		t.Fatalf("expected the session to be expiring and running, got %s and %s", session.Expiry, session.SessionState)
+	}
+
+	setExpiry(time.Now().Add(-time.Minute))
+	session := expire()
+	if session.Expiry != Expired || session.SessionState != Stopped || session.StopReason != StoppedExpired {
+		t.Fatalf("expected the session to be expired and stopped, got %s, %s and %s", session.Expiry, session.SessionState, session.StopReason)
+	}
+	if err := ToggleDeploy(ctx, cs, store, testSessionID); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("expected starting an expired session to fail, got %v", err)
+	}
+
+	// extending the session lets it start again
+	if _, err := ExtendSession(ctx, store, cfg, testSessionID, time.Hour*4); err != nil {
+		t.Fatalf("ExtendSession failed: %v", err)
+	}
+	if err := ToggleDeploy(ctx, cs, store, testSessionID); err != nil {
+		t.Fatalf("ToggleDeploy failed: %v", err)
+	}
+	if session := expire(); session.Expiry != "" || session.SessionState != Running {
+		t.Fatalf("expected the extended session to run, got %s and %s", session.Expiry, session.SessionState)
+	}
+
+	setExpiry(time.Now().Add(-2 * time.Hour))
+	if session := expire(); session != nil {
+		t.Fatalf("expected the session to be deleted after the grace period, got %+v", session)
+	}
+}
@@ -0,0 +1,251 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/k8s"
+	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// SessionLocker takes the lock of a session, as the handlers do before
+// changing it. *locking.Locker implements it.
+type SessionLocker interface {
+	AcquireLock(ctx context.Context, name string, opts lck.Options) (*lck.Lock, error)
+}
+
+// updateUnlessLocked is updateSession for the background workers: it takes
+// the lock of the session first, as the handlers do, so that what they
+// record can't make a request fail with ErrConflict. It fails with
+// locking.ErrLocked right away when the session is being changed.
+func updateUnlessLocked(ctx context.Context, store SessionStore, locker SessionLocker, sessionID string, mutate func(*SessionInfo) (bool, error)) (*SessionInfo, error) {
+	lock, err := locker.AcquireLock(ctx, sessionID, lck.Options{TryLock: true})
+	defer lock.Release()
+	if err != nil {
+		return nil, err
+	}
+	return updateSession(ctx, store, sessionID, mutate)
+}
+
+// ActivityTracker collects the activity of the sessions seen by this
+// replica, such as the requests made to the API or the heartbeats of their
+// code editor. It is only recorded in the sessions by Flush, so that the
+// sessions aren't written on every request.
+type ActivityTracker struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewActivityTracker() *ActivityTracker {
+	return &ActivityTracker{seen: make(map[string]time.Time)}
+}
+
+// Touch records that the session is in use.
+func (t *ActivityTracker) Touch(sessionID string) {
+	t.touchAt(sessionID, time.Now())
+}
+
+func (t *ActivityTracker) touchAt(sessionID string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at.After(t.seen[sessionID]) {
+		t.seen[sessionID] = at
+	}
+}
+
+// Flush records the activity seen since the last flush in the LastActivity
+// of the sessions. The activity of the sessions that couldn't be updated,
+// or whose lock is held, is kept for the next flush, unless the session is
+// gone.
+func (t *ActivityTracker) Flush(ctx context.Context, store SessionStore, locker SessionLocker) error {
+	t.mu.Lock()
+	seen := t.seen
+	t.seen = make(map[string]time.Time)
+	t.mu.Unlock()
+
+	var errs []error
+	for sessionID, at := range seen {
+		_, err := updateUnlessLocked(ctx, store, locker, sessionID, func(session *SessionInfo) (bool, error) {
+			if !at.After(session.LastActivity) {
+				return false, nil
+			}
+			session.LastActivity = at
+			return true, nil
+		})
+		if errors.Is(err, ErrSessionNotFound) {
+			continue
+		}
+		if errors.Is(err, lck.ErrLocked) {
+			t.touchAt(sessionID, at)
+			continue
+		}
+		if err != nil {
+			logging.Logger.Warn("failed to record session activity", "sessionID", sessionID, "error", err)
+			t.touchAt(sessionID, at)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ActivityProbe tells when a session was last used, from what its components
+// record themselves, such as the heartbeat of code-server. The traffic of the
+// components goes through the ingress, so it is never seen by the API. It
+// returns the zero time when nothing was recorded.
+type ActivityProbe interface {
+	LastActivity(ctx context.Context, session *SessionInfo, sessionID string) (time.Time, error)
+}
+
+// execFunc runs command in a container of a pod, see k8s.Exec.
+type execFunc func(ctx context.Context, namespace string, pod string, container string, command []string) (string, error)
+
+type execActivityProbe struct {
+	cs   kubernetes.Interface
+	exec execFunc
+}
+
+// NewExecActivityProbe returns an ActivityProbe reading the modification
+// time of the activity file of each component (see cmp.ActivityReporter)
+// in the running pods of the session.
+func NewExecActivityProbe(cs kubernetes.Interface, config *rest.Config) ActivityProbe {
+	return &execActivityProbe{
+		cs: cs,
+		exec: func(ctx context.Context, namespace string, pod string, container string, command []string) (string, error) {
+			return k8s.Exec(ctx, config, cs, namespace, pod, container, command)
+		},
+	}
+}
+
+func (p *execActivityProbe) LastActivity(ctx context.Context, session *SessionInfo, sessionID string) (time.Time, error) {
+	files := make(map[string]string)
+	for _, component := range session.Components {
+		provider, ok := cmp.Lookup(component.ComponentType)
+		if !ok {
+			continue
+		}
+		if reporter, ok := provider.(cmp.ActivityReporter); ok && reporter.ActivityFile() != "" {
+			files[component.ComponentID] = reporter.ActivityFile()
+		}
+	}
+	if len(files) == 0 {
+		return time.Time{}, nil
+	}
+	pods, err := p.cs.CoreV1().Pods(session.namespace()).List(ctx, metav1.ListOptions{LabelSelector: "app=" + sessionID})
+	if err != nil {
+		return time.Time{}, err
+	}
+	var last time.Time
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+		for container, file := range files {
+			// the file doesn't exist until the component is first used
+			out, err := p.exec(ctx, pod.Namespace, pod.Name, container, []string{"sh", "-c", `stat -c %Y "$0" 2>/dev/null || echo 0`, file})
+			if err != nil {
+				return time.Time{}, err
+			}
+			seconds, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("unexpected modification time of %s in %s/%s: %q", file, pod.Name, container, out)
+			}
+			if seen := time.Unix(seconds, 0); seconds > 0 && seen.After(last) {
+				last = seen
+			}
+		}
+	}
+	return last, nil
+}
+
+// StopIdleSessions stops the running sessions whose last activity is older
+// than idleAfter, as if they were toggled off, recording StoppedIdle as the
+// reason. The idle time of the sessions that have no recorded activity yet
+// starts now. Before a session is stopped, probe is asked for the activity
+// of its components, unless it is nil. Sessions whose lock is held are being
+// changed, hence in use, and are left alone.
+func StopIdleSessions(ctx context.Context, cs kubernetes.Interface, store SessionStore, locker SessionLocker, probe ActivityProbe, idleAfter time.Duration) error {
+	sessions, err := store.List(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var errs []error
+	for sessionID, session := range sessions {
+		if session.SessionState != Running {
+			continue
+		}
+		if session.LastActivity.IsZero() {
+			_, err := updateUnlessLocked(ctx, store, locker, sessionID, func(session *SessionInfo) (bool, error) {
+				if !session.LastActivity.IsZero() {
+					return false, nil
+				}
+				session.LastActivity = now
+				return true, nil
+			})
+			if err != nil && !errors.Is(err, ErrSessionNotFound) && !errors.Is(err, lck.ErrLocked) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if now.Sub(session.LastActivity) < idleAfter {
+			continue
+		}
+		if err := stopIdleSession(ctx, cs, store, locker, probe, sessionID, idleAfter); err != nil {
+			logging.Logger.Error("failed to stop idle session", "sessionID", sessionID, "error", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func stopIdleSession(ctx context.Context, cs kubernetes.Interface, store SessionStore, locker SessionLocker, probe ActivityProbe, sessionID string, idleAfter time.Duration) error {
+	lock, err := locker.AcquireLock(ctx, sessionID, lck.Options{TryLock: true})
+	defer lock.Release()
+	if errors.Is(err, lck.ErrLocked) {
+		logging.Logger.Info("not stopping idle session, it is being changed", "sessionID", sessionID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// read it again under the lock, it may have changed since it was listed
+	session, revision, err := store.Get(ctx, sessionID)
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if session.SessionState != Running || time.Since(session.LastActivity) < idleAfter {
+		return nil
+	}
+	if probe != nil {
+		seen, err := probe.LastActivity(ctx, session, sessionID)
+		if err != nil {
+			// better keep a session running than stop one that is in use
+			return fmt.Errorf("failed to probe the activity of session %s: %w", sessionID, err)
+		}
+		if seen.After(session.LastActivity) {
+			session.LastActivity = seen
+			if time.Since(seen) < idleAfter {
+				logging.Logger.Debug("session is in use", "sessionID", sessionID, "lastActivity", seen)
+				return swapSession(ctx, store, sessionID, revision, session)
+			}
+		}
+	}
+	idleFor := time.Since(session.LastActivity)
+	logging.Logger.Info("stopping idle session", "sessionID", sessionID, "idleFor", idleFor.Round(time.Second))
+	return stopDeploy(ctx, cs, store, sessionID, session, revision, StoppedIdle)
+}
@@ -0,0 +1,195 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// freeLocker hands out every lock, or none when locked is set.
+type freeLocker struct {
+	locked bool
+}
+
+func (l freeLocker) AcquireLock(ctx context.Context, name string, opts lck.Options) (*lck.Lock, error) {
+	if l.locked {
+		return nil, lck.ErrLocked
+	}
+	return nil, nil
+}
+
+func TestStopIdleSessions(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	for _, sessionID := range []string{"session-idle", "session-busy", "session-new"} {
+		if err := InitSession(ctx, store, nil, cs, testConfig(), sessionID, cmp.Storage{}, nil, 0); err != nil {
+			t.Fatalf("InitSession failed: %v", err)
+		}
+		if err := CreateDeploy(ctx, cs, store, nil, testConfig(), sessionID, testComponents()); err != nil {
+			t.Fatalf("CreateDeploy failed: %v", err)
+		}
+		updateSession(ctx, store, sessionID, func(session *SessionInfo) (bool, error) {
+			session.SessionState = Running
+			return true, nil
+		})
+	}
+	tracker := NewActivityTracker()
+	tracker.touchAt("session-idle", time.Now().Add(-2*time.Hour))
+	tracker.Touch("session-busy")
+	tracker.Touch("session-gone")
+	if err := tracker.Flush(ctx, store, freeLocker{}); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if err := StopIdleSessions(ctx, cs, store, freeLocker{}, nil, time.Hour); err != nil {
+		t.Fatalf("StopIdleSessions failed: %v", err)
+	}
+	idle, _, _ := store.Get(ctx, "session-idle")
+	if idle.SessionState != Stopped || idle.StopReason != StoppedIdle {
+		t.Fatalf("expected the idle session to be stopped for being idle, got %s (%s)", idle.SessionState, idle.StopReason)
+	}
+	if _, err := cs.AppsV1().Deployments("default").Get(ctx, "session-idle", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the deployment of the idle session to be deleted, got %v", err)
+	}
+	for _, sessionID := range []string{"session-busy", "session-new"} {
+		session, _, _ := store.Get(ctx, sessionID)
+		if session.SessionState != Running {
+			t.Fatalf("expected %s to keep running, got %s", sessionID, session.SessionState)
+		}
+		if session.LastActivity.IsZero() {
+			t.Fatalf("expected the activity of %s to be recorded", sessionID)
+		}
+	}
+
+	// toggling the session on again resets its idle time
+	if err := ToggleDeploy(ctx, cs, store, "session-idle"); err != nil {
+		t.Fatalf("ToggleDeploy failed: %v", err)
+	}
+	if err := StopIdleSessions(ctx, cs, store, freeLocker{}, nil, time.Hour); err != nil {
+		t.Fatalf("StopIdleSessions failed: %v", err)
+	}
+	idle, _, _ = store.Get(ctx, "session-idle")
+	if idle.SessionState != Running || idle.StopReason != "" {
+		t.Fatalf("expected the session toggled on to keep running, got %s (%s)", idle.SessionState, idle.StopReason)
+	}
+}
+
+func TestStopIdleSessionsSkipsLockedSessions(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	updateSession(ctx, store, testSessionID, func(session *SessionInfo) (bool, error) {
+		session.SessionState = Running
+		session.LastActivity = time.Now().Add(-2 * time.Hour)
+		return true, nil
+	})
+
+	if err := StopIdleSessions(ctx, cs, store, freeLocker{locked: true}, nil, time.Hour); err != nil {
+		t.Fatalf("StopIdleSessions failed: %v", err)
+	}
+	session, _, _ := store.Get(ctx, testSessionID)
+	if session.SessionState != Running {
+		t.Fatalf("expected the locked session to keep running, got %s", session.SessionState)
+	}
+}
+
+// fakeProbe reports the same activity for every session.
+type fakeProbe struct {
+	seen time.Time
+	err  error
+}
+
+func (p fakeProbe) LastActivity(ctx context.Context, session *SessionInfo, sessionID string) (time.Time, error) {
+	return p.seen, p.err
+}
+
+func TestStopIdleSessionsProbesActivity(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	updateSession(ctx, store, testSessionID, func(session *SessionInfo) (bool, error) {
+		session.SessionState = Running
+		session.LastActivity = time.Now().Add(-2 * time.Hour)
+		return true, nil
+	})
+
+	// the code editor was used without a single request to the API
+	typing := time.Now().Add(-5 * time.Minute).Truncate(time.Second)
+	if err := StopIdleSessions(ctx, cs, store, freeLocker{}, fakeProbe{seen: typing}, time.Hour); err != nil {
+		t.Fatalf("StopIdleSessions failed: %v", err)
+	}
+	session, _, _ := store.Get(ctx, testSessionID)
+	if session.SessionState != Running || !session.LastActivity.Equal(typing) {
+		t.Fatalf("expected the session in use to keep running with its activity recorded, got %s at %s", session.SessionState, session.LastActivity)
+	}
+
+	// a session whose activity can't be read is kept running
+	updateSession(ctx, store, testSessionID, func(session *SessionInfo) (bool, error) {
+		session.LastActivity = time.Now().Add(-2 * time.Hour)
+		return true, nil
+	})
+	if err := StopIdleSessions(ctx, cs, store, freeLocker{}, fakeProbe{err: errors.New("exec failed")}, time.Hour); err == nil {
+		t.Fatalf("expected StopIdleSessions to report the failed probe")
+	}
+	if session, _, _ := store.Get(ctx, testSessionID); session.SessionState != Running {
+		t.Fatalf("expected the session to keep running, got %s", session.SessionState)
+	}
+
+	// and stopped once its components report no recent activity either
+	if err := StopIdleSessions(ctx, cs, store, freeLocker{}, fakeProbe{seen: time.Now().Add(-90 * time.Minute)}, time.Hour); err != nil {
+		t.Fatalf("StopIdleSessions failed: %v", err)
+	}
+	if session, _, _ := store.Get(ctx, testSessionID); session.SessionState != Stopped {
+		t.Fatalf("expected the idle session to be stopped, got %s", session.SessionState)
+	}
+}
+
+func TestExecActivityProbe(t *testing.T) {
+	ctx := context.Background()
+	cs, _ := newTestEnv()
+	heartbeat := time.Now().Add(-3 * time.Minute).Truncate(time.Second)
+	for name, phase := range map[string]v1.PodPhase{"running": v1.PodRunning, "pending": v1.PodPending} {
+		_, err := cs.CoreV1().Pods("default").Create(ctx, &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": testSessionID}},
+			Status:     v1.PodStatus{Phase: phase},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("failed to create pod: %v", err)
+		}
+	}
+	var ran []string
+	probe := &execActivityProbe{
+		cs: cs,
+		exec: func(ctx context.Context, namespace string, pod string, container string, command []string) (string, error) {
+			ran = append(ran, pod+"/"+container+" "+command[len(command)-1])
+			return fmt.Sprintf("%d\n", heartbeat.Unix()), nil
+		},
+	}
+
+	seen, err := probe.LastActivity(ctx, &SessionInfo{Components: testComponents()}, testSessionID)
+	if err != nil {
+		t.Fatalf("LastActivity failed: %v", err)
+	}
+	if !seen.Equal(heartbeat) {
+		t.Fatalf("expected the heartbeat of the code editor, got %s", seen)
+	}
+	// only the code editor of the running pod records its activity
+	if fmt.Sprint(ran) != "[running/my-code-editor /config/.local/share/code-server/heartbeat]" {
+		t.Fatalf("unexpected commands %v", ran)
+	}
+}
@@ -0,0 +1,205 @@
+package sessions
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// DefaultListLimit is the size of a page of ListSessions when the caller
+	// doesn't ask for one.
+	DefaultListLimit = 50
+	// MaxListLimit is the largest page ListSessions returns.
+	MaxListLimit = 500
+)
+
+var (
+	// ErrInvalidLabels is returned when the labels of a session, or the
+	// selector used to filter sessions by label, are not valid.
+	ErrInvalidLabels = errors.New("invalid labels")
+	// ErrInvalidCursor is returned by ListSessions for a cursor it didn't
+	// hand out.
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// SessionFilter selects the sessions returned by ListSessions. Its zero
+// value selects every session.
+type SessionFilter struct {
+	// State only keeps the sessions in this state. The sessions that have
+	// no components yet are Initialized.
+	State SessionState
+	// ComponentType only keeps the sessions with a component of this type.
+	ComponentType cmp.ComponentType
+	// Labels only keeps the sessions whose labels match this selector.
+	Labels labels.Selector
+}
+
+// ParseLabelSelector parses a selector of session labels, written like the
+// label selectors of Kubernetes (e.g. "team=web,env!=prod").
+func ParseLabelSelector(selector string) (labels.Selector, error) {
+	res, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidLabels, err)
+	}
+	return res, nil
+}
+
+func (f SessionFilter) matches(session *SessionInfo) bool {
+	if f.State != "" && stateOf(session) != f.State {
+		return false
+	}
+	if f.ComponentType != "" {
+		found := false
+		for _, component := range session.Components {
+			if component.ComponentType == f.ComponentType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Labels != nil && !f.Labels.Matches(labels.Set(session.Labels)) {
+		return false
+	}
+	return true
+}
+
+// stateOf returns the state of the session, as reported to the clients.
+func stateOf(session *SessionInfo) SessionState {
+	if session.SessionState == "" {
+		return Initialized
+	}
+	return session.SessionState
+}
+
+// SessionSummary describes a session listed by ListSessions. Name is the
+// name of the session in the API, without the prefix of its ID.
+type SessionSummary struct {
+	SessionID    string            `json:"sessionID"`
+	Name         string            `json:"name"`
+	SessionState SessionState      `json:"sessionState"`
+	Components   []cmp.Component   `json:"components"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	// StopReason tells why a stopped session was stopped.
+	StopReason StopReason `json:"stopReason,omitempty"`
+	// ExpiresAt is nil for the sessions that never expire.
+	ExpiresAt *time.Time  `json:"expiresAt,omitempty"`
+	Expiry    ExpiryState `json:"expiry,omitempty"`
+	// Conditions are the last observations of the objects of the session.
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+// SessionPage is a page of sessions. NextCursor is empty on the last page.
+type SessionPage struct {
+	Sessions   []SessionSummary `json:"sessions"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+// ListSessions returns, sorted by ID, at most limit sessions matching filter,
+// starting after cursor, which is either empty for the first page or the
+// NextCursor of the previous page. A page can be cut short by sessions
+// deleted in the meantime, but never skips a session that existed for the
+// whole listing.
+func ListSessions(ctx context.Context, store SessionStore, filter SessionFilter, cursor string, limit int) (*SessionPage, error) {
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	logging.Logger.Debug("listing sessions", "after", after, "limit", limit)
+
+	page := &SessionPage{Sessions: make([]SessionSummary, 0, limit)}
+	for {
+		sessions, next, err := store.ListPage(ctx, after, limit)
+		if err != nil {
+			logging.Logger.Error("failed to list sessions", "after", after, "error", err)
+			return nil, err
+		}
+		for i, stored := range sessions {
+			if !filter.matches(stored.Session) {
+				continue
+			}
+			summary := SessionSummary{
+				SessionID:    stored.SessionID,
+				Name:         strings.TrimPrefix(stored.SessionID, sessionIDPrefix),
+				SessionState: stateOf(stored.Session),
+				Components:   redactComponents(stored.Session.Components),
+				Labels:       stored.Session.Labels,
+				StopReason:   stored.Session.StopReason,
+				Expiry:       stored.Session.Expiry,
+				Conditions:   stored.Session.Conditions,
+			}
+			if !stored.Session.ExpiresAt.IsZero() {
+				summary.ExpiresAt = &stored.Session.ExpiresAt
+			}
+			page.Sessions = append(page.Sessions, summary)
+			if len(page.Sessions) == limit {
+				if next != "" || i < len(sessions)-1 {
+					page.NextCursor = encodeCursor(stored.SessionID)
+				}
+				return page, nil
+			}
+		}
+		if next == "" {
+			return page, nil
+		}
+		after = next
+	}
+}
+
+// redactComponents returns a copy of components without their passwords,
+// which are not listed along with every session.
+func redactComponents(components []cmp.Component) []cmp.Component {
+	redacted := make([]cmp.Component, len(components))
+	copy(redacted, components)
+	for i := range redacted {
+		redacted[i].ComponentMetadata.Password = ""
+	}
+	return redacted
+}
+
+// validateLabels checks that labels are valid Kubernetes labels, so that
+// they can be selected with the same syntax.
+func validateLabels(sessionLabels map[string]string) error {
+	for key, value := range sessionLabels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("%w: key %q: %s", ErrInvalidLabels, key, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Errorf("%w: value of %q: %s", ErrInvalidLabels, key, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+// The cursors are opaque to the clients, so that they don't build their own.
+func encodeCursor(sessionID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(sessionID))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+	after, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(after), sessionIDPrefix) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidCursor, cursor)
+	}
+	return string(after), nil
+}
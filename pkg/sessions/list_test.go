@@ -0,0 +1,125 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+)
+
+func TestListSessions(t *testing.T) {
+	ctx := context.Background()
+	store := NewSessionStore(cache.NewMemoryStore())
+	for i := 0; i < 7; i++ {
+		session := &SessionInfo{
+			SessionState: Running,
+			Components:   []cmp.Component{{ComponentType: cmp.Code, ComponentID: "code"}},
+			Labels:       map[string]string{"team": "web"},
+		}
+		if i%2 == 1 {
+			session.SessionState = Stopped
+			session.Components = append(session.Components, cmp.Component{ComponentType: cmp.Redis, ComponentID: "cache"})
+			session.Labels = map[string]string{"team": "data"}
+		}
+		store.CreateIfAbsent(ctx, fmt.Sprintf("session-%d", i), session)
+	}
+	store.CreateIfAbsent(ctx, "session-new", &SessionInfo{})
+
+	list := func(filter SessionFilter, limit int) []string {
+		var names []string
+		cursor := ""
+		for {
+			page, err := ListSessions(ctx, store, filter, cursor, limit)
+			if err != nil {
+				t.Fatalf("ListSessions failed: %v", err)
+			}
+			if len(page.Sessions) > limit {
+				t.Fatalf("expected at most %d sessions, got %d", limit, len(page.Sessions))
+			}
+			for _, session := range page.Sessions {
+				names = append(names, session.Name)
+			}
+			if page.NextCursor == "" {
+				return names
+			}
+			cursor = page.NextCursor
+		}
+	}
+
+	if names := list(SessionFilter{}, 3); fmt.Sprint(names) != "[0 1 2 3 4 5 6 new]" {
+		t.Fatalf("unexpected sessions %v", names)
+	}
+	if names := list(SessionFilter{State: Initialized}, 3); fmt.Sprint(names) != "[new]" {
+		t.Fatalf("unexpected initialized sessions %v", names)
+	}
+	if names := list(SessionFilter{ComponentType: cmp.Redis}, 2); fmt.Sprint(names) != "[1 3 5]" {
+		t.Fatalf("unexpected sessions with redis %v", names)
+	}
+	selector, err := ParseLabelSelector("team=web")
+	if err != nil {
+		t.Fatalf("ParseLabelSelector failed: %v", err)
+	}
+	if names := list(SessionFilter{State: Running, Labels: selector}, 2); fmt.Sprint(names) != "[0 2 4 6]" {
+		t.Fatalf("unexpected running web sessions %v", names)
+	}
+
+	if _, err := ListSessions(ctx, store, SessionFilter{}, "not a cursor", 0); !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("expected ErrInvalidCursor, got %v", err)
+	}
+	if _, err := ParseLabelSelector("team in (web"); !errors.Is(err, ErrInvalidLabels) {
+		t.Fatalf("expected ErrInvalidLabels, got %v", err)
+	}
+}
+
+func TestListDeployedSessionsByLabel(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	web := map[string]string{"team": "web"}
+	if err := InitSession(ctx, store, nil, cs, testConfig(), "session-created", cmp.Storage{}, web, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), "session-created", testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	if _, err := ApplySession(ctx, cs, store, nil, testConfig(), "session-applied", testComponents(), cmp.Storage{}, web, 0, false); err != nil {
+		t.Fatalf("ApplySession failed: %v", err)
+	}
+
+	// the labels survive the deployment of the components
+	selector, err := ParseLabelSelector("team=web")
+	if err != nil {
+		t.Fatalf("ParseLabelSelector failed: %v", err)
+	}
+	page, err := ListSessions(ctx, store, SessionFilter{Labels: selector}, "", 0)
+	if err != nil {
+		t.Fatalf("ListSessions failed: %v", err)
+	}
+	var names []string
+	for _, session := range page.Sessions {
+		names = append(names, session.Name)
+	}
+	if fmt.Sprint(names) != "[applied created]" {
+		t.Fatalf("unexpected web sessions %v", names)
+	}
+}
+
+func TestInitSessionRejectsInvalidLabels(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, map[string]string{"team": "not valid"}, 0); !errors.Is(err, ErrInvalidLabels) {
+		t.Fatalf("expected ErrInvalidLabels, got %v", err)
+	}
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, map[string]string{"team": "web"}, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	session, _, err := store.Get(ctx, testSessionID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if session.Labels["team"] != "web" {
+		t.Fatalf("expected the labels to be recorded, got %v", session.Labels)
+	}
+}
@@ -0,0 +1,173 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The prefixes of the records of this package before the keys of autodev
+// were prefixed with cache.KeyPrefix. Sessions were kept at their ID.
+const (
+	legacySessionKeyPrefix  = sessionIDPrefix
+	legacySnapshotKeyPrefix = "snapshot-"
+	legacyTemplateKeyPrefix = "template-"
+)
+
+// Migrate brings the records of this package up to date: it moves the
+// records kept under their legacy keys, and rewrites the sessions written at
+// an older SchemaVersion. It changes nothing when run again, and can run on
+// several replicas at once. It must run before the stores are used, since
+// they don't read the legacy keys.
+func Migrate(ctx context.Context, kv cache.Store) error {
+	logging.Logger.Info("migrating session records", "schemaVersion", SchemaVersion)
+	moves := []struct {
+		from, to string
+		rewrite  cache.RewriteFunc
+	}{
+		{legacySessionKeyPrefix, sessionKeyPrefix + sessionIDPrefix, upgradeSession},
+		{legacySnapshotKeyPrefix, snapshotKeyPrefix, nil},
+		{legacyTemplateKeyPrefix, templateKeyPrefix, nil},
+	}
+	for _, move := range moves {
+		moved, err := cache.MoveKeys(ctx, kv, move.from, move.to, move.rewrite)
+		if err != nil {
+			return fmt.Errorf("failed to move the records under %s: %w", move.from, err)
+		}
+		if moved > 0 {
+			logging.Logger.Info("moved records to their new keys", "from", move.from, "to", move.to, "count", moved)
+		}
+	}
+
+	kvs, err := kv.List(ctx, sessionKeyPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %w", err)
+	}
+	for _, record := range kvs {
+		sessionID := strings.TrimPrefix(record.Key, sessionKeyPrefix)
+		session, err := decodeSession(sessionID, record.Value)
+		if err != nil {
+			logging.Logger.Warn("not upgrading undecodable session record", "sessionID", sessionID, "error", err)
+			continue
+		}
+		if session.SchemaVersion == SchemaVersion {
+			continue
+		}
+		value, err := upgradeSession(record.Value)
+		if err != nil {
+			return err
+		}
+		swapped, err := kv.CompareAndSwap(ctx, record.Key, record.Revision, value)
+		if err != nil {
+			return fmt.Errorf("failed to upgrade session %s: %w", sessionID, err)
+		}
+		if swapped {
+			logging.Logger.Info("upgraded session record", "sessionID", sessionID, "from", session.SchemaVersion, "to", SchemaVersion)
+		}
+		// otherwise it was written in the meantime, at the current version
+	}
+	return nil
+}
+
+// upgradeSession rewrites a session record at the current SchemaVersion.
+// Records of version 0, written before the version was recorded, only lack
+// their version.
+func upgradeSession(value []byte) ([]byte, error) {
+	session, err := decodeSession("", value)
+	if err != nil {
+		return nil, err
+	}
+	return encodeSession(session)
+}
+
+// MigrateVolumeClaims marks the components created before their volumes
+// were named by cmp.VolumeName, whose data is still in the claim their type
+// used back then (see cmp.LegacyVolumeName), so that they keep mounting it:
+// claims can't be renamed. It changes nothing when run again.
+func MigrateVolumeClaims(ctx context.Context, cs kubernetes.Interface, store SessionStore) error {
+	sessions, err := store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %w", err)
+	}
+	for sessionID, session := range sessions {
+		claims := cs.CoreV1().PersistentVolumeClaims(session.namespace())
+		legacy := make(map[string]bool)
+		for _, component := range session.Components {
+			legacyName := cmp.LegacyVolumeName(component.ComponentType)
+			if component.LegacyVolume || legacyName == "" {
+				continue
+			}
+			_, err := claims.Get(ctx, cmp.VolumeName(sessionID, component.ComponentID), metav1.GetOptions{})
+			if err == nil {
+				continue
+			}
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+			_, err = claims.Get(ctx, legacyName, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			logging.Logger.Info("component keeps its legacy PVC", "sessionID", sessionID, "componentID", component.ComponentID, "PVCName", legacyName)
+			legacy[component.ComponentID] = true
+		}
+		if len(legacy) == 0 {
+			continue
+		}
+		_, err := updateSession(ctx, store, sessionID, func(session *SessionInfo) (bool, error) {
+			changed := false
+			for i, component := range session.Components {
+				if legacy[component.ComponentID] && !component.LegacyVolume {
+					session.Components[i].LegacyVolume = true
+					changed = true
+				}
+			}
+			return changed, nil
+		})
+		if err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyClaimShared reports whether claim is a legacy claim of the session
+// that another session of its namespace still mounts. It is then left for
+// the last of them to delete.
+func legacyClaimShared(ctx context.Context, store SessionStore, session *SessionInfo, sessionID string, claim string) (bool, error) {
+	isLegacy := false
+	for _, component := range session.Components {
+		if component.LegacyVolume && cmp.LegacyVolumeName(component.ComponentType) == claim {
+			isLegacy = true
+		}
+	}
+	if !isLegacy {
+		return false, nil
+	}
+	sessions, err := store.List(ctx)
+	if err != nil {
+		return false, err
+	}
+	for otherID, other := range sessions {
+		if otherID == sessionID || other.namespace() != session.namespace() {
+			continue
+		}
+		for _, component := range other.Components {
+			if component.LegacyVolume && cmp.LegacyVolumeName(component.ComponentType) == claim {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
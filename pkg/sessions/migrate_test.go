@@ -0,0 +1,148 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	kv := cache.NewMemoryStore()
+	legacy := map[string]string{
+		"session-old":                `{"sessionState":"running","namespace":"default"}`,
+		"snapshot-session-old/daily": `{"name":"daily","sessionID":"session-old"}`,
+		"template-web":               `{"name":"web","components":[]}`,
+		"session-broken":             `not json`,
+	}
+	for key, value := range legacy {
+		kv.CreateIfAbsent(ctx, key, []byte(value))
+	}
+	kv.CreateIfAbsent(ctx, "unrelated", []byte("kept"))
+	store := NewSessionStore(kv)
+	// a session written by this version, and one by an older version under
+	// the new keys
+	store.CreateIfAbsent(ctx, "session-new", &SessionInfo{SessionState: Stopped})
+	kv.CreateIfAbsent(ctx, sessionKey("session-unversioned"), []byte(`{"sessionState":"stopped"}`))
+
+	for i := 0; i < 2; i++ {
+		if err := Migrate(ctx, kv); err != nil {
+			t.Fatalf("Migrate failed on run %d: %v", i+1, err)
+		}
+	}
+
+	for _, sessionID := range []string{"session-old", "session-new", "session-unversioned"} {
+		session, _, err := store.Get(ctx, sessionID)
+		if err != nil {
+			t.Fatalf("expected session %s to be migrated: %v", sessionID, err)
+		}
+		kvs, _ := kv.List(ctx, sessionKey(sessionID))
+		var recorded SessionInfo
+		if err := json.Unmarshal(kvs[0].Value, &recorded); err != nil || recorded.SchemaVersion != SchemaVersion {
+			t.Fatalf("expected session %s to be recorded at version %d, got %+v", sessionID, SchemaVersion, recorded)
+		}
+		if session.SessionState == "" {
+			t.Fatalf("expected session %s to keep its state", sessionID)
+		}
+	}
+	if _, err := NewSnapshotStore(kv).Get(ctx, "session-old", "daily"); err != nil {
+		t.Fatalf("expected the snapshot to be migrated: %v", err)
+	}
+	if _, _, err := NewTemplateStore(kv).Get(ctx, "web"); err != nil {
+		t.Fatalf("expected the template to be migrated: %v", err)
+	}
+	for key := range legacy {
+		_, err := kv.Get(ctx, key)
+		if key == "session-broken" {
+			// left where it was, rather than lost
+			if err != nil {
+				t.Fatalf("expected the undecodable record to be kept: %v", err)
+			}
+			continue
+		}
+		if !errors.Is(err, cache.ErrNotFound) {
+			t.Fatalf("expected %s to be moved, got %v", key, err)
+		}
+	}
+	if _, err := kv.Get(ctx, "unrelated"); err != nil {
+		t.Fatalf("expected unrelated keys to be kept: %v", err)
+	}
+}
+
+func TestGetRejectsNewerSchema(t *testing.T) {
+	ctx := context.Background()
+	kv := cache.NewMemoryStore()
+	kv.CreateIfAbsent(ctx, sessionKey(testSessionID), []byte(`{"schemaVersion":99}`))
+	if _, _, err := NewSessionStore(kv).Get(ctx, testSessionID); !errors.Is(err, ErrUnsupportedSchema) {
+		t.Fatalf("expected ErrUnsupportedSchema, got %v", err)
+	}
+}
+
+func TestMigrateVolumeClaims(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	// the redis components of every session used to share this claim
+	_, err := cs.CoreV1().PersistentVolumeClaims("default").Create(ctx, &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "redis-data", Namespace: "default"},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create PVC: %v", err)
+	}
+	redis := []cmp.Component{{ComponentType: cmp.Redis, ComponentID: "my-redis"}}
+	for _, sessionID := range []string{"session-old", "session-older"} {
+		store.CreateIfAbsent(ctx, sessionID, &SessionInfo{SessionState: Stopped, Components: redis})
+	}
+	if err := InitSession(ctx, store, nil, cs, testConfig(), "session-new", cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	// clients can't mount the legacy claim themselves
+	withLegacy := []cmp.Component{{ComponentType: cmp.Redis, ComponentID: "my-redis", LegacyVolume: true}}
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), "session-new", withLegacy); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := MigrateVolumeClaims(ctx, cs, store); err != nil {
+			t.Fatalf("MigrateVolumeClaims failed: %v", err)
+		}
+	}
+	for sessionID, want := range map[string]bool{"session-old": true, "session-older": true, "session-new": false} {
+		session, _, _ := store.Get(ctx, sessionID)
+		if session.Components[0].LegacyVolume != want {
+			t.Fatalf("expected the legacy volume of %s to be %t", sessionID, want)
+		}
+	}
+
+	// the data of the old session is mounted when it starts again
+	if err := ToggleDeploy(ctx, cs, store, "session-old"); err != nil {
+		t.Fatalf("ToggleDeploy failed: %v", err)
+	}
+	deployment, err := cs.AppsV1().Deployments("default").Get(ctx, "session-old", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if claim := deployment.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName; claim != "redis-data" {
+		t.Fatalf("expected the legacy claim to be mounted, got %s", claim)
+	}
+
+	// and deleted along with the last session using it
+	if err := DeleteDeploy(ctx, cs, store, nil, testConfig(), "session-old"); err != nil {
+		t.Fatalf("DeleteDeploy failed: %v", err)
+	}
+	if _, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, "redis-data", metav1.GetOptions{}); err != nil {
+		t.Fatalf("expected the shared claim to be kept, got %v", err)
+	}
+	if err := DeleteDeploy(ctx, cs, store, nil, testConfig(), "session-older"); err != nil {
+		t.Fatalf("DeleteDeploy failed: %v", err)
+	}
+	if _, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, "redis-data", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the claim to be deleted with its last session, got %v", err)
+	}
+}
@@ -0,0 +1,325 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hamza-boudouche/autodev/pkg/helpers/k8s"
+	lck "github.com/hamza-boudouche/autodev/pkg/helpers/locking"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Reconciler keeps the state and conditions of the sessions in line with
+// their objects in the cluster. It watches the deployments, services, volume
+// claims and pods labelled with k8s.SessionLabel, and reconciles a session
+// whenever one of its objects, or its record, changes.
+type Reconciler struct {
+	cs     kubernetes.Interface
+	store  SessionStore
+	locker SessionLocker
+	resync time.Duration
+
+	factory     informers.SharedInformerFactory
+	deployments appslisters.DeploymentLister
+	services    corelisters.ServiceLister
+	claims      corelisters.PersistentVolumeClaimLister
+	pods        corelisters.PodLister
+	queue       workqueue.RateLimitingInterface
+}
+
+// NewReconciler returns a Reconciler that also reconciles every session
+// each resync, to catch up with what its watches missed.
+func NewReconciler(cs kubernetes.Interface, store SessionStore, locker SessionLocker, resync time.Duration) *Reconciler {
+	factory := informers.NewSharedInformerFactoryWithOptions(cs, resync,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = k8s.SessionLabel
+		}),
+	)
+	r := &Reconciler{
+		cs:          cs,
+		store:       store,
+		locker:      locker,
+		resync:      resync,
+		factory:     factory,
+		deployments: factory.Apps().V1().Deployments().Lister(),
+		services:    factory.Core().V1().Services().Lister(),
+		claims:      factory.Core().V1().PersistentVolumeClaims().Lister(),
+		pods:        factory.Core().V1().Pods().Lister(),
+		queue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "sessions"),
+	}
+	handler := toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    r.enqueueObject,
+		UpdateFunc: func(_, obj interface{}) { r.enqueueObject(obj) },
+		DeleteFunc: r.enqueueObject,
+	}
+	for _, informer := range []toolscache.SharedIndexInformer{
+		factory.Apps().V1().Deployments().Informer(),
+		factory.Core().V1().Services().Informer(),
+		factory.Core().V1().PersistentVolumeClaims().Informer(),
+		factory.Core().V1().Pods().Informer(),
+	} {
+		informer.AddEventHandler(handler)
+	}
+	return r
+}
+
+// Run labels the objects of the sessions created before they were labelled,
+// starts the watches and reconciles the sessions with workers goroutines
+// until ctx is done.
+func (r *Reconciler) Run(ctx context.Context, workers int) error {
+	defer r.queue.ShutDown()
+
+	sessions, err := r.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	for sessionID, session := range sessions {
+		if err := labelSessionObjects(ctx, r.cs, session, sessionID); err != nil {
+			logging.Logger.Warn("failed to label the objects of session", "sessionID", sessionID, "error", err)
+		}
+	}
+
+	r.factory.Start(ctx.Done())
+	for informer, synced := range r.factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("failed to sync the informer of %s", informer)
+		}
+	}
+	logging.Logger.Info("reconciling sessions", "workers", workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for r.processNext(ctx) {
+			}
+		}()
+	}
+	go r.watchSessions(ctx)
+	for {
+		r.enqueueAll(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.resync):
+		}
+	}
+}
+
+func (r *Reconciler) enqueueObject(obj interface{}) {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	if sessionID := object.GetLabels()[k8s.SessionLabel]; sessionID != "" {
+		r.queue.Add(sessionID)
+	}
+}
+
+func (r *Reconciler) enqueueAll(ctx context.Context) {
+	sessions, err := r.store.List(ctx)
+	if err != nil {
+		logging.Logger.Error("failed to list the sessions to reconcile", "error", err)
+		return
+	}
+	for sessionID := range sessions {
+		r.queue.Add(sessionID)
+	}
+}
+
+// watchSessions reconciles the sessions whose record changes, so that a
+// session created or changed by another replica is looked at right away.
+func (r *Reconciler) watchSessions(ctx context.Context) {
+	for {
+		for event := range r.store.Watch(ctx) {
+			if event.Session != nil {
+				r.queue.Add(event.SessionID)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+			// the watch was cut, by etcd or the network
+		}
+	}
+}
+
+func (r *Reconciler) processNext(ctx context.Context) bool {
+	item, shutdown := r.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.queue.Done(item)
+
+	sessionID := item.(string)
+	requeue, err := r.reconcile(ctx, sessionID)
+	switch {
+	case err != nil:
+		logging.Logger.Error("failed to reconcile session", "sessionID", sessionID, "error", err)
+		r.queue.AddRateLimited(item)
+	case requeue:
+		r.queue.AddRateLimited(item)
+	default:
+		r.queue.Forget(item)
+	}
+	return true
+}
+
+// reconcile records the objects of the session found by the informers in
+// its state and conditions. It asks to be retried later when the session
+// is being changed.
+func (r *Reconciler) reconcile(ctx context.Context, sessionID string) (bool, error) {
+	session, _, err := r.store.Get(ctx, sessionID)
+	if errors.Is(err, ErrSessionNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	obs, err := r.observe(session, sessionID)
+	if err != nil {
+		return false, err
+	}
+	// most events change nothing worth recording, which is checked before
+	// taking the lock of the session
+	unchanged := *session
+	unchanged.Conditions = append([]Condition(nil), session.Conditions...)
+	if !obs.apply(&unchanged, sessionID, time.Now()) {
+		return false, nil
+	}
+
+	drifted := session.Drifted()
+	updated, err := updateUnlessLocked(ctx, r.store, r.locker, sessionID, func(session *SessionInfo) (bool, error) {
+		return obs.apply(session, sessionID, time.Now()), nil
+	})
+	if errors.Is(err, lck.ErrLocked) {
+		return true, nil
+	}
+	if errors.Is(err, ErrSessionNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if updated.Drifted() && !drifted {
+		logging.Logger.Warn("objects of session are missing from the cluster", "sessionID", sessionID, "conditions", updated.Conditions)
+	}
+	logging.Logger.Debug("reconciled session", "sessionID", sessionID, "sessionState", updated.SessionState)
+	return false, nil
+}
+
+// observe is observeCluster reading from the informers.
+func (r *Reconciler) observe(session *SessionInfo, sessionID string) (*observation, error) {
+	namespace := session.namespace()
+	obs := &observation{claims: make(map[string]bool)}
+	deployment, err := r.deployments.Deployments(namespace).Get(sessionID)
+	switch {
+	case err == nil:
+		obs.deployment = deployment
+	case !apierrors.IsNotFound(err):
+		return nil, err
+	}
+	service, err := r.services.Services(namespace).Get(sessionID)
+	switch {
+	case err == nil:
+		obs.service = service
+	case !apierrors.IsNotFound(err):
+		return nil, err
+	}
+	for _, claim := range sessionClaims(session, sessionID) {
+		_, err := r.claims.PersistentVolumeClaims(namespace).Get(claim)
+		switch {
+		case err == nil:
+			obs.claims[claim] = true
+		case !apierrors.IsNotFound(err):
+			return nil, err
+		}
+	}
+	pods, err := r.pods.Pods(namespace).List(labels.SelectorFromSet(labels.Set{k8s.SessionLabel: sessionID}))
+	if err != nil {
+		return nil, err
+	}
+	obs.pods = pods
+	return obs, nil
+}
+
+// labelSessionObjects adds k8s.SessionLabel to the objects of a session
+// created before they were labelled, for the Reconciler to see them. The
+// label is added to the pod template of the deployment too, which replaces
+// its pod with a labelled one.
+func labelSessionObjects(ctx context.Context, cs kubernetes.Interface, session *SessionInfo, sessionID string) error {
+	metadata := map[string]interface{}{
+		"labels": map[string]string{k8s.SessionLabel: sessionID},
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": metadata})
+	if err != nil {
+		return err
+	}
+	deploymentPatch, err := json.Marshal(map[string]interface{}{
+		"metadata": metadata,
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{"metadata": metadata},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	namespace := session.namespace()
+	label := func(object metav1.Object, err error, patchObject func() error) error {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := object.GetLabels()[k8s.SessionLabel]; ok {
+			return nil
+		}
+		logging.Logger.Info("labelling object of session", "sessionID", sessionID, "name", object.GetName())
+		return ignoreNotFound(patchObject())
+	}
+
+	deployments := cs.AppsV1().Deployments(namespace)
+	deployment, err := deployments.Get(ctx, sessionID, metav1.GetOptions{})
+	if err := label(deployment, err, func() error {
+		_, err := deployments.Patch(ctx, sessionID, types.MergePatchType, deploymentPatch, metav1.PatchOptions{})
+		return err
+	}); err != nil {
+		return err
+	}
+	services := cs.CoreV1().Services(namespace)
+	service, err := services.Get(ctx, sessionID, metav1.GetOptions{})
+	if err := label(service, err, func() error {
+		_, err := services.Patch(ctx, sessionID, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	}); err != nil {
+		return err
+	}
+	claims := cs.CoreV1().PersistentVolumeClaims(namespace)
+	for _, name := range sessionClaims(session, sessionID) {
+		claim, err := claims.Get(ctx, name, metav1.GetOptions{})
+		if err := label(claim, err, func() error {
+			_, err := claims.Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
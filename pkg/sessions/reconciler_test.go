@@ -0,0 +1,139 @@
+package sessions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/k8s"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func conditionOf(session *SessionInfo, conditionType ConditionType) *Condition {
+	for i := range session.Conditions {
+		if session.Conditions[i].Type == conditionType {
+			return &session.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// waitForSession waits for the stored session to satisfy done.
+func waitForSession(t *testing.T, ctx context.Context, store SessionStore, what string, done func(*SessionInfo) bool) *SessionInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		session, _, err := store.Get(ctx, testSessionID)
+		if err == nil && done(session) {
+			return session
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s, session: %+v (error: %v)", what, session, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReconcilerFollowsCluster(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs, store := newTestEnv()
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	go NewReconciler(cs, store, freeLocker{}, time.Hour).Run(ctx, 2)
+
+	waitForSession(t, ctx, store, "the pod to be waited for", func(session *SessionInfo) bool {
+		condition := conditionOf(session, DeploymentReady)
+		return condition != nil && condition.Status == metav1.ConditionFalse
+	})
+
+	// no refresh: the session starts running as soon as its pod is ready
+	markDeploymentReady(t, ctx, cs, testSessionID)
+	session := waitForSession(t, ctx, store, "the session to run", func(session *SessionInfo) bool {
+		return session.SessionState == Running
+	})
+	if condition := conditionOf(session, DeploymentReady); condition == nil || condition.Status != metav1.ConditionTrue {
+		t.Fatalf("expected the deployment to be ready, got %+v", condition)
+	}
+	if session.Drifted() {
+		t.Fatalf("expected no drift, got %+v", session.Conditions)
+	}
+
+	if err := cs.CoreV1().Services("default").Delete(ctx, testSessionID, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete service: %v", err)
+	}
+	session = waitForSession(t, ctx, store, "the missing service", func(session *SessionInfo) bool {
+		condition := conditionOf(session, ServiceFound)
+		return condition != nil && condition.Reason == ReasonServiceMissing
+	})
+	if !session.Drifted() || session.SessionState != Running {
+		t.Fatalf("expected a running session that drifted, got %s with %+v", session.SessionState, session.Conditions)
+	}
+
+	if err := cs.CoreV1().PersistentVolumeClaims("default").Delete(ctx, testSessionID, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete volume claim: %v", err)
+	}
+	waitForSession(t, ctx, store, "the missing volume", func(session *SessionInfo) bool {
+		condition := conditionOf(session, VolumesFound)
+		return condition != nil && condition.Reason == ReasonVolumesMissing
+	})
+}
+
+func TestRefreshKeepsSessionWithMissingVolume(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	if err := cs.CoreV1().PersistentVolumeClaims("default").Delete(ctx, testSessionID, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete volume claim: %v", err)
+	}
+
+	session, err := RefreshDeploy(ctx, cs, store, testSessionID)
+	if err != nil {
+		t.Fatalf("RefreshDeploy failed: %v", err)
+	}
+	condition := conditionOf(session, VolumesFound)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Message != "missing volume claims: "+testSessionID {
+		t.Fatalf("expected the workspace volume to be reported missing, got %+v", condition)
+	}
+	if _, _, err := store.Get(ctx, testSessionID); err != nil {
+		t.Fatalf("expected the session to be kept, got %v", err)
+	}
+}
+
+func TestLabelSessionObjects(t *testing.T) {
+	ctx := context.Background()
+	cs, _ := newTestEnv()
+	// a deployment created before the objects of the sessions were labelled
+	_, err := cs.AppsV1().Deployments("default").Create(ctx, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: testSessionID, Namespace: "default"},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create deployment: %v", err)
+	}
+
+	if err := labelSessionObjects(ctx, cs, &SessionInfo{SessionState: Running}, testSessionID); err != nil {
+		t.Fatalf("labelSessionObjects failed: %v", err)
+	}
+	deployment, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if deployment.Labels[k8s.SessionLabel] != testSessionID {
+		t.Fatalf("expected the deployment to be labelled, got %v", deployment.Labels)
+	}
+	// its pod is replaced with one the reconciler watches
+	if deployment.Spec.Template.Labels[k8s.SessionLabel] != testSessionID {
+		t.Fatalf("expected the pod template to be labelled, got %v", deployment.Spec.Template.Labels)
+	}
+}
@@ -0,0 +1,225 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/k8s"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The sagas run by this package, as named in the journal.
+const (
+	initSessionSaga      = "init-session"
+	createDeploySaga     = "create-deploy"
+	deleteSessionSaga    = "delete-session"
+	updateComponentsSaga = "update-components"
+	createSnapshotSaga   = "create-snapshot"
+	restoreSnapshotSaga  = "restore-snapshot"
+)
+
+// The compensations of the steps of these sagas, as named in the journal.
+const (
+	deleteSessionRecordAction   = "delete-session-record"
+	deleteSessionAction         = "delete-session"
+	deleteNamespaceAction       = "delete-namespace"
+	deleteVolumeAction          = "delete-volume"
+	deleteDeploymentAction      = "delete-deployment"
+	deleteServiceAction         = "delete-service"
+	deleteIngressAction         = "delete-ingress"
+	removeIngressRulesAction    = "remove-ingress-rules"
+	restoreSessionObjectsAction = "restore-session-objects"
+	deleteSnapshotRecordAction  = "delete-snapshot-record"
+	deleteVolumeSnapshotAction  = "delete-volume-snapshot"
+)
+
+// objectRef is the input of the compensations acting on one object of a
+// session.
+type objectRef struct {
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// sessionRef is the input of the sagas and compensations acting on a whole
+// session.
+type sessionRef struct {
+	SessionID string `json:"sessionID"`
+}
+
+type snapshotRef struct {
+	SessionID string `json:"sessionID"`
+	Name      string `json:"name"`
+}
+
+// RegisterRecovery registers with j how to recover the sagas of this
+// package journaled in it: deleting a session is resumed, every other saga
+// is compensated. The functions of this package journal their sagas in the
+// journal they are given, and only run them when it is nil.
+func RegisterRecovery(j *consistency.Journal, cs kubernetes.Interface, dc dynamic.Interface, store SessionStore, snapshots SnapshotStore, cfg config.SessionsConfig) {
+	j.RegisterResume(deleteSessionSaga, func(ctx context.Context, input json.RawMessage) error {
+		var ref sessionRef
+		if err := json.Unmarshal(input, &ref); err != nil {
+			return err
+		}
+		return deleteIfExists(ctx, cs, store, j, cfg, ref.SessionID)
+	})
+
+	j.RegisterCompensation(deleteSessionRecordAction, func(ctx context.Context, input json.RawMessage) error {
+		var ref sessionRef
+		if err := json.Unmarshal(input, &ref); err != nil {
+			return err
+		}
+		session, revision, err := store.Get(ctx, ref.SessionID)
+		if errors.Is(err, ErrSessionNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if session.SessionState != "" {
+			// the session was populated since, by someone else
+			return nil
+		}
+		return deleteSession(ctx, store, ref.SessionID, revision)
+	})
+	j.RegisterCompensation(deleteSessionAction, func(ctx context.Context, input json.RawMessage) error {
+		var ref sessionRef
+		if err := json.Unmarshal(input, &ref); err != nil {
+			return err
+		}
+		return deleteIfExists(ctx, cs, store, j, cfg, ref.SessionID)
+	})
+	j.RegisterCompensation(deleteNamespaceAction, func(ctx context.Context, input json.RawMessage) error {
+		var ref objectRef
+		if err := json.Unmarshal(input, &ref); err != nil {
+			return err
+		}
+		return k8s.DeleteNamespace(ctx, cs, ref.Name)
+	})
+	j.RegisterCompensation(deleteVolumeAction, func(ctx context.Context, input json.RawMessage) error {
+		var ref objectRef
+		if err := json.Unmarshal(input, &ref); err != nil {
+			return err
+		}
+		return ignoreNotFound(cs.CoreV1().PersistentVolumeClaims(ref.Namespace).Delete(ctx, ref.Name, metav1.DeleteOptions{}))
+	})
+	j.RegisterCompensation(deleteDeploymentAction, func(ctx context.Context, input json.RawMessage) error {
+		var ref objectRef
+		if err := json.Unmarshal(input, &ref); err != nil {
+			return err
+		}
+		return ignoreNotFound(cs.AppsV1().Deployments(ref.Namespace).Delete(ctx, ref.Name, metav1.DeleteOptions{}))
+	})
+	j.RegisterCompensation(deleteServiceAction, func(ctx context.Context, input json.RawMessage) error {
+		var ref objectRef
+		if err := json.Unmarshal(input, &ref); err != nil {
+			return err
+		}
+		return ignoreNotFound(cs.CoreV1().Services(ref.Namespace).Delete(ctx, ref.Name, metav1.DeleteOptions{}))
+	})
+	j.RegisterCompensation(deleteIngressAction, func(ctx context.Context, input json.RawMessage) error {
+		var ref objectRef
+		if err := json.Unmarshal(input, &ref); err != nil {
+			return err
+		}
+		return ignoreNotFound(cs.NetworkingV1().Ingresses(ref.Namespace).Delete(ctx, ref.Name, metav1.DeleteOptions{}))
+	})
+	j.RegisterCompensation(removeIngressRulesAction, func(ctx context.Context, input json.RawMessage) error {
+		var ref objectRef
+		if err := json.Unmarshal(input, &ref); err != nil {
+			return err
+		}
+		ingress, err := cs.NetworkingV1().Ingresses(ref.Namespace).Get(ctx, cfg.IngressName, metav1.GetOptions{})
+		if err != nil {
+			return ignoreNotFound(err)
+		}
+		ingress.Spec.Rules = withoutSessionRules(ingress.Spec.Rules, ref.Name)
+		_, err = cs.NetworkingV1().Ingresses(ref.Namespace).Update(ctx, ingress, metav1.UpdateOptions{})
+		return err
+	})
+	j.RegisterCompensation(restoreSessionObjectsAction, func(ctx context.Context, input json.RawMessage) error {
+		var ref sessionRef
+		if err := json.Unmarshal(input, &ref); err != nil {
+			return err
+		}
+		return restoreSessionObjects(ctx, cs, store, cfg, ref.SessionID)
+	})
+	j.RegisterCompensation(deleteSnapshotRecordAction, func(ctx context.Context, input json.RawMessage) error {
+		var ref snapshotRef
+		if err := json.Unmarshal(input, &ref); err != nil {
+			return err
+		}
+		err := snapshots.Delete(ctx, ref.SessionID, ref.Name)
+		if errors.Is(err, ErrSnapshotNotFound) {
+			return nil
+		}
+		return err
+	})
+	j.RegisterCompensation(deleteVolumeSnapshotAction, func(ctx context.Context, input json.RawMessage) error {
+		var ref objectRef
+		if err := json.Unmarshal(input, &ref); err != nil {
+			return err
+		}
+		return k8s.DeleteVolumeSnapshot(ctx, dc, ref.Namespace, ref.Name)
+	})
+}
+
+// deleteIfExists is DeleteDeploy, for sessions that may be gone already.
+func deleteIfExists(ctx context.Context, cs kubernetes.Interface, store SessionStore, journal *consistency.Journal, cfg config.SessionsConfig, sessionID string) error {
+	err := DeleteDeploy(ctx, cs, store, journal, cfg, sessionID)
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil
+	}
+	return err
+}
+
+// restoreSessionObjects brings the deployment, service and ingress rules of
+// the session back in line with its record. The record of a session is the
+// last thing updateComponents writes, so it still holds the components the
+// session had before an unfinished update.
+func restoreSessionObjects(ctx context.Context, cs kubernetes.Interface, store SessionStore, cfg config.SessionsConfig, sessionID string) error {
+	session, _, err := store.Get(ctx, sessionID)
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logging.Logger.Info("restoring the session from its record", "sessionID", sessionID)
+	namespace := session.namespace()
+	if session.SessionState != Stopped {
+		containers, volumes, err := cmp.ParseComponents(session.Components, sessionID)
+		if err != nil {
+			return err
+		}
+		deployment, err := cs.AppsV1().Deployments(namespace).Get(ctx, sessionID, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		recorded := newDeployment(sessionID, containers, volumes)
+		deployment.Spec.Strategy = recorded.Spec.Strategy
+		deployment.Spec.Template = recorded.Spec.Template
+		if _, err := cs.AppsV1().Deployments(namespace).Update(ctx, deployment, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+	if err := updateServicePorts(ctx, cs, session, sessionID, session.Components); err != nil {
+		return err
+	}
+	return updateIngressRules(ctx, cs, cfg, session, sessionID, session.Components)
+}
+
+func ignoreNotFound(err error) error {
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
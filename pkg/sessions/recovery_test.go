@@ -0,0 +1,152 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestJournal(t *testing.T, cs kubernetes.Interface, store SessionStore) *consistency.Journal {
+	t.Helper()
+	j := consistency.NewJournal(cache.NewMemoryStore())
+	RegisterRecovery(j, cs, newDynamicClient(), store, NewSnapshotStore(cache.NewMemoryStore()), testConfig())
+	return j
+}
+
+// crashOn makes the first matching request panic, which leaves the saga
+// running it unfinished, as if the process had died.
+func crashOn(cs kubernetes.Interface, verb string, resource string) {
+	crashed := false
+	cs.(*fake.Clientset).PrependReactor(verb, resource, func(k8stesting.Action) (bool, runtime.Object, error) {
+		if !crashed {
+			crashed = true
+			panic("crash")
+		}
+		return false, nil, nil
+	})
+}
+
+func runUntilCrash(t *testing.T, run func() error) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected the saga to crash")
+		}
+	}()
+	run()
+}
+
+func TestRecoverCreateDeploy(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	j := newTestJournal(t, cs, store)
+
+	if err := InitSession(ctx, store, j, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	crashOn(cs, "create", "services")
+	runUntilCrash(t, func() error {
+		return CreateDeploy(ctx, cs, store, j, testConfig(), testSessionID, testComponents())
+	})
+	records, err := j.List(ctx)
+	if err != nil || len(records) != 1 || records[0].Name != createDeploySaga {
+		t.Fatalf("expected the unfinished saga to be journaled, got %+v (err %v)", records, err)
+	}
+
+	if err := j.Recover(ctx, 0); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	if _, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{}); err == nil {
+		t.Fatal("expected the deployment to be deleted")
+	}
+	pvcs, err := cs.CoreV1().PersistentVolumeClaims("default").List(ctx, metav1.ListOptions{})
+	if err != nil || len(pvcs.Items) != 1 {
+		t.Fatalf("expected only the workspace PVC to be left, got %+v (err %v)", pvcs, err)
+	}
+	if records, _ := j.List(ctx); len(records) != 0 {
+		t.Fatalf("expected the recovered saga to be removed, got %+v", records)
+	}
+
+	// the session is back to where it was before the crash
+	if err := CreateDeploy(ctx, cs, store, j, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+}
+
+func TestRecoverDeleteDeploy(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	j := newTestJournal(t, cs, store)
+
+	if err := InitSession(ctx, store, j, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, j, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	crashOn(cs, "delete", "persistentvolumeclaims")
+	runUntilCrash(t, func() error {
+		return DeleteDeploy(ctx, cs, store, j, testConfig(), testSessionID)
+	})
+
+	// deleting a session is resumed rather than rolled back
+	if err := j.Recover(ctx, 0); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	if _, _, err := store.Get(ctx, testSessionID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+	pvcs, err := cs.CoreV1().PersistentVolumeClaims("default").List(ctx, metav1.ListOptions{})
+	if err != nil || len(pvcs.Items) != 0 {
+		t.Fatalf("expected every PVC to be deleted, got %+v (err %v)", pvcs, err)
+	}
+	if records, _ := j.List(ctx); len(records) != 0 {
+		t.Fatalf("expected the recovered saga to be removed, got %+v", records)
+	}
+}
+
+func TestRecoverUpdateComponents(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	j := newTestJournal(t, cs, store)
+
+	if err := InitSession(ctx, store, j, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, j, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	crashOn(cs, "update", "ingresses")
+	runUntilCrash(t, func() error {
+		_, err := AddComponent(ctx, cs, store, j, testConfig(), testSessionID, cmp.Component{
+			ComponentType:   cmp.Redis,
+			ExposeComponent: true,
+			ComponentID:     "other-redis",
+		})
+		return err
+	})
+
+	if err := j.Recover(ctx, 0); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	service, err := cs.CoreV1().Services("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil || len(service.Spec.Ports) != 3 {
+		t.Fatalf("expected the service to be restored, got %+v (err %v)", service, err)
+	}
+	deployment, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil || len(deployment.Spec.Template.Spec.Containers) != 3 {
+		t.Fatalf("expected the deployment to be restored, got %+v (err %v)", deployment, err)
+	}
+	if _, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, cmp.VolumeName(testSessionID, "other-redis"), metav1.GetOptions{}); err == nil {
+		t.Fatal("expected the volume of the new component to be deleted")
+	}
+}
@@ -2,20 +2,21 @@ package sessions
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/k8s"
 	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
-	clientv3 "go.etcd.io/etcd/client/v3"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
@@ -29,28 +30,109 @@ const (
 	Stopped     SessionState = "stopped"
 )
 
+// StopReason tells why a session was stopped.
+type StopReason string
+
+const (
+	// StoppedByUser sessions were toggled off through the API.
+	StoppedByUser StopReason = "toggled"
+	// StoppedIdle sessions were stopped by StopIdleSessions.
+	StoppedIdle StopReason = "idle"
+	// StoppedExpired sessions were stopped by ExpireSessions.
+	StoppedExpired StopReason = "expired"
+)
+
+// defaultNamespace is where sessions recorded before namespaces were
+// configurable live.
+const defaultNamespace = "default"
+
+// SessionInfo is the state of a session as persisted in the SessionStore. A
+// session that was initialized but has no components yet has an empty
+// SessionState.
 type SessionInfo struct {
-	SessionState SessionState    `json:"sessionState"`
-	Components   []cmp.Component `json:"components"`
+	// SchemaVersion is the version of the record, set by the SessionStore.
+	SchemaVersion int             `json:"schemaVersion"`
+	SessionState  SessionState    `json:"sessionState,omitempty"`
+	Components    []cmp.Component `json:"components,omitempty"`
+	// Namespace holds every Kubernetes resource of the session.
+	Namespace string `json:"namespace,omitempty"`
+	// DedicatedNamespace is true when Namespace was created for this
+	// session alone, and must be deleted along with it.
+	DedicatedNamespace bool `json:"dedicatedNamespace,omitempty"`
+	// Workspace is the storage of the workspace volume.
+	Workspace cmp.Storage `json:"workspace,omitempty"`
+	// Resizes tracks the last volume expansion of each component, keyed by
+	// component ID. See ExpandStorage.
+	Resizes map[string]VolumeStatus `json:"resizes,omitempty"`
+	// Labels are set when the session is initialized, to find it with
+	// ListSessions.
+	Labels map[string]string `json:"labels,omitempty"`
+	// LastActivity is the last time the session was seen in use, as
+	// recorded by ActivityTracker.Flush.
+	LastActivity time.Time `json:"lastActivity"`
+	// StopReason tells why a Stopped session was stopped, at StoppedAt.
+	StopReason StopReason `json:"stopReason,omitempty"`
+	StoppedAt  time.Time  `json:"stoppedAt"`
+	// ExpiresAt is when the session expires, or the zero time if it never
+	// does. Expiry tells how close to it the session is. See ExpireSessions.
+	ExpiresAt time.Time   `json:"expiresAt"`
+	Expiry    ExpiryState `json:"expiry,omitempty"`
+	// Conditions are the last observations of the objects of the session
+	// in the cluster, recorded by the Reconciler and RefreshDeploy.
+	Conditions []Condition `json:"conditions,omitempty"`
 }
 
-func InitSession(ctx context.Context, cc *clientv3.Client, kcs *kubernetes.Clientset, sessionID string) error {
-	logging.Logger.Info("initializing session", "sessionID", sessionID)
+// namespaceFor returns the namespace in which a new session is created.
+func namespaceFor(cfg config.SessionsConfig, sessionID string) string {
+	if cfg.DedicatedNamespaces {
+		return sessionID
+	}
+	return cfg.Namespace
+}
 
-	initSessionKey := func(ctx context.Context) (context.Context, func(context.Context), error) {
-		txn := cc.Txn(ctx)
-		txnResp, err := txn.If(
-			clientv3.Compare(clientv3.CreateRevision(sessionID), "=", 0), // Check if key doesn't exist
-		).Then(
-			clientv3.OpPut(sessionID, "{}"),
-		).Commit()
+func (s *SessionInfo) namespace() string {
+	if s.Namespace == "" {
+		return defaultNamespace
+	}
+	return s.Namespace
+}
 
+// InitSession records the session, with its labels, and creates its
+// workspace volume. Unset fields of workspace are taken from the
+// configuration. The session expires ttl from now, or after the configured
+// default time to live if ttl is zero.
+func InitSession(ctx context.Context, store SessionStore, journal *consistency.Journal, kcs kubernetes.Interface, cfg config.SessionsConfig, sessionID string, workspace cmp.Storage, labels map[string]string, ttl time.Duration) error {
+	logging.Logger.Info("initializing session", "sessionID", sessionID)
+	namespace := namespaceFor(cfg, sessionID)
+	workspace, err := cmp.ResolveStorage(workspace, cfg.WorkspaceStorageDefaults(), cfg.StorageBounds)
+	if err != nil {
+		logging.Logger.Error("invalid workspace storage", "sessionID", sessionID)
+		return err
+	}
+	if err := validateLabels(labels); err != nil {
+		logging.Logger.Error("invalid session labels", "sessionID", sessionID)
+		return err
+	}
+	expiresAt, err := expiryFor(cfg, ttl, time.Now())
+	if err != nil {
+		logging.Logger.Error("invalid session time to live", "sessionID", sessionID)
+		return err
+	}
+
+	initSessionKey := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		created, err := store.CreateIfAbsent(ctx, sessionID, &SessionInfo{
+			Namespace:          namespace,
+			DedicatedNamespace: cfg.DedicatedNamespaces,
+			Workspace:          workspace,
+			Labels:             labels,
+			ExpiresAt:          expiresAt,
+		})
 		if err != nil {
 			logging.Logger.Error("some error (other than key already exists) occured", "sessionID", sessionID)
 			return ctx, nil, err
 		}
 
-		if !txnResp.Succeeded {
+		if !created {
 			logging.Logger.Info("session was found, no need to initialize again", "sessionID", sessionID)
 			return ctx, nil, fmt.Errorf("session %s already exists", sessionID)
 		}
@@ -58,92 +140,135 @@ func InitSession(ctx context.Context, cc *clientv3.Client, kcs *kubernetes.Clien
 		ctx = context.WithValue(ctx, "keyWritten", true)
 		logging.Logger.Info("key written to etcd successfully while initializing session", "sessionID", sessionID)
 
-		cancel := func(ctx context.Context) {
+		cancel := func(ctx context.Context) error {
 			logging.Logger.Info("rolling back the write of the etcd key for session initialization", "sessionID", sessionID)
 			if keyWritten, ok := ctx.Value("keyWritten").(bool); ok {
 				if keyWritten {
-					cc.Delete(ctx, sessionID)
+					return store.Delete(ctx, sessionID)
 				}
-			} else {
-				logging.Logger.Error("context is corrupted", "sessionID", sessionID)
+				return nil
 			}
+			logging.Logger.Error("context is corrupted", "sessionID", sessionID)
+			return errors.New("context is corrupted")
 		}
 
 		return ctx, cancel, nil
 	}
 
-	createSessionPVC := func(ctx context.Context) (context.Context, func(context.Context), error) {
-        err := k8s.CreatePVC(ctx, kcs, sessionID, "10Mi")
-        if err != nil {
+	createSessionNamespace := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		err := k8s.CreateNamespace(ctx, kcs, namespace)
+		if err != nil {
+			logging.Logger.Error("failed to create namespace while initializing session", "sessionID", sessionID, "namespace", namespace)
+			return ctx, nil, err
+		}
+
+		logging.Logger.Info("created namespace successfully while initializing session", "sessionID", sessionID, "namespace", namespace)
+
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the creation of the session namespace", "sessionID", sessionID, "namespace", namespace)
+			return k8s.DeleteNamespace(ctx, kcs, namespace)
+		}
+
+		return ctx, cancel, nil
+	}
+
+	createSessionPVC := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		err := k8s.CreatePVC(ctx, kcs, namespace, cmp.WorkspaceVolumeName(sessionID), workspace.Size, workspace.StorageClass, workspace.AccessMode, sessionLabels(sessionID))
+		if err != nil {
 			logging.Logger.Error("failed to create PVC while initializing session", "sessionID", sessionID)
-            return ctx, nil, err
-        }
+			return ctx, nil, err
+		}
 
 		logging.Logger.Info("created PVC successfully while initializing session", "sessionID", sessionID)
 
-        cancel := func(ctx context.Context) {
-            // TODO: Implement this later (not needed because it's the last transaction in the saga)
-        }
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the creation of the workspace PVC", "sessionID", sessionID)
+			return ignoreNotFound(kcs.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, cmp.WorkspaceVolumeName(sessionID), metav1.DeleteOptions{}))
+		}
 
-        return ctx, cancel, nil
-    }
+		return ctx, cancel, nil
+	}
 
-	s := consistency.Saga([]consistency.Transaction{initSessionKey, createSessionPVC})
+	transactions := []consistency.Transaction{consistency.DurableStep("record session", deleteSessionRecordAction, sessionRef{SessionID: sessionID}, initSessionKey)}
+	if cfg.DedicatedNamespaces {
+		transactions = append(transactions, consistency.DurableStep("create namespace", deleteNamespaceAction, objectRef{Name: namespace}, createSessionNamespace))
+	}
+	transactions = append(transactions, consistency.DurableStep("create workspace volume", deleteVolumeAction, objectRef{Namespace: namespace, Name: cmp.WorkspaceVolumeName(sessionID)}, createSessionPVC))
+	s := consistency.Saga(transactions)
 
-	_, err := s.Run()
+	result, err := s.RunJournaled(ctx, journal, initSessionSaga, sessionRef{SessionID: sessionID})
 
 	if err != nil {
-		logging.Logger.Error("initializing session failed", "sessionID", sessionID)
+		logging.Logger.Error("initializing session failed", "sessionID", sessionID, "error", err, "leftBehind", result.LeftBehind())
 	}
 
 	return err
 }
 
-func exposeSession(ctx context.Context, cs *kubernetes.Clientset, sessionID string, components []cmp.Component, ingressName string) ([]cmp.Component, error) {
-	// create all the port that need to be exposed
-	logging.Logger.Info("Exposing session", "session", sessionID)
-	ports := make([]v1.ServicePort, 0, len(components))
-	for _, component := range components {
-		if component.ExposeComponent {
-			ports = append(ports, v1.ServicePort{
-				Port:       int32(component.GetPublicPort()),
-				TargetPort: intstr.FromInt(component.GetPublicPort()),
-				Name:       component.ComponentID,
-			})
-		}
-	}
-	// creating the service
-	service := &v1.Service{
+// newService returns the Service exposing the components of the session.
+func newService(sessionID string, components []cmp.Component) *v1.Service {
+	return &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: sessionID,
+			Name:   sessionID,
+			Labels: sessionLabels(sessionID),
 		},
 		Spec: v1.ServiceSpec{
 			Selector: map[string]string{
 				"app": sessionID,
 			},
-			Ports: ports,
+			Ports: servicePorts(components),
 			Type:  v1.ServiceTypeClusterIP,
 		},
 	}
-	_, err := cs.CoreV1().Services("default").Create(ctx, service, metav1.CreateOptions{})
+}
+
+// createSessionIngress creates the ingress of a session living in a
+// dedicated namespace, and sets the URL of the exposed components.
+func createSessionIngress(ctx context.Context, cs kubernetes.Interface, cfg config.SessionsConfig, namespace string, sessionID string, components []cmp.Component) error {
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: sessionID,
+		},
+		Spec: networkingv1.IngressSpec{
+			Rules: ingressRules(cfg, sessionID, components),
+		},
+	}
+	if cfg.IngressClassName != "" {
+		ingress.Spec.IngressClassName = &cfg.IngressClassName
+	}
+	_, err := cs.NetworkingV1().Ingresses(namespace).Create(ctx, ingress, metav1.CreateOptions{})
 	if err != nil {
-		logging.Logger.Error("failed to create session service", "session", sessionID)
-		return nil, errors.New(fmt.Sprintf("failed to create service for session %s", sessionID))
+		logging.Logger.Error("failed to create session ingress", "sessionID", sessionID, "namespace", namespace)
+		return fmt.Errorf("failed to create the ingress for the session %s: %w", sessionID, err)
 	}
-	logging.Logger.Info("created service successfully", "session", sessionID)
+	logging.Logger.Info("created session ingress successfully", "sessionID", sessionID)
+	return nil
+}
 
-	// update ingress with a new entry
-	ingress, err := cs.NetworkingV1().Ingresses("default").Get(ctx, ingressName, metav1.GetOptions{})
-	if err != nil {
-		logging.Logger.Error("failed to get ingress", "ingressName", ingressName)
-		return nil, errors.New(fmt.Sprintf("failed to get ingress %s", ingressName))
+// servicePorts returns the ports of the session Service, one per exposed
+// component.
+func servicePorts(components []cmp.Component) []v1.ServicePort {
+	ports := make([]v1.ServicePort, 0, len(components))
+	for _, component := range components {
+		if component.ExposeComponent {
+			ports = append(ports, v1.ServicePort{
+				Port:       int32(component.GetPublicPort()),
+				TargetPort: intstr.FromInt(component.GetPublicPort()),
+				Name:       component.ComponentID,
+			})
+		}
 	}
-	logging.Logger.Info("ingress found", "ingressName", ingressName)
+	return ports
+}
+
+// ingressRules returns the ingress rules routing to the exposed components
+// of the session, and sets the URL of these components.
+func ingressRules(cfg config.SessionsConfig, sessionID string, components []cmp.Component) []networkingv1.IngressRule {
 	pathType := networkingv1.PathTypePrefix
-	rules := make([]networkingv1.IngressRule, 0, len(ports))
+	rules := make([]networkingv1.IngressRule, 0, len(components))
 	for i, component := range components {
 		if component.ExposeComponent {
-			url := fmt.Sprintf("%s.%s.hamzaboudouche.tech", sessionID, component.ComponentID)
+			url := fmt.Sprintf("%s.%s.%s", sessionID, component.ComponentID, cfg.BaseDomain)
 			components[i].ComponentMetadata.Url = url
 			rules = append(rules, networkingv1.IngressRule{
 				Host: url,
@@ -168,129 +293,205 @@ func exposeSession(ctx context.Context, cs *kubernetes.Clientset, sessionID stri
 			})
 		}
 	}
+	return rules
+}
 
-	ingress.Spec.Rules = append(ingress.Spec.Rules, rules...)
-	_, err = cs.NetworkingV1().Ingresses("default").Update(ctx, ingress, metav1.UpdateOptions{})
-	if err != nil {
-		logging.Logger.Error("failed to update ingress rules", "sessionID", sessionID)
-		return nil, fmt.Errorf("failed to update the ingress %s with a new rule for the session %s", ingressName, sessionID)
+// withoutSessionRules returns rules, minus the rules routing to the session.
+func withoutSessionRules(rules []networkingv1.IngressRule, sessionID string) []networkingv1.IngressRule {
+	var filteredRules []networkingv1.IngressRule
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.Host, fmt.Sprintf("%s.", sessionID)) {
+			filteredRules = append(filteredRules, rule)
+		}
 	}
-	logging.Logger.Info("updated ingress rules successfully", "sessionID", sessionID)
-	return components, nil
+	return filteredRules
+}
+
+func CreateDeploy(ctx context.Context, cs kubernetes.Interface, store SessionStore, journal *consistency.Journal, cfg config.SessionsConfig, sessionID string, components []cmp.Component) error {
+	return createDeploy(ctx, cs, store, journal, cfg, sessionID, components, nil)
 }
 
-func CreateDeploy(ctx context.Context, cs *kubernetes.Clientset, cc *clientv3.Client, sessionID string, components []cmp.Component) error {
+// createDeploy is CreateDeploy, with the volumes of the components listed in
+// sources (keyed by component ID) restored from the given VolumeSnapshots.
+func createDeploy(ctx context.Context, cs kubernetes.Interface, store SessionStore, journal *consistency.Journal, cfg config.SessionsConfig, sessionID string, components []cmp.Component, sources map[string]string) error {
 	logging.Logger.Info("creating deployment", "sessionID", sessionID)
 	logging.Logger.Info("reading sessionID", "sessionID", sessionID)
-	resp, err := cc.Get(ctx, sessionID)
+	session, revision, err := store.Get(ctx, sessionID)
 	if err != nil {
 		logging.Logger.Error("failed to read session Info from etcd", "sessionID", sessionID)
 		return err
 	}
-	if len(resp.Kvs) == 0 {
-		logging.Logger.Error("session Info not found", "sessionID", sessionID)
-		return fmt.Errorf("session info not found for session %s", sessionID)
-	}
-	sessionState := string(resp.Kvs[0].Value)
-	if sessionState != "{}" {
+	if session.SessionState != "" {
 		// session hasn't been just created
 		logging.Logger.Error("session already populated", "sessionID", sessionID)
 		return errors.New(fmt.Sprintf("session %s is already populated, delete and reinitialize first", sessionID))
 	}
-	var replicas *int32
-	replicas = new(int32)
-	*replicas = 1
+	for i, component := range components {
+		components[i].Resources, err = cmp.ResolveResources(component.Resources, cfg.DefaultResources, cfg.MaxResources)
+		if err != nil {
+			logging.Logger.Error("invalid component resources", "sessionID", sessionID, "componentID", component.ComponentID)
+			return err
+		}
+		// new components get volumes of their own
+		components[i].LegacyVolume = false
+	}
+	err = cmp.GenerateCredentials(components)
+	if err != nil {
+		logging.Logger.Error("failed to generate component credentials", "sessionID", sessionID)
+		return err
+	}
 	containers, volumes, err := cmp.ParseComponents(components, sessionID)
 	if err != nil {
 		logging.Logger.Error("failed to parse components for the new deployment", "sessionID", sessionID)
 		return err
 	}
 
-	logging.Logger.Info("create PVCs for each volume", "sessionID", sessionID)
-	for _, volume := range volumes {
-		if volume.Name == sessionID {
-			logging.Logger.Info("skipping main IDE volume", "sessionID", sessionID)
+	// the storage of every volume is checked before creating any of them
+	storages := make(map[string]cmp.Storage, len(volumes))
+	volumeSources := make(map[string]string, len(sources))
+	for i, component := range components {
+		volumeName := cmp.VolumeName(sessionID, component.ComponentID)
+		if !hasVolume(volumes, volumeName) {
 			continue
 		}
-		err = k8s.CreatePVC(ctx, cs, volume.Name, "20Mi")
+		components[i].Storage, err = cmp.ResolveStorage(component.Storage, cfg.ComponentStorageDefaults(), cfg.StorageBounds)
 		if err != nil {
-			logging.Logger.Error("failed to create PVC", "sessionID", sessionID, "PVCName", volume.Name)
+			logging.Logger.Error("invalid component storage", "sessionID", sessionID, "componentID", component.ComponentID)
 			return err
 		}
-		logging.Logger.Info("created PVC successfully", "sessionID", sessionID, "PVCName", volume.Name)
+		storages[volumeName] = components[i].Storage
+		if source, ok := sources[component.ComponentID]; ok {
+			volumeSources[volumeName] = source
+		}
 	}
 
-	containerValues := make([]v1.Container, len(containers))
-	volumeValues := make([]v1.Volume, len(volumes))
+	namespace := session.namespace()
+	transactions := make([]consistency.Transaction, 0, len(storages)+4)
+	for _, volume := range volumes {
+		storage, ok := storages[volume.Name]
+		if !ok {
+			logging.Logger.Info("skipping main IDE volume", "sessionID", sessionID)
+			continue
+		}
+		volumeName := volume.Name
+		source, fromSnapshot := volumeSources[volumeName]
+		transactions = append(transactions, consistency.DurableStep("create volume "+volumeName, deleteVolumeAction, objectRef{Namespace: namespace, Name: volumeName}, func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+			var err error
+			if fromSnapshot {
+				err = k8s.CreatePVCFromSnapshot(ctx, cs, namespace, volumeName, storage.Size, storage.StorageClass, storage.AccessMode, source, sessionLabels(sessionID))
+			} else {
+				err = k8s.CreatePVC(ctx, cs, namespace, volumeName, storage.Size, storage.StorageClass, storage.AccessMode, sessionLabels(sessionID))
+			}
+			if err != nil {
+				logging.Logger.Error("failed to create PVC", "sessionID", sessionID, "PVCName", volumeName)
+				return ctx, nil, err
+			}
+			logging.Logger.Info("created PVC successfully", "sessionID", sessionID, "PVCName", volumeName)
+			cancel := func(ctx context.Context) error {
+				logging.Logger.Info("rolling back the creation of the PVC", "sessionID", sessionID, "PVCName", volumeName)
+				return ignoreNotFound(cs.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, volumeName, metav1.DeleteOptions{}))
+			}
+			return ctx, cancel, nil
+		}))
+	}
 
-	for i, container := range containers {
-		containerValues[i] = *container
+	createDeployment := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		_, err := cs.AppsV1().Deployments(namespace).Create(ctx, newDeployment(sessionID, containers, volumes), metav1.CreateOptions{})
+		if err != nil {
+			logging.Logger.Error("failed to create the deployment ressource", "sessionID", sessionID)
+			return ctx, nil, err
+		}
+		logging.Logger.Info("created the deployment ressource successfully", "sessionID", sessionID)
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the creation of the deployment", "sessionID", sessionID)
+			return ignoreNotFound(cs.AppsV1().Deployments(namespace).Delete(ctx, sessionID, metav1.DeleteOptions{}))
+		}
+		return ctx, cancel, nil
 	}
 
-	for i, volume := range volumes {
-		volumeValues[i] = *volume
+	createService := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		logging.Logger.Info("Exposing session", "session", sessionID)
+		_, err := cs.CoreV1().Services(namespace).Create(ctx, newService(sessionID, components), metav1.CreateOptions{})
+		if err != nil {
+			logging.Logger.Error("failed to create session service", "session", sessionID)
+			return ctx, nil, fmt.Errorf("failed to create service for session %s: %w", sessionID, err)
+		}
+		logging.Logger.Info("created service successfully", "session", sessionID)
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the creation of the service", "sessionID", sessionID)
+			return ignoreNotFound(cs.CoreV1().Services(namespace).Delete(ctx, sessionID, metav1.DeleteOptions{}))
+		}
+		return ctx, cancel, nil
 	}
 
-	deployment := &appsv1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: sessionID,
-		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: replicas,
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"app": sessionID,
-				},
-			},
-			Template: v1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": sessionID,
-					},
-				},
-				Spec: v1.PodSpec{
-					Containers: containerValues,
-					Volumes:    volumeValues,
-				},
-			},
-		},
+	exposeIngress := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		if session.DedicatedNamespace {
+			// an ingress can only route to services of its own namespace, so
+			// a session living in a dedicated namespace gets its own ingress
+			if err := createSessionIngress(ctx, cs, cfg, namespace, sessionID, components); err != nil {
+				return ctx, nil, err
+			}
+			cancel := func(ctx context.Context) error {
+				logging.Logger.Info("rolling back the creation of the session ingress", "sessionID", sessionID)
+				return ignoreNotFound(cs.NetworkingV1().Ingresses(namespace).Delete(ctx, sessionID, metav1.DeleteOptions{}))
+			}
+			return ctx, cancel, nil
+		}
+		if err := updateIngressRules(ctx, cs, cfg, session, sessionID, components); err != nil {
+			return ctx, nil, err
+		}
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the ingress rules of the session", "sessionID", sessionID)
+			return updateIngressRules(ctx, cs, cfg, session, sessionID, nil)
+		}
+		return ctx, cancel, nil
 	}
 
-	// Create the Deployment
-	_, err = cs.AppsV1().Deployments("default").Create(ctx, deployment, metav1.CreateOptions{})
-	if err != nil {
-		logging.Logger.Error("failed to create the deployment ressource", "sessionID", sessionID)
-		return err
+	recordSession := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		// everything else recorded by InitSession, such as the labels and
+		// the expiry, is kept
+		updated := *session
+		updated.SessionState = Initialized
+		updated.Components = components
+		err := swapSession(ctx, store, sessionID, revision, &updated)
+		if err != nil {
+			logging.Logger.Error("failed to write session status in etcd", "sessionID", sessionID)
+			return ctx, nil, err
+		}
+		return ctx, consistency.NoCompensation, nil
 	}
-	logging.Logger.Info("created the deployment ressource successfully", "sessionID", sessionID)
 
-	// expose the deployment
-	components, err = exposeSession(ctx, cs, sessionID, components, "minimal-ingress")
-	if err != nil {
+	// the rules of a session are removed from the shared ingress, the
+	// ingress of a dedicated namespace is deleted
+	unexpose := removeIngressRulesAction
+	if session.DedicatedNamespace {
+		unexpose = deleteIngressAction
+	}
+	sessionObject := objectRef{Namespace: namespace, Name: sessionID}
+	transactions = append(transactions,
+		consistency.DurableStep("create deployment", deleteDeploymentAction, sessionObject, createDeployment),
+		consistency.DurableStep("create service", deleteServiceAction, sessionObject, createService),
+		consistency.DurableStep("expose session", unexpose, sessionObject, exposeIngress),
+		consistency.Step("record session", recordSession),
+	)
+	if _, err := consistency.Saga(transactions).RunJournaled(ctx, journal, createDeploySaga, sessionRef{SessionID: sessionID}); err != nil {
+		logging.Logger.Error("creating deployment failed", "sessionID", sessionID, "error", err)
 		return err
 	}
 	logging.Logger.Info("exposed the session successfully", "sessionID", sessionID)
+	return nil
+}
 
-	sessionJSON, _ := json.Marshal(SessionInfo{
-		SessionState: Initialized,
-		Components:   components,
-	})
-	_, err = cc.Put(
-		ctx,
-		sessionID,
-		string(sessionJSON))
+func ContainerStatus(ctx context.Context, cs kubernetes.Interface, store SessionStore, sessionID string) (map[string]cmp.ComponentState, error) {
+	session, _, err := store.Get(ctx, sessionID)
 	if err != nil {
-		logging.Logger.Error("failed to write session status in etcd", "sessionID", sessionID)
+		return nil, err
 	}
-	return err
-}
-
-func ContainerStatus(ctx context.Context, cs *kubernetes.Clientset, sessionID string) (map[string]cmp.ComponentState, error) {
-	_, err := cs.AppsV1().Deployments("default").Get(ctx, sessionID, metav1.GetOptions{})
+	_, err = cs.AppsV1().Deployments(session.namespace()).Get(ctx, sessionID, metav1.GetOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get deployment for session: %s", sessionID)
 	}
-	pods, err := cs.CoreV1().Pods("default").List(
+	pods, err := cs.CoreV1().Pods(session.namespace()).List(
 		ctx,
 		metav1.ListOptions{
 			LabelSelector: fmt.Sprintf("app=%s", sessionID),
@@ -322,86 +523,38 @@ func ContainerStatus(ctx context.Context, cs *kubernetes.Clientset, sessionID st
 	return res, nil
 }
 
-func RefreshDeploy(ctx context.Context, cs *kubernetes.Clientset, cc *clientv3.Client, sessionID string) (*SessionInfo, error) {
-	// get stored SessionInfo
-	resp, err := cc.Get(ctx, sessionID)
+// RefreshDeploy updates the state of the session, and the progress of its
+// volume expansions, from the state of the cluster.
+func RefreshDeploy(ctx context.Context, cs kubernetes.Interface, store SessionStore, sessionID string) (*SessionInfo, error) {
+	session, err := refreshState(ctx, cs, store, sessionID)
+	if err != nil || session == nil || len(session.Resizes) == 0 {
+		return session, err
+	}
+	return refreshResizes(ctx, cs, store, sessionID, session)
+}
+
+// refreshState records the objects of the session found in the cluster in
+// its state and conditions, as the Reconciler does.
+func refreshState(ctx context.Context, cs kubernetes.Interface, store SessionStore, sessionID string) (*SessionInfo, error) {
+	session, _, err := store.Get(ctx, sessionID)
 	if err != nil {
 		return nil, err
 	}
-	if len(resp.Kvs) == 0 {
-		return nil, fmt.Errorf("session %s not found", sessionID)
-	}
-	var session SessionInfo
-	err = json.Unmarshal([]byte(resp.Kvs[0].Value), &session)
+	obs, err := observeCluster(ctx, cs, session, sessionID)
 	if err != nil {
 		return nil, err
 	}
-	if session.SessionState == Initialized {
-		deployment, err := cs.AppsV1().Deployments("default").Get(ctx, sessionID, metav1.GetOptions{})
-		if err != nil {
-			// deployment not found
-			// TODO: check the type of this error to see if it concerns anything another than the deployment not being found
-			return nil, err
-		}
-		if deployment.Status.ReadyReplicas == 1 {
-			// deployment is ready
-			session.SessionState = Running
-			sessionJSON, _ := json.Marshal(session)
-			_, err = cc.Put(
-				ctx,
-				sessionID,
-				string(sessionJSON))
-			return &session, err
-		} else {
-			return &session, nil
-		}
-	} else if session.SessionState == Running {
-		deployment, err := cs.AppsV1().Deployments("default").Get(ctx, sessionID, metav1.GetOptions{})
-		if err != nil {
-			// deployment not found
-			// TODO: check the type of this error to see if it concerns anything another than the deployment not being found
-			return nil, err
-		}
-		if deployment.Status.ReadyReplicas == 1 {
-			// deployment is still ready
-			return &session, err
-		} else {
-			_, volumes, _ := cmp.ParseComponents(session.Components, sessionID)
-			for _, volume := range volumes {
-				_, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, volume.Name, metav1.GetOptions{})
-				if err != nil {
-					// the pvc was not found
-					// the session was deleted
-					// delete from cache
-					_, err := cc.Delete(
-						ctx,
-						sessionID)
-					return nil, err
-				}
-			}
-			return &session, nil
-		}
-	} else if session.SessionState == Stopped {
-		_, volumes, _ := cmp.ParseComponents(session.Components, sessionID)
-		for _, volume := range volumes {
-			_, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, volume.Name, metav1.GetOptions{})
-			if err != nil {
-				// the pvc was not found
-				// the session was deleted
-				// delete from cache
-				_, err = cc.Delete(
-					ctx,
-					sessionID)
-				return nil, err
-			}
-		}
-		return &session, nil
-	}
-	return nil, nil
+	return updateSession(ctx, store, sessionID, func(session *SessionInfo) (bool, error) {
+		return obs.apply(session, sessionID, time.Now()), nil
+	})
 }
 
-func GetSessionLogs(ctx context.Context, cs *kubernetes.Clientset, sessionID string, componentID string) (io.ReadCloser, error) {
-	pods, err := cs.CoreV1().Pods("default").List(
+func GetSessionLogs(ctx context.Context, cs kubernetes.Interface, store SessionStore, sessionID string, componentID string) (io.ReadCloser, error) {
+	session, _, err := store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := cs.CoreV1().Pods(session.namespace()).List(
 		ctx,
 		metav1.ListOptions{
 			LabelSelector: fmt.Sprintf("app=%s", sessionID),
@@ -420,7 +573,7 @@ func GetSessionLogs(ctx context.Context, cs *kubernetes.Clientset, sessionID str
 				Follow:    true,
 			}
 			podLogRequest := cs.CoreV1().
-				Pods("default").
+				Pods(session.namespace()).
 				GetLogs(pods.Items[0].Name, &podLogOptions)
 			stream, err := podLogRequest.Stream(ctx)
 			if err != nil {
@@ -433,90 +586,54 @@ func GetSessionLogs(ctx context.Context, cs *kubernetes.Clientset, sessionID str
 	return nil, fmt.Errorf("failed to find component %s", componentID)
 }
 
-func ToggleDeploy(ctx context.Context, cs *kubernetes.Clientset, cc *clientv3.Client, sessionID string) error {
-	resp, err := cc.Get(ctx, sessionID)
-	if err != nil {
-		return err
-	}
-	if len(resp.Kvs) == 0 {
-		return fmt.Errorf("session %s not found", sessionID)
-	}
-	var session SessionInfo
-	err = json.Unmarshal([]byte(resp.Kvs[0].Value), &session)
+func ToggleDeploy(ctx context.Context, cs kubernetes.Interface, store SessionStore, sessionID string) error {
+	session, revision, err := store.Get(ctx, sessionID)
 	if err != nil {
 		return err
 	}
+	updated := *session
 
 	if session.SessionState == Running {
 		// toggle off
-		err = cs.AppsV1().Deployments("default").Delete(ctx, sessionID, metav1.DeleteOptions{})
-		if err != nil {
-			return err
-		}
-		session.SessionState = Stopped
-		sessionJSON, _ := json.Marshal(session)
-		_, err = cc.Put(
-			ctx,
-			sessionID,
-			string(sessionJSON))
-		return err
+		return stopDeploy(ctx, cs, store, sessionID, session, revision, StoppedByUser)
 	} else if session.SessionState == Stopped {
 		// toggle on
-		var replicas *int32
-		replicas = new(int32)
-		*replicas = 1
+		if session.expired(time.Now()) {
+			return fmt.Errorf("%w: session %s must be extended before it is started", ErrSessionExpired, sessionID)
+		}
 		containers, volumes, err := cmp.ParseComponents(session.Components, sessionID)
 		if err != nil {
 			return err
 		}
+		namespace := session.namespace()
 
-		containerValues := make([]v1.Container, len(containers))
-		volumeValues := make([]v1.Volume, len(volumes))
-
-		for i, container := range containers {
-			containerValues[i] = *container
-		}
-
-		for i, volume := range volumes {
-			volumeValues[i] = *volume
-		}
-
-		deployment := &appsv1.Deployment{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: sessionID,
-			},
-			Spec: appsv1.DeploymentSpec{
-				Replicas: replicas,
-				Selector: &metav1.LabelSelector{
-					MatchLabels: map[string]string{
-						"app": sessionID,
-					},
-				},
-				Template: v1.PodTemplateSpec{
-					ObjectMeta: metav1.ObjectMeta{
-						Labels: map[string]string{
-							"app": sessionID,
-						},
-					},
-					Spec: v1.PodSpec{
-						Containers: containerValues,
-						Volumes:    volumeValues,
-					},
-				},
-			},
+		createDeployment := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+			_, err := cs.AppsV1().Deployments(namespace).Create(ctx, newDeployment(sessionID, containers, volumes), metav1.CreateOptions{})
+			if err != nil {
+				return ctx, nil, err
+			}
+			cancel := func(ctx context.Context) error {
+				logging.Logger.Info("rolling back the start of the session", "sessionID", sessionID)
+				return ignoreNotFound(cs.AppsV1().Deployments(namespace).Delete(ctx, sessionID, metav1.DeleteOptions{}))
+			}
+			return ctx, cancel, nil
 		}
-
-		// Create the Deployment
-		_, err = cs.AppsV1().Deployments("default").Create(ctx, deployment, metav1.CreateOptions{})
-		if err != nil {
-			return err
+		recordSession := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+			updated.SessionState = Running
+			updated.StopReason = ""
+			updated.StoppedAt = time.Time{}
+			// the session was idle while stopped, it isn't anymore
+			updated.LastActivity = time.Now()
+			if err := swapSession(ctx, store, sessionID, revision, &updated); err != nil {
+				return ctx, nil, err
+			}
+			return ctx, consistency.NoCompensation, nil
 		}
-		session.SessionState = Running
-		sessionJSON, _ := json.Marshal(session)
-		_, err = cc.Put(
-			ctx,
-			sessionID,
-			string(sessionJSON))
+		// the deployment is deleted again if the record can't be updated
+		_, err = consistency.Saga{
+			consistency.Step("create deployment", createDeployment),
+			consistency.Step("record session", recordSession),
+		}.Run(ctx)
 		return err
 	} else {
 		// session is neither Running nor Stopped
@@ -526,71 +643,365 @@ func ToggleDeploy(ctx context.Context, cs *kubernetes.Clientset, cc *clientv3.Cl
 	}
 }
 
-func DeleteDeploy(ctx context.Context, cs *kubernetes.Clientset, cc *clientv3.Client, sessionID string) error {
-	cs.AppsV1().Deployments("default").Delete(ctx, sessionID, metav1.DeleteOptions{})
-	resp, err := cc.Get(ctx, sessionID)
+// stopDeploy stops the running session, read at revision, by deleting its
+// deployment, and records why it was stopped. Its volumes, service and
+// ingress rules are kept, so that it can be toggled on again. The deployment
+// is created again if the record can't be updated.
+func stopDeploy(ctx context.Context, cs kubernetes.Interface, store SessionStore, sessionID string, session *SessionInfo, revision int64, reason StopReason) error {
+	logging.Logger.Info("stopping session", "sessionID", sessionID, "reason", reason)
+	containers, volumes, err := cmp.ParseComponents(session.Components, sessionID)
 	if err != nil {
 		return err
 	}
-	if len(resp.Kvs) == 0 {
-		return fmt.Errorf("session %s was not found", sessionID)
+	namespace := session.namespace()
+
+	deleteDeployment := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		err := cs.AppsV1().Deployments(namespace).Delete(ctx, sessionID, metav1.DeleteOptions{})
+		if err != nil {
+			return ctx, nil, err
+		}
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the stop of the session", "sessionID", sessionID)
+			_, err := cs.AppsV1().Deployments(namespace).Create(ctx, newDeployment(sessionID, containers, volumes), metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				return nil
+			}
+			return err
+		}
+		return ctx, cancel, nil
+	}
+	recordSession := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		updated := *session
+		updated.SessionState = Stopped
+		updated.StopReason = reason
+		updated.StoppedAt = time.Now()
+		if err := swapSession(ctx, store, sessionID, revision, &updated); err != nil {
+			return ctx, nil, err
+		}
+		return ctx, consistency.NoCompensation, nil
 	}
-	if string(resp.Kvs[0].Value) == "{}" {
-		// session was just initialized
-		// we still need to delete the code editor's pvc
-		cs.CoreV1().PersistentVolumeClaims("default").Delete(
-			ctx,
-			sessionID,
-			metav1.DeleteOptions{},
-		)
+	_, err = consistency.Saga{
+		consistency.Step("delete deployment", deleteDeployment),
+		consistency.Step("record session", recordSession),
+	}.Run(ctx)
+	return err
+}
+
+// deleteRetry retries the deletions of DeleteDeploy when the API server is
+// briefly unavailable. They skip what is already gone, so they can run again.
+var deleteRetry = consistency.WithRetry(consistency.RetryPolicy{
+	Attempts:   3,
+	Backoff:    500 * time.Millisecond,
+	MaxBackoff: 2 * time.Second,
+	Retryable:  isTransient,
+})
+
+func isTransient(err error) bool {
+	return apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsInternalError(err)
+}
 
-		_, err = cc.Delete(
-			ctx,
-			sessionID)
+// DeleteDeploy deletes the session and everything it owns. The deletion of
+// the deployment, service and ingress rules is rolled back if a later step
+// fails; volumes can't be restored once deleted, so they're deleted last,
+// right before the session record. Resources that are already gone are
+// skipped, so a failed deletion can simply be retried.
+func DeleteDeploy(ctx context.Context, cs kubernetes.Interface, store SessionStore, journal *consistency.Journal, cfg config.SessionsConfig, sessionID string) error {
+	session, revision, err := store.Get(ctx, sessionID)
+	if err != nil {
 		return err
 	}
+	namespace := session.namespace()
 
-	var session SessionInfo
-	err = json.Unmarshal([]byte(resp.Kvs[0].Value), &session)
-	if err != nil {
+	forgetSession := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		if err := deleteSession(ctx, store, sessionID, revision); err != nil {
+			return ctx, nil, err
+		}
+		return ctx, consistency.NoCompensation, nil
+	}
+
+	if session.DedicatedNamespace {
+		// everything the session owns lives in its namespace
+		deleteNamespace := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+			err := k8s.DeleteNamespace(ctx, cs, namespace)
+			if err != nil {
+				return ctx, nil, fmt.Errorf("failed to delete namespace %s of session %s: %w", namespace, sessionID, err)
+			}
+			return ctx, consistency.NoCompensation, nil
+		}
+		_, err := consistency.Saga([]consistency.Transaction{
+			consistency.Step("delete namespace", deleteNamespace, deleteRetry),
+			consistency.Step("delete session record", forgetSession),
+		}).RunJournaled(ctx, journal, deleteSessionSaga, sessionRef{SessionID: sessionID})
 		return err
 	}
 
+	removeIngressRules := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		ingress, err := cs.NetworkingV1().Ingresses(namespace).Get(ctx, cfg.IngressName, metav1.GetOptions{})
+		if err != nil {
+			return ctx, nil, fmt.Errorf("failed to get the ingress %s: %w", cfg.IngressName, err)
+		}
+		var removed []networkingv1.IngressRule
+		for _, rule := range ingress.Spec.Rules {
+			if strings.HasPrefix(rule.Host, fmt.Sprintf("%s.", sessionID)) {
+				removed = append(removed, rule)
+			}
+		}
+		if len(removed) == 0 {
+			return ctx, consistency.NoCompensation, nil
+		}
+		ingress.Spec.Rules = withoutSessionRules(ingress.Spec.Rules, sessionID)
+		_, err = cs.NetworkingV1().Ingresses(namespace).Update(ctx, ingress, metav1.UpdateOptions{})
+		if err != nil {
+			return ctx, nil, fmt.Errorf("failed to update ingress %s: %w", cfg.IngressName, err)
+		}
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the removal of the ingress rules of the session", "sessionID", sessionID)
+			ingress, err := cs.NetworkingV1().Ingresses(namespace).Get(ctx, cfg.IngressName, metav1.GetOptions{})
+			if err != nil {
+				logging.Logger.Error("failed to get the ingress to roll back", "ingressName", cfg.IngressName)
+				return err
+			}
+			ingress.Spec.Rules = append(withoutSessionRules(ingress.Spec.Rules, sessionID), removed...)
+			_, err = cs.NetworkingV1().Ingresses(namespace).Update(ctx, ingress, metav1.UpdateOptions{})
+			return err
+		}
+		return ctx, cancel, nil
+	}
+
+	deleteService := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		service, err := cs.CoreV1().Services(namespace).Get(ctx, sessionID, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return ctx, consistency.NoCompensation, nil
+		}
+		if err != nil {
+			return ctx, nil, err
+		}
+		if err := cs.CoreV1().Services(namespace).Delete(ctx, sessionID, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return ctx, nil, err
+		}
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the deletion of the service", "sessionID", sessionID)
+			recreated := newService(sessionID, nil)
+			recreated.Spec.Ports = service.Spec.Ports
+			_, err := cs.CoreV1().Services(namespace).Create(ctx, recreated, metav1.CreateOptions{})
+			return err
+		}
+		return ctx, cancel, nil
+	}
+
+	deleteDeployment := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		deployment, err := cs.AppsV1().Deployments(namespace).Get(ctx, sessionID, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			// stopped sessions have no deployment
+			return ctx, consistency.NoCompensation, nil
+		}
+		if err != nil {
+			return ctx, nil, err
+		}
+		if err := cs.AppsV1().Deployments(namespace).Delete(ctx, sessionID, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return ctx, nil, err
+		}
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the deletion of the deployment", "sessionID", sessionID)
+			recreated := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   deployment.Name,
+					Labels: deployment.Labels,
+				},
+				Spec: deployment.Spec,
+			}
+			_, err := cs.AppsV1().Deployments(namespace).Create(ctx, recreated, metav1.CreateOptions{})
+			return err
+		}
+		return ctx, cancel, nil
+	}
+
+	// the workspace pvc exists even if no component mounts it
+	claims := []string{cmp.WorkspaceVolumeName(sessionID)}
 	_, volumes, err := cmp.ParseComponents(session.Components, sessionID)
 	if err != nil {
 		return err
 	}
-
 	for _, volume := range volumes {
-		cs.CoreV1().PersistentVolumeClaims("default").Delete(
-			ctx,
-			volume.VolumeSource.PersistentVolumeClaim.ClaimName,
-			metav1.DeleteOptions{})
+		if volume.Name == cmp.WorkspaceVolumeName(sessionID) {
+			continue
+		}
+		claim := volume.VolumeSource.PersistentVolumeClaim.ClaimName
+		shared, err := legacyClaimShared(ctx, store, session, sessionID, claim)
+		if err != nil {
+			return err
+		}
+		if shared {
+			logging.Logger.Info("keeping the legacy PVC still used by other sessions", "sessionID", sessionID, "PVCName", claim)
+			continue
+		}
+		claims = append(claims, claim)
+	}
+	deleteVolumes := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		for _, claim := range claims {
+			err := cs.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, claim, metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				logging.Logger.Error("failed to delete PVC", "sessionID", sessionID, "PVCName", claim)
+				return ctx, nil, fmt.Errorf("failed to delete PVC %s: %w", claim, err)
+			}
+		}
+		return ctx, consistency.NoCompensation, nil
 	}
 
-	_ = cs.CoreV1().Services("default").Delete(ctx, sessionID, metav1.DeleteOptions{})
+	var transactions []consistency.Transaction
+	if session.SessionState != "" {
+		// sessions that were just initialized were never exposed
+		transactions = append(transactions,
+			consistency.Step("remove ingress rules", removeIngressRules),
+			consistency.Step("delete service", deleteService, deleteRetry),
+		)
+	}
+	transactions = append(transactions,
+		consistency.Step("delete deployment", deleteDeployment, deleteRetry),
+		consistency.Step("delete volumes", deleteVolumes, deleteRetry),
+		consistency.Step("delete session record", forgetSession),
+	)
+	if _, err := consistency.Saga(transactions).RunJournaled(ctx, journal, deleteSessionSaga, sessionRef{SessionID: sessionID}); err != nil {
+		logging.Logger.Error("deleting session failed", "sessionID", sessionID, "error", err)
+		return err
+	}
+	return nil
+}
 
-	ingress, err := cs.NetworkingV1().Ingresses("default").Get(ctx, "minimal-ingress", metav1.GetOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to get the ingress %s", "minimal-ingress")
+// sessionLabels are the labels of the Kubernetes objects of the session,
+// which the Reconciler watches.
+func sessionLabels(sessionID string) map[string]string {
+	return map[string]string{
+		k8s.ManagedByLabel: "autodev",
+		k8s.SessionLabel:   sessionID,
 	}
-	var filteredRules []networkingv1.IngressRule
-	for _, rule := range ingress.Spec.Rules {
-		if !strings.HasPrefix(rule.Host, fmt.Sprintf("%s.", sessionID)) {
-			filteredRules = append(filteredRules, rule)
+}
+
+// newDeployment returns the Deployment running the containers of the session.
+func newDeployment(sessionID string, containers []*v1.Container, volumes []*v1.Volume) *appsv1.Deployment {
+	var replicas *int32
+	replicas = new(int32)
+	*replicas = 1
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   sessionID,
+			Labels: sessionLabels(sessionID),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": sessionID,
+				},
+			},
+			// the volumes of the session can only be mounted by one pod at
+			// a time, so the old pod must be gone before the new one starts
+			Strategy: appsv1.DeploymentStrategy{
+				Type: appsv1.RecreateDeploymentStrategyType,
+			},
+			Template: podTemplate(sessionID, containers, volumes),
+		},
+	}
+}
+
+// podTemplate returns the template of the pods running the containers of the
+// session.
+func podTemplate(sessionID string, containers []*v1.Container, volumes []*v1.Volume) v1.PodTemplateSpec {
+	containerValues := make([]v1.Container, len(containers))
+	volumeValues := make([]v1.Volume, len(volumes))
+
+	for i, container := range containers {
+		containerValues[i] = *container
+	}
+
+	for i, volume := range volumes {
+		volumeValues[i] = *volume
+	}
+
+	return v1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{
+				"app":            sessionID,
+				k8s.SessionLabel: sessionID,
+			},
+		},
+		Spec: v1.PodSpec{
+			Containers: containerValues,
+			Volumes:    volumeValues,
+		},
+	}
+}
+
+func hasVolume(volumes []*v1.Volume, name string) bool {
+	for _, volume := range volumes {
+		if volume.Name == name {
+			return true
 		}
 	}
-	ingress.Spec.Rules = filteredRules
+	return false
+}
 
-	_, err = cs.NetworkingV1().Ingresses("default").Update(ctx, ingress, metav1.UpdateOptions{})
+// maxConflictRetries bounds how many times updateSession re-reads a session
+// and re-applies its mutation after losing a race with another writer.
+const maxConflictRetries = 3
 
+// swapSession writes updated as the new state of the session, failing with
+// ErrConflict if the session was modified since it was read at revision.
+func swapSession(ctx context.Context, store SessionStore, sessionID string, revision int64, updated *SessionInfo) error {
+	swapped, err := store.CompareAndSwap(ctx, sessionID, revision, updated)
 	if err != nil {
-		return fmt.Errorf("failed to update ingress %s", "minimal-ingress")
+		return err
+	}
+	if !swapped {
+		logging.Logger.Warn("session was modified concurrently", "sessionID", sessionID, "revision", revision)
+		return fmt.Errorf("%w: %s", ErrConflict, sessionID)
 	}
+	return nil
+}
 
-	_, err = cc.Delete(
-		ctx,
-		sessionID)
+// deleteSession removes the session from the store, failing with ErrConflict
+// if the session was modified since it was read at revision.
+func deleteSession(ctx context.Context, store SessionStore, sessionID string, revision int64) error {
+	deleted, err := store.CompareAndDelete(ctx, sessionID, revision)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		logging.Logger.Warn("session was modified concurrently", "sessionID", sessionID, "revision", revision)
+		return fmt.Errorf("%w: %s", ErrConflict, sessionID)
+	}
+	return nil
+}
 
-	return err
+// updateSession applies mutate to the latest stored version of the session
+// and writes it back with swapSession. mutate only touches the session record
+// (no side effects on the cluster), so on conflict it is simply re-applied to
+// a fresh read, up to maxConflictRetries times. mutate reports whether it
+// changed anything; when it didn't, nothing is written.
+func updateSession(ctx context.Context, store SessionStore, sessionID string, mutate func(*SessionInfo) (bool, error)) (*SessionInfo, error) {
+	for attempt := 0; ; attempt++ {
+		session, revision, err := store.Get(ctx, sessionID)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := mutate(session)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			return session, nil
+		}
+		err = swapSession(ctx, store, sessionID, revision, session)
+		if err == nil {
+			return session, nil
+		}
+		if !errors.Is(err, ErrConflict) || attempt >= maxConflictRetries {
+			return nil, err
+		}
+		logging.Logger.Info("retrying session update", "sessionID", sessionID, "attempt", attempt+1)
+	}
 }
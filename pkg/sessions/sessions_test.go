@@ -0,0 +1,748 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testSessionID = "session-test"
+
+func newTestEnv() (kubernetes.Interface, SessionStore) {
+	cs := fake.NewSimpleClientset(&networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "minimal-ingress",
+			Namespace: "default",
+		},
+	})
+	return cs, NewSessionStore(cache.NewMemoryStore())
+}
+
+func testConfig() config.SessionsConfig {
+	return config.Default().Sessions
+}
+
+func testComponents() []cmp.Component {
+	return []cmp.Component{
+		{
+			ComponentType:     cmp.Code,
+			ExposeComponent:   true,
+			ComponentID:       "my-code-editor",
+			ComponentMetadata: cmp.ComponentMetadata{Password: "thisismypassword"},
+		},
+		{
+			ComponentType:   cmp.Redis,
+			ExposeComponent: true,
+			ComponentID:     "my-redis",
+		},
+		{
+			ComponentType:   cmp.Mongo,
+			ExposeComponent: true,
+			ComponentID:     "my-mongo",
+		},
+	}
+}
+
+// markDeploymentReady simulates the deployment controller reporting the
+// session's pod as ready, which the fake clientset never does on its own.
+func markDeploymentReady(t *testing.T, ctx context.Context, cs kubernetes.Interface, sessionID string) {
+	t.Helper()
+	deployment, err := cs.AppsV1().Deployments("default").Get(ctx, sessionID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	deployment.Status.ReadyReplicas = 1
+	if _, err := cs.AppsV1().Deployments("default").UpdateStatus(ctx, deployment, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update deployment status: %v", err)
+	}
+}
+
+func mustRefresh(t *testing.T, ctx context.Context, cs kubernetes.Interface, store SessionStore, want SessionState) *SessionInfo {
+	t.Helper()
+	session, err := RefreshDeploy(ctx, cs, store, testSessionID)
+	if err != nil {
+		t.Fatalf("RefreshDeploy failed: %v", err)
+	}
+	if session.SessionState != want {
+		t.Fatalf("expected session state %q, got %q", want, session.SessionState)
+	}
+	return session
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+
+	// init
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if _, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, testSessionID, metav1.GetOptions{}); err != nil {
+		t.Fatalf("workspace PVC was not created: %v", err)
+	}
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err == nil {
+		t.Fatal("expected re-initializing an existing session to fail")
+	}
+
+	// create
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); err == nil {
+		t.Fatal("expected creating components twice to fail")
+	}
+	deployment, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("deployment was not created: %v", err)
+	}
+	if got := len(deployment.Spec.Template.Spec.Containers); got != 3 {
+		t.Fatalf("expected 3 containers, got %d", got)
+	}
+	service, err := cs.CoreV1().Services("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("service was not created: %v", err)
+	}
+	if got := len(service.Spec.Ports); got != 3 {
+		t.Fatalf("expected 3 service ports, got %d", got)
+	}
+	ingress, err := cs.NetworkingV1().Ingresses("default").Get(ctx, "minimal-ingress", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get ingress: %v", err)
+	}
+	if got := len(ingress.Spec.Rules); got != 3 {
+		t.Fatalf("expected 3 ingress rules, got %d", got)
+	}
+
+	// refresh
+	session := mustRefresh(t, ctx, cs, store, Initialized)
+	if url := session.Components[0].ComponentMetadata.Url; url != "session-test.my-code-editor.hamzaboudouche.tech" {
+		t.Fatalf("unexpected code editor url %q", url)
+	}
+	markDeploymentReady(t, ctx, cs, testSessionID)
+	mustRefresh(t, ctx, cs, store, Running)
+
+	// statuses and logs
+	_, err = cs.CoreV1().Pods("default").Create(ctx, &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   testSessionID + "-pod",
+			Labels: map[string]string{"app": testSessionID},
+		},
+		Spec: deployment.Spec.Template.Spec,
+		Status: v1.PodStatus{
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "my-code-editor", State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}},
+				{Name: "my-redis", State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}}},
+				{Name: "my-mongo", State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{}}},
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create pod: %v", err)
+	}
+	statuses, err := ContainerStatus(ctx, cs, store, testSessionID)
+	if err != nil {
+		t.Fatalf("ContainerStatus failed: %v", err)
+	}
+	if statuses["my-code-editor"] != cmp.Ready || statuses["my-redis"] != cmp.Initializing || statuses["my-mongo"] != cmp.Terminated {
+		t.Fatalf("unexpected container statuses %v", statuses)
+	}
+	logs, err := GetSessionLogs(ctx, cs, store, testSessionID, "my-redis")
+	if err != nil {
+		t.Fatalf("GetSessionLogs failed: %v", err)
+	}
+	if _, err := io.ReadAll(logs); err != nil {
+		t.Fatalf("failed to read logs: %v", err)
+	}
+	logs.Close()
+	if _, err := GetSessionLogs(ctx, cs, store, testSessionID, "unknown"); err == nil {
+		t.Fatal("expected fetching logs of an unknown component to fail")
+	}
+
+	// toggle off and on
+	if err := ToggleDeploy(ctx, cs, store, testSessionID); err != nil {
+		t.Fatalf("ToggleDeploy (off) failed: %v", err)
+	}
+	if _, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{}); err == nil {
+		t.Fatal("expected deployment to be deleted when toggling off")
+	}
+	mustRefresh(t, ctx, cs, store, Stopped)
+	if err := ToggleDeploy(ctx, cs, store, testSessionID); err != nil {
+		t.Fatalf("ToggleDeploy (on) failed: %v", err)
+	}
+	if _, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{}); err != nil {
+		t.Fatalf("expected deployment to be recreated when toggling on: %v", err)
+	}
+
+	// delete
+	if err := DeleteDeploy(ctx, cs, store, nil, testConfig(), testSessionID); err != nil {
+		t.Fatalf("DeleteDeploy failed: %v", err)
+	}
+	if _, _, err := store.Get(ctx, testSessionID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected session to be removed from the store, got %v", err)
+	}
+	pvcs, err := cs.CoreV1().PersistentVolumeClaims("default").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list PVCs: %v", err)
+	}
+	if len(pvcs.Items) != 0 {
+		t.Fatalf("expected all PVCs to be deleted, %d left", len(pvcs.Items))
+	}
+	if _, err := cs.CoreV1().Services("default").Get(ctx, testSessionID, metav1.GetOptions{}); err == nil {
+		t.Fatal("expected service to be deleted")
+	}
+	ingress, err = cs.NetworkingV1().Ingresses("default").Get(ctx, "minimal-ingress", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get ingress: %v", err)
+	}
+	for _, rule := range ingress.Spec.Rules {
+		if strings.HasPrefix(rule.Host, testSessionID+".") {
+			t.Fatalf("ingress rule %s was not removed", rule.Host)
+		}
+	}
+}
+
+func TestDeleteInitializedSession(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := DeleteDeploy(ctx, cs, store, nil, testConfig(), testSessionID); err != nil {
+		t.Fatalf("DeleteDeploy failed: %v", err)
+	}
+	if _, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, testSessionID, metav1.GetOptions{}); err == nil {
+		t.Fatal("expected workspace PVC to be deleted")
+	}
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("expected a deleted session to be re-initializable: %v", err)
+	}
+}
+
+func TestCreateDeployRollback(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	failIngress := true
+	cs.(*fake.Clientset).PrependReactor("update", "ingresses", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if failIngress {
+			return true, nil, errors.New("ingress is unavailable")
+		}
+		return false, nil, nil
+	})
+	err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents())
+	var stepErr *consistency.StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "expose session" {
+		t.Fatalf("expected the expose step to fail, got %v", err)
+	}
+
+	if _, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{}); err == nil {
+		t.Fatal("expected the deployment to be rolled back")
+	}
+	if _, err := cs.CoreV1().Services("default").Get(ctx, testSessionID, metav1.GetOptions{}); err == nil {
+		t.Fatal("expected the service to be rolled back")
+	}
+	pvcs, err := cs.CoreV1().PersistentVolumeClaims("default").List(ctx, metav1.ListOptions{})
+	if err != nil || len(pvcs.Items) != 1 {
+		t.Fatalf("expected only the workspace PVC to be left, got %+v (err %v)", pvcs, err)
+	}
+
+	// nothing is left behind, so the creation can be retried
+	failIngress = false
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+}
+
+func TestDeleteDeployRollback(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	failVolumes := true
+	cs.(*fake.Clientset).PrependReactor("delete", "persistentvolumeclaims", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if failVolumes {
+			return true, nil, errors.New("storage is unavailable")
+		}
+		return false, nil, nil
+	})
+	err := DeleteDeploy(ctx, cs, store, nil, testConfig(), testSessionID)
+	var stepErr *consistency.StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "delete volumes" {
+		t.Fatalf("expected the volumes step to fail, got %v", err)
+	}
+
+	if _, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{}); err != nil {
+		t.Fatalf("expected the deployment to be restored: %v", err)
+	}
+	service, err := cs.CoreV1().Services("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil || len(service.Spec.Ports) != 3 {
+		t.Fatalf("expected the service to be restored, got %+v (err %v)", service, err)
+	}
+	ingress, err := cs.NetworkingV1().Ingresses("default").Get(ctx, "minimal-ingress", metav1.GetOptions{})
+	if err != nil || len(ingress.Spec.Rules) != 3 {
+		t.Fatalf("expected the ingress rules to be restored, got %+v (err %v)", ingress, err)
+	}
+	if _, _, err := store.Get(ctx, testSessionID); err != nil {
+		t.Fatalf("expected the session to be kept: %v", err)
+	}
+
+	failVolumes = false
+	if err := DeleteDeploy(ctx, cs, store, nil, testConfig(), testSessionID); err != nil {
+		t.Fatalf("DeleteDeploy failed: %v", err)
+	}
+	if _, _, err := store.Get(ctx, testSessionID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestDeleteDeployRetries(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	failures := 1
+	cs.(*fake.Clientset).PrependReactor("delete", "persistentvolumeclaims", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if failures > 0 {
+			failures--
+			return true, nil, apierrors.NewServiceUnavailable("storage is restarting")
+		}
+		return false, nil, nil
+	})
+	if err := DeleteDeploy(ctx, cs, store, nil, testConfig(), testSessionID); err != nil {
+		t.Fatalf("expected the deletion to be retried, got %v", err)
+	}
+	if _, _, err := store.Get(ctx, testSessionID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestDedicatedNamespace(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+
+	cfg := testConfig()
+	cfg.DedicatedNamespaces = true
+	if err := InitSession(ctx, store, nil, cs, cfg, testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if _, err := cs.CoreV1().Namespaces().Get(ctx, testSessionID, metav1.GetOptions{}); err != nil {
+		t.Fatalf("session namespace was not created: %v", err)
+	}
+	if _, err := cs.CoreV1().PersistentVolumeClaims(testSessionID).Get(ctx, testSessionID, metav1.GetOptions{}); err != nil {
+		t.Fatalf("workspace PVC was not created in the session namespace: %v", err)
+	}
+
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	session, _, err := store.Get(ctx, testSessionID)
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	if session.Namespace != testSessionID || !session.DedicatedNamespace {
+		t.Fatalf("namespace was not recorded in the session: %+v", session)
+	}
+	if _, err := cs.AppsV1().Deployments(testSessionID).Get(ctx, testSessionID, metav1.GetOptions{}); err != nil {
+		t.Fatalf("deployment was not created in the session namespace: %v", err)
+	}
+	ingress, err := cs.NetworkingV1().Ingresses(testSessionID).Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("session ingress was not created: %v", err)
+	}
+	if got := len(ingress.Spec.Rules); got != 3 {
+		t.Fatalf("expected 3 ingress rules, got %d", got)
+	}
+	shared, err := cs.NetworkingV1().Ingresses("default").Get(ctx, "minimal-ingress", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get shared ingress: %v", err)
+	}
+	if len(shared.Spec.Rules) != 0 {
+		t.Fatal("expected the shared ingress to be left untouched")
+	}
+
+	if err := DeleteDeploy(ctx, cs, store, nil, testConfig(), testSessionID); err != nil {
+		t.Fatalf("DeleteDeploy failed: %v", err)
+	}
+	if _, err := cs.CoreV1().Namespaces().Get(ctx, testSessionID, metav1.GetOptions{}); err == nil {
+		t.Fatal("expected session namespace to be deleted")
+	}
+}
+
+func TestToggleInitializingSession(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	if err := ToggleDeploy(ctx, cs, store, testSessionID); err == nil {
+		t.Fatal("expected toggling an initializing session to fail")
+	}
+}
+
+func TestUnknownSession(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound from CreateDeploy, got %v", err)
+	}
+	if _, err := RefreshDeploy(ctx, cs, store, testSessionID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound from RefreshDeploy, got %v", err)
+	}
+	if err := ToggleDeploy(ctx, cs, store, testSessionID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound from ToggleDeploy, got %v", err)
+	}
+}
+
+// racyStore simulates another replica writing the session right before the
+// next compare-and-swap, as would happen if a lock lease expired mid-request.
+type racyStore struct {
+	SessionStore
+	races int
+}
+
+func (s *racyStore) CompareAndSwap(ctx context.Context, sessionID string, revision int64, session *SessionInfo) (bool, error) {
+	if s.races > 0 {
+		s.races--
+		current, currentRevision, err := s.SessionStore.Get(ctx, sessionID)
+		if err != nil {
+			return false, err
+		}
+		if _, err := s.SessionStore.CompareAndSwap(ctx, sessionID, currentRevision, current); err != nil {
+			return false, err
+		}
+	}
+	return s.SessionStore.CompareAndSwap(ctx, sessionID, revision, session)
+}
+
+func TestConcurrentModification(t *testing.T) {
+	ctx := context.Background()
+	cs, memStore := newTestEnv()
+	store := &racyStore{SessionStore: memStore}
+
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+
+	// writes that follow side effects on the cluster are not retried
+	store.races = 1
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict from CreateDeploy, got %v", err)
+	}
+	session, _, err := store.Get(ctx, testSessionID)
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	if session.SessionState != "" {
+		t.Fatalf("expected the losing write to be discarded, got state %q", session.SessionState)
+	}
+}
+
+func TestRefreshRetriesOnConflict(t *testing.T) {
+	ctx := context.Background()
+	cs, memStore := newTestEnv()
+	store := &racyStore{SessionStore: memStore}
+
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	markDeploymentReady(t, ctx, cs, testSessionID)
+
+	store.races = maxConflictRetries
+	mustRefresh(t, ctx, cs, store, Running)
+
+	store.races = maxConflictRetries + 1
+	if err := ToggleDeploy(ctx, cs, store, testSessionID); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict from ToggleDeploy, got %v", err)
+	}
+}
+
+func TestToggleRollsBackOnConflict(t *testing.T) {
+	ctx := context.Background()
+	cs, memStore := newTestEnv()
+	store := &racyStore{SessionStore: memStore}
+
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	markDeploymentReady(t, ctx, cs, testSessionID)
+	mustRefresh(t, ctx, cs, store, Running)
+
+	// the session is changed elsewhere while it is stopped
+	store.races = 1
+	if err := ToggleDeploy(ctx, cs, store, testSessionID); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if _, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{}); err != nil {
+		t.Fatalf("expected the deployment of the running session to be created again, got %v", err)
+	}
+
+	if err := ToggleDeploy(ctx, cs, store, testSessionID); err != nil {
+		t.Fatalf("ToggleDeploy failed: %v", err)
+	}
+	// and while it is started
+	store.races = 1
+	if err := ToggleDeploy(ctx, cs, store, testSessionID); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if _, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{}); err == nil {
+		t.Fatal("expected the deployment of the stopped session to be deleted again")
+	}
+	session, _, err := store.Get(ctx, testSessionID)
+	if err != nil || session.SessionState != Stopped {
+		t.Fatalf("expected the session to stay stopped, got %+v (err %v)", session, err)
+	}
+}
+
+func TestSessionsShareNamespace(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	const otherSessionID = "session-other"
+
+	for _, sessionID := range []string{testSessionID, otherSessionID} {
+		if err := InitSession(ctx, store, nil, cs, testConfig(), sessionID, cmp.Storage{}, nil, 0); err != nil {
+			t.Fatalf("InitSession failed: %v", err)
+		}
+		if err := CreateDeploy(ctx, cs, store, nil, testConfig(), sessionID, testComponents()); err != nil {
+			t.Fatalf("CreateDeploy of %s failed: %v", sessionID, err)
+		}
+	}
+	pvcs, err := cs.CoreV1().PersistentVolumeClaims("default").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list PVCs: %v", err)
+	}
+	// a workspace, a redis and a mongo volume per session
+	if len(pvcs.Items) != 6 {
+		t.Fatalf("expected 6 PVCs, got %d", len(pvcs.Items))
+	}
+
+	if err := DeleteDeploy(ctx, cs, store, nil, testConfig(), testSessionID); err != nil {
+		t.Fatalf("DeleteDeploy failed: %v", err)
+	}
+	pvcs, err = cs.CoreV1().PersistentVolumeClaims("default").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list PVCs: %v", err)
+	}
+	if len(pvcs.Items) != 3 {
+		t.Fatalf("expected the PVCs of the other session to be kept, got %d", len(pvcs.Items))
+	}
+	for _, pvc := range pvcs.Items {
+		if !strings.HasPrefix(pvc.Name, otherSessionID) {
+			t.Fatalf("unexpected PVC %s left behind", pvc.Name)
+		}
+	}
+}
+
+func TestComponentResources(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	components := testComponents()
+	components[1].Resources.Limits.Memory = "64Gi"
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, components); !errors.Is(err, cmp.ErrInvalidComponent) {
+		t.Fatalf("expected resources above the caps to be rejected, got %v", err)
+	}
+	if _, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{}); err == nil {
+		t.Fatal("expected no deployment to be created")
+	}
+
+	components[1].Resources.Limits.Memory = "512Mi"
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, components); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	session, _, err := store.Get(ctx, testSessionID)
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	if r := session.Components[1].Resources; r.Limits.Memory != "512Mi" || r.Requests.CPU != "100m" {
+		t.Fatalf("expected resolved resources to be recorded, got %+v", r)
+	}
+	deployment, err := cs.AppsV1().Deployments("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("deployment was not created: %v", err)
+	}
+	if limits := deployment.Spec.Template.Spec.Containers[1].Resources.Limits; limits.Memory().String() != "512Mi" {
+		t.Fatalf("unexpected container limits %v", limits)
+	}
+}
+
+func TestComponentStorage(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	cfg := testConfig()
+	cfg.StorageBounds.StorageClasses = []string{"standard", "fast-ssd"}
+
+	if err := InitSession(ctx, store, nil, cs, cfg, testSessionID, cmp.Storage{Size: "1Ti"}, nil, 0); !errors.Is(err, cmp.ErrInvalidComponent) {
+		t.Fatalf("expected a workspace above the maximum size to be rejected, got %v", err)
+	}
+	workspace := cmp.Storage{Size: "20Gi", StorageClass: "fast-ssd"}
+	if err := InitSession(ctx, store, nil, cs, cfg, testSessionID, workspace, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	pvc, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("workspace PVC was not created: %v", err)
+	}
+	if size := pvc.Spec.Resources.Requests[v1.ResourceStorage]; size.String() != "20Gi" || *pvc.Spec.StorageClassName != "fast-ssd" {
+		t.Fatalf("unexpected workspace PVC spec %+v", pvc.Spec)
+	}
+
+	components := testComponents()
+	components[1].Storage = cmp.Storage{Size: "1Gi", AccessMode: v1.ReadWriteOncePod}
+	components[2].Storage = cmp.Storage{StorageClass: "gold"}
+	if err := CreateDeploy(ctx, cs, store, nil, cfg, testSessionID, components); !errors.Is(err, cmp.ErrInvalidComponent) {
+		t.Fatalf("expected a storage class outside of the allowed ones to be rejected, got %v", err)
+	}
+	pvcs, err := cs.CoreV1().PersistentVolumeClaims("default").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list PVCs: %v", err)
+	}
+	if len(pvcs.Items) != 1 {
+		t.Fatalf("expected no component PVC to be created, got %d PVCs", len(pvcs.Items))
+	}
+
+	components[2].Storage = cmp.Storage{}
+	if err := CreateDeploy(ctx, cs, store, nil, cfg, testSessionID, components); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+	pvc, err = cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, cmp.VolumeName(testSessionID, "my-redis"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("redis PVC was not created: %v", err)
+	}
+	if size := pvc.Spec.Resources.Requests[v1.ResourceStorage]; size.String() != "1Gi" || pvc.Spec.AccessModes[0] != v1.ReadWriteOncePod {
+		t.Fatalf("unexpected redis PVC spec %+v", pvc.Spec)
+	}
+	session, _, err := store.Get(ctx, testSessionID)
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	if session.Workspace.Size != "20Gi" || session.Components[2].Storage.Size != "20Mi" {
+		t.Fatalf("expected resolved storage to be recorded, got %+v", session)
+	}
+}
+
+func TestExpandStorage(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	allow, deny := true, false
+	for _, class := range []*storagev1.StorageClass{
+		{
+			ObjectMeta:           metav1.ObjectMeta{Name: "standard", Annotations: map[string]string{defaultStorageClassAnnotation: "true"}},
+			AllowVolumeExpansion: &allow,
+		},
+		{
+			ObjectMeta:           metav1.ObjectMeta{Name: "fixed"},
+			AllowVolumeExpansion: &deny,
+		},
+	} {
+		if _, err := cs.StorageV1().StorageClasses().Create(ctx, class, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("failed to create storage class: %v", err)
+		}
+	}
+
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	components := testComponents()
+	components[2].Storage.StorageClass = "fixed"
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, components); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+
+	if _, err := ExpandStorage(ctx, cs, store, testConfig(), testSessionID, "my-mongo", "1Gi"); !errors.Is(err, ErrExpansionNotAllowed) {
+		t.Fatalf("expected ErrExpansionNotAllowed, got %v", err)
+	}
+	if _, err := ExpandStorage(ctx, cs, store, testConfig(), testSessionID, "my-redis", "1Mi"); !errors.Is(err, cmp.ErrInvalidComponent) {
+		t.Fatalf("expected shrinking to be rejected, got %v", err)
+	}
+	if _, err := ExpandStorage(ctx, cs, store, testConfig(), testSessionID, "unknown", "1Gi"); !errors.Is(err, ErrComponentNotFound) {
+		t.Fatalf("expected ErrComponentNotFound, got %v", err)
+	}
+
+	// the code editor grows the workspace
+	if _, err := ExpandStorage(ctx, cs, store, testConfig(), testSessionID, "my-code-editor", "1Gi"); err != nil {
+		t.Fatalf("ExpandStorage failed: %v", err)
+	}
+	pvc, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, testSessionID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get workspace PVC: %v", err)
+	}
+	if size := pvc.Spec.Resources.Requests[v1.ResourceStorage]; size.String() != "1Gi" {
+		t.Fatalf("expected the workspace PVC to be patched, got %s", size.String())
+	}
+
+	// simulate the resize going through
+	pvc.Status.Capacity = v1.ResourceList{v1.ResourceStorage: resource.MustParse("10Mi")}
+	pvc.Status.Conditions = []v1.PersistentVolumeClaimCondition{
+		{Type: v1.PersistentVolumeClaimResizing, Status: v1.ConditionTrue},
+	}
+	if pvc, err = cs.CoreV1().PersistentVolumeClaims("default").UpdateStatus(ctx, pvc, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update PVC status: %v", err)
+	}
+	session := mustRefresh(t, ctx, cs, store, Initialized)
+	if state := session.Resizes["my-code-editor"].ResizeState; state != ResizeInProgress {
+		t.Fatalf("expected the resize to be in progress, got %q", state)
+	}
+	if session.Workspace.Size != "1Gi" {
+		t.Fatalf("expected the new workspace size to be recorded, got %q", session.Workspace.Size)
+	}
+
+	pvc.Status.Capacity = v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")}
+	pvc.Status.Conditions = nil
+	if _, err = cs.CoreV1().PersistentVolumeClaims("default").UpdateStatus(ctx, pvc, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update PVC status: %v", err)
+	}
+	session = mustRefresh(t, ctx, cs, store, Initialized)
+	if resize := session.Resizes["my-code-editor"]; resize.ResizeState != ResizeCompleted || resize.Capacity != "1Gi" {
+		t.Fatalf("expected the resize to be completed, got %+v", resize)
+	}
+
+	statuses, err := StorageStatus(ctx, cs, store, testSessionID)
+	if err != nil {
+		t.Fatalf("StorageStatus failed: %v", err)
+	}
+	if len(statuses) != 3 || statuses["my-code-editor"].Capacity != "1Gi" {
+		t.Fatalf("unexpected storage statuses %+v", statuses)
+	}
+}
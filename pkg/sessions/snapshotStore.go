@@ -0,0 +1,118 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+)
+
+// snapshotKeyPrefix is the prefix of the snapshot records. They are kept
+// apart from the session records so that they outlive the session.
+const snapshotKeyPrefix = cache.KeyPrefix + "snapshots/"
+
+var (
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	ErrSnapshotExists   = errors.New("snapshot already exists")
+)
+
+// SnapshotVolume is the VolumeSnapshot of one volume of a session.
+type SnapshotVolume struct {
+	// ComponentID is empty for the workspace volume.
+	ComponentID  string      `json:"componentID,omitempty"`
+	ClaimName    string      `json:"claimName"`
+	SnapshotName string      `json:"snapshotName"`
+	Storage      cmp.Storage `json:"storage"`
+	ReadyToUse   bool        `json:"readyToUse"`
+	Error        string      `json:"error,omitempty"`
+}
+
+// SnapshotInfo records a snapshot of every volume of a session, along with
+// what is needed to recreate the session from it.
+type SnapshotInfo struct {
+	Name       string           `json:"name"`
+	SessionID  string           `json:"sessionID"`
+	Namespace  string           `json:"namespace"`
+	CreatedAt  time.Time        `json:"createdAt"`
+	Workspace  cmp.Storage      `json:"workspace"`
+	Components []cmp.Component  `json:"components,omitempty"`
+	Volumes    []SnapshotVolume `json:"volumes"`
+}
+
+// SnapshotStore persists the SnapshotInfo of every snapshot, per session.
+type SnapshotStore interface {
+	Get(ctx context.Context, sessionID string, name string) (*SnapshotInfo, error)
+	// CreateIfAbsent stores snapshot only if the session has no snapshot
+	// with the same name yet, and reports whether it did.
+	CreateIfAbsent(ctx context.Context, snapshot *SnapshotInfo) (bool, error)
+	Delete(ctx context.Context, sessionID string, name string) error
+	// List returns the snapshots of the session, sorted by name.
+	List(ctx context.Context, sessionID string) ([]*SnapshotInfo, error)
+}
+
+type snapshotStore struct {
+	kv cache.Store
+}
+
+// NewSnapshotStore returns a SnapshotStore that keeps snapshots as JSON
+// documents in kv.
+func NewSnapshotStore(kv cache.Store) SnapshotStore {
+	return &snapshotStore{kv: kv}
+}
+
+func snapshotKeys(sessionID string) string {
+	return fmt.Sprintf("%s%s/", snapshotKeyPrefix, sessionID)
+}
+
+func snapshotKey(sessionID string, name string) string {
+	return snapshotKeys(sessionID) + name
+}
+
+func (s *snapshotStore) Get(ctx context.Context, sessionID string, name string) (*SnapshotInfo, error) {
+	kv, err := s.kv.Get(ctx, snapshotKey(sessionID, name))
+	if errors.Is(err, cache.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s of %s", ErrSnapshotNotFound, name, sessionID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot SnapshotInfo
+	if err := json.Unmarshal(kv.Value, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %s of %s: %w", name, sessionID, err)
+	}
+	return &snapshot, nil
+}
+
+func (s *snapshotStore) CreateIfAbsent(ctx context.Context, snapshot *SnapshotInfo) (bool, error) {
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return false, err
+	}
+	return s.kv.CreateIfAbsent(ctx, snapshotKey(snapshot.SessionID, snapshot.Name), snapshotJSON)
+}
+
+func (s *snapshotStore) Delete(ctx context.Context, sessionID string, name string) error {
+	return s.kv.Delete(ctx, snapshotKey(sessionID, name))
+}
+
+func (s *snapshotStore) List(ctx context.Context, sessionID string) ([]*SnapshotInfo, error) {
+	kvs, err := s.kv.List(ctx, snapshotKeys(sessionID))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*SnapshotInfo, 0, len(kvs))
+	for _, kv := range kvs {
+		var snapshot SnapshotInfo
+		if err := json.Unmarshal(kv.Value, &snapshot); err != nil {
+			logging.Logger.Warn("skipping undecodable snapshot record", "key", kv.Key)
+			continue
+		}
+		res = append(res, &snapshot)
+	}
+	return res, nil
+}
@@ -0,0 +1,263 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/consistency"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/k8s"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	// ErrSnapshotsUnsupported is returned when snapshotting sessions living
+	// in dedicated namespaces: their snapshots would be deleted along with
+	// the namespace, and couldn't be restored in another one anyway.
+	ErrSnapshotsUnsupported = errors.New("snapshots are not supported for sessions in dedicated namespaces")
+	// ErrSnapshotNotRestorable is returned when restoring a snapshot that
+	// isn't ready yet, or that lives in another namespace than the new
+	// session.
+	ErrSnapshotNotRestorable = errors.New("snapshot can't be restored")
+)
+
+// snapshotLabel marks the VolumeSnapshots with the name of the snapshot
+// they're part of.
+const snapshotLabel = "autodev/snapshot"
+
+// CreateSnapshot takes a VolumeSnapshot of every volume of the session (the
+// workspace and the volumes of its components) and records them under name.
+// An empty name defaults to the current time.
+func CreateSnapshot(ctx context.Context, cs kubernetes.Interface, dc dynamic.Interface, store SessionStore, journal *consistency.Journal, snapshots SnapshotStore, cfg config.SessionsConfig, sessionID string, name string) (*SnapshotInfo, error) {
+	logging.Logger.Info("creating snapshot", "sessionID", sessionID, "snapshot", name)
+	session, _, err := store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.DedicatedNamespace {
+		return nil, ErrSnapshotsUnsupported
+	}
+	if name == "" {
+		name = time.Now().UTC().Format("20060102-150405")
+	}
+	if msgs := validation.IsDNS1123Label(name); len(msgs) > 0 {
+		return nil, fmt.Errorf("%w: invalid snapshot name %q: %s", cmp.ErrInvalidComponent, name, strings.Join(msgs, ", "))
+	}
+	namespace := session.namespace()
+
+	snapshot := &SnapshotInfo{
+		Name:       name,
+		SessionID:  sessionID,
+		Namespace:  namespace,
+		CreatedAt:  time.Now().UTC(),
+		Workspace:  session.Workspace,
+		Components: session.Components,
+	}
+	claims := []SnapshotVolume{{ClaimName: cmp.WorkspaceVolumeName(sessionID)}}
+	for _, component := range session.Components {
+		_, claimName, err := componentVolume(session, sessionID, component.ComponentID)
+		if err != nil || claimName == cmp.WorkspaceVolumeName(sessionID) {
+			continue
+		}
+		claims = append(claims, SnapshotVolume{ComponentID: component.ComponentID, ClaimName: claimName})
+	}
+	for _, claim := range claims {
+		// the claim is the source of truth for the size the volume must be
+		// restored with
+		pvc, err := cs.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, claim.ClaimName, metav1.GetOptions{})
+		if err != nil {
+			logging.Logger.Error("failed to get PVC to snapshot", "sessionID", sessionID, "PVCName", claim.ClaimName)
+			return nil, err
+		}
+		claim.Storage = claimStorage(pvc)
+		claim.SnapshotName = fmt.Sprintf("%s-%s", claim.ClaimName, name)
+		snapshot.Volumes = append(snapshot.Volumes, claim)
+	}
+
+	recordSnapshot := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		created, err := snapshots.CreateIfAbsent(ctx, snapshot)
+		if err != nil {
+			return ctx, nil, err
+		}
+		if !created {
+			return ctx, nil, fmt.Errorf("%w: %s of %s", ErrSnapshotExists, name, sessionID)
+		}
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the snapshot record", "sessionID", sessionID, "snapshot", name)
+			return snapshots.Delete(ctx, sessionID, name)
+		}
+		return ctx, cancel, nil
+	}
+	transactions := []consistency.Transaction{consistency.DurableStep("record snapshot", deleteSnapshotRecordAction, snapshotRef{SessionID: sessionID, Name: name}, recordSnapshot)}
+	for _, volume := range snapshot.Volumes {
+		volume := volume
+		transactions = append(transactions, consistency.DurableStep("snapshot volume "+volume.ClaimName, deleteVolumeSnapshotAction, objectRef{Namespace: namespace, Name: volume.SnapshotName}, func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+			err := k8s.CreateVolumeSnapshot(ctx, dc, namespace, volume.SnapshotName, volume.ClaimName, cfg.SnapshotClassName, map[string]string{
+				"app":         sessionID,
+				snapshotLabel: name,
+			})
+			if err != nil {
+				return ctx, nil, err
+			}
+			cancel := func(ctx context.Context) error {
+				logging.Logger.Info("rolling back the volume snapshot", "sessionID", sessionID, "snapshot", volume.SnapshotName)
+				return k8s.DeleteVolumeSnapshot(ctx, dc, namespace, volume.SnapshotName)
+			}
+			return ctx, cancel, nil
+		}))
+	}
+	if _, err := consistency.Saga(transactions).RunJournaled(ctx, journal, createSnapshotSaga, snapshotRef{SessionID: sessionID, Name: name}); err != nil {
+		logging.Logger.Error("creating snapshot failed", "sessionID", sessionID, "snapshot", name)
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func claimStorage(pvc *v1.PersistentVolumeClaim) cmp.Storage {
+	size := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	storage := cmp.Storage{Size: size.String()}
+	if pvc.Spec.StorageClassName != nil {
+		storage.StorageClass = *pvc.Spec.StorageClassName
+	}
+	if len(pvc.Spec.AccessModes) > 0 {
+		storage.AccessMode = pvc.Spec.AccessModes[0]
+	}
+	return storage
+}
+
+// refreshSnapshot updates the readiness of the volumes of snapshot from their
+// VolumeSnapshots.
+func refreshSnapshot(ctx context.Context, dc dynamic.Interface, snapshot *SnapshotInfo) {
+	for i, volume := range snapshot.Volumes {
+		status, err := k8s.GetVolumeSnapshotStatus(ctx, dc, snapshot.Namespace, volume.SnapshotName)
+		if err != nil {
+			snapshot.Volumes[i].ReadyToUse = false
+			snapshot.Volumes[i].Error = fmt.Sprintf("failed to get volume snapshot %s", volume.SnapshotName)
+			continue
+		}
+		snapshot.Volumes[i].ReadyToUse = status.ReadyToUse
+		snapshot.Volumes[i].Error = status.Error
+	}
+}
+
+// ListSnapshots returns the snapshots of the session, which may have been
+// deleted already, with the current readiness of their volumes.
+func ListSnapshots(ctx context.Context, dc dynamic.Interface, snapshots SnapshotStore, sessionID string) ([]*SnapshotInfo, error) {
+	res, err := snapshots.List(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range res {
+		refreshSnapshot(ctx, dc, snapshot)
+	}
+	return res, nil
+}
+
+// RestoreSnapshot creates the session targetID with the components of the
+// snapshot, and their volumes restored from it. Nothing is left behind if
+// the restore fails.
+func RestoreSnapshot(ctx context.Context, cs kubernetes.Interface, dc dynamic.Interface, store SessionStore, journal *consistency.Journal, snapshots SnapshotStore, cfg config.SessionsConfig, sessionID string, name string, targetID string) error {
+	logging.Logger.Info("restoring snapshot", "sessionID", sessionID, "snapshot", name, "targetID", targetID)
+	snapshot, err := snapshots.Get(ctx, sessionID, name)
+	if err != nil {
+		return err
+	}
+	namespace := namespaceFor(cfg, targetID)
+	if cfg.DedicatedNamespaces || namespace != snapshot.Namespace {
+		return fmt.Errorf("%w: snapshot %s lives in namespace %s", ErrSnapshotNotRestorable, name, snapshot.Namespace)
+	}
+	refreshSnapshot(ctx, dc, snapshot)
+	var workspace *SnapshotVolume
+	sources := make(map[string]string)
+	for i, volume := range snapshot.Volumes {
+		if !volume.ReadyToUse {
+			return fmt.Errorf("%w: volume snapshot %s is not ready", ErrSnapshotNotRestorable, volume.SnapshotName)
+		}
+		if volume.ComponentID == "" {
+			workspace = &snapshot.Volumes[i]
+		} else {
+			sources[volume.ComponentID] = volume.SnapshotName
+		}
+	}
+	if workspace == nil {
+		return fmt.Errorf("%w: snapshot %s has no workspace volume", ErrSnapshotNotRestorable, name)
+	}
+
+	components := make([]cmp.Component, len(snapshot.Components))
+	copy(components, snapshot.Components)
+	for i, component := range components {
+		components[i].ComponentMetadata.Url = ""
+		for _, volume := range snapshot.Volumes {
+			if volume.ComponentID == component.ComponentID {
+				components[i].Storage = volume.Storage
+			}
+		}
+	}
+
+	// the restored session is a new session, living for the default time
+	// to live
+	expiresAt, err := expiryFor(cfg, 0, time.Now())
+	if err != nil {
+		return err
+	}
+
+	initSessionKey := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		created, err := store.CreateIfAbsent(ctx, targetID, &SessionInfo{
+			Namespace: namespace,
+			Workspace: workspace.Storage,
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			return ctx, nil, err
+		}
+		if !created {
+			return ctx, nil, fmt.Errorf("session %s already exists", targetID)
+		}
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the write of the etcd key for the restored session", "sessionID", targetID)
+			return store.Delete(ctx, targetID)
+		}
+		return ctx, cancel, nil
+	}
+	restoreWorkspace := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		err := k8s.CreatePVCFromSnapshot(ctx, cs, namespace, cmp.WorkspaceVolumeName(targetID), workspace.Storage.Size, workspace.Storage.StorageClass, workspace.Storage.AccessMode, workspace.SnapshotName, sessionLabels(targetID))
+		if err != nil {
+			return ctx, nil, err
+		}
+		cancel := func(ctx context.Context) error {
+			logging.Logger.Info("rolling back the restore of the workspace", "sessionID", targetID)
+			return ignoreNotFound(cs.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, cmp.WorkspaceVolumeName(targetID), metav1.DeleteOptions{}))
+		}
+		return ctx, cancel, nil
+	}
+	restoreComponents := func(ctx context.Context) (context.Context, func(context.Context) error, error) {
+		if len(components) == 0 {
+			return ctx, consistency.NoCompensation, nil
+		}
+		// createDeploy cleans up after itself when it fails
+		err := createDeploy(ctx, cs, store, journal, cfg, targetID, components, sources)
+		if err != nil {
+			return ctx, nil, err
+		}
+		return ctx, consistency.NoCompensation, nil
+	}
+
+	_, err = consistency.Saga([]consistency.Transaction{
+		consistency.DurableStep("record session", deleteSessionRecordAction, sessionRef{SessionID: targetID}, initSessionKey),
+		consistency.DurableStep("restore workspace volume", deleteVolumeAction, objectRef{Namespace: namespace, Name: cmp.WorkspaceVolumeName(targetID)}, restoreWorkspace),
+		consistency.DurableStep("restore components", deleteSessionAction, sessionRef{SessionID: targetID}, restoreComponents),
+	}).RunJournaled(ctx, journal, restoreSnapshotSaga, sessionRef{SessionID: targetID})
+	if err != nil {
+		logging.Logger.Error("restoring snapshot failed", "sessionID", sessionID, "snapshot", name, "targetID", targetID)
+	}
+	return err
+}
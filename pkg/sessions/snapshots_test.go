@@ -0,0 +1,125 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/k8s"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newDynamicClient() dynamic.Interface {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		k8s.VolumeSnapshotGVR: "VolumeSnapshotList",
+	})
+}
+
+// markSnapshotReady simulates the snapshot controller reporting every
+// volume snapshot of the namespace as ready to use.
+func markSnapshotsReady(t *testing.T, ctx context.Context, dc dynamic.Interface) {
+	t.Helper()
+	list, err := dc.Resource(k8s.VolumeSnapshotGVR).Namespace("default").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list volume snapshots: %v", err)
+	}
+	for i := range list.Items {
+		snapshot := &list.Items[i]
+		if err := unstructured.SetNestedField(snapshot.Object, true, "status", "readyToUse"); err != nil {
+			t.Fatalf("failed to set snapshot status: %v", err)
+		}
+		if _, err := dc.Resource(k8s.VolumeSnapshotGVR).Namespace("default").UpdateStatus(ctx, snapshot, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("failed to update snapshot status: %v", err)
+		}
+	}
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	ctx := context.Background()
+	cs, store := newTestEnv()
+	dc := newDynamicClient()
+	snapshots := NewSnapshotStore(cache.NewMemoryStore())
+	const restoredID = "session-restored"
+
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{Size: "1Gi"}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, testComponents()); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+
+	snapshot, err := CreateSnapshot(ctx, cs, dc, store, nil, snapshots, testConfig(), testSessionID, "before-upgrade")
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	// the workspace, redis and mongo volumes
+	if len(snapshot.Volumes) != 3 {
+		t.Fatalf("expected 3 volume snapshots, got %d", len(snapshot.Volumes))
+	}
+	if _, err := CreateSnapshot(ctx, cs, dc, store, nil, snapshots, testConfig(), testSessionID, "before-upgrade"); !errors.Is(err, ErrSnapshotExists) {
+		t.Fatalf("expected ErrSnapshotExists, got %v", err)
+	}
+	if err := RestoreSnapshot(ctx, cs, dc, store, nil, snapshots, testConfig(), testSessionID, "before-upgrade", restoredID); !errors.Is(err, ErrSnapshotNotRestorable) {
+		t.Fatalf("expected restoring a snapshot that isn't ready to fail, got %v", err)
+	}
+	if _, _, err := store.Get(ctx, restoredID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected the failed restore to leave nothing behind, got %v", err)
+	}
+
+	// snapshots outlive their session
+	if err := DeleteDeploy(ctx, cs, store, nil, testConfig(), testSessionID); err != nil {
+		t.Fatalf("DeleteDeploy failed: %v", err)
+	}
+	markSnapshotsReady(t, ctx, dc)
+	listed, err := ListSnapshots(ctx, dc, snapshots, testSessionID)
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+	if len(listed) != 1 || !listed[0].Volumes[0].ReadyToUse {
+		t.Fatalf("expected one ready snapshot, got %+v", listed)
+	}
+
+	// the restored session gets the default time to live
+	cfg := testConfig()
+	cfg.DefaultTTL = 8 * time.Hour
+	if err := RestoreSnapshot(ctx, cs, dc, store, nil, snapshots, cfg, testSessionID, "before-upgrade", restoredID); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	session, _, err := store.Get(ctx, restoredID)
+	if err != nil {
+		t.Fatalf("restored session was not recorded: %v", err)
+	}
+	if session.SessionState != Initialized || len(session.Components) != 3 {
+		t.Fatalf("unexpected restored session %+v", session)
+	}
+	if until := time.Until(session.ExpiresAt); until <= 7*time.Hour || until > 8*time.Hour {
+		t.Fatalf("expected the restored session to expire in 8h, got %s", session.ExpiresAt)
+	}
+	if url := session.Components[0].ComponentMetadata.Url; url != "session-restored.my-code-editor.hamzaboudouche.tech" {
+		t.Fatalf("unexpected restored url %q", url)
+	}
+	for _, name := range []string{cmp.WorkspaceVolumeName(restoredID), cmp.VolumeName(restoredID, "my-redis")} {
+		pvc, err := cs.CoreV1().PersistentVolumeClaims("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("PVC %s was not restored: %v", name, err)
+		}
+		if pvc.Spec.DataSource == nil || pvc.Spec.DataSource.Kind != "VolumeSnapshot" {
+			t.Fatalf("expected PVC %s to be restored from a snapshot, got %+v", name, pvc.Spec.DataSource)
+		}
+	}
+
+	if _, err := ListSnapshots(ctx, dc, snapshots, "session-unknown"); err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+	if err := RestoreSnapshot(ctx, cs, dc, store, nil, snapshots, testConfig(), testSessionID, "unknown", "session-other"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected ErrSnapshotNotFound, got %v", err)
+	}
+}
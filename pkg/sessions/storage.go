@@ -0,0 +1,278 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	// ErrComponentNotFound is returned for components the session doesn't
+	// have.
+	ErrComponentNotFound = errors.New("component not found")
+	// ErrExpansionNotAllowed is returned when the storage class of a volume
+	// doesn't support growing it.
+	ErrExpansionNotAllowed = errors.New("volume expansion is not allowed")
+)
+
+// defaultStorageClassAnnotation marks the storage class used by claims that
+// don't name one.
+const defaultStorageClassAnnotation = "storageclass.kubernetes.io/is-default-class"
+
+type ResizeState string
+
+const (
+	// ResizePending means the new size was requested but the resize hasn't
+	// started yet.
+	ResizePending ResizeState = "pending"
+	// ResizeInProgress means the volume is being resized by the storage
+	// backend.
+	ResizeInProgress ResizeState = "resizing"
+	// ResizeFileSystemPending means the volume was resized but its file
+	// system will only be grown when a pod (re)starts using it.
+	ResizeFileSystemPending ResizeState = "fileSystemResizePending"
+	ResizeCompleted         ResizeState = "completed"
+)
+
+// VolumeStatus is the state of the volume of a component, as reported by its
+// PersistentVolumeClaim.
+type VolumeStatus struct {
+	ClaimName     string      `json:"claimName"`
+	RequestedSize string      `json:"requestedSize"`
+	Capacity      string      `json:"capacity,omitempty"`
+	ResizeState   ResizeState `json:"resizeState,omitempty"`
+	Message       string      `json:"message,omitempty"`
+}
+
+// volumeStatus derives the status of a volume from its claim.
+func volumeStatus(pvc *v1.PersistentVolumeClaim) VolumeStatus {
+	requested := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	capacity, bound := pvc.Status.Capacity[v1.ResourceStorage]
+	status := VolumeStatus{
+		ClaimName:     pvc.Name,
+		RequestedSize: requested.String(),
+		ResizeState:   ResizeCompleted,
+	}
+	if bound {
+		status.Capacity = capacity.String()
+		if capacity.Cmp(requested) < 0 {
+			status.ResizeState = ResizePending
+		}
+	}
+	for _, condition := range pvc.Status.Conditions {
+		if condition.Status != v1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case v1.PersistentVolumeClaimResizing:
+			status.ResizeState = ResizeInProgress
+			status.Message = condition.Message
+		case v1.PersistentVolumeClaimFileSystemResizePending:
+			status.ResizeState = ResizeFileSystemPending
+			status.Message = condition.Message
+		}
+	}
+	return status
+}
+
+// componentVolume returns the name of the claim mounted by the component of
+// the session, failing with ErrComponentNotFound if there is no such
+// component.
+func componentVolume(session *SessionInfo, sessionID string, componentID string) (int, string, error) {
+	for i, component := range session.Components {
+		if component.ComponentID != componentID {
+			continue
+		}
+		_, volume, err := component.ToContainer(sessionID)
+		if err != nil {
+			return 0, "", err
+		}
+		if volume == nil {
+			return 0, "", fmt.Errorf("%w: component %s has no volume", cmp.ErrInvalidComponent, componentID)
+		}
+		return i, volume.PersistentVolumeClaim.ClaimName, nil
+	}
+	return 0, "", fmt.Errorf("%w: %s", ErrComponentNotFound, componentID)
+}
+
+// allowsExpansion checks that the storage class of the claim (or the
+// default class, if the claim doesn't name one) allows volume expansion.
+func allowsExpansion(ctx context.Context, cs kubernetes.Interface, pvc *v1.PersistentVolumeClaim) error {
+	var class *storagev1.StorageClass
+	if pvc.Spec.StorageClassName != nil && *pvc.Spec.StorageClassName != "" {
+		var err error
+		class, err = cs.StorageV1().StorageClasses().Get(ctx, *pvc.Spec.StorageClassName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get storage class %s: %w", *pvc.Spec.StorageClassName, err)
+		}
+	} else {
+		classes, err := cs.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to list storage classes: %w", err)
+		}
+		for i := range classes.Items {
+			if classes.Items[i].Annotations[defaultStorageClassAnnotation] == "true" {
+				class = &classes.Items[i]
+				break
+			}
+		}
+		if class == nil {
+			return fmt.Errorf("%w: claim %s has no storage class", ErrExpansionNotAllowed, pvc.Name)
+		}
+	}
+	if class.AllowVolumeExpansion == nil || !*class.AllowVolumeExpansion {
+		return fmt.Errorf("%w: storage class %s doesn't allow it", ErrExpansionNotAllowed, class.Name)
+	}
+	return nil
+}
+
+// ExpandStorage grows the volume of a component of the session to size. The
+// new size is recorded in the session, and the progress of the resize is
+// tracked by RefreshDeploy. Components mounting the workspace grow the
+// workspace.
+func ExpandStorage(ctx context.Context, cs kubernetes.Interface, store SessionStore, cfg config.SessionsConfig, sessionID string, componentID string, size string) (*VolumeStatus, error) {
+	logging.Logger.Info("expanding component storage", "sessionID", sessionID, "componentID", componentID, "size", size)
+	session, _, err := store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	_, claimName, err := componentVolume(session, sessionID, componentID)
+	if err != nil {
+		return nil, err
+	}
+	pvc, err := cs.CoreV1().PersistentVolumeClaims(session.namespace()).Get(ctx, claimName, metav1.GetOptions{})
+	if err != nil {
+		logging.Logger.Error("failed to get PVC", "sessionID", sessionID, "PVCName", claimName)
+		return nil, err
+	}
+
+	requested, err := resource.ParseQuantity(size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid storage size %q", cmp.ErrInvalidComponent, size)
+	}
+	current := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	if requested.Cmp(current) <= 0 {
+		return nil, fmt.Errorf("%w: storage size %s must be larger than the current size %s", cmp.ErrInvalidComponent, requested.String(), current.String())
+	}
+	bounds := cmp.StorageBounds{
+		MinSize: cfg.StorageBounds.MinSize,
+		MaxSize: cfg.StorageBounds.MaxSize,
+	}
+	if _, err := cmp.ResolveStorage(cmp.Storage{Size: requested.String()}, cmp.Storage{}, bounds); err != nil {
+		return nil, err
+	}
+	if err := allowsExpansion(ctx, cs, pvc); err != nil {
+		logging.Logger.Error("volume can't be expanded", "sessionID", sessionID, "PVCName", claimName, "error", err)
+		return nil, err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"resources": map[string]interface{}{
+				"requests": map[string]string{
+					string(v1.ResourceStorage): requested.String(),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	pvc, err = cs.CoreV1().PersistentVolumeClaims(session.namespace()).Patch(ctx, claimName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		logging.Logger.Error("failed to patch PVC", "sessionID", sessionID, "PVCName", claimName)
+		return nil, err
+	}
+	logging.Logger.Info("requested PVC expansion", "sessionID", sessionID, "PVCName", claimName, "size", requested.String())
+
+	status := volumeStatus(pvc)
+	if status.ResizeState == ResizeCompleted && status.Capacity == "" {
+		// unbound claims are resized as soon as they're provisioned
+		status.ResizeState = ResizePending
+	}
+	_, err = updateSession(ctx, store, sessionID, func(session *SessionInfo) (bool, error) {
+		i, _, err := componentVolume(session, sessionID, componentID)
+		if err != nil {
+			return false, err
+		}
+		if claimName == cmp.WorkspaceVolumeName(sessionID) {
+			session.Workspace.Size = requested.String()
+		} else {
+			session.Components[i].Storage.Size = requested.String()
+		}
+		if session.Resizes == nil {
+			session.Resizes = make(map[string]VolumeStatus)
+		}
+		session.Resizes[componentID] = status
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// refreshResizes updates the resizes of the session that are still in
+// progress from the state of their claims.
+func refreshResizes(ctx context.Context, cs kubernetes.Interface, store SessionStore, sessionID string, session *SessionInfo) (*SessionInfo, error) {
+	updates := make(map[string]VolumeStatus)
+	for componentID, resize := range session.Resizes {
+		if resize.ResizeState == ResizeCompleted {
+			continue
+		}
+		pvc, err := cs.CoreV1().PersistentVolumeClaims(session.namespace()).Get(ctx, resize.ClaimName, metav1.GetOptions{})
+		if err != nil {
+			logging.Logger.Warn("failed to get PVC being resized", "sessionID", sessionID, "PVCName", resize.ClaimName)
+			continue
+		}
+		if status := volumeStatus(pvc); status != resize {
+			updates[componentID] = status
+		}
+	}
+	if len(updates) == 0 {
+		return session, nil
+	}
+	return updateSession(ctx, store, sessionID, func(session *SessionInfo) (bool, error) {
+		changed := false
+		for componentID, status := range updates {
+			if _, ok := session.Resizes[componentID]; ok {
+				session.Resizes[componentID] = status
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+}
+
+// StorageStatus returns the status of the volume of every component of the
+// session that has one, keyed by component ID.
+func StorageStatus(ctx context.Context, cs kubernetes.Interface, store SessionStore, sessionID string) (map[string]VolumeStatus, error) {
+	session, _, err := store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]VolumeStatus)
+	for _, component := range session.Components {
+		_, claimName, err := componentVolume(session, sessionID, component.ComponentID)
+		if err != nil {
+			continue
+		}
+		pvc, err := cs.CoreV1().PersistentVolumeClaims(session.namespace()).Get(ctx, claimName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get PVC %s of session %s", claimName, sessionID)
+		}
+		res[component.ComponentID] = volumeStatus(pvc)
+	}
+	return res, nil
+}
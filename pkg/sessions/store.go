@@ -0,0 +1,218 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+)
+
+// sessionIDPrefix is the prefix shared by every session ID: the handlers
+// name sessions "session-<name>".
+const sessionIDPrefix = "session-"
+
+// sessionKeyPrefix is the prefix of the session records, which are kept at
+// sessionKeyPrefix followed by the session ID.
+const sessionKeyPrefix = cache.KeyPrefix + "sessions/"
+
+// SchemaVersion is the version of SessionInfo written by this version of
+// autodev. It is bumped whenever the records written before need to be
+// upgraded, which Migrate does.
+const SchemaVersion = 1
+
+var (
+	// ErrSessionNotFound is returned by SessionStore.Get for unknown sessions.
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrConflict is returned when a session was modified by someone else
+	// between the moment it was read and the moment it was written back.
+	ErrConflict = errors.New("session was modified concurrently")
+	// ErrUnsupportedSchema is returned for sessions written by a newer
+	// version of autodev, which this one can't safely update.
+	ErrUnsupportedSchema = errors.New("unsupported session schema version")
+)
+
+// SessionEvent describes a change to a session observed through
+// SessionStore.Watch. Session is nil when the session was deleted.
+type SessionEvent struct {
+	Type      cache.EventType
+	SessionID string
+	Session   *SessionInfo
+}
+
+// StoredSession is a session read from the SessionStore, along with its ID.
+type StoredSession struct {
+	SessionID string
+	Session   *SessionInfo
+}
+
+// SessionStore persists the SessionInfo of every session. Every session
+// carries the revision at which it was last written; writes that depend on a
+// previous read must go through CompareAndSwap or CompareAndDelete with that
+// revision so that concurrent writers cannot clobber each other.
+type SessionStore interface {
+	// Get returns the session and the revision at which it was last written.
+	Get(ctx context.Context, sessionID string) (*SessionInfo, int64, error)
+	// CreateIfAbsent stores session only if sessionID is not known yet and
+	// reports whether it did.
+	CreateIfAbsent(ctx context.Context, sessionID string, session *SessionInfo) (bool, error)
+	// CompareAndSwap replaces the stored session with session only if it was
+	// last written at revision, and reports whether it did.
+	CompareAndSwap(ctx context.Context, sessionID string, revision int64, session *SessionInfo) (bool, error)
+	Delete(ctx context.Context, sessionID string) error
+	// CompareAndDelete deletes the session only if it was last written at
+	// revision, and reports whether it did.
+	CompareAndDelete(ctx context.Context, sessionID string, revision int64) (bool, error)
+	List(ctx context.Context) (map[string]*SessionInfo, error)
+	// ListPage returns, sorted by ID, at most limit sessions whose ID comes
+	// after after, and the ID of the last session it read, which is where
+	// the next page starts. That ID is empty once every session was read.
+	ListPage(ctx context.Context, after string, limit int) ([]StoredSession, string, error)
+	Watch(ctx context.Context) <-chan SessionEvent
+}
+
+type sessionStore struct {
+	kv cache.Store
+}
+
+// NewSessionStore returns a SessionStore that keeps sessions as JSON
+// documents in kv, one key per session ID, written at the current
+// SchemaVersion.
+func NewSessionStore(kv cache.Store) SessionStore {
+	return &sessionStore{kv: kv}
+}
+
+func sessionKey(sessionID string) string {
+	return sessionKeyPrefix + sessionID
+}
+
+// encodeSession encodes session at the current SchemaVersion.
+func encodeSession(session *SessionInfo) ([]byte, error) {
+	versioned := *session
+	versioned.SchemaVersion = SchemaVersion
+	return json.Marshal(&versioned)
+}
+
+func decodeSession(sessionID string, value []byte) (*SessionInfo, error) {
+	var session SessionInfo
+	if err := json.Unmarshal(value, &session); err != nil {
+		return nil, fmt.Errorf("failed to decode session %s: %w", sessionID, err)
+	}
+	if session.SchemaVersion > SchemaVersion {
+		return nil, fmt.Errorf("%w: session %s has version %d, this version of autodev supports up to %d", ErrUnsupportedSchema, sessionID, session.SchemaVersion, SchemaVersion)
+	}
+	return &session, nil
+}
+
+func (s *sessionStore) Get(ctx context.Context, sessionID string) (*SessionInfo, int64, error) {
+	kv, err := s.kv.Get(ctx, sessionKey(sessionID))
+	if errors.Is(err, cache.ErrNotFound) {
+		return nil, 0, fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	session, err := decodeSession(sessionID, kv.Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	return session, kv.Revision, nil
+}
+
+func (s *sessionStore) CreateIfAbsent(ctx context.Context, sessionID string, session *SessionInfo) (bool, error) {
+	sessionJSON, err := encodeSession(session)
+	if err != nil {
+		return false, err
+	}
+	return s.kv.CreateIfAbsent(ctx, sessionKey(sessionID), sessionJSON)
+}
+
+func (s *sessionStore) CompareAndSwap(ctx context.Context, sessionID string, revision int64, session *SessionInfo) (bool, error) {
+	sessionJSON, err := encodeSession(session)
+	if err != nil {
+		return false, err
+	}
+	return s.kv.CompareAndSwap(ctx, sessionKey(sessionID), revision, sessionJSON)
+}
+
+func (s *sessionStore) Delete(ctx context.Context, sessionID string) error {
+	return s.kv.Delete(ctx, sessionKey(sessionID))
+}
+
+func (s *sessionStore) CompareAndDelete(ctx context.Context, sessionID string, revision int64) (bool, error) {
+	return s.kv.CompareAndDelete(ctx, sessionKey(sessionID), revision)
+}
+
+func (s *sessionStore) List(ctx context.Context) (map[string]*SessionInfo, error) {
+	kvs, err := s.kv.List(ctx, sessionKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]*SessionInfo, len(kvs))
+	for _, kv := range kvs {
+		sessionID := strings.TrimPrefix(kv.Key, sessionKeyPrefix)
+		session, err := decodeSession(sessionID, kv.Value)
+		if err != nil {
+			logging.Logger.Warn("skipping undecodable session record", "sessionID", sessionID, "error", err)
+			continue
+		}
+		res[sessionID] = session
+	}
+	return res, nil
+}
+
+func (s *sessionStore) ListPage(ctx context.Context, after string, limit int) ([]StoredSession, string, error) {
+	afterKey := ""
+	if after != "" {
+		afterKey = sessionKey(after)
+	}
+	kvs, err := s.kv.ListPage(ctx, sessionKeyPrefix, afterKey, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	res := make([]StoredSession, 0, len(kvs))
+	for _, kv := range kvs {
+		sessionID := strings.TrimPrefix(kv.Key, sessionKeyPrefix)
+		session, err := decodeSession(sessionID, kv.Value)
+		if err != nil {
+			logging.Logger.Warn("skipping undecodable session record", "sessionID", sessionID, "error", err)
+			continue
+		}
+		res = append(res, StoredSession{SessionID: sessionID, Session: session})
+	}
+	next := ""
+	if len(kvs) == limit {
+		next = strings.TrimPrefix(kvs[len(kvs)-1].Key, sessionKeyPrefix)
+	}
+	return res, next, nil
+}
+
+func (s *sessionStore) Watch(ctx context.Context) <-chan SessionEvent {
+	events := make(chan SessionEvent)
+	go func() {
+		defer close(events)
+		for ev := range s.kv.Watch(ctx, sessionKeyPrefix) {
+			event := SessionEvent{
+				Type:      ev.Type,
+				SessionID: strings.TrimPrefix(ev.Key, sessionKeyPrefix),
+			}
+			if ev.Type == cache.EventPut {
+				session, err := decodeSession(event.SessionID, ev.Value)
+				if err != nil {
+					logging.Logger.Warn("skipping undecodable session event", "sessionID", event.SessionID, "error", err)
+					continue
+				}
+				event.Session = session
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
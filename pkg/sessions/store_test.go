@@ -0,0 +1,143 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/etcdtest"
+)
+
+func TestSessionStore(t *testing.T) {
+	backends := map[string]func(t *testing.T) cache.Store{
+		"memory": func(t *testing.T) cache.Store { return cache.NewMemoryStore() },
+		"etcd": func(t *testing.T) cache.Store {
+			return cache.NewEtcdStore(etcdtest.Start(t), 5*time.Second)
+		},
+	}
+	for name, newKV := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			kv := newKV(t)
+			store := NewSessionStore(kv)
+
+			if _, _, err := store.Get(ctx, testSessionID); !errors.Is(err, ErrSessionNotFound) {
+				t.Fatalf("expected ErrSessionNotFound, got %v", err)
+			}
+			if ok, err := store.CreateIfAbsent(ctx, testSessionID, &SessionInfo{SessionState: Initialized}); err != nil || !ok {
+				t.Fatalf("expected first create to succeed, got %v (err %v)", ok, err)
+			}
+			if ok, _ := store.CreateIfAbsent(ctx, testSessionID, &SessionInfo{SessionState: Running}); ok {
+				t.Fatal("expected second create to fail")
+			}
+			session, revision, err := store.Get(ctx, testSessionID)
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			if session.SessionState != Initialized || session.SchemaVersion != SchemaVersion {
+				t.Fatalf("unexpected session %+v", session)
+			}
+
+			session.SessionState = Running
+			if ok, _ := store.CompareAndSwap(ctx, testSessionID, revision+1, session); ok {
+				t.Fatal("expected swap at a stale revision to fail")
+			}
+			if ok, err := store.CompareAndSwap(ctx, testSessionID, revision, session); err != nil || !ok {
+				t.Fatalf("expected swap at the current revision to succeed, got %v (err %v)", ok, err)
+			}
+			if ok, _ := store.CompareAndDelete(ctx, testSessionID, revision); ok {
+				t.Fatal("expected delete at a stale revision to fail")
+			}
+			session, revision, err = store.Get(ctx, testSessionID)
+			if err != nil || session.SessionState != Running {
+				t.Fatalf("unexpected session %+v (err %v)", session, err)
+			}
+
+			// records that can't be decoded are skipped when listing
+			store.CreateIfAbsent(ctx, "session-other", &SessionInfo{SessionState: Initialized})
+			kv.CreateIfAbsent(ctx, sessionKey("session-broken"), []byte("not json"))
+			kv.CreateIfAbsent(ctx, cache.KeyPrefix+"unrelated", []byte("{}"))
+			sessions, err := store.List(ctx)
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+			if len(sessions) != 2 || sessions[testSessionID] == nil || sessions["session-other"] == nil {
+				t.Fatalf("unexpected sessions %v", sessions)
+			}
+
+			var ids []string
+			after := ""
+			for {
+				page, next, err := store.ListPage(ctx, after, 1)
+				if err != nil {
+					t.Fatalf("ListPage failed: %v", err)
+				}
+				for _, stored := range page {
+					ids = append(ids, stored.SessionID)
+				}
+				if next == "" {
+					break
+				}
+				after = next
+			}
+			if len(ids) != 2 || ids[0] != "session-other" || ids[1] != testSessionID {
+				t.Fatalf("unexpected pages %v", ids)
+			}
+
+			if ok, err := store.CompareAndDelete(ctx, testSessionID, revision); err != nil || !ok {
+				t.Fatalf("expected delete at the current revision to succeed, got %v (err %v)", ok, err)
+			}
+			if err := store.Delete(ctx, "session-other"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if _, _, err := store.Get(ctx, "session-other"); !errors.Is(err, ErrSessionNotFound) {
+				t.Fatalf("expected ErrSessionNotFound after delete, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSessionStoreWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kv := cache.NewMemoryStore()
+	store := NewSessionStore(kv)
+	events := store.Watch(ctx)
+
+	// the watch is set up in the background, write until it sees the session
+	deadline := time.After(5 * time.Second)
+	for created := false; !created; {
+		store.Delete(ctx, testSessionID)
+		store.CreateIfAbsent(ctx, testSessionID, &SessionInfo{SessionState: Initialized})
+		select {
+		case ev := <-events:
+			if ev.Type == cache.EventPut {
+				if ev.SessionID != testSessionID || ev.Session == nil || ev.Session.SessionState != Initialized {
+					t.Fatalf("unexpected event %+v", ev)
+				}
+				created = true
+			}
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("timed out waiting for the watch to be set up")
+		}
+	}
+
+	// records that can't be decoded are skipped
+	kv.CreateIfAbsent(ctx, sessionKey("session-broken"), []byte("not json"))
+	store.Delete(ctx, testSessionID)
+	select {
+	case ev := <-events:
+		if ev.Type != cache.EventDelete || ev.SessionID != testSessionID || ev.Session != nil {
+			t.Fatalf("expected the session to be deleted, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the session to be deleted")
+	}
+
+	cancel()
+	for range events {
+	}
+}
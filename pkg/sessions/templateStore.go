@@ -0,0 +1,110 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+)
+
+// templateKeyPrefix is the prefix of the session template records.
+const templateKeyPrefix = cache.KeyPrefix + "templates/"
+
+var (
+	ErrTemplateNotFound = errors.New("template not found")
+	ErrTemplateExists   = errors.New("template already exists")
+)
+
+// SessionTemplate is a named list of components sessions can be created
+// from, so that clients don't have to post the full list every time.
+type SessionTemplate struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Components  []cmp.Component `json:"components"`
+}
+
+// TemplateStore persists the session templates. Like SessionStore, updates
+// go through CompareAndSwap with the revision returned by Get.
+type TemplateStore interface {
+	// Get returns the template and the revision at which it was last written.
+	Get(ctx context.Context, name string) (*SessionTemplate, int64, error)
+	// CreateIfAbsent stores template only if no template has the same name
+	// yet, and reports whether it did.
+	CreateIfAbsent(ctx context.Context, template *SessionTemplate) (bool, error)
+	// CompareAndSwap replaces the stored template only if it was last
+	// written at revision, and reports whether it did.
+	CompareAndSwap(ctx context.Context, revision int64, template *SessionTemplate) (bool, error)
+	Delete(ctx context.Context, name string) error
+	// List returns every template, sorted by name.
+	List(ctx context.Context) ([]*SessionTemplate, error)
+}
+
+type templateStore struct {
+	kv cache.Store
+}
+
+// NewTemplateStore returns a TemplateStore that keeps templates as JSON
+// documents in kv.
+func NewTemplateStore(kv cache.Store) TemplateStore {
+	return &templateStore{kv: kv}
+}
+
+func templateKey(name string) string {
+	return templateKeyPrefix + name
+}
+
+func (s *templateStore) Get(ctx context.Context, name string) (*SessionTemplate, int64, error) {
+	kv, err := s.kv.Get(ctx, templateKey(name))
+	if errors.Is(err, cache.ErrNotFound) {
+		return nil, 0, fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var template SessionTemplate
+	if err := json.Unmarshal(kv.Value, &template); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode template %s: %w", name, err)
+	}
+	return &template, kv.Revision, nil
+}
+
+func (s *templateStore) CreateIfAbsent(ctx context.Context, template *SessionTemplate) (bool, error) {
+	templateJSON, err := json.Marshal(template)
+	if err != nil {
+		return false, err
+	}
+	return s.kv.CreateIfAbsent(ctx, templateKey(template.Name), templateJSON)
+}
+
+func (s *templateStore) CompareAndSwap(ctx context.Context, revision int64, template *SessionTemplate) (bool, error) {
+	templateJSON, err := json.Marshal(template)
+	if err != nil {
+		return false, err
+	}
+	return s.kv.CompareAndSwap(ctx, templateKey(template.Name), revision, templateJSON)
+}
+
+func (s *templateStore) Delete(ctx context.Context, name string) error {
+	return s.kv.Delete(ctx, templateKey(name))
+}
+
+func (s *templateStore) List(ctx context.Context) ([]*SessionTemplate, error) {
+	kvs, err := s.kv.List(ctx, templateKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*SessionTemplate, 0, len(kvs))
+	for _, kv := range kvs {
+		var template SessionTemplate
+		if err := json.Unmarshal(kv.Value, &template); err != nil {
+			logging.Logger.Warn("skipping undecodable template record", "key", kv.Key)
+			continue
+		}
+		res = append(res, &template)
+	}
+	return res, nil
+}
@@ -0,0 +1,110 @@
+package sessions
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/config"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/logging"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// templateSessionID stands in for the session ID when checking the
+// components of a template, which don't belong to any session yet.
+const templateSessionID = "session-template"
+
+// validateTemplate checks that sessions could be created from template with
+// the given configuration.
+func validateTemplate(cfg config.SessionsConfig, template *SessionTemplate) error {
+	if msgs := validation.IsDNS1123Label(template.Name); len(msgs) > 0 {
+		return fmt.Errorf("%w: invalid template name %q: %s", cmp.ErrInvalidComponent, template.Name, strings.Join(msgs, ", "))
+	}
+	if len(template.Components) == 0 {
+		return fmt.Errorf("%w: template %s has no components", cmp.ErrInvalidComponent, template.Name)
+	}
+	for _, component := range template.Components {
+		if _, err := cmp.ResolveResources(component.Resources, cfg.DefaultResources, cfg.MaxResources); err != nil {
+			return err
+		}
+		if _, err := cmp.ResolveStorage(component.Storage, cfg.ComponentStorageDefaults(), cfg.StorageBounds); err != nil {
+			return err
+		}
+	}
+	_, _, err := cmp.ParseComponents(template.Components, templateSessionID)
+	return err
+}
+
+// CreateTemplate validates and records a new session template.
+func CreateTemplate(ctx context.Context, templates TemplateStore, cfg config.SessionsConfig, template *SessionTemplate) error {
+	if err := validateTemplate(cfg, template); err != nil {
+		return err
+	}
+	created, err := templates.CreateIfAbsent(ctx, template)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("%w: %s", ErrTemplateExists, template.Name)
+	}
+	logging.Logger.Info("created session template", "template", template.Name)
+	return nil
+}
+
+// UpdateTemplate replaces an existing session template. Sessions already
+// created from it are left untouched.
+func UpdateTemplate(ctx context.Context, templates TemplateStore, cfg config.SessionsConfig, template *SessionTemplate) error {
+	if err := validateTemplate(cfg, template); err != nil {
+		return err
+	}
+	_, revision, err := templates.Get(ctx, template.Name)
+	if err != nil {
+		return err
+	}
+	swapped, err := templates.CompareAndSwap(ctx, revision, template)
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		logging.Logger.Warn("template was modified concurrently", "template", template.Name, "revision", revision)
+		return fmt.Errorf("%w: template %s", ErrConflict, template.Name)
+	}
+	logging.Logger.Info("updated session template", "template", template.Name)
+	return nil
+}
+
+// DeleteTemplate removes a session template. Sessions already created from
+// it are left untouched.
+func DeleteTemplate(ctx context.Context, templates TemplateStore, name string) error {
+	if _, _, err := templates.Get(ctx, name); err != nil {
+		return err
+	}
+	return templates.Delete(ctx, name)
+}
+
+// TemplateComponents returns the components of the template, with overrides
+// applied: an override replaces the template component with the same ID,
+// and overrides with a new ID are added after the template components.
+func TemplateComponents(ctx context.Context, templates TemplateStore, name string, overrides []cmp.Component) ([]cmp.Component, error) {
+	template, _, err := templates.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	components := make([]cmp.Component, len(template.Components), len(template.Components)+len(overrides))
+	copy(components, template.Components)
+	for _, override := range overrides {
+		replaced := false
+		for i, component := range components {
+			if component.ComponentID == override.ComponentID {
+				components[i] = override
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			components = append(components, override)
+		}
+	}
+	return components, nil
+}
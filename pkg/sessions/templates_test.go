@@ -0,0 +1,79 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	cmp "github.com/hamza-boudouche/autodev/pkg/components"
+	"github.com/hamza-boudouche/autodev/pkg/helpers/cache"
+)
+
+func TestTemplates(t *testing.T) {
+	ctx := context.Background()
+	templates := NewTemplateStore(cache.NewMemoryStore())
+	template := &SessionTemplate{
+		Name:       "code-mongo-redis",
+		Components: testComponents(),
+	}
+
+	if err := CreateTemplate(ctx, templates, testConfig(), template); err != nil {
+		t.Fatalf("CreateTemplate failed: %v", err)
+	}
+	if err := CreateTemplate(ctx, templates, testConfig(), template); !errors.Is(err, ErrTemplateExists) {
+		t.Fatalf("expected ErrTemplateExists, got %v", err)
+	}
+	invalid := []*SessionTemplate{
+		{Name: "Not_A_Name", Components: testComponents()},
+		{Name: "empty"},
+		{Name: "unknown-type", Components: []cmp.Component{{ComponentType: "cobol", ComponentID: "legacy"}}},
+	}
+	for _, tpl := range invalid {
+		if err := CreateTemplate(ctx, templates, testConfig(), tpl); !errors.Is(err, cmp.ErrInvalidComponent) {
+			t.Errorf("expected template %s to be rejected, got %v", tpl.Name, err)
+		}
+	}
+
+	// overrides replace the template component with the same ID, and are
+	// added otherwise
+	components, err := TemplateComponents(ctx, templates, template.Name, []cmp.Component{
+		{ComponentType: cmp.Redis, ComponentID: "my-redis"},
+		{ComponentType: cmp.Postgres, ComponentID: "my-postgres"},
+	})
+	if err != nil {
+		t.Fatalf("TemplateComponents failed: %v", err)
+	}
+	if len(components) != 4 || components[1].ExposeComponent || components[3].ComponentID != "my-postgres" {
+		t.Fatalf("unexpected components %+v", components)
+	}
+	stored, _, err := templates.Get(ctx, template.Name)
+	if err != nil || !stored.Components[1].ExposeComponent {
+		t.Fatalf("overrides must not modify the template (err %v)", err)
+	}
+
+	cs, store := newTestEnv()
+	if err := InitSession(ctx, store, nil, cs, testConfig(), testSessionID, cmp.Storage{}, nil, 0); err != nil {
+		t.Fatalf("InitSession failed: %v", err)
+	}
+	if err := CreateDeploy(ctx, cs, store, nil, testConfig(), testSessionID, components); err != nil {
+		t.Fatalf("CreateDeploy failed: %v", err)
+	}
+
+	template.Components = template.Components[:1]
+	if err := UpdateTemplate(ctx, templates, testConfig(), template); err != nil {
+		t.Fatalf("UpdateTemplate failed: %v", err)
+	}
+	list, err := templates.List(ctx)
+	if err != nil || len(list) != 1 || len(list[0].Components) != 1 {
+		t.Fatalf("unexpected templates %+v (err %v)", list, err)
+	}
+	if err := DeleteTemplate(ctx, templates, template.Name); err != nil {
+		t.Fatalf("DeleteTemplate failed: %v", err)
+	}
+	if err := DeleteTemplate(ctx, templates, template.Name); !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("expected ErrTemplateNotFound, got %v", err)
+	}
+	if _, err := TemplateComponents(ctx, templates, template.Name, nil); !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("expected ErrTemplateNotFound, got %v", err)
+	}
+}